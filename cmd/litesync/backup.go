@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mikaelhg/litesync/internal"
+)
+
+const (
+	defaultBackupInterval   = 24 * time.Hour
+	defaultBackupKeepDaily  = 7
+	defaultBackupKeepWeekly = 4
+)
+
+// backupFlags are the snapshot flags, shared by the server's scheduler and
+// the backup command. Only the server has an interval.
+type backupFlags struct {
+	dir        *string
+	interval   *time.Duration
+	keepDaily  *int
+	keepWeekly *int
+}
+
+func addBackupFlags(fs *flag.FlagSet, scheduled bool) *backupFlags {
+	f := &backupFlags{
+		dir:        fs.String("backup-dir", "", "directory the database snapshots are written to"),
+		keepDaily:  fs.Int("backup-keep-daily", defaultBackupKeepDaily, "number of days to keep a daily snapshot for"),
+		keepWeekly: fs.Int("backup-keep-weekly", defaultBackupKeepWeekly, "number of weeks to keep a weekly snapshot for"),
+	}
+	if scheduled {
+		f.interval = fs.Duration("backup-interval", defaultBackupInterval, "how often the server writes a snapshot to -backup-dir")
+	}
+	return f
+}
+
+func (f *backupFlags) config() (internal.BackupConfig, error) {
+	cfg := internal.BackupConfig{
+		Dir:        *f.dir,
+		KeepDaily:  *f.keepDaily,
+		KeepWeekly: *f.keepWeekly,
+	}
+	if cfg.KeepDaily < 0 || cfg.KeepWeekly < 0 {
+		return cfg, errors.New("-backup-keep-daily and -backup-keep-weekly must not be negative")
+	}
+	if f.interval != nil {
+		if *f.interval <= 0 {
+			return cfg, errors.New("-backup-interval must be positive")
+		}
+		cfg.Interval = *f.interval
+	}
+	return cfg, nil
+}
+
+// runBackup takes one snapshot of the database, which can be in use by a
+// running server.
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	store := addStoreFlags(fs)
+	backup := addBackupFlags(fs, false)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s backup -backup-dir <dir> [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Writes a verified snapshot of the database and deletes the ones no longer kept.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *backup.dir == "" {
+		return errors.New("-backup-dir is required")
+	}
+	backupConfig, err := backup.config()
+	if err != nil {
+		return err
+	}
+	cfg, err := store.config()
+	if err != nil {
+		return err
+	}
+	snapshot, pruned, err := internal.BackupStore(cfg, backupConfig)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %s (%d bytes, sha256 %s)\n", snapshot.Path, snapshot.Size, snapshot.SHA256)
+	for _, path := range pruned {
+		fmt.Printf("Deleted %s\n", path)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/mikaelhg/litesync/internal"
+)
+
+// runCheck checks a stopped server's database beyond SQLite's own checks,
+// and optionally repairs what it finds.
+func runCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	store := addStoreFlags(fs)
+	repair := fs.Bool("repair", false, "fix the problems found, in one transaction per database")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s check [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Runs integrity_check and checks the tag items and item counts of every chain.\n")
+		fmt.Fprintf(os.Stderr, "The server must be stopped first.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg, err := store.config()
+	if err != nil {
+		return err
+	}
+	findings, err := internal.CheckStore(cfg, *repair)
+	if errors.Is(err, internal.ErrDatabaseInUse) {
+		return fmt.Errorf("%w, stop the server before checking", err)
+	}
+	if len(findings) == 0 {
+		if err == nil {
+			fmt.Println("No problems found")
+		}
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROBLEM\tCHAIN\tID\tDETAIL\tREPAIRED")
+	remaining, corrupt := 0, false
+	for _, finding := range findings {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\n",
+			finding.Problem, finding.ClientID, finding.ID, finding.Detail, finding.Repaired)
+		if !finding.Repaired {
+			remaining++
+		}
+		corrupt = corrupt || finding.Problem == internal.ProblemIntegrity
+	}
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil || remaining == 0 {
+		return err
+	}
+	if corrupt {
+		return fmt.Errorf("%d problems found, a database failing integrity_check is restored from a snapshot", remaining)
+	}
+	return fmt.Errorf("%d problems found, -repair fixes them", remaining)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mikaelhg/litesync/internal"
+)
+
+const (
+	defaultTombstoneMaxAge  = 90 * 24 * time.Hour
+	defaultCompactBatchSize = 500
+)
+
+// runCompact removes the tombstones of deleted entities which every device
+// has fetched, and reports the space reclaimed per chain.
+func runCompact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	store := addStoreFlags(fs)
+	maxAge := fs.Duration("tombstone-max-age", defaultTombstoneMaxAge, "age after which tombstones which every syncing device has fetched are removed")
+	batchSize := fs.Int("batch-size", defaultCompactBatchSize, "tombstones removed per transaction")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s compact [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Removes the tombstones of deleted entities. It can run next to the server.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *maxAge <= 0 {
+		return errors.New("-tombstone-max-age must be positive")
+	}
+	cfg, err := store.config()
+	if err != nil {
+		return err
+	}
+	compacted, err := internal.CompactStoreTombstones(cfg, *maxAge, *batchSize)
+	if len(compacted) == 0 {
+		if err == nil {
+			fmt.Println("No tombstones to remove")
+		}
+		return err
+	}
+
+	clientIDs := make([]string, 0, len(compacted))
+	var total internal.TombstoneStats
+	for clientID, stats := range compacted {
+		clientIDs = append(clientIDs, clientID)
+		total.Rows += stats.Rows
+		total.Bytes += stats.Bytes
+	}
+	sort.Strings(clientIDs)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "CHAIN\tROWS\tBYTES\t")
+	for _, clientID := range clientIDs {
+		fmt.Fprintf(w, "%s\t%d\t%d\t\n", clientID, compacted[clientID].Rows, compacted[clientID].Bytes)
+	}
+	fmt.Fprintf(w, "total\t%d\t%d\t\n", total.Rows, total.Bytes)
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
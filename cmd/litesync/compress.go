@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mikaelhg/litesync/internal"
+)
+
+const defaultCompressBatchSize = 500
+
+// runCompress compresses the specifics stored before -compress-specifics was
+// turned on, and reports the space saved.
+func runCompress(args []string) error {
+	fs := flag.NewFlagSet("compress", flag.ExitOnError)
+	store := addStoreFlags(fs)
+	batchSize := fs.Int("batch-size", defaultCompressBatchSize, "rows compressed per transaction")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s compress [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Compresses the specifics of existing rows. It can run next to the server.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *batchSize <= 0 {
+		return errors.New("-batch-size must be positive")
+	}
+	cfg, err := store.config()
+	if err != nil {
+		return err
+	}
+	stats, err := internal.CompressStore(cfg, *batchSize)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Compressed %d of %d rows\n", stats.Compressed, stats.Rows)
+	if stats.Compressed > 0 {
+		fmt.Printf("Specifics went from %d to %d bytes, saving %d bytes (%.1f%%)\n",
+			stats.BytesBefore, stats.BytesAfter, stats.Saved(),
+			100*float64(stats.Saved())/float64(stats.BytesBefore))
+		fmt.Printf("Run VACUUM on the database to return the space to the file system\n")
+	}
+	return nil
+}
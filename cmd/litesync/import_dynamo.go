@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mikaelhg/litesync/internal"
+)
+
+// runImportDynamo loads a DynamoDB export of an upstream go-sync table, so
+// that devices keep their sync state when moving off AWS.
+func runImportDynamo(args []string) error {
+	fs := flag.NewFlagSet("import-dynamo", flag.ExitOnError)
+	store := addStoreFlags(fs)
+	replace := fs.Bool("replace", false, "replace the chains the database already has")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s import-dynamo [options] <export dir or file>...\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Loads a DynamoDB table export of go-sync, in DynamoDB JSON or Amazon Ion,\n")
+		fmt.Fprintf(os.Stderr, "such as the data directory of an export to S3.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	cfg, err := store.config()
+	if err != nil {
+		return err
+	}
+
+	result, err := internal.ImportDynamoExport(cfg, fs.Args(), *replace)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d chains: %d entities, %d tag items, %d item counts, %d disabled chains\n",
+		result.Chains, result.Entities, result.TagItems, result.ItemCounts, result.DisabledChains)
+	if len(result.Skipped) > 0 {
+		return fmt.Errorf("%d chains are already in the database, use -replace to overwrite them: %s",
+			len(result.Skipped), strings.Join(result.Skipped, ", "))
+	}
+	return nil
+}
@@ -11,16 +11,41 @@ import (
 
 var (
 	bindAddr = flag.String("bind", defaultBindAddr, "interface and port to bind the server to")
-	dbPath   = flag.String("db", defaultDBPath, "database file path")
 	showHelp = flag.Bool("help", false, "display usage information")
-)
 
-const (
-	defaultBindAddr = ":8295"
-	defaultDBPath   = "./litesync.sqlite"
+	store = addStoreFlags(flag.CommandLine)
+
+	backup = addBackupFlags(flag.CommandLine, true)
+
+	tombstoneMaxAge = flag.Duration("tombstone-max-age", defaultTombstoneMaxAge, "age after which the server removes tombstones which every syncing device has fetched, 0 keeps them")
 )
 
+const defaultBindAddr = ":8295"
+
+// commands are run as "litesync <command> [options]", without a command the
+// server is started.
+var commands = map[string]func(args []string) error{
+	"backup":        runBackup,
+	"check":         runCheck,
+	"compact":       runCompact,
+	"compress":      runCompress,
+	"export":        runExport,
+	"import":        runImport,
+	"import-dynamo": runImportDynamo,
+	"reencrypt":     runReencrypt,
+	"restore":       runRestore,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatalf("%s: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
+
 	flag.Usage = usage
 	flag.Parse()
 
@@ -29,15 +54,35 @@ func main() {
 		os.Exit(0)
 	}
 
-	if err := internal.StartServer(*bindAddr, *dbPath); err != nil {
+	storeConfig, err := store.config()
+	if err != nil {
+		log.Fatalf("Failed to configure the datastore: %v", err)
+	}
+	backupConfig, err := backup.config()
+	if err != nil {
+		log.Fatalf("Failed to configure backups: %v", err)
+	}
+	if err := internal.StartServer(*bindAddr, storeConfig, backupConfig, *tombstoneMaxAge); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s <command> [options]\n\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "Options:\n")
 	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	fmt.Fprintf(os.Stderr, "  backup      write a snapshot of the database\n")
+	fmt.Fprintf(os.Stderr, "  check       check and repair the database of a stopped server\n")
+	fmt.Fprintf(os.Stderr, "  compact     remove old tombstones of deleted entities\n")
+	fmt.Fprintf(os.Stderr, "  compress    compress the specifics of existing rows\n")
+	fmt.Fprintf(os.Stderr, "  export      write one chain to a file\n")
+	fmt.Fprintf(os.Stderr, "  import      load a chain written by export\n")
+	fmt.Fprintf(os.Stderr, "  import-dynamo\n")
+	fmt.Fprintf(os.Stderr, "              load a DynamoDB export of a go-sync table\n")
+	fmt.Fprintf(os.Stderr, "  reencrypt   move every row to the current encryption key\n")
+	fmt.Fprintf(os.Stderr, "  restore     replace the database by a snapshot\n")
 	fmt.Fprintf(os.Stderr, "\nBrowser startup example:\n")
 	fmt.Fprintf(os.Stderr, "  brave-browser --sync-url=http://localhost:8295/litesync\n")
 }
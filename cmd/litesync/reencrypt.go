@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mikaelhg/litesync/internal"
+)
+
+const defaultReencryptBatchSize = 500
+
+// runReencrypt moves every row to the first encryption key, which finishes a
+// key rotation.
+func runReencrypt(args []string) error {
+	fs := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	store := addStoreFlags(fs)
+	batchSize := fs.Int("batch-size", defaultReencryptBatchSize, "rows resealed per transaction")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s reencrypt [options]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Reseals the rows encrypted with an older key, or stored in the clear, with the\n")
+		fmt.Fprintf(os.Stderr, "first key of the key file. Once it is done the older keys can be removed. It\n")
+		fmt.Fprintf(os.Stderr, "can run next to the server.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg, err := store.config()
+	if err != nil {
+		return err
+	}
+	resealed, err := internal.ReencryptStore(cfg, *batchSize, func(resealed int) {
+		fmt.Printf("Resealed %d rows so far\n", resealed)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Resealed %d rows, every row now uses the first key\n", resealed)
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/mikaelhg/litesync/internal"
+)
+
+// runRestore replaces the database by a snapshot, while no server uses it.
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dbPath := fs.String("db", defaultDBPath, "database file path of the sqlite backend")
+	dryRun := fs.Bool("dry-run", false, "check the snapshot and show what would change, without restoring it")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s restore [options] <snapshot>\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Replaces the database by a snapshot. The server must be stopped first.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	snapshot := fs.Arg(0)
+
+	result, err := internal.RestoreSnapshot(snapshot, *dbPath, *dryRun)
+	if errors.Is(err, internal.ErrDatabaseInUse) {
+		return fmt.Errorf("%w, stop the server before restoring", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		fmt.Printf("Would restore %s (schema version %d) to %s\n", snapshot, result.SchemaVersion, *dbPath)
+	} else {
+		fmt.Printf("Restored %s (schema version %d) to %s\n", snapshot, result.SchemaVersion, *dbPath)
+	}
+	if result.Previous != "" {
+		fmt.Printf("The previous database is kept as %s\n", result.Previous)
+	}
+	if len(result.Chains) == 0 {
+		return nil
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "CHAIN\tBEFORE\tAFTER\tADDED\tREMOVED\tCHANGED\t")
+	for _, chain := range result.Chains {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t\n",
+			chain.ClientID, chain.Before, chain.After, chain.Added, chain.Removed, chain.Changed)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/mikaelhg/litesync/internal"
+)
+
+var defaultDBOptions = internal.DefaultSqliteOptions()
+
+const (
+	defaultDBPath        = "./litesync.sqlite"
+	defaultBoltPath      = "./litesync.bolt"
+	defaultMaxOpenShards = 64
+
+	// memoryDBPath selects the memory backend. An in-memory SQLite database
+	// is lost whenever the pool closes its connection, and cannot be
+	// shared by the reader pool.
+	memoryDBPath = ":memory:"
+)
+
+// storeFlags are the flags which select and tune the datastore, shared by
+// the server and the maintenance commands.
+type storeFlags struct {
+	backend *string
+	dbPath  *string
+	dsn     *string
+
+	memorySnapshot *string
+	boltPath       *string
+
+	journalMode *string
+	synchronous *string
+	busyTimeout *time.Duration
+	foreignKeys *bool
+	readConns   *int
+
+	shardDir      *string
+	maxOpenShards *int
+
+	encryptionKeyFile *string
+	compressSpecifics *bool
+
+	quotaMaxEntities       *int
+	quotaMaxSpecificsBytes *int64
+	quotaMaxEntitySize     *int
+	quotaFile              *string
+}
+
+func addStoreFlags(fs *flag.FlagSet) *storeFlags {
+	return &storeFlags{
+		backend: fs.String("backend", internal.BackendSqlite, "datastore backend: sqlite, postgres, memory or bolt"),
+		dbPath:  fs.String("db", defaultDBPath, "database file path of the sqlite backend, "+memoryDBPath+" for the memory backend"),
+		dsn:     fs.String("dsn", "", "connection string of the postgres backend, $LITESYNC_POSTGRES_DSN when not given"),
+
+		memorySnapshot: fs.String("memory-snapshot", "", "file the memory backend loads on start and writes on shutdown, nothing is kept when not given"),
+		boltPath:       fs.String("bolt-db", defaultBoltPath, "database file path of the bolt backend"),
+
+		journalMode: fs.String("journal-mode", defaultDBOptions.JournalMode, "SQLite journal mode: DELETE, TRUNCATE, PERSIST, MEMORY, WAL or OFF"),
+		synchronous: fs.String("synchronous", defaultDBOptions.Synchronous, "SQLite synchronous level: OFF, NORMAL, FULL or EXTRA"),
+		busyTimeout: fs.Duration("busy-timeout", defaultDBOptions.BusyTimeout, "how long to wait for a locked database"),
+		foreignKeys: fs.Bool("foreign-keys", defaultDBOptions.ForeignKeys, "enforce foreign key constraints"),
+		readConns:   fs.Int("read-conns", defaultDBOptions.ReadConns, "number of read-only database connections"),
+
+		shardDir:      fs.String("shard-dir", "", "keep each sync chain in its own SQLite file in this directory, instead of -db"),
+		maxOpenShards: fs.Int("max-open-shards", defaultMaxOpenShards, "number of chain files kept open with -shard-dir"),
+
+		encryptionKeyFile: fs.String("encryption-key-file", "", "encrypt entities at rest with the keys in this file, $"+internal.EncryptionKeysEnv+" holds them when not given"),
+		compressSpecifics: fs.Bool("compress-specifics", false, "store large specifics zstd compressed"),
+
+		quotaMaxEntities:       fs.Int("quota-max-entities", 0, "most live entities a chain can store, 0 for no limit"),
+		quotaMaxSpecificsBytes: fs.Int64("quota-max-specifics-bytes", 0, "most bytes of specifics a chain can store, 0 for no limit"),
+		quotaMaxEntitySize:     fs.Int("quota-max-entity-size", 0, "most bytes of specifics a single entity can have, 0 for no limit"),
+		quotaFile:              fs.String("quota-file", "", "file of per chain quotas, one \"<client id> max_entities=N ...\" per line"),
+	}
+}
+
+// config builds the StoreConfig of the parsed flags.
+func (f *storeFlags) config() (internal.StoreConfig, error) {
+	// The DSN can hold a password, which is better kept out of the process
+	// list and the usage text.
+	dsn := *f.dsn
+	if dsn == "" {
+		dsn = os.Getenv("LITESYNC_POSTGRES_DSN")
+	}
+
+	encryptionKeys, err := f.loadEncryptionKeys()
+	if err != nil {
+		return internal.StoreConfig{}, err
+	}
+
+	quotas, err := f.loadQuotas()
+	if err != nil {
+		return internal.StoreConfig{}, err
+	}
+
+	backend := *f.backend
+	if backend == internal.BackendSqlite && *f.dbPath == memoryDBPath {
+		backend = internal.BackendMemory
+	}
+
+	return internal.StoreConfig{
+		Backend:    backend,
+		SqlitePath: *f.dbPath,
+		Sqlite: internal.SqliteOptions{
+			JournalMode: *f.journalMode,
+			Synchronous: *f.synchronous,
+			BusyTimeout: *f.busyTimeout,
+			ForeignKeys: *f.foreignKeys,
+			ReadConns:   *f.readConns,
+
+			EncryptionKeys:    encryptionKeys,
+			CompressSpecifics: *f.compressSpecifics,
+		},
+		SqliteShardDir: *f.shardDir,
+		MaxOpenShards:  *f.maxOpenShards,
+		PostgresDSN:    dsn,
+
+		MemorySnapshotPath: *f.memorySnapshot,
+		BoltPath:           *f.boltPath,
+
+		Quotas: quotas,
+	}, nil
+}
+
+// loadEncryptionKeys returns nil when neither a key file nor the environment
+// variable is given, entities are then stored in the clear.
+func (f *storeFlags) loadEncryptionKeys() (*internal.EncryptionKeys, error) {
+	if *f.encryptionKeyFile != "" {
+		return internal.LoadEncryptionKeys(*f.encryptionKeyFile)
+	}
+	if keys := os.Getenv(internal.EncryptionKeysEnv); keys != "" {
+		return internal.ParseEncryptionKeys(keys)
+	}
+	return nil, nil
+}
+
+// loadQuotas returns nil when no limit is set, chains are then unlimited.
+func (f *storeFlags) loadQuotas() (*internal.Quotas, error) {
+	defaults := internal.Quota{
+		MaxEntities:       *f.quotaMaxEntities,
+		MaxSpecificsBytes: *f.quotaMaxSpecificsBytes,
+		MaxEntitySize:     *f.quotaMaxEntitySize,
+	}
+	if defaults.MaxEntities < 0 || defaults.MaxSpecificsBytes < 0 || defaults.MaxEntitySize < 0 {
+		return nil, errors.New("quotas must not be negative")
+	}
+	if *f.quotaFile != "" {
+		return internal.LoadQuotas(defaults, *f.quotaFile)
+	}
+	if defaults == (internal.Quota{}) {
+		return nil, nil
+	}
+	return &internal.Quotas{Default: defaults}, nil
+}
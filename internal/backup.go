@@ -0,0 +1,339 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Snapshots are named after the time they were taken, in UTC, so that they
+// sort by age. Each has a sha256sum compatible checksum file next to it.
+const (
+	snapshotPrefix     = "litesync-"
+	snapshotSuffix     = ".sqlite"
+	snapshotTimeLayout = "20060102T150405Z"
+	checksumSuffix     = ".sha256"
+)
+
+// BackupConfig is where snapshots are written and how many are kept.
+type BackupConfig struct {
+	Dir string
+
+	// Interval is how often the server takes a snapshot.
+	Interval time.Duration
+
+	// The newest snapshot of each of the last KeepDaily days and of each of
+	// the last KeepWeekly weeks is kept, the others are deleted. Days are
+	// UTC and weeks start on Monday. With both 0 nothing is deleted.
+	KeepDaily  int
+	KeepWeekly int
+}
+
+// validate checks the limits of c, a scheduled config also needs an
+// interval. Snapshots are named by the second, and one taken in the same
+// second would replace the last.
+func (c BackupConfig) validate(scheduled bool) error {
+	if c.KeepDaily < 0 || c.KeepWeekly < 0 {
+		return errors.New("the numbers of snapshots kept must not be negative")
+	}
+	if scheduled && c.Interval <= 0 {
+		return errors.New("the backup interval must be positive")
+	}
+	return nil
+}
+
+// Snapshot is a verified backup.
+type Snapshot struct {
+	Path   string
+	Time   time.Time
+	Size   int64
+	SHA256 string
+}
+
+// snapshotSource is a store which can back itself up.
+type snapshotSource interface {
+	Backup(destPath string) error
+}
+
+// Backup writes a consistent copy of the database to destPath with SQLite's
+// online backup API. The copy is read from a reader connection, with WAL the
+// server keeps writing while it runs.
+func (d *SqliteDatastore) Backup(destPath string) error {
+	ctx := context.Background()
+	conn, err := d.ReadDb.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("Backup: %w", classifySqliteError(err))
+	}
+	defer conn.Close()
+
+	if err = sqliteBackup(ctx, conn, destPath); err != nil {
+		return fmt.Errorf("Backup: %w", classifySqliteError(err))
+	}
+	return nil
+}
+
+// sqliteFileSource is a database file which is backed up without opening a
+// store on it. The file is only read, a server of another version may be
+// using it, and a store would migrate it.
+type sqliteFileSource struct {
+	path string
+	opts SqliteOptions
+}
+
+func (s sqliteFileSource) Backup(destPath string) error {
+	if _, err := os.Stat(s.path); err != nil {
+		return fmt.Errorf("Backup: %w", err)
+	}
+	db, err := sql.Open(SqliteDriver, s.opts.readerDSN(s.path))
+	if err != nil {
+		return fmt.Errorf("Backup: %w", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("Backup: %w", classifySqliteError(err))
+	}
+	defer conn.Close()
+
+	if err = sqliteBackup(ctx, conn, destPath); err != nil {
+		return fmt.Errorf("Backup: %w", classifySqliteError(err))
+	}
+	return nil
+}
+
+// BackupStore takes a snapshot of the database of cfg, see TakeSnapshot. The
+// database is opened read-only, it is neither checked nor migrated.
+func BackupStore(cfg StoreConfig, backup BackupConfig) (Snapshot, []string, error) {
+	if cfg.Backend != BackendSqlite || cfg.SqliteShardDir != "" || isMemoryDatabase(cfg.SqlitePath) {
+		return Snapshot{}, nil, errors.New("backups need the sqlite backend with a single database file")
+	}
+	if err := backup.validate(false); err != nil {
+		return Snapshot{}, nil, err
+	}
+	return TakeSnapshot(sqliteFileSource{path: cfg.SqlitePath, opts: cfg.Sqlite}, backup, time.Now())
+}
+
+// TakeSnapshot backs source up into backup.Dir as of now, verifies the
+// snapshot and deletes the snapshots which are no longer kept. It returns the
+// new snapshot and the paths of the deleted ones.
+//
+// The snapshot is written under a temporary name and renamed once complete,
+// so that a crash never leaves a partial snapshot behind.
+func TakeSnapshot(source snapshotSource, backup BackupConfig, now time.Time) (Snapshot, []string, error) {
+	fail := func(err error) (Snapshot, []string, error) {
+		return Snapshot{}, nil, fmt.Errorf("TakeSnapshot: %w", err)
+	}
+
+	if err := os.MkdirAll(backup.Dir, 0o700); err != nil {
+		return fail(err)
+	}
+	now = now.UTC()
+	path := filepath.Join(backup.Dir, snapshotPrefix+now.Format(snapshotTimeLayout)+snapshotSuffix)
+	tmpPath := path + ".tmp"
+	if err := os.Remove(tmpPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fail(err)
+	}
+
+	if err := source.Backup(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return fail(err)
+	}
+	sum, size, err := fileSHA256(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fail(err)
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fail(err)
+	}
+	checksum := sum + "  " + filepath.Base(path) + "\n"
+	if err = writeFileAtomic(path+checksumSuffix, []byte(checksum)); err != nil {
+		return fail(err)
+	}
+
+	// Read the snapshot back from disk, rather than trusting the copy.
+	if err = VerifySnapshot(path); err != nil {
+		return fail(err)
+	}
+
+	pruned, err := pruneSnapshots(backup, now)
+	if err != nil {
+		return fail(err)
+	}
+	return Snapshot{Path: path, Time: now, Size: size, SHA256: sum}, pruned, nil
+}
+
+// VerifySnapshot checks a snapshot against its checksum file, and runs
+// SQLite's integrity_check on it.
+func VerifySnapshot(path string) error {
+	recorded, err := os.ReadFile(path + checksumSuffix)
+	if err != nil {
+		return err
+	}
+	want, _, _ := strings.Cut(string(recorded), " ")
+	sum, _, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if sum != want {
+		return fmt.Errorf("%w: %s does not match its checksum", ErrCorrupt, path)
+	}
+
+	db, err := openSnapshot(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = runIntegrityCheck(db, "integrity_check"); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func fileSHA256(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// listSnapshots returns the snapshots in dir, newest first.
+func listSnapshots(dir string) ([]Snapshot, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, snapshotPrefix+"*"+snapshotSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []Snapshot
+	for _, path := range paths {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), snapshotPrefix), snapshotSuffix)
+		taken, err := time.Parse(snapshotTimeLayout, stamp)
+		if err != nil {
+			continue // Not one of ours.
+		}
+		snapshots = append(snapshots, Snapshot{Path: path, Time: taken})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.After(snapshots[j].Time)
+	})
+	return snapshots, nil
+}
+
+// pruneSnapshots deletes the snapshots which backup does not keep. Days and
+// weeks are counted back from now, a snapshot kept as a daily one can be the
+// weekly one as well.
+func pruneSnapshots(backup BackupConfig, now time.Time) ([]string, error) {
+	if backup.KeepDaily == 0 && backup.KeepWeekly == 0 {
+		return nil, nil
+	}
+	snapshots, err := listSnapshots(backup.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	today := now.Truncate(24 * time.Hour)
+	sinceMonday := int(today.Weekday()+6) % 7
+	days := map[int]bool{}
+	weeks := map[int]bool{}
+	var pruned []string
+	for _, snapshot := range snapshots {
+		// Whole days and weeks before today, 0 being today and this week.
+		day := int(today.Sub(snapshot.Time.Truncate(24*time.Hour)).Hours() / 24)
+		week := (day + 6 - sinceMonday) / 7
+		keep := false
+		if day < backup.KeepDaily && !days[day] {
+			days[day] = true
+			keep = true
+		}
+		if week < backup.KeepWeekly && !weeks[week] {
+			weeks[week] = true
+			keep = true
+		}
+		if keep {
+			continue
+		}
+		for _, path := range []string{snapshot.Path, snapshot.Path + checksumSuffix} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return pruned, err
+			}
+		}
+		pruned = append(pruned, snapshot.Path)
+	}
+	return pruned, nil
+}
+
+// BackupScheduler takes a snapshot every interval while the server runs.
+type BackupScheduler struct {
+	source snapshotSource
+	backup BackupConfig
+	logger *zerolog.Logger
+}
+
+func NewBackupScheduler(source snapshotSource, backup BackupConfig, logger *zerolog.Logger) *BackupScheduler {
+	return &BackupScheduler{source: source, backup: backup, logger: logger}
+}
+
+// Run takes a snapshot whenever the newest one in the directory is interval
+// old, until ctx is done. A server which restarts often still gets its
+// snapshots, and one which does not restart does not get extra ones.
+func (s *BackupScheduler) Run(ctx context.Context) {
+	wait := s.untilNext(time.Now())
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		snapshot, pruned, err := TakeSnapshot(s.source, s.backup, time.Now())
+		if err != nil {
+			s.logger.Error().Err(err).Msg("Failed to back up the database")
+		} else {
+			s.logger.Info().Str("snapshot", snapshot.Path).Int64("size", snapshot.Size).
+				Int("pruned", len(pruned)).Msg("Backed up the database")
+		}
+		// A failed snapshot is tried again after an interval too, rather
+		// than in a tight loop.
+		wait = s.backup.Interval
+	}
+}
+
+// untilNext returns how long to wait for the first snapshot.
+func (s *BackupScheduler) untilNext(now time.Time) time.Duration {
+	snapshots, err := listSnapshots(s.backup.Dir)
+	if err != nil || len(snapshots) == 0 {
+		return 0
+	}
+	return max(snapshots[0].Time.Add(s.backup.Interval).Sub(now), 0)
+}
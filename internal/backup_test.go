@@ -0,0 +1,168 @@
+package internal_test
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func insertTestEntities(t *testing.T, ds *internal.SqliteDatastore, prefix string, count int) {
+	for i := 0; i < count; i++ {
+		_, err := ds.InsertSyncEntity(&datastore.SyncEntity{
+			ClientID: "client",
+			ID:       fmt.Sprintf("%s%d", prefix, i),
+			Version:  aws.Int64(1),
+			Mtime:    aws.Int64(int64(i)),
+			DataType: aws.Int(123),
+			Folder:   aws.Bool(false),
+		})
+		require.NoError(t, err)
+	}
+}
+
+func TestBackupWhileWriting(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := internal.NewSqliteDatastore(filepath.Join(dir, "litesync.sqlite"))
+	require.NoError(t, err)
+	defer ds.Close()
+	insertTestEntities(t, ds, "before", 50)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		insertTestEntities(t, ds, "during", 50)
+	}()
+	snapshot, pruned, err := internal.TakeSnapshot(ds, internal.BackupConfig{Dir: filepath.Join(dir, "backups")}, time.Now())
+	wg.Wait()
+	require.NoError(t, err)
+	assert.Empty(t, pruned)
+	assert.NoError(t, internal.VerifySnapshot(snapshot.Path))
+
+	info, err := os.Stat(snapshot.Path)
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), snapshot.Size)
+
+	copy, err := internal.NewSqliteDatastore(snapshot.Path)
+	require.NoError(t, err)
+	defer copy.Close()
+	_, entities, err := copy.GetUpdatesForType(123, -1, true, "client", 1000)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, len(entities), 50, "the snapshot has everything written before it started")
+}
+
+func TestVerifySnapshotDetectsDamage(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := internal.NewSqliteDatastore(filepath.Join(dir, "litesync.sqlite"))
+	require.NoError(t, err)
+	defer ds.Close()
+	insertTestEntities(t, ds, "id", 10)
+
+	snapshot, _, err := internal.TakeSnapshot(ds, internal.BackupConfig{Dir: dir}, time.Now())
+	require.NoError(t, err)
+
+	file, err := os.OpenFile(snapshot.Path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = file.WriteAt([]byte{0xff}, snapshot.Size/2)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	assert.ErrorIs(t, internal.VerifySnapshot(snapshot.Path), internal.ErrCorrupt)
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := internal.NewSqliteDatastore(filepath.Join(dir, "litesync.sqlite"))
+	require.NoError(t, err)
+	defer ds.Close()
+
+	// Twice a day from Thursday 1st to Tuesday 20th.
+	backup := internal.BackupConfig{Dir: filepath.Join(dir, "backups"), KeepDaily: 3, KeepWeekly: 3}
+	start := time.Date(2026, 10, 1, 1, 0, 0, 0, time.UTC)
+	for now := start; now.Before(start.AddDate(0, 0, 20)); now = now.Add(12 * time.Hour) {
+		_, _, err := internal.TakeSnapshot(ds, backup, now)
+		require.NoError(t, err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(backup.Dir, "*.sqlite"))
+	require.NoError(t, err)
+	var kept []string
+	for _, file := range files {
+		kept = append(kept, filepath.Base(file))
+	}
+	sort.Strings(kept)
+	assert.Equal(t, []string{
+		"litesync-20261011T130000Z.sqlite", // the week before last
+		"litesync-20261018T130000Z.sqlite", // the day before yesterday and last week
+		"litesync-20261019T130000Z.sqlite", // yesterday
+		"litesync-20261020T130000Z.sqlite", // today and this week
+	}, kept)
+
+	checksums, err := filepath.Glob(filepath.Join(backup.Dir, "*.sha256"))
+	require.NoError(t, err)
+	assert.Len(t, checksums, len(kept))
+}
+
+func TestBackupStoreLeavesDatabaseAlone(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "litesync.sqlite")
+	ds, err := internal.NewSqliteDatastore(path)
+	require.NoError(t, err)
+	insertTestEntities(t, ds, "id", 10)
+	// A server of an older version, which a backup must not migrate.
+	_, err = ds.Db.Exec("DELETE FROM schema_version WHERE version = ?", latestSchemaVersion(t))
+	require.NoError(t, err)
+	require.NoError(t, ds.Close())
+
+	cfg := internal.StoreConfig{Backend: internal.BackendSqlite, SqlitePath: path, Sqlite: internal.DefaultSqliteOptions()}
+	snapshot, _, err := internal.BackupStore(cfg, internal.BackupConfig{Dir: filepath.Join(dir, "backups")})
+	require.NoError(t, err)
+	require.NoError(t, internal.VerifySnapshot(snapshot.Path))
+
+	for _, p := range []string{path, snapshot.Path} {
+		db, err := sql.Open(internal.SqliteDriver, p)
+		require.NoError(t, err)
+		var version int
+		require.NoError(t, db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version))
+		require.NoError(t, db.Close())
+		assert.Equal(t, latestSchemaVersion(t)-1, version, p)
+	}
+
+	cfg.SqlitePath = filepath.Join(dir, "missing.sqlite")
+	_, _, err = internal.BackupStore(cfg, internal.BackupConfig{Dir: filepath.Join(dir, "backups")})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(cfg.SqlitePath)
+	assert.ErrorIs(t, err, os.ErrNotExist, "a backup should not create the database")
+}
+
+func TestBackupConfigIsChecked(t *testing.T) {
+	dir := t.TempDir()
+	cfg := internal.StoreConfig{Backend: internal.BackendSqlite, SqlitePath: filepath.Join(dir, "litesync.sqlite"), Sqlite: internal.DefaultSqliteOptions()}
+	backups := filepath.Join(dir, "backups")
+
+	_, _, err := internal.BackupStore(cfg, internal.BackupConfig{Dir: backups, KeepDaily: -1})
+	assert.Error(t, err)
+
+	// Snapshots taken in a tight loop would replace each other.
+	for _, backup := range []internal.BackupConfig{
+		{Dir: backups},
+		{Dir: backups, Interval: -time.Hour},
+		{Dir: backups, Interval: time.Hour, KeepWeekly: -1},
+	} {
+		err = internal.StartServer("127.0.0.1:0", cfg, backup, 0)
+		assert.Error(t, err, backup)
+	}
+	_, err = os.Stat(backups)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
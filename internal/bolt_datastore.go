@@ -0,0 +1,944 @@
+package internal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	braveds "github.com/brave/go-sync/datastore"
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+)
+
+// BoltDatastore stores the sync data in a bbolt file, with the same
+// semantics as SqliteDatastore, for small machines which are better off
+// without SQL. Each chain has its own buckets:
+//
+//	chains/<client id>/entities/<id>                the row, as a chain export record
+//	chains/<client id>/updates/<type><mtime><id>    orders GetUpdatesForType
+//	chains/<client id>/expirations/<time><id>       finds the expired rows
+//	chains/<client id>/watermarks/<type><day>       the lowest fetch token
+//	chains/<client id>/counts                       the counts, as a chain export record
+//	chains/<client id>/usage                        the live entities and their specifics bytes
+//
+// Numbers in keys are big endian with the sign bit flipped, so that they
+// sort like the numbers. bbolt has a single writer, which it serializes.
+type BoltDatastore struct {
+	braveds.Datastore
+	Db *bolt.DB
+
+	quotas     *Quotas
+	watermarks *fetchWatermarks
+}
+
+// Version of the bucket layout, stored in meta/version.
+const boltSchemaVersion = 1
+
+var (
+	boltMetaBucket   = []byte("meta")
+	boltChainsBucket = []byte("chains")
+	boltVersionKey   = []byte("version")
+
+	boltEntitiesBucket    = []byte("entities")
+	boltUpdatesBucket     = []byte("updates")
+	boltExpirationsBucket = []byte("expirations")
+	boltWatermarksBucket  = []byte("watermarks")
+	boltCountsKey         = []byte("counts")
+	boltUsageKey          = []byte("usage")
+)
+
+// NewBoltDatastore opens the bbolt file at path, creating it when missing.
+// A file another process has open fails with ErrDatabaseInUse.
+func NewBoltDatastore(path string) (*BoltDatastore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, berrors.ErrTimeout) {
+		return nil, fmt.Errorf("%w: %s", ErrDatabaseInUse, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists(boltChainsBucket); err != nil {
+			return err
+		}
+		if version := meta.Get(boltVersionKey); version != nil {
+			if v := decodeOrderedInt(version); v > boltSchemaVersion {
+				return fmt.Errorf("schema version %d is newer than this server's %d", v, boltSchemaVersion)
+			}
+			return nil
+		}
+		return meta.Put(boltVersionKey, orderedInt(boltSchemaVersion))
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltDatastore{Db: db, watermarks: newFetchWatermarks()}, nil
+}
+
+// Close writes the pending fetch watermarks and closes the file.
+func (d *BoltDatastore) Close() error {
+	return errors.Join(d.FlushWatermarks(), d.Db.Close())
+}
+
+// SchemaVersion returns the version of the bucket layout of the file.
+func (d *BoltDatastore) SchemaVersion() (int, error) {
+	var version int64
+	err := d.Db.View(func(tx *bolt.Tx) error {
+		version = decodeOrderedInt(tx.Bucket(boltMetaBucket).Get(boltVersionKey))
+		return nil
+	})
+	return int(version), err
+}
+
+func orderedInt(v int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(v)^1<<63)
+}
+
+func decodeOrderedInt(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b) ^ 1<<63)
+}
+
+// orderedKey joins two numbers and an ID into an index key.
+func orderedKey(a, b int64, id string) []byte {
+	key := append(orderedInt(a), orderedInt(b)...)
+	return append(key, id...)
+}
+
+// boltChain is the buckets of one chain in a transaction.
+type boltChain struct {
+	bucket      *bolt.Bucket
+	entities    *bolt.Bucket
+	updates     *bolt.Bucket
+	expirations *bolt.Bucket
+	watermarks  *bolt.Bucket
+}
+
+// readChain returns the chain of clientID, nil when it has none.
+func readChain(tx *bolt.Tx, clientID string) *boltChain {
+	bucket := tx.Bucket(boltChainsBucket).Bucket([]byte(clientID))
+	if bucket == nil {
+		return nil
+	}
+	return &boltChain{
+		bucket:      bucket,
+		entities:    bucket.Bucket(boltEntitiesBucket),
+		updates:     bucket.Bucket(boltUpdatesBucket),
+		expirations: bucket.Bucket(boltExpirationsBucket),
+		watermarks:  bucket.Bucket(boltWatermarksBucket),
+	}
+}
+
+// writeChain returns the chain of clientID, creating its buckets.
+func writeChain(tx *bolt.Tx, clientID string) (*boltChain, error) {
+	bucket, err := tx.Bucket(boltChainsBucket).CreateBucketIfNotExists([]byte(clientID))
+	if err != nil {
+		return nil, err
+	}
+	chain := &boltChain{bucket: bucket}
+	for name, sub := range map[string]**bolt.Bucket{
+		string(boltEntitiesBucket):    &chain.entities,
+		string(boltUpdatesBucket):     &chain.updates,
+		string(boltExpirationsBucket): &chain.expirations,
+		string(boltWatermarksBucket):  &chain.watermarks,
+	} {
+		if *sub, err = bucket.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return nil, err
+		}
+	}
+	return chain, nil
+}
+
+func (c *boltChain) has(id string) bool {
+	return c.entities.Get([]byte(id)) != nil
+}
+
+// get returns the row id, false when there is none.
+func (c *boltChain) get(id string) (braveds.SyncEntity, bool, error) {
+	value := c.entities.Get([]byte(id))
+	if value == nil {
+		return braveds.SyncEntity{}, false, nil
+	}
+	row, err := decodeBoltRow(value)
+	return row, true, err
+}
+
+func decodeBoltRow(value []byte) (braveds.SyncEntity, error) {
+	var record chainEntityRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return braveds.SyncEntity{}, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return record.entity(""), nil
+}
+
+// indexKeys returns the keys of row in the updates and expirations
+// buckets, nil for the ones it is not in.
+func indexKeys(row braveds.SyncEntity) (update, expiration []byte) {
+	if row.DataType != nil && row.Mtime != nil {
+		update = orderedKey(int64(*row.DataType), *row.Mtime, row.ID)
+	}
+	if row.ExpirationTime != nil {
+		expiration = append(orderedInt(*row.ExpirationTime), row.ID...)
+	}
+	return update, expiration
+}
+
+// put stores row, replacing the stored one, and keeps the indexes and the
+// usage up to date.
+func (c *boltChain) put(row braveds.SyncEntity) error {
+	if _, _, err := c.remove(row.ID); err != nil {
+		return err
+	}
+	value, err := json.Marshal(newChainEntityRecord(row))
+	if err != nil {
+		return err
+	}
+	if err = c.entities.Put([]byte(row.ID), value); err != nil {
+		return err
+	}
+	update, expiration := indexKeys(row)
+	if update != nil {
+		if err = c.updates.Put(update, nil); err != nil {
+			return err
+		}
+	}
+	if expiration != nil {
+		if err = c.expirations.Put(expiration, nil); err != nil {
+			return err
+		}
+	}
+	// remove took the stored row off the usage already.
+	return c.addUsage(usageGrowth(braveds.SyncEntity{}, row))
+}
+
+// remove deletes the row id, with its index keys, and returns it.
+func (c *boltChain) remove(id string) (braveds.SyncEntity, bool, error) {
+	stored, ok, err := c.get(id)
+	if err != nil || !ok {
+		return stored, ok, err
+	}
+	if err = c.entities.Delete([]byte(id)); err != nil {
+		return stored, ok, err
+	}
+	update, expiration := indexKeys(stored)
+	if update != nil {
+		if err = c.updates.Delete(update); err != nil {
+			return stored, ok, err
+		}
+	}
+	if expiration != nil {
+		if err = c.expirations.Delete(expiration); err != nil {
+			return stored, ok, err
+		}
+	}
+	return stored, ok, c.addUsage(usageGrowth(stored, braveds.SyncEntity{}))
+}
+
+func (c *boltChain) usage() chainUsage {
+	value := c.bucket.Get(boltUsageKey)
+	if value == nil {
+		return chainUsage{}
+	}
+	return chainUsage{
+		entities:       int(decodeOrderedInt(value[:8])),
+		specificsBytes: decodeOrderedInt(value[8:]),
+	}
+}
+
+// addUsage adds grown, which may be negative, to the stored usage.
+func (c *boltChain) addUsage(grown chainUsage) error {
+	usage := c.usage()
+	usage.entities += grown.entities
+	usage.specificsBytes += grown.specificsBytes
+	return c.bucket.Put(boltUsageKey, append(orderedInt(int64(usage.entities)), orderedInt(usage.specificsBytes)...))
+}
+
+// counts returns the stored counts, nil when there are none.
+func (c *boltChain) counts(clientID string) (*braveds.ClientItemCounts, error) {
+	value := c.bucket.Get(boltCountsKey)
+	if value == nil {
+		return nil, nil
+	}
+	var record chainCountsRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return record.counts(clientID), nil
+}
+
+func (c *boltChain) putCounts(counts *braveds.ClientItemCounts) error {
+	value, err := json.Marshal(newChainCountsRecord(counts))
+	if err != nil {
+		return err
+	}
+	return c.bucket.Put(boltCountsKey, value)
+}
+
+// clear deletes the rows and counts of the chain, and keeps its fetch
+// watermarks.
+func (c *boltChain) clear() error {
+	for _, name := range [][]byte{boltEntitiesBucket, boltUpdatesBucket, boltExpirationsBucket} {
+		if err := c.bucket.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	for _, key := range [][]byte{boltCountsKey, boltUsageKey} {
+		if err := c.bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	var err error
+	for name, sub := range map[string]**bolt.Bucket{
+		string(boltEntitiesBucket):    &c.entities,
+		string(boltUpdatesBucket):     &c.updates,
+		string(boltExpirationsBucket): &c.expirations,
+	} {
+		if *sub, err = c.bucket.CreateBucket([]byte(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkChainUsage checks the usage of the chain, which includes the writes
+// of the transaction, like SqliteDatastore.checkChainUsage.
+func (d *BoltDatastore) checkChainUsage(chain *boltChain, clientID string, grown chainUsage) error {
+	quota := d.quotas.For(clientID)
+	if !quota.limitsUsage() || (grown.entities <= 0 && grown.specificsBytes <= 0) {
+		return nil
+	}
+	return quota.checkUsage(chain.usage(), grown)
+}
+
+// InsertSyncEntity inserts a new entity, together with its client tag item
+// when it has a client defined unique tag. A duplicate ID or tag returns
+// conflict along with an error wrapping ErrConflict, and an entity taking
+// the chain over its quota fails with ErrOverQuota.
+func (d *BoltDatastore) InsertSyncEntity(entity *braveds.SyncEntity) (bool, error) {
+	fail := func(err error) (bool, error) {
+		return errors.Is(err, ErrConflict), fmt.Errorf("InsertSyncEntity: %w", err)
+	}
+
+	if err := d.quotas.For(entity.ClientID).checkEntity(entity); err != nil {
+		return fail(err)
+	}
+
+	err := d.Db.Update(func(tx *bolt.Tx) error {
+		chain, err := writeChain(tx, entity.ClientID)
+		if err != nil {
+			return err
+		}
+		if chain.has(entity.ID) {
+			return fmt.Errorf("%w: %s", ErrConflict, entity.ID)
+		}
+		if err = chain.put(*entity); err != nil {
+			return err
+		}
+		if entity.ClientDefinedUniqueTag != nil {
+			tagID := "Client#" + *entity.ClientDefinedUniqueTag
+			if chain.has(tagID) {
+				return fmt.Errorf("%w: client tag %s", ErrConflict, *entity.ClientDefinedUniqueTag)
+			}
+			if err = chain.put(tagItem(entity.ClientID, tagID, entity.Mtime, entity.Ctime)); err != nil {
+				return err
+			}
+		}
+		grown := chainUsage{entities: 1, specificsBytes: int64(len(entity.Specifics))}
+		return d.checkChainUsage(chain, entity.ClientID, grown)
+	})
+	if err != nil {
+		return fail(err)
+	}
+	return false, nil
+}
+
+// InsertSyncEntitiesWithServerTags inserts the entities and a tag item for
+// each server tag in one transaction.
+func (d *BoltDatastore) InsertSyncEntitiesWithServerTags(entities []*braveds.SyncEntity) error {
+	err := d.Db.Update(func(tx *bolt.Tx) error {
+		chains := map[string]*boltChain{}
+		grown := map[string]chainUsage{}
+		for _, se := range entities {
+			if err := d.quotas.For(se.ClientID).checkEntity(se); err != nil {
+				return err
+			}
+			usage := grown[se.ClientID]
+			usage.entities++
+			usage.specificsBytes += int64(len(se.Specifics))
+			grown[se.ClientID] = usage
+
+			chain, ok := chains[se.ClientID]
+			if !ok {
+				var err error
+				if chain, err = writeChain(tx, se.ClientID); err != nil {
+					return err
+				}
+				chains[se.ClientID] = chain
+			}
+			if se.ServerDefinedUniqueTag != nil {
+				tagID := "Server#" + *se.ServerDefinedUniqueTag
+				if chain.has(tagID) {
+					return fmt.Errorf("%w: server tag %s", ErrConflict, *se.ServerDefinedUniqueTag)
+				}
+				tag := braveds.SyncEntity{ClientID: se.ClientID, ID: tagID, Mtime: se.Mtime, Ctime: se.Ctime}
+				if err := chain.put(tag); err != nil {
+					return err
+				}
+			}
+			if chain.has(se.ID) {
+				return fmt.Errorf("%w: %s", ErrConflict, se.ID)
+			}
+			if err := chain.put(*se); err != nil {
+				return err
+			}
+		}
+		for clientID, usage := range grown {
+			if err := d.checkChainUsage(chains[clientID], clientID, usage); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("InsertSyncEntitiesWithServerTags: %w", err)
+	}
+	return nil
+}
+
+// UpdateSyncEntity updates an entity at oldVersion, a changed version
+// returns conflict, see updatedEntity. An update growing the chain over its
+// quota fails with ErrOverQuota, deletes always go through.
+func (d *BoltDatastore) UpdateSyncEntity(se *braveds.SyncEntity, oldVersion int64) (bool, bool, error) {
+	deleting := isTrue(se.Deleted)
+	if !deleting {
+		if err := d.quotas.For(se.ClientID).checkEntity(se); err != nil {
+			return false, false, fmt.Errorf("UpdateSyncEntity: %w", err)
+		}
+	}
+
+	var conflict, deleted bool
+	err := d.Db.Update(func(tx *bolt.Tx) error {
+		chain := readChain(tx, se.ClientID)
+		if chain == nil {
+			conflict = true
+			return nil
+		}
+		stored, ok, err := chain.get(se.ID)
+		if err != nil {
+			return err
+		}
+		if !ok || !updatesVersion(stored, oldVersion) {
+			conflict = true
+			return nil
+		}
+		updated := updatedEntity(stored, se)
+		if err = chain.put(updated); err != nil {
+			return err
+		}
+		if deleting && se.ClientDefinedUniqueTag != nil {
+			if _, _, err = chain.remove("Client#" + *se.ClientDefinedUniqueTag); err != nil {
+				return err
+			}
+		}
+		// The caller decrements the client's item count when we report a
+		// delete, so only report it for the transition into the deleted
+		// state.
+		deleted = deleting && !isTrue(stored.Deleted)
+		return d.checkChainUsage(chain, se.ClientID, usageGrowth(stored, updated))
+	})
+	if err != nil {
+		return false, false, fmt.Errorf("UpdateSyncEntity: %w", err)
+	}
+	return conflict, deleted, nil
+}
+
+// GetUpdatesForType returns up to maxSize entities of the given type that
+// were modified after clientToken, ordered by mtime and ID, leaving out the
+// expired ones. They are read from the updates bucket from the token on.
+// hasChangesRemaining is true when the batch is full. The token is recorded
+// for tombstone compaction.
+func (d *BoltDatastore) GetUpdatesForType(dataType int, clientToken int64, fetchFolders bool, clientID string, maxSize int64) (bool, []braveds.SyncEntity, error) {
+	fail := func(err error) (bool, []braveds.SyncEntity, error) {
+		return false, nil, fmt.Errorf("GetUpdatesForType: %w", err)
+	}
+
+	now := time.Now().Unix()
+	syncEntities := []braveds.SyncEntity{}
+	err := d.Db.View(func(tx *bolt.Tx) error {
+		chain := readChain(tx, clientID)
+		if chain == nil {
+			return nil
+		}
+		prefix := orderedInt(int64(dataType))
+		cursor := chain.updates.Cursor()
+		for key, _ := cursor.Seek(orderedKey(int64(dataType), clientToken, "")); key != nil; key, _ = cursor.Next() {
+			if maxSize >= 0 && int64(len(syncEntities)) >= maxSize {
+				break
+			}
+			if string(key[:8]) != string(prefix) {
+				break
+			}
+			if decodeOrderedInt(key[8:16]) <= clientToken {
+				continue
+			}
+			row, _, err := chain.get(string(key[16:]))
+			if err != nil {
+				return err
+			}
+			if !fetchFolders && (row.Folder == nil || *row.Folder) {
+				continue
+			}
+			if row.ExpirationTime != nil && *row.ExpirationTime <= now {
+				continue
+			}
+			row.ClientID = clientID
+			syncEntities = append(syncEntities, row)
+		}
+		return nil
+	})
+	if err != nil {
+		return fail(err)
+	}
+	d.watermarks.record(clientID, dataType, clientToken)
+
+	hasChangesRemaining := int64(len(syncEntities)) == maxSize
+	return hasChangesRemaining, syncEntities, nil
+}
+
+// FlushWatermarks writes the fetches recorded since the last write.
+func (d *BoltDatastore) FlushWatermarks() error {
+	pending := d.watermarks.take()
+	if len(pending) == 0 {
+		return nil
+	}
+	if err := d.Db.Update(func(tx *bolt.Tx) error {
+		return writeBoltWatermarks(tx, pending)
+	}); err != nil {
+		d.watermarks.giveBack(pending)
+		return fmt.Errorf("FlushWatermarks: %w", err)
+	}
+	return nil
+}
+
+// writeBoltWatermarks lowers the stored watermarks of the day to the given
+// tokens.
+func writeBoltWatermarks(tx *bolt.Tx, watermarks map[dayWatermark]int64) error {
+	for key, token := range watermarks {
+		chain, err := writeChain(tx, key.clientID)
+		if err != nil {
+			return err
+		}
+		dayKey := orderedKey(int64(key.dataType), key.day, "")
+		if stored := chain.watermarks.Get(dayKey); stored != nil && decodeOrderedInt(stored) <= token {
+			continue
+		}
+		if err = chain.watermarks.Put(dayKey, orderedInt(token)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasStaleDevice reports whether the chain has a device info older than
+// cutoff, see SqliteDatastore.CompactTombstones.
+func (c *boltChain) hasStaleDevice(cutoff int64) (bool, error) {
+	cursor := c.updates.Cursor()
+	prefix := orderedInt(deviceInfoTypeID)
+	for key, _ := cursor.Seek(prefix); key != nil && string(key[:8]) == string(prefix); key, _ = cursor.Next() {
+		if decodeOrderedInt(key[8:16]) >= cutoff {
+			break
+		}
+		row, _, err := c.get(string(key[16:]))
+		if err != nil {
+			return false, err
+		}
+		if row.Version != nil && !isTrue(row.Deleted) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (d *BoltDatastore) HasServerDefinedUniqueTag(clientID string, tag string) (bool, error) {
+	return d.HasItem(clientID, "Server#"+tag)
+}
+
+func (d *BoltDatastore) HasItem(clientID string, ID string) (bool, error) {
+	var exists bool
+	err := d.Db.View(func(tx *bolt.Tx) error {
+		chain := readChain(tx, clientID)
+		exists = chain != nil && chain.has(ID)
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("HasItem: %w", err)
+	}
+	return exists, nil
+}
+
+// GetClientItemCount returns the stored counts with the expired history
+// periods rotated out. Counts imported from before clientItemCountsVersion
+// are recounted from the entities.
+func (d *BoltDatastore) GetClientItemCount(clientID string) (*braveds.ClientItemCounts, error) {
+	now := time.Now().Unix()
+	fresh := &braveds.ClientItemCounts{
+		ClientID:             clientID,
+		ID:                   clientID,
+		LastPeriodChangeTime: now,
+		Version:              clientItemCountsVersion,
+	}
+	var counts *braveds.ClientItemCounts
+	err := d.Db.View(func(tx *bolt.Tx) error {
+		chain := readChain(tx, clientID)
+		if chain == nil {
+			return nil
+		}
+		var err error
+		if counts, err = chain.counts(clientID); err != nil || counts == nil {
+			return err
+		}
+		if counts.Version >= clientItemCountsVersion {
+			rotateHistoryCounts(counts, now)
+			return nil
+		}
+
+		counts = fresh
+		return chain.entities.ForEach(func(_, value []byte) error {
+			row, err := decodeBoltRow(value)
+			switch {
+			case err != nil:
+				return err
+			case !isLiveEntity(row):
+			case isHistoryDataType(row.DataType):
+				counts.HistoryItemCountPeriod4++
+			default:
+				counts.ItemCount++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetClientItemCount: %w", err)
+	}
+	if counts == nil {
+		return fresh, nil
+	}
+	return counts, nil
+}
+
+// UpdateClientItemCount adds the new items to counts, which must come from
+// GetClientItemCount, and stores the result.
+func (d *BoltDatastore) UpdateClientItemCount(counts *braveds.ClientItemCounts, newNormalItemCount int, newHistoryItemCount int) error {
+	counts.ItemCount += newNormalItemCount
+	counts.HistoryItemCountPeriod4 += newHistoryItemCount
+
+	err := d.Db.Update(func(tx *bolt.Tx) error {
+		chain, err := writeChain(tx, counts.ClientID)
+		if err != nil {
+			return err
+		}
+		return chain.putCounts(counts)
+	})
+	if err != nil {
+		return fmt.Errorf("UpdateClientItemCount: %w", err)
+	}
+	return nil
+}
+
+// ClearServerData deletes every row of a chain but its disabled chain
+// marker, and its counts, in one transaction, and returns the deleted rows.
+func (d *BoltDatastore) ClearServerData(clientID string) ([]braveds.SyncEntity, error) {
+	syncEntities := []braveds.SyncEntity{}
+	err := d.Db.Update(func(tx *bolt.Tx) error {
+		chain := readChain(tx, clientID)
+		if chain == nil {
+			return nil
+		}
+		var marker *braveds.SyncEntity
+		err := chain.entities.ForEach(func(_, value []byte) error {
+			row, err := decodeBoltRow(value)
+			if err != nil {
+				return err
+			}
+			row.ClientID = clientID
+			if row.ID == disabledChainID {
+				marker = &row
+			} else {
+				syncEntities = append(syncEntities, row)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err = chain.clear(); err != nil {
+			return err
+		}
+		if marker != nil {
+			return chain.put(*marker)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ClearServerData: %w", err)
+	}
+	return syncEntities, nil
+}
+
+// DisableSyncChain stores the disabled chain marker of the chain, which
+// ClearServerData keeps.
+func (d *BoltDatastore) DisableSyncChain(clientID string) error {
+	err := d.Db.Update(func(tx *bolt.Tx) error {
+		chain, err := writeChain(tx, clientID)
+		if err != nil || chain.has(disabledChainID) {
+			return err
+		}
+		now := time.Now().UnixMilli()
+		return chain.put(braveds.SyncEntity{ClientID: clientID, ID: disabledChainID, Mtime: &now, Ctime: &now})
+	})
+	if err != nil {
+		return fmt.Errorf("DisableSyncChain: %w", err)
+	}
+	return nil
+}
+
+func (d *BoltDatastore) IsSyncChainDisabled(clientID string) (bool, error) {
+	disabled, err := d.HasItem(clientID, disabledChainID)
+	if err != nil {
+		return false, fmt.Errorf("IsSyncChainDisabled: %w", err)
+	}
+	return disabled, nil
+}
+
+// forEachChain calls fn with every chain, until fn returns false or an
+// error.
+func forEachChain(tx *bolt.Tx, fn func(clientID string, chain *boltChain) (bool, error)) error {
+	cursor := tx.Bucket(boltChainsBucket).Cursor()
+	for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+		more, err := fn(string(key), readChain(tx, string(key)))
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteExpiredEntities deletes up to limit entities whose expiration time
+// is at or before now, found through the expirations bucket, together with
+// the client tag items of the live ones, and returns how many entities were
+// deleted per client. Live entities of normal types are taken off the
+// client's item count.
+func (d *BoltDatastore) DeleteExpiredEntities(now int64, limit int) (map[string]int, error) {
+	deleted := map[string]int{}
+	err := d.Db.Update(func(tx *bolt.Tx) error {
+		total := 0
+		return forEachChain(tx, func(clientID string, chain *boltChain) (bool, error) {
+			var expired []string
+			cursor := chain.expirations.Cursor()
+			for key, _ := cursor.First(); key != nil && total < limit; key, _ = cursor.Next() {
+				if decodeOrderedInt(key[:8]) > now {
+					break
+				}
+				expired = append(expired, string(key[8:]))
+				total++
+			}
+			if len(expired) == 0 {
+				return total < limit, nil
+			}
+
+			liveNormalItems := 0
+			for _, id := range expired {
+				row, _, err := chain.remove(id)
+				if err != nil {
+					return false, err
+				}
+				// A tombstone's tag may belong to a newer entity by now.
+				if !isLiveEntity(row) {
+					continue
+				}
+				if row.ClientDefinedUniqueTag != nil {
+					if _, _, err = chain.remove("Client#" + *row.ClientDefinedUniqueTag); err != nil {
+						return false, err
+					}
+				}
+				if !isHistoryDataType(row.DataType) {
+					liveNormalItems++
+				}
+			}
+			deleted[clientID] = len(expired)
+
+			counts, err := chain.counts(clientID)
+			if err != nil || counts == nil || liveNormalItems == 0 {
+				return total < limit, err
+			}
+			counts.ItemCount = max(counts.ItemCount-liveNormalItems, 0)
+			return total < limit, chain.putCounts(counts)
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("DeleteExpiredEntities: %w", err)
+	}
+	return deleted, nil
+}
+
+// CompactTombstones removes up to limit tombstones with an mtime before
+// cutoff which every device syncing since cutoff has fetched, and the
+// watermarks from before cutoff, see SqliteDatastore.CompactTombstones. The
+// tombstones of a type are looked for in its updates, up to the lowest
+// token it was fetched with.
+func (d *BoltDatastore) CompactTombstones(cutoff int64, limit int) (map[string]TombstoneStats, error) {
+	pending := d.watermarks.take()
+	cutoffDay := cutoff / millisPerDay
+	compacted := map[string]TombstoneStats{}
+	err := d.Db.Update(func(tx *bolt.Tx) error {
+		if err := writeBoltWatermarks(tx, pending); err != nil {
+			return err
+		}
+		total := 0
+		return forEachChain(tx, func(clientID string, chain *boltChain) (bool, error) {
+			// The lowest token of each type since the cutoff.
+			fetched := map[int64]int64{}
+			var old [][]byte
+			err := chain.watermarks.ForEach(func(key, value []byte) error {
+				dataType, token := decodeOrderedInt(key[:8]), decodeOrderedInt(value)
+				if decodeOrderedInt(key[8:16]) < cutoffDay {
+					old = append(old, key)
+					return nil
+				}
+				if lowest, ok := fetched[dataType]; !ok || token < lowest {
+					fetched[dataType] = token
+				}
+				return nil
+			})
+			if err != nil {
+				return false, err
+			}
+			stale, err := chain.hasStaleDevice(cutoff)
+			if err != nil {
+				return false, err
+			}
+			if stale {
+				fetched = nil
+			}
+
+			var tombstones []string
+			for dataType, lowest := range fetched {
+				cursor := chain.updates.Cursor()
+				prefix := orderedInt(dataType)
+				for key, _ := cursor.Seek(prefix); key != nil && total < limit; key, _ = cursor.Next() {
+					if string(key[:8]) != string(prefix) {
+						break
+					}
+					if mtime := decodeOrderedInt(key[8:16]); mtime >= cutoff || mtime > lowest {
+						break
+					}
+					row, _, err := chain.get(string(key[16:]))
+					if err != nil {
+						return false, err
+					}
+					if row.Version != nil && isTrue(row.Deleted) {
+						tombstones = append(tombstones, row.ID)
+						total++
+					}
+				}
+			}
+
+			for _, id := range tombstones {
+				row, _, err := chain.remove(id)
+				if err != nil {
+					return false, err
+				}
+				row.ClientID = clientID
+				stats := compacted[clientID]
+				stats.add(TombstoneStats{Rows: 1, Bytes: storedBytes(row)})
+				compacted[clientID] = stats
+			}
+			for _, key := range old {
+				if err = chain.watermarks.Delete(key); err != nil {
+					return false, err
+				}
+			}
+			return total < limit, nil
+		})
+	})
+	if err != nil {
+		d.watermarks.giveBack(pending)
+		return nil, fmt.Errorf("CompactTombstones: %w", err)
+	}
+	return compacted, nil
+}
+
+// ExportChain reads the chain of clientID in one transaction, rows ordered
+// by ID.
+func (d *BoltDatastore) ExportChain(clientID string) (ChainExport, error) {
+	chain := ChainExport{ClientID: clientID, Entities: []braveds.SyncEntity{}}
+	err := d.Db.View(func(tx *bolt.Tx) error {
+		stored := readChain(tx, clientID)
+		if stored == nil {
+			return nil
+		}
+		err := stored.entities.ForEach(func(_, value []byte) error {
+			row, err := decodeBoltRow(value)
+			if err != nil {
+				return err
+			}
+			row.ClientID = clientID
+			chain.Entities = append(chain.Entities, row)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		chain.Counts, err = stored.counts(clientID)
+		return err
+	})
+	if err != nil {
+		return ChainExport{}, fmt.Errorf("ExportChain: %w", err)
+	}
+	return chain, nil
+}
+
+// ImportChain stores chain in one transaction. A chain which already has
+// data is replaced with replace, otherwise the import fails with
+// ErrConflict.
+func (d *BoltDatastore) ImportChain(chain ChainExport, replace bool) error {
+	err := d.Db.Update(func(tx *bolt.Tx) error {
+		stored, err := writeChain(tx, chain.ClientID)
+		if err != nil {
+			return err
+		}
+		hasData := stored.entities.Stats().KeyN > 0 || stored.bucket.Get(boltCountsKey) != nil
+		if hasData && !replace {
+			return fmt.Errorf("%w: chain %s already has data", ErrConflict, chain.ClientID)
+		}
+		if err = stored.clear(); err != nil {
+			return err
+		}
+
+		for _, entity := range chain.Entities {
+			if stored.has(entity.ID) {
+				return fmt.Errorf("%w: %s", ErrConflict, entity.ID)
+			}
+			entity.ClientID = chain.ClientID
+			if err = stored.put(entity); err != nil {
+				return err
+			}
+		}
+		if chain.Counts != nil {
+			counts := *chain.Counts
+			counts.ClientID = chain.ClientID
+			return stored.putCounts(&counts)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("ImportChain: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package internal_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoltReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "litesync.bolt")
+	ds, err := internal.NewBoltDatastore(path)
+	require.NoError(t, err)
+
+	entity := &datastore.SyncEntity{
+		ClientID:               "client",
+		ID:                     "id1",
+		Version:                aws.Int64(1),
+		Mtime:                  aws.Int64(1000),
+		Specifics:              []byte("specifics"),
+		DataType:               aws.Int(123),
+		Folder:                 aws.Bool(false),
+		Deleted:                aws.Bool(false),
+		ClientDefinedUniqueTag: aws.String("tag1"),
+		UniquePosition:         []byte{0, 1, 2},
+	}
+	_, err = ds.InsertSyncEntity(entity)
+	require.NoError(t, err)
+	counts, err := ds.GetClientItemCount("client")
+	require.NoError(t, err)
+	require.NoError(t, ds.UpdateClientItemCount(counts, 1, 0))
+	_, _, err = ds.GetUpdatesForType(123, 1000, true, "client", 100)
+	require.NoError(t, err)
+	exported, err := ds.ExportChain("client")
+	require.NoError(t, err)
+
+	// A second server on the same file would corrupt it.
+	_, err = internal.NewBoltDatastore(path)
+	assert.ErrorIs(t, err, internal.ErrDatabaseInUse)
+	require.NoError(t, ds.Close())
+
+	ds, err = internal.NewBoltDatastore(path)
+	require.NoError(t, err)
+	defer ds.Close()
+	version, err := ds.SchemaVersion()
+	require.NoError(t, err)
+	assert.Equal(t, 1, version)
+	reloaded, err := ds.ExportChain("client")
+	require.NoError(t, err)
+	assert.Equal(t, exported, reloaded)
+
+	// The fetch at 1000 was stored too, so the tombstone it covers can go.
+	entity.Version = aws.Int64(2)
+	entity.Deleted = aws.Bool(true)
+	_, deleted, err := ds.UpdateSyncEntity(entity, 1)
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	compacted, err := ds.CompactTombstones(time.Now().UnixMilli(), 100)
+	require.NoError(t, err)
+	assert.Equal(t, 1, compacted["client"].Rows)
+	has, err := ds.HasItem("client", "id1")
+	require.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestBoltDeleteExpiredEntities(t *testing.T) {
+	ds, err := internal.NewBoltDatastore(filepath.Join(t.TempDir(), "litesync.bolt"))
+	require.NoError(t, err)
+	defer ds.Close()
+
+	now := time.Now().Unix()
+	entity := datastore.SyncEntity{
+		ClientID:       "client1",
+		ID:             "id1",
+		Version:        aws.Int64(1),
+		Mtime:          aws.Int64(12345678),
+		DataType:       aws.Int(123),
+		Deleted:        aws.Bool(false),
+		ExpirationTime: aws.Int64(now - 10),
+	}
+	history := entity
+	history.ID = "history1"
+	history.DataType = aws.Int(963985)
+	history.ClientDefinedUniqueTag = aws.String("history1")
+	live := entity
+	live.ID = "id2"
+	live.ExpirationTime = aws.Int64(now + 300)
+	other := entity
+	other.ClientID = "client2"
+	for _, e := range []datastore.SyncEntity{entity, history, live, other} {
+		_, err = ds.InsertSyncEntity(&e)
+		require.NoError(t, err)
+	}
+	counts, err := ds.GetClientItemCount("client1")
+	require.NoError(t, err)
+	require.NoError(t, ds.UpdateClientItemCount(counts, 2, 1))
+
+	// The limit holds across chains.
+	deleted, err := ds.DeleteExpiredEntities(now, 2)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"client1": 2}, deleted)
+	deleted, err = ds.DeleteExpiredEntities(now, 10)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"client2": 1}, deleted)
+
+	for id, expected := range map[string]bool{"id1": false, "history1": false, "Client#history1": false, "id2": true} {
+		has, err := ds.HasItem("client1", id)
+		require.NoError(t, err)
+		assert.Equal(t, expected, has, id)
+	}
+	counts, err = ds.GetClientItemCount("client1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, counts.ItemCount)
+}
+
+func TestBoltDeleteExpiredEntitiesKeepsReusedTags(t *testing.T) {
+	ds, err := internal.NewBoltDatastore(filepath.Join(t.TempDir(), "litesync.bolt"))
+	require.NoError(t, err)
+	defer ds.Close()
+	checkReapKeepsReusedTag(t, ds)
+}
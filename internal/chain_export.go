@@ -0,0 +1,422 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	braveds "github.com/brave/go-sync/datastore"
+)
+
+// ChainExport is every sync_entities row of one chain, tag items and the
+// disabled chain marker included, and its item counts. Sealed fields and
+// compressed specifics are exported in the clear, so that the receiving
+// server can store them with its own settings.
+type ChainExport struct {
+	ClientID string
+	Entities []braveds.SyncEntity
+
+	// Counts is nil for a chain which has no counts row yet.
+	Counts *braveds.ClientItemCounts
+}
+
+// chainTransferer is a store which can export and import whole chains.
+type chainTransferer interface {
+	ExportChain(clientID string) (ChainExport, error)
+	ImportChain(chain ChainExport, replace bool) error
+}
+
+// An export is written as JSON Lines, a header line and then one line per
+// entity and one for the counts. Byte fields are base64 encoded.
+const (
+	chainExportFormat  = "litesync-chain"
+	chainExportVersion = 1
+
+	chainRecordHeader = "chain"
+	chainRecordEntity = "entity"
+	chainRecordCounts = "counts"
+)
+
+type chainHeaderRecord struct {
+	Kind          string `json:"kind"`
+	Format        string `json:"format"`
+	FormatVersion int    `json:"format_version"`
+	ClientID      string `json:"client_id"`
+}
+
+type chainEntityRecord struct {
+	Kind                   string  `json:"kind"`
+	ID                     string  `json:"id"`
+	ParentID               *string `json:"parent_id,omitempty"`
+	Version                *int64  `json:"version,omitempty"`
+	Mtime                  *int64  `json:"mtime,omitempty"`
+	Ctime                  *int64  `json:"ctime,omitempty"`
+	Name                   *string `json:"name,omitempty"`
+	NonUniqueName          *string `json:"non_unique_name,omitempty"`
+	ServerDefinedUniqueTag *string `json:"server_defined_unique_tag,omitempty"`
+	Deleted                *bool   `json:"deleted,omitempty"`
+	OriginatorCacheGUID    *string `json:"originator_cache_guid,omitempty"`
+	OriginatorClientItemID *string `json:"originator_client_item_id,omitempty"`
+	Specifics              []byte  `json:"specifics,omitempty"`
+	DataType               *int    `json:"data_type,omitempty"`
+	Folder                 *bool   `json:"folder,omitempty"`
+	ClientDefinedUniqueTag *string `json:"client_defined_unique_tag,omitempty"`
+	UniquePosition         []byte  `json:"unique_position,omitempty"`
+	DataTypeMtime          *string `json:"data_type_mtime,omitempty"`
+	ExpirationTime         *int64  `json:"expiration_time,omitempty"`
+}
+
+type chainCountsRecord struct {
+	Kind                    string `json:"kind"`
+	ItemCount               int    `json:"item_count"`
+	HistoryItemCountPeriod1 int    `json:"history_item_count_period1"`
+	HistoryItemCountPeriod2 int    `json:"history_item_count_period2"`
+	HistoryItemCountPeriod3 int    `json:"history_item_count_period3"`
+	HistoryItemCountPeriod4 int    `json:"history_item_count_period4"`
+	LastPeriodChangeTime    int64  `json:"last_period_change_time"`
+	Version                 int    `json:"version"`
+}
+
+// newChainEntityRecord returns the export record of e.
+func newChainEntityRecord(e braveds.SyncEntity) chainEntityRecord {
+	return chainEntityRecord{
+		Kind:                   chainRecordEntity,
+		ID:                     e.ID,
+		ParentID:               e.ParentID,
+		Version:                e.Version,
+		Mtime:                  e.Mtime,
+		Ctime:                  e.Ctime,
+		Name:                   e.Name,
+		NonUniqueName:          e.NonUniqueName,
+		ServerDefinedUniqueTag: e.ServerDefinedUniqueTag,
+		Deleted:                e.Deleted,
+		OriginatorCacheGUID:    e.OriginatorCacheGUID,
+		OriginatorClientItemID: e.OriginatorClientItemID,
+		Specifics:              e.Specifics,
+		DataType:               e.DataType,
+		Folder:                 e.Folder,
+		ClientDefinedUniqueTag: e.ClientDefinedUniqueTag,
+		UniquePosition:         e.UniquePosition,
+		DataTypeMtime:          e.DataTypeMtime,
+		ExpirationTime:         e.ExpirationTime,
+	}
+}
+
+func (e chainEntityRecord) entity(clientID string) braveds.SyncEntity {
+	return braveds.SyncEntity{
+		ClientID:               clientID,
+		ID:                     e.ID,
+		ParentID:               e.ParentID,
+		Version:                e.Version,
+		Mtime:                  e.Mtime,
+		Ctime:                  e.Ctime,
+		Name:                   e.Name,
+		NonUniqueName:          e.NonUniqueName,
+		ServerDefinedUniqueTag: e.ServerDefinedUniqueTag,
+		Deleted:                e.Deleted,
+		OriginatorCacheGUID:    e.OriginatorCacheGUID,
+		OriginatorClientItemID: e.OriginatorClientItemID,
+		Specifics:              e.Specifics,
+		DataType:               e.DataType,
+		Folder:                 e.Folder,
+		ClientDefinedUniqueTag: e.ClientDefinedUniqueTag,
+		UniquePosition:         e.UniquePosition,
+		DataTypeMtime:          e.DataTypeMtime,
+		ExpirationTime:         e.ExpirationTime,
+	}
+}
+
+func newChainCountsRecord(c *braveds.ClientItemCounts) chainCountsRecord {
+	return chainCountsRecord{
+		Kind:                    chainRecordCounts,
+		ItemCount:               c.ItemCount,
+		HistoryItemCountPeriod1: c.HistoryItemCountPeriod1,
+		HistoryItemCountPeriod2: c.HistoryItemCountPeriod2,
+		HistoryItemCountPeriod3: c.HistoryItemCountPeriod3,
+		HistoryItemCountPeriod4: c.HistoryItemCountPeriod4,
+		LastPeriodChangeTime:    c.LastPeriodChangeTime,
+		Version:                 c.Version,
+	}
+}
+
+func (c chainCountsRecord) counts(clientID string) *braveds.ClientItemCounts {
+	return &braveds.ClientItemCounts{
+		ClientID:                clientID,
+		ID:                      clientID,
+		ItemCount:               c.ItemCount,
+		HistoryItemCountPeriod1: c.HistoryItemCountPeriod1,
+		HistoryItemCountPeriod2: c.HistoryItemCountPeriod2,
+		HistoryItemCountPeriod3: c.HistoryItemCountPeriod3,
+		HistoryItemCountPeriod4: c.HistoryItemCountPeriod4,
+		LastPeriodChangeTime:    c.LastPeriodChangeTime,
+		Version:                 c.Version,
+	}
+}
+
+// WriteChainExport writes chain to w as JSON Lines.
+func WriteChainExport(w io.Writer, chain ChainExport) error {
+	out := bufio.NewWriter(w)
+	enc := json.NewEncoder(out)
+
+	err := enc.Encode(chainHeaderRecord{
+		Kind:          chainRecordHeader,
+		Format:        chainExportFormat,
+		FormatVersion: chainExportVersion,
+		ClientID:      chain.ClientID,
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range chain.Entities {
+		err = enc.Encode(newChainEntityRecord(e))
+		if err != nil {
+			return err
+		}
+	}
+	if c := chain.Counts; c != nil {
+		err = enc.Encode(newChainCountsRecord(c))
+		if err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// ReadChainExport reads a chain written by WriteChainExport.
+func ReadChainExport(r io.Reader) (ChainExport, error) {
+	var chain ChainExport
+	scanner := bufio.NewScanner(r)
+	// Lines hold whole entities, bookmarks with favicons run long.
+	scanner.Buffer(nil, 64<<20)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		fail := func(err error) (ChainExport, error) {
+			return ChainExport{}, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		var kind struct {
+			Kind string `json:"kind"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &kind); err != nil {
+			return fail(err)
+		}
+		if line == 1 && kind.Kind != chainRecordHeader {
+			return fail(errors.New("not a litesync chain export"))
+		}
+
+		switch kind.Kind {
+		case chainRecordHeader:
+			var header chainHeaderRecord
+			if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+				return fail(err)
+			}
+			if line != 1 || header.Format != chainExportFormat || header.ClientID == "" {
+				return fail(errors.New("not a litesync chain export"))
+			}
+			if header.FormatVersion != chainExportVersion {
+				return fail(fmt.Errorf("unsupported format version %d", header.FormatVersion))
+			}
+			chain.ClientID = header.ClientID
+		case chainRecordEntity:
+			var e chainEntityRecord
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				return fail(err)
+			}
+			if e.ID == "" {
+				return fail(errors.New("entity without an id"))
+			}
+			chain.Entities = append(chain.Entities, e.entity(chain.ClientID))
+		case chainRecordCounts:
+			var c chainCountsRecord
+			if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+				return fail(err)
+			}
+			chain.Counts = c.counts(chain.ClientID)
+		default:
+			return fail(fmt.Errorf("unknown record kind %q", kind.Kind))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return ChainExport{}, err
+	}
+	if line == 0 {
+		return ChainExport{}, errors.New("empty chain export")
+	}
+	return chain, nil
+}
+
+// ExportStoreChain writes the chain of clientID in the store of cfg to w.
+func ExportStoreChain(cfg StoreConfig, clientID string, w io.Writer) (ChainExport, error) {
+	store, err := openStore(cfg)
+	if err != nil {
+		return ChainExport{}, err
+	}
+	defer store.Close()
+
+	chain, err := store.ExportChain(clientID)
+	if err != nil {
+		return ChainExport{}, err
+	}
+	if len(chain.Entities) == 0 && chain.Counts == nil {
+		return ChainExport{}, fmt.Errorf("chain %s has no data", clientID)
+	}
+	return chain, WriteChainExport(w, chain)
+}
+
+// ImportStoreChain reads a chain from r into the store of cfg. A chain which
+// already has data is only overwritten with replace.
+func ImportStoreChain(cfg StoreConfig, r io.Reader, replace bool) (ChainExport, error) {
+	chain, err := ReadChainExport(r)
+	if err != nil {
+		return ChainExport{}, err
+	}
+
+	store, err := openStore(cfg)
+	if err != nil {
+		return ChainExport{}, err
+	}
+	defer store.Close()
+	return chain, store.ImportChain(chain, replace)
+}
+
+// scanClientItemCounts reads a row selected like getClientItemCountQuery, as
+// it is stored.
+func scanClientItemCounts(row rowScanner, clientID string) (*braveds.ClientItemCounts, error) {
+	counts := braveds.ClientItemCounts{ClientID: clientID, ID: clientID}
+	err := row.Scan(
+		&counts.ItemCount,
+		&counts.HistoryItemCountPeriod1,
+		&counts.HistoryItemCountPeriod2,
+		&counts.HistoryItemCountPeriod3,
+		&counts.HistoryItemCountPeriod4,
+		&counts.LastPeriodChangeTime,
+		&counts.Version,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &counts, nil
+}
+
+const exportChainQuery = `
+SELECT ` + syncEntityColumns + `, key_id
+FROM sync_entities
+WHERE client_id = ?
+ORDER BY id
+`
+
+// ExportChain reads the chain of clientID in one transaction.
+func (d *SqliteDatastore) ExportChain(clientID string) (ChainExport, error) {
+	fail := func(err error) (ChainExport, error) {
+		return ChainExport{}, fmt.Errorf("ExportChain: %w", classifySqliteError(err))
+	}
+
+	tx, err := d.ReadDb.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(exportChainQuery, clientID)
+	if err != nil {
+		return fail(err)
+	}
+	defer rows.Close()
+
+	chain := ChainExport{ClientID: clientID, Entities: []braveds.SyncEntity{}}
+	for rows.Next() {
+		entity, err := d.scanSealedSyncEntity(rows)
+		if err != nil {
+			return fail(err)
+		}
+		chain.Entities = append(chain.Entities, entity)
+	}
+	if err = rows.Err(); err != nil {
+		return fail(err)
+	}
+	rows.Close()
+
+	if chain.Counts, err = scanClientItemCounts(tx.QueryRow(getClientItemCountQuery, clientID), clientID); err != nil {
+		return fail(err)
+	}
+	return chain, nil
+}
+
+const chainHasDataQuery = `
+SELECT EXISTS(SELECT 1 FROM sync_entities WHERE client_id = ?)
+    OR EXISTS(SELECT 1 FROM client_item_counts WHERE client_id = ?)
+`
+
+// ImportChain stores chain in one transaction, sealing and compressing it
+// as configured. A chain which already has data is replaced with replace,
+// otherwise the import fails with ErrConflict.
+func (d *SqliteDatastore) ImportChain(chain ChainExport, replace bool) error {
+	fail := func(err error) error {
+		return fmt.Errorf("ImportChain: %w", classifySqliteError(err))
+	}
+
+	tx, err := d.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+
+	var hasData bool
+	if err = tx.QueryRow(chainHasDataQuery, chain.ClientID, chain.ClientID).Scan(&hasData); err != nil {
+		return fail(err)
+	}
+	if hasData && !replace {
+		return fail(fmt.Errorf("%w: chain %s already has data", ErrConflict, chain.ClientID))
+	}
+	if _, err = tx.Exec("DELETE FROM sync_entities WHERE client_id = ?", chain.ClientID); err != nil {
+		return fail(err)
+	}
+	if _, err = tx.Exec("DELETE FROM client_item_counts WHERE client_id = ?", chain.ClientID); err != nil {
+		return fail(err)
+	}
+
+	for i := range chain.Entities {
+		entity := chain.Entities[i]
+		entity.ClientID = chain.ClientID
+		// Tag items and the disabled marker have nothing to seal.
+		args := append(syncEntityArgs(&entity), nil)
+		if entity.Version != nil {
+			if args, err = d.sealedSyncEntityArgs(&entity); err != nil {
+				return fail(err)
+			}
+		}
+		if _, err = tx.Exec(insertSyncEntityQuery, args...); err != nil {
+			return fail(err)
+		}
+	}
+
+	if c := chain.Counts; c != nil {
+		_, err = tx.Exec(upsertClientItemCountQuery,
+			chain.ClientID,
+			c.ItemCount,
+			c.HistoryItemCountPeriod1,
+			c.HistoryItemCountPeriod2,
+			c.HistoryItemCountPeriod3,
+			c.HistoryItemCountPeriod4,
+			c.LastPeriodChangeTime,
+			c.Version,
+		)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package internal_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChainExportRoundTrip(t *testing.T) {
+	// Sealed and compressed on the way out, stored as the destination is
+	// configured on the way in.
+	source := openCompressingDatastore(t, filepath.Join(t.TempDir(), "litesync.sqlite"), true, encryptionKeyLine(t, "k1"))
+
+	bookmark := encryptedTestEntity("id1")
+	bookmark.ClientDefinedUniqueTag = aws.String("tag1")
+	bookmark.Specifics = bytes.Repeat([]byte("favicon "), 100)
+	bookmark.UniquePosition = []byte{0, 1, 2}
+	_, err := source.InsertSyncEntity(bookmark)
+	require.NoError(t, err)
+	require.NoError(t, source.InsertSyncEntitiesWithServerTags([]*datastore.SyncEntity{{
+		ClientID:               "client",
+		ID:                     "id2",
+		Version:                aws.Int64(1),
+		Mtime:                  aws.Int64(1),
+		ServerDefinedUniqueTag: aws.String("bookmark_bar"),
+		DataType:               aws.Int(123),
+		Folder:                 aws.Bool(true),
+	}}))
+	_, err = source.InsertSyncEntity(encryptedTestEntity("id3"))
+	require.NoError(t, err)
+	_, err = source.InsertSyncEntity(&datastore.SyncEntity{ClientID: "other", ID: "id4", Version: aws.Int64(1), DataType: aws.Int(123)})
+	require.NoError(t, err)
+	counts, err := source.GetClientItemCount("client")
+	require.NoError(t, err)
+	require.NoError(t, source.UpdateClientItemCount(counts, 3, 0))
+	require.NoError(t, source.DisableSyncChain("client"))
+
+	exported, err := source.ExportChain("client")
+	require.NoError(t, err)
+	var ids []string
+	for _, entity := range exported.Entities {
+		ids = append(ids, entity.ID)
+	}
+	assert.Equal(t, []string{"Client#tag1", "Server#bookmark_bar", "disabled_chain", "id1", "id2", "id3"}, ids)
+
+	var buf bytes.Buffer
+	require.NoError(t, internal.WriteChainExport(&buf, exported))
+	assert.NotContains(t, buf.String(), "secret specifics", "specifics are base64 encoded")
+	read, err := internal.ReadChainExport(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, exported, read)
+
+	dest := newShardedDatastore(t, 4)
+	require.NoError(t, dest.ImportChain(read, false))
+	reexported, err := dest.ExportChain("client")
+	require.NoError(t, err)
+	assert.Equal(t, exported, reexported)
+
+	_, entities, err := dest.GetUpdatesForType(123, 0, true, "client", 100)
+	require.NoError(t, err)
+	require.Len(t, entities, 3)
+	assert.Equal(t, bookmark.Specifics, entities[0].Specifics)
+	assert.Equal(t, "secret name id1", *entities[0].Name)
+	disabled, err := dest.IsSyncChainDisabled("client")
+	require.NoError(t, err)
+	assert.True(t, disabled)
+	has, err := dest.HasItem("client", "Client#tag1")
+	require.NoError(t, err)
+	assert.True(t, has)
+	counts, err = dest.GetClientItemCount("client")
+	require.NoError(t, err)
+	assert.Equal(t, 3, counts.ItemCount)
+}
+
+func TestImportChainReplace(t *testing.T) {
+	ds, err := internal.NewSqliteDatastore(filepath.Join(t.TempDir(), "litesync.sqlite"))
+	require.NoError(t, err)
+	defer ds.Close()
+	insertTestEntities(t, ds, "old", 3)
+
+	chain := internal.ChainExport{
+		ClientID: "client",
+		Entities: []datastore.SyncEntity{{ID: "new", Version: aws.Int64(1), Mtime: aws.Int64(1), DataType: aws.Int(123)}},
+	}
+	assert.ErrorIs(t, ds.ImportChain(chain, false), internal.ErrConflict)
+	has, err := ds.HasItem("client", "old0")
+	require.NoError(t, err)
+	assert.True(t, has, "a refused import leaves the chain alone")
+
+	require.NoError(t, ds.ImportChain(chain, true))
+	exported, err := ds.ExportChain("client")
+	require.NoError(t, err)
+	require.Len(t, exported.Entities, 1)
+	assert.Equal(t, "new", exported.Entities[0].ID)
+	assert.Nil(t, exported.Counts)
+}
+
+func TestReadChainExportRejectsOtherFiles(t *testing.T) {
+	for name, text := range map[string]string{
+		"empty":     "",
+		"no header": `{"kind":"entity","id":"id1"}` + "\n",
+		"version":   `{"kind":"chain","format":"litesync-chain","format_version":2,"client_id":"client"}` + "\n",
+		"not json":  "SQLite format 3\n",
+	} {
+		_, err := internal.ReadChainExport(strings.NewReader(text))
+		assert.Error(t, err, name)
+	}
+}
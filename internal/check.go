@@ -0,0 +1,274 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Problems found by CheckStore.
+const (
+	ProblemIntegrity        = "integrity"
+	ProblemOrphanClientTag  = "orphan client tag"
+	ProblemMissingClientTag = "missing client tag"
+	ProblemOrphanServerTag  = "orphan server tag"
+	ProblemMissingServerTag = "missing server tag"
+	ProblemItemCount        = "item count"
+)
+
+// CheckFinding is a problem found in a database. ID is the row it is about,
+// the client ID for item counts, and Detail tells what is wrong with it.
+type CheckFinding struct {
+	Problem  string
+	ClientID string
+	ID       string
+	Detail   string
+	Repaired bool
+}
+
+// invariant is a rule the rows of a database keep. find returns the
+// client_id, id and detail of every row breaking it, and repair fixes one of
+// them given its client_id and id as ?1 and ?2. The args follow as ?3 and
+// on in repair, and as ?1 and on in find.
+type invariant struct {
+	problem string
+	find    string
+	repair  string
+	args    []any
+}
+
+// A live entity with a client tag keeps its tag item, which InsertSyncEntity
+// adds and UpdateSyncEntity removes with the delete.
+const findOrphanClientTagsQuery = `
+SELECT t.client_id, t.id, 'no live entity has tag ' || substr(t.id, 8)
+FROM sync_entities t
+LEFT JOIN sync_entities e
+    ON e.client_id = t.client_id AND e.client_defined_unique_tag = substr(t.id, 8)
+    AND e.version IS NOT NULL AND NOT COALESCE(e.deleted, 0)
+WHERE t.version IS NULL AND substr(t.id, 1, 7) = 'Client#' AND e.id IS NULL
+`
+
+const findMissingClientTagsQuery = `
+SELECT e.client_id, e.id, 'no tag item for ' || e.client_defined_unique_tag
+FROM sync_entities e
+WHERE e.version IS NOT NULL AND NOT COALESCE(e.deleted, 0) AND e.client_defined_unique_tag IS NOT NULL
+  AND NOT EXISTS (
+      SELECT 1 FROM sync_entities t
+      WHERE t.client_id = e.client_id AND t.id = 'Client#' || e.client_defined_unique_tag
+  )
+`
+
+const insertMissingClientTagQuery = `
+INSERT INTO sync_entities (client_id, id, mtime, ctime)
+SELECT client_id, 'Client#' || client_defined_unique_tag, mtime, ctime
+FROM sync_entities
+WHERE client_id = ?1 AND id = ?2
+ON CONFLICT (client_id, id) DO NOTHING
+`
+
+// Server tag items mark the permanent folders as created, a tag item without
+// its entity keeps them from being created again.
+const findOrphanServerTagsQuery = `
+SELECT t.client_id, t.id, 'no entity has tag ' || substr(t.id, 8)
+FROM sync_entities t
+LEFT JOIN sync_entities e
+    ON e.client_id = t.client_id AND e.server_defined_unique_tag = substr(t.id, 8)
+    AND e.version IS NOT NULL
+WHERE t.version IS NULL AND substr(t.id, 1, 7) = 'Server#' AND e.id IS NULL
+`
+
+const findMissingServerTagsQuery = `
+SELECT e.client_id, e.id, 'no tag item for ' || e.server_defined_unique_tag
+FROM sync_entities e
+WHERE e.version IS NOT NULL AND e.server_defined_unique_tag IS NOT NULL
+  AND NOT EXISTS (
+      SELECT 1 FROM sync_entities t
+      WHERE t.client_id = e.client_id AND t.id = 'Server#' || e.server_defined_unique_tag
+  )
+`
+
+const insertMissingServerTagQuery = `
+INSERT INTO sync_entities (client_id, id, mtime, ctime)
+SELECT client_id, 'Server#' || server_defined_unique_tag, mtime, ctime
+FROM sync_entities
+WHERE client_id = ?1 AND id = ?2
+ON CONFLICT (client_id, id) DO NOTHING
+`
+
+// The item count is checked like countClientItemsQuery counts it. History
+// counts age out by period rather than with their entities, and counts from
+// before clientItemCountsVersion are recounted on read, neither is checked.
+const findItemCountsQuery = `
+SELECT c.client_id, c.client_id, 'stored ' || c.item_count || ', counted ' || COUNT(e.id)
+FROM client_item_counts c
+LEFT JOIN sync_entities e
+    ON e.client_id = c.client_id AND e.version IS NOT NULL AND NOT COALESCE(e.deleted, 0)
+    AND COALESCE(e.data_type, 0) NOT IN (?1, ?2)
+WHERE c.version >= ?3
+GROUP BY c.client_id
+HAVING c.item_count != COUNT(e.id)
+`
+
+const repairItemCountQuery = `
+UPDATE client_item_counts
+SET item_count = (
+    SELECT COUNT(*) FROM sync_entities
+    WHERE client_id = ?1 AND version IS NOT NULL AND NOT COALESCE(deleted, 0)
+      AND COALESCE(data_type, 0) NOT IN (?3, ?4)
+)
+WHERE client_id = ?2 AND version >= ?5
+`
+
+var invariants = []invariant{
+	{
+		problem: ProblemOrphanClientTag,
+		find:    findOrphanClientTagsQuery,
+		repair:  "DELETE FROM sync_entities WHERE client_id = ?1 AND id = ?2",
+	},
+	{
+		problem: ProblemMissingClientTag,
+		find:    findMissingClientTagsQuery,
+		repair:  insertMissingClientTagQuery,
+	},
+	{
+		problem: ProblemOrphanServerTag,
+		find:    findOrphanServerTagsQuery,
+		repair:  "DELETE FROM sync_entities WHERE client_id = ?1 AND id = ?2",
+	},
+	{
+		problem: ProblemMissingServerTag,
+		find:    findMissingServerTagsQuery,
+		repair:  insertMissingServerTagQuery,
+	},
+	{
+		problem: ProblemItemCount,
+		find:    findItemCountsQuery,
+		repair:  repairItemCountQuery,
+		args:    []any{historyTypeID, historyDeleteDirectiveTypeID, clientItemCountsVersion},
+	},
+}
+
+// CheckStore runs integrity_check on the database of cfg, or on every file
+// of a sharded one, and checks the invariants of the litesync tables. With
+// repair, the broken invariants of a database are fixed in one transaction.
+// A database failing integrity_check is not repaired, it is restored from a
+// snapshot instead.
+//
+// The databases are locked for the check, so it fails with ErrDatabaseInUse
+// while a server has them open.
+func CheckStore(cfg StoreConfig, repair bool) ([]CheckFinding, error) {
+	if cfg.Backend != BackendSqlite {
+		return nil, errors.New("checks need the sqlite backend")
+	}
+	if cfg.SqliteShardDir == "" {
+		return checkDatabase(cfg.SqlitePath, "", repair)
+	}
+
+	sharded, err := NewShardedSqliteDatastore(cfg.SqliteShardDir, cfg.Sqlite, cfg.MaxOpenShards)
+	if err != nil {
+		return nil, err
+	}
+	defer sharded.Close()
+	clientIDs, err := sharded.ClientIDs()
+	if err != nil {
+		return nil, err
+	}
+	var findings []CheckFinding
+	for _, clientID := range clientIDs {
+		path, err := sharded.ShardPath(clientID)
+		if err != nil {
+			return findings, err
+		}
+		shardFindings, err := checkDatabase(path, clientID, repair)
+		findings = append(findings, shardFindings...)
+		if err != nil {
+			return findings, fmt.Errorf("%s: %w", clientID, err)
+		}
+	}
+	return findings, nil
+}
+
+// checkDatabase checks the database at path, clientID is the chain of a
+// shard and names the integrity findings.
+func checkDatabase(path, clientID string, repair bool) ([]CheckFinding, error) {
+	// Opening creates a missing database, there is nothing to check then.
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	lock, err := lockDatabaseFile(path, true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	ctx := context.Background()
+	db, conn, err := openDatabase(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	defer conn.Close()
+
+	problems, err := integrityProblems(conn, "integrity_check")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if len(problems) > 0 {
+		findings := make([]CheckFinding, len(problems))
+		for i, problem := range problems {
+			findings[i] = CheckFinding{Problem: ProblemIntegrity, ClientID: clientID, Detail: problem}
+		}
+		return findings, nil
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var findings []CheckFinding
+	for _, inv := range invariants {
+		found, err := findBrokenInvariant(tx, inv)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", inv.problem, err)
+		}
+		if repair {
+			for i := range found {
+				args := append([]any{found[i].ClientID, found[i].ID}, inv.args...)
+				if _, err = tx.Exec(inv.repair, args...); err != nil {
+					return nil, fmt.Errorf("%s: %w", inv.problem, err)
+				}
+				found[i].Repaired = true
+			}
+		}
+		findings = append(findings, found...)
+	}
+
+	if !repair {
+		return findings, nil
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return findings, nil
+}
+
+func findBrokenInvariant(tx *sql.Tx, inv invariant) ([]CheckFinding, error) {
+	rows, err := tx.Query(inv.find, inv.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var findings []CheckFinding
+	for rows.Next() {
+		finding := CheckFinding{Problem: inv.problem}
+		if err = rows.Scan(&finding.ClientID, &finding.ID, &finding.Detail); err != nil {
+			return nil, err
+		}
+		findings = append(findings, finding)
+	}
+	return findings, rows.Err()
+}
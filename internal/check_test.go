@@ -0,0 +1,88 @@
+package internal_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckStore(t *testing.T) {
+	cfg := internal.StoreConfig{
+		Backend:    internal.BackendSqlite,
+		SqlitePath: filepath.Join(t.TempDir(), "litesync.sqlite"),
+		Sqlite:     internal.DefaultSqliteOptions(),
+	}
+	ds, err := internal.NewSqliteDatastore(cfg.SqlitePath)
+	require.NoError(t, err)
+
+	_, err = ds.InsertSyncEntity(&datastore.SyncEntity{
+		ClientID: "client1", ID: "id1", Version: aws.Int64(1), Mtime: aws.Int64(1000), Ctime: aws.Int64(1000),
+		DataType: aws.Int(123), ClientDefinedUniqueTag: aws.String("tag1"),
+	})
+	require.NoError(t, err)
+	err = ds.InsertSyncEntitiesWithServerTags([]*datastore.SyncEntity{{
+		ClientID: "client1", ID: "id2", Version: aws.Int64(1), Mtime: aws.Int64(1000), Ctime: aws.Int64(1000),
+		DataType: aws.Int(32904), ServerDefinedUniqueTag: aws.String("bookmark_bar"),
+	}})
+	require.NoError(t, err)
+	counts, err := ds.GetClientItemCount("client1")
+	require.NoError(t, err)
+	require.NoError(t, ds.UpdateClientItemCount(counts, 2, 0))
+
+	findings, err := internal.CheckStore(cfg, false)
+	require.Error(t, err, "the database is in use")
+	assert.ErrorIs(t, err, internal.ErrDatabaseInUse)
+	assert.Empty(t, findings)
+
+	for _, query := range []string{
+		"DELETE FROM sync_entities WHERE id IN ('Client#tag1', 'Server#bookmark_bar')",
+		"INSERT INTO sync_entities (client_id, id) VALUES ('client1', 'Client#gone'), ('client1', 'Server#gone')",
+		"UPDATE client_item_counts SET item_count = 5",
+	} {
+		_, err = ds.Db.Exec(query)
+		require.NoError(t, err)
+	}
+	require.NoError(t, ds.Close())
+
+	expected := []internal.CheckFinding{
+		{Problem: internal.ProblemOrphanClientTag, ClientID: "client1", ID: "Client#gone", Detail: "no live entity has tag gone"},
+		{Problem: internal.ProblemMissingClientTag, ClientID: "client1", ID: "id1", Detail: "no tag item for tag1"},
+		{Problem: internal.ProblemOrphanServerTag, ClientID: "client1", ID: "Server#gone", Detail: "no entity has tag gone"},
+		{Problem: internal.ProblemMissingServerTag, ClientID: "client1", ID: "id2", Detail: "no tag item for bookmark_bar"},
+		{Problem: internal.ProblemItemCount, ClientID: "client1", ID: "client1", Detail: "stored 5, counted 2"},
+	}
+	findings, err = internal.CheckStore(cfg, false)
+	require.NoError(t, err)
+	assert.Equal(t, expected, findings)
+	findings, err = internal.CheckStore(cfg, false)
+	require.NoError(t, err)
+	assert.Equal(t, expected, findings, "a check without repair changes nothing")
+
+	findings, err = internal.CheckStore(cfg, true)
+	require.NoError(t, err)
+	for i := range expected {
+		expected[i].Repaired = true
+	}
+	assert.Equal(t, expected, findings)
+	findings, err = internal.CheckStore(cfg, false)
+	require.NoError(t, err)
+	assert.Empty(t, findings)
+
+	ds, err = internal.NewSqliteDatastore(cfg.SqlitePath)
+	require.NoError(t, err)
+	defer ds.Close()
+	has, err := ds.HasItem("client1", "Client#tag1")
+	require.NoError(t, err)
+	assert.True(t, has)
+	has, err = ds.HasServerDefinedUniqueTag("client1", "bookmark_bar")
+	require.NoError(t, err)
+	assert.True(t, has)
+	counts, err = ds.GetClientItemCount("client1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, counts.ItemCount)
+}
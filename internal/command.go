@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/brave/go-sync/cache"
+	"github.com/brave/go-sync/command"
+	syncContext "github.com/brave/go-sync/context"
+	braveds "github.com/brave/go-sync/datastore"
+	"github.com/brave/go-sync/schema/protobuf/sync_pb"
+	"github.com/rs/zerolog/hlog"
+	"google.golang.org/protobuf/proto"
+)
+
+// commandPayloadLimit is go-sync's limit on the size of a command.
+const commandPayloadLimit = 1024 * 1024 * 10
+
+// commandHandler serves sync commands like go-sync's controller.Command,
+// except that commits which failed with ErrOverQuota are reported as
+// OVER_QUOTA. The go-sync commit handler only knows its own item count
+// quota, and reports any other failed write as a TRANSIENT_ERROR, which the
+// browser keeps retrying. Over its quota, it stops committing the type.
+func commandHandler(c cache.Cache, store braveds.Datastore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := hlog.FromRequest(r)
+		clientID, ok := r.Context().Value(syncContext.ContextKeyClientID).(string)
+		if !ok {
+			http.Error(w, "missing client ID", http.StatusUnauthorized)
+			return
+		}
+
+		// The limit holds for the inflated command, a small gzip body can
+		// inflate to any size.
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gr, err := gzip.NewReader(body)
+			if err != nil {
+				http.Error(w, "invalid gzip body", http.StatusBadRequest)
+				return
+			}
+			defer gr.Close()
+			body = gr
+		}
+		msg, err := io.ReadAll(io.LimitReader(body, commandPayloadLimit+1))
+		if err != nil {
+			http.Error(w, "reading the command failed", http.StatusBadRequest)
+			return
+		}
+		if len(msg) > commandPayloadLimit {
+			http.Error(w, "command too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		pb := &sync_pb.ClientToServerMessage{}
+		if err := proto.Unmarshal(msg, pb); err != nil {
+			http.Error(w, "unmarshal error", http.StatusBadRequest)
+			return
+		}
+
+		pbRsp := &sync_pb.ClientToServerResponse{}
+		tracker := newOverQuotaTracker(store)
+		if err := command.HandleClientToServerMessage(&c, pb, pbRsp, tracker, clientID); err != nil {
+			logger.Error().Err(err).Str("client_id", clientID).Msg("handling the command failed")
+			http.Error(w, "handling the command failed", http.StatusInternalServerError)
+			return
+		}
+		tracker.markOverQuota(pb.GetCommit(), pbRsp.GetCommit())
+
+		out, err := proto.Marshal(pbRsp)
+		if err != nil {
+			logger.Error().Err(err).Msg("marshalling the response failed")
+			http.Error(w, "marshal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(out)
+	}
+}
+
+// overQuotaTracker is the datastore of one command. It remembers the
+// entities whose writes failed with ErrOverQuota, by their server ID and by
+// the ID the client gave a new entity, which is what a commit entry carries.
+type overQuotaTracker struct {
+	braveds.Datastore
+	ids map[string]bool
+}
+
+func newOverQuotaTracker(store braveds.Datastore) *overQuotaTracker {
+	return &overQuotaTracker{Datastore: store, ids: map[string]bool{}}
+}
+
+func (t *overQuotaTracker) InsertSyncEntity(entity *braveds.SyncEntity) (bool, error) {
+	conflict, err := t.Datastore.InsertSyncEntity(entity)
+	t.track(entity, err)
+	return conflict, err
+}
+
+func (t *overQuotaTracker) UpdateSyncEntity(entity *braveds.SyncEntity, oldVersion int64) (bool, bool, error) {
+	conflict, deleted, err := t.Datastore.UpdateSyncEntity(entity, oldVersion)
+	t.track(entity, err)
+	return conflict, deleted, err
+}
+
+func (t *overQuotaTracker) track(entity *braveds.SyncEntity, err error) {
+	if !errors.Is(err, ErrOverQuota) {
+		return
+	}
+	t.ids[entity.ID] = true
+	if entity.OriginatorClientItemID != nil {
+		t.ids[*entity.OriginatorClientItemID] = true
+	}
+}
+
+// markOverQuota turns the TRANSIENT_ERROR responses to the entries which
+// went over quota into OVER_QUOTA. The responses are in the order of the
+// entries.
+func (t *overQuotaTracker) markOverQuota(commit *sync_pb.CommitMessage, rsp *sync_pb.CommitResponse) {
+	if len(t.ids) == 0 {
+		return
+	}
+	entries := commit.GetEntries()
+	for i, entry := range rsp.GetEntryresponse() {
+		if i < len(entries) && entry.GetResponseType() == sync_pb.CommitResponse_TRANSIENT_ERROR &&
+			t.ids[entries[i].GetIdString()] {
+			entry.ResponseType = sync_pb.CommitResponse_OVER_QUOTA.Enum()
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package internal_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	syncContext "github.com/brave/go-sync/context"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandHandlerLimitsInflatedCommands(t *testing.T) {
+	ds, err := internal.NewMemoryDatastore("")
+	require.NoError(t, err)
+	handler := internal.CommandHandler(ds)
+
+	// 11MB of zeros compress to a few kilobytes.
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	_, err = zw.Write(make([]byte, 11*1024*1024))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.Less(t, body.Len(), 100*1024)
+
+	req := httptest.NewRequest(http.MethodPost, "/command/", &body)
+	req.Header.Set("Content-Encoding", "gzip")
+	req = req.WithContext(context.WithValue(req.Context(), syncContext.ContextKeyClientID, "client"))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/command/", bytes.NewReader(nil)))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "no client ID")
+}
@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	braveds "github.com/brave/go-sync/datastore"
+	"github.com/klauspost/compress/zstd"
+)
+
+// specificsZstdHeader marks specifics which are stored zstd compressed. A
+// serialized EntitySpecifics never starts with it, as a tag byte it would be
+// field 0 with wire type 7, both of which are invalid.
+const specificsZstdHeader byte = 0x07
+
+// Smaller specifics are stored as they are, the zstd frame would eat most of
+// what compressing them saves.
+const minCompressedSpecificsSize = 128
+
+// Bounds the memory a damaged or hostile row can make the decoder allocate.
+const maxDecompressedSpecificsSize = 64 << 20
+
+var (
+	specificsEncoder *zstd.Encoder
+	specificsDecoder *zstd.Decoder
+)
+
+func init() {
+	var err error
+	specificsEncoder, err = zstd.NewWriter(nil)
+	if err != nil {
+		panic(err)
+	}
+	specificsDecoder, err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSpecificsSize))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// compressSpecifics returns specifics zstd compressed behind the header byte,
+// or as they are when they are small or compressing does not shrink them.
+func compressSpecifics(specifics []byte) []byte {
+	if len(specifics) < minCompressedSpecificsSize || isCompressedSpecifics(specifics) {
+		return specifics
+	}
+	compressed := specificsEncoder.EncodeAll(specifics, []byte{specificsZstdHeader})
+	if len(compressed) >= len(specifics) {
+		return specifics
+	}
+	return compressed
+}
+
+// decompressSpecifics undoes compressSpecifics. Specifics without the header
+// are returned as they are, whether or not compression is turned on.
+func decompressSpecifics(stored []byte) ([]byte, error) {
+	if !isCompressedSpecifics(stored) {
+		return stored, nil
+	}
+	specifics, err := specificsDecoder.DecodeAll(stored[1:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing specifics: %w", err)
+	}
+	return specifics, nil
+}
+
+func isCompressedSpecifics(specifics []byte) bool {
+	return len(specifics) > 0 && specifics[0] == specificsZstdHeader
+}
+
+// compressEntity returns entity with its specifics compressed when d has
+// compression turned on.
+func (d *SqliteDatastore) compressEntity(entity *braveds.SyncEntity) *braveds.SyncEntity {
+	if !d.compress {
+		return entity
+	}
+	compressed := *entity
+	compressed.Specifics = compressSpecifics(entity.Specifics)
+	return &compressed
+}
+
+// CompressionStats reports what CompressSpecifics did.
+type CompressionStats struct {
+	// Rows is the number of rows large enough to be looked at, Compressed
+	// the number of them which were rewritten.
+	Rows       int
+	Compressed int
+
+	// The stored size of the rewritten specifics, before and after.
+	BytesBefore int64
+	BytesAfter  int64
+}
+
+// Saved returns the number of bytes compression saved.
+func (s CompressionStats) Saved() int64 {
+	return s.BytesBefore - s.BytesAfter
+}
+
+func (s *CompressionStats) add(other CompressionStats) {
+	s.Rows += other.Rows
+	s.Compressed += other.Compressed
+	s.BytesBefore += other.BytesBefore
+	s.BytesAfter += other.BytesAfter
+}
+
+// Rows are walked in rowid order, the last rowid of a batch starts the next.
+const selectSpecificsBatchQuery = `
+SELECT rowid, client_id, id, key_id, specifics
+FROM sync_entities
+WHERE rowid > ? AND version IS NOT NULL AND length(specifics) >= ?
+ORDER BY rowid
+LIMIT ?
+`
+
+// CompressSpecifics compresses the specifics of the rows written before
+// compression was turned on, batchSize rows per transaction so that the
+// server can keep writing in between. Rows stay sealed by their own key.
+//
+// SQLite keeps the freed pages for reuse, the file only shrinks once it is
+// vacuumed.
+func (d *SqliteDatastore) CompressSpecifics(batchSize int) (CompressionStats, error) {
+	if batchSize <= 0 {
+		return CompressionStats{}, errors.New("CompressSpecifics: batch size must be positive")
+	}
+	var stats CompressionStats
+	var lastRowID int64
+	for {
+		batch, last, err := d.compressSpecificsBatch(lastRowID, batchSize)
+		stats.add(batch)
+		if err != nil {
+			return stats, fmt.Errorf("CompressSpecifics: %w", classifySqliteError(err))
+		}
+		if batch.Rows < batchSize {
+			return stats, nil
+		}
+		lastRowID = last
+	}
+}
+
+func (d *SqliteDatastore) compressSpecificsBatch(afterRowID int64, batchSize int) (CompressionStats, int64, error) {
+	var stats CompressionStats
+	fail := func(err error) (CompressionStats, int64, error) {
+		return CompressionStats{}, 0, err
+	}
+
+	tx, err := d.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+
+	type storedSpecifics struct {
+		rowID     int64
+		clientID  string
+		id        string
+		keyID     *string
+		specifics []byte
+	}
+	// The size filter is only a first cut, sealing adds a few bytes.
+	rows, err := tx.Query(selectSpecificsBatchQuery, afterRowID, minCompressedSpecificsSize, batchSize)
+	if err != nil {
+		return fail(err)
+	}
+	defer rows.Close()
+	var batch []storedSpecifics
+	for rows.Next() {
+		var s storedSpecifics
+		if err = rows.Scan(&s.rowID, &s.clientID, &s.id, &s.keyID, &s.specifics); err != nil {
+			return fail(err)
+		}
+		batch = append(batch, s)
+	}
+	if err = rows.Err(); err != nil {
+		return fail(err)
+	}
+	rows.Close()
+
+	var lastRowID int64
+	for _, s := range batch {
+		lastRowID = s.rowID
+		specifics, err := d.keys.openSpecifics(s.keyID, s.clientID, s.id, s.specifics)
+		if err != nil {
+			return fail(fmt.Errorf("entity %s: %w", s.id, err))
+		}
+		smaller := compressSpecifics(specifics)
+		if len(smaller) == len(specifics) {
+			continue
+		}
+		stored, err := d.keys.sealSpecifics(s.keyID, s.clientID, s.id, smaller)
+		if err != nil {
+			return fail(fmt.Errorf("entity %s: %w", s.id, err))
+		}
+		if _, err = tx.Exec("UPDATE sync_entities SET specifics = ? WHERE rowid = ?", stored, s.rowID); err != nil {
+			return fail(err)
+		}
+		stats.Compressed++
+		stats.BytesBefore += int64(len(s.specifics))
+		stats.BytesAfter += int64(len(stored))
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+	stats.Rows = len(batch)
+	return stats, lastRowID, nil
+}
+
+// specificsCompressor is a store which can compress the rows it already has.
+type specificsCompressor interface {
+	CompressSpecifics(batchSize int) (CompressionStats, error)
+}
+
+// CompressStore compresses the existing rows of the store of cfg.
+func CompressStore(cfg StoreConfig, batchSize int) (CompressionStats, error) {
+	store, err := openStore(cfg)
+	if err != nil {
+		return CompressionStats{}, err
+	}
+	defer store.Close()
+
+	compressor, ok := store.(specificsCompressor)
+	if !ok {
+		return CompressionStats{}, fmt.Errorf("the %s backend does not compress specifics", cfg.Backend)
+	}
+	return compressor.CompressSpecifics(batchSize)
+}
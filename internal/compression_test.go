@@ -0,0 +1,109 @@
+package internal_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openCompressingDatastore(t *testing.T, path string, compress bool, keyText string) *internal.SqliteDatastore {
+	opts := internal.DefaultSqliteOptions()
+	opts.CompressSpecifics = compress
+	if keyText != "" {
+		keys, err := internal.ParseEncryptionKeys(keyText)
+		require.NoError(t, err)
+		opts.EncryptionKeys = keys
+	}
+	ds, err := internal.NewSqliteDatastoreWithOptions(path, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { ds.Close() })
+	return ds
+}
+
+func TestCompressedSpecificsRoundTrip(t *testing.T) {
+	ds := openCompressingDatastore(t, filepath.Join(t.TempDir(), "litesync.sqlite"), true, "")
+	large := bytes.Repeat([]byte("favicon "), 100)
+
+	small := encryptedTestEntity("small")
+	_, err := ds.InsertSyncEntity(small)
+	require.NoError(t, err)
+	big := encryptedTestEntity("big")
+	big.Specifics = large
+	_, err = ds.InsertSyncEntity(big)
+	require.NoError(t, err)
+
+	var stored []byte
+	require.NoError(t, ds.Db.QueryRow("SELECT specifics FROM sync_entities WHERE id = 'big'").Scan(&stored))
+	assert.Less(t, len(stored), len(large))
+	require.NoError(t, ds.Db.QueryRow("SELECT specifics FROM sync_entities WHERE id = 'small'").Scan(&stored))
+	assert.Equal(t, small.Specifics, stored, "small specifics are stored as they are")
+
+	update := encryptedTestEntity("small")
+	update.Version = aws.Int64(2)
+	update.Specifics = large
+	_, _, err = ds.UpdateSyncEntity(update, 1)
+	require.NoError(t, err)
+
+	_, entities, err := ds.GetUpdatesForType(123, 0, true, "client", 10)
+	require.NoError(t, err)
+	require.Len(t, entities, 2)
+	for _, entity := range entities {
+		assert.Equal(t, large, entity.Specifics, entity.ID)
+	}
+}
+
+func TestCompressSpecificsOfExistingRows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "litesync.sqlite")
+	keyText := encryptionKeyLine(t, "k1")
+	large := bytes.Repeat([]byte("session tab "), 100)
+
+	// Rows written before compression was turned on, in the clear and
+	// encrypted.
+	ds := openCompressingDatastore(t, path, false, "")
+	for _, id := range []string{"a", "b", "c"} {
+		entity := encryptedTestEntity(id)
+		entity.Specifics = large
+		_, err := ds.InsertSyncEntity(entity)
+		require.NoError(t, err)
+	}
+	_, err := ds.InsertSyncEntity(encryptedTestEntity("small"))
+	require.NoError(t, err)
+	require.NoError(t, ds.Close())
+	ds = openCompressingDatastore(t, path, false, keyText)
+	entity := encryptedTestEntity("sealed")
+	entity.Specifics = large
+	_, err = ds.InsertSyncEntity(entity)
+	require.NoError(t, err)
+
+	stats, err := ds.CompressSpecifics(2)
+	require.NoError(t, err)
+	assert.Equal(t, 4, stats.Rows)
+	assert.Equal(t, 4, stats.Compressed)
+	assert.Greater(t, stats.Saved(), int64(0))
+	assert.Equal(t, stats.BytesBefore-stats.BytesAfter, stats.Saved())
+
+	// Running it again finds nothing left to do.
+	stats, err = ds.CompressSpecifics(2)
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.Compressed)
+
+	// An empty batch would never end the walk.
+	for _, batchSize := range []int{0, -1} {
+		_, err = ds.CompressSpecifics(batchSize)
+		assert.Error(t, err, batchSize)
+	}
+
+	_, entities, err := ds.GetUpdatesForType(123, 0, true, "client", 10)
+	require.NoError(t, err)
+	require.Len(t, entities, 5)
+	for _, entity := range entities {
+		if entity.ID != "small" {
+			assert.Equal(t, large, entity.Specifics, entity.ID)
+		}
+	}
+}
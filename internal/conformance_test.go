@@ -0,0 +1,68 @@
+package internal_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/mikaelhg/litesync/internal/datastoretest"
+	"github.com/stretchr/testify/require"
+)
+
+// The backends under test, each a fresh store per call, shared by the
+// conformance and model tests.
+
+func newTestSqlite(opts internal.SqliteOptions) datastoretest.Factory {
+	return func(t *testing.T) datastore.Datastore {
+		ds, err := internal.NewSqliteDatastoreWithOptions(filepath.Join(t.TempDir(), "litesync.sqlite"), opts)
+		require.NoError(t, err)
+		t.Cleanup(func() { ds.Close() })
+		return ds
+	}
+}
+
+func newTestShardedSqlite(t *testing.T) datastore.Datastore {
+	ds, err := internal.NewShardedSqliteDatastore(t.TempDir(), internal.DefaultSqliteOptions(), 2)
+	require.NoError(t, err)
+	t.Cleanup(func() { ds.Close() })
+	return ds
+}
+
+func newTestMemory(t *testing.T) datastore.Datastore {
+	ds, err := internal.NewMemoryDatastore("")
+	require.NoError(t, err)
+	return ds
+}
+
+func newTestBolt(t *testing.T) datastore.Datastore {
+	ds, err := internal.NewBoltDatastore(filepath.Join(t.TempDir(), "litesync.bolt"))
+	require.NoError(t, err)
+	t.Cleanup(func() { ds.Close() })
+	return ds
+}
+
+func TestSqliteConformance(t *testing.T) {
+	datastoretest.RunConformance(t, newTestSqlite(internal.DefaultSqliteOptions()))
+}
+
+func TestShardedSqliteConformance(t *testing.T) {
+	datastoretest.RunConformance(t, newTestShardedSqlite)
+}
+
+func TestEncryptedSqliteConformance(t *testing.T) {
+	keys, err := internal.ParseEncryptionKeys(encryptionKeyLine(t, "key1"))
+	require.NoError(t, err)
+	opts := internal.DefaultSqliteOptions()
+	opts.EncryptionKeys = keys
+	opts.CompressSpecifics = true
+	datastoretest.RunConformance(t, newTestSqlite(opts))
+}
+
+func TestMemoryConformance(t *testing.T) {
+	datastoretest.RunConformance(t, newTestMemory)
+}
+
+func TestBoltConformance(t *testing.T) {
+	datastoretest.RunConformance(t, newTestBolt)
+}
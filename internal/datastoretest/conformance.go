@@ -0,0 +1,367 @@
+package datastoretest
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns an empty datastore for one test, and closes it in a
+// t.Cleanup when it needs closing.
+type Factory func(t *testing.T) datastore.Datastore
+
+const (
+	bookmarksType = 32904
+	historyType   = 963985
+)
+
+// RunConformance checks that a datastore behaves like SqliteDatastore, which
+// follows the upstream DynamoDB datastore, in every method of the
+// datastore.Datastore interface. Each subtest gets a fresh datastore.
+func RunConformance(t *testing.T, factory Factory) {
+	for _, test := range []struct {
+		name string
+		run  func(t *testing.T, ds datastore.Datastore)
+	}{
+		{"InsertSyncEntity", testInsertSyncEntity},
+		{"InsertSyncEntitiesWithServerTags", testInsertSyncEntitiesWithServerTags},
+		{"UpdateSyncEntity", testUpdateSyncEntity},
+		{"DeleteSyncEntity", testDeleteSyncEntity},
+		{"HistoryIgnoresVersion", testHistoryIgnoresVersion},
+		{"GetUpdatesForType", testGetUpdatesForType},
+		{"Expiration", testExpiration},
+		{"ClientItemCount", testClientItemCount},
+		{"ClearServerData", testClearServerData},
+		{"DisableSyncChain", testDisableSyncChain},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, factory(t))
+		})
+	}
+}
+
+// newEntity returns a live entity at version 1 with every field the tests
+// compare set.
+func newEntity(clientID, id string, dataType int, mtime int64) *datastore.SyncEntity {
+	return &datastore.SyncEntity{
+		ClientID:      clientID,
+		ID:            id,
+		ParentID:      aws.String("root"),
+		Version:       aws.Int64(1),
+		Mtime:         aws.Int64(mtime),
+		Ctime:         aws.Int64(mtime),
+		Name:          aws.String("name of " + id),
+		Deleted:       aws.Bool(false),
+		Specifics:     []byte("specifics of " + id),
+		DataType:      aws.Int(dataType),
+		Folder:        aws.Bool(false),
+		DataTypeMtime: aws.String(fmt.Sprintf("%d#%d", dataType, mtime)),
+	}
+}
+
+func ids(entities []datastore.SyncEntity) []string {
+	ids := make([]string, 0, len(entities))
+	for _, entity := range entities {
+		ids = append(ids, entity.ID)
+	}
+	return ids
+}
+
+func hasItem(t *testing.T, ds datastore.Datastore, clientID, id string) bool {
+	has, err := ds.HasItem(clientID, id)
+	require.NoError(t, err)
+	return has
+}
+
+func testInsertSyncEntity(t *testing.T, ds datastore.Datastore) {
+	entity := newEntity("client1", "id1", bookmarksType, 1000)
+	entity.ClientDefinedUniqueTag = aws.String("tag1")
+	conflict, err := ds.InsertSyncEntity(entity)
+	require.NoError(t, err)
+	assert.False(t, conflict)
+	assert.True(t, hasItem(t, ds, "client1", "id1"))
+	assert.True(t, hasItem(t, ds, "client1", "Client#tag1"), "the client tag gets its tag item")
+
+	conflict, err = ds.InsertSyncEntity(entity)
+	assert.ErrorIs(t, err, internal.ErrConflict, "same ID")
+	assert.True(t, conflict)
+
+	sameTag := newEntity("client1", "id2", bookmarksType, 1000)
+	sameTag.ClientDefinedUniqueTag = aws.String("tag1")
+	conflict, err = ds.InsertSyncEntity(sameTag)
+	assert.ErrorIs(t, err, internal.ErrConflict, "same client tag")
+	assert.True(t, conflict)
+	assert.False(t, hasItem(t, ds, "client1", "id2"), "the failed insert leaves nothing behind")
+
+	otherChain := *entity
+	otherChain.ClientID = "client2"
+	conflict, err = ds.InsertSyncEntity(&otherChain)
+	require.NoError(t, err, "chains do not share IDs or tags")
+	assert.False(t, conflict)
+}
+
+func testInsertSyncEntitiesWithServerTags(t *testing.T, ds datastore.Datastore) {
+	folder := newEntity("client1", "id1", bookmarksType, 1000)
+	folder.Folder = aws.Bool(true)
+	folder.ServerDefinedUniqueTag = aws.String("bookmark_bar")
+	child := newEntity("client1", "id2", bookmarksType, 1000)
+	require.NoError(t, ds.InsertSyncEntitiesWithServerTags([]*datastore.SyncEntity{folder, child}))
+
+	has, err := ds.HasServerDefinedUniqueTag("client1", "bookmark_bar")
+	require.NoError(t, err)
+	assert.True(t, has)
+	assert.True(t, hasItem(t, ds, "client1", "id1"))
+	assert.True(t, hasItem(t, ds, "client1", "id2"))
+	has, err = ds.HasServerDefinedUniqueTag("client2", "bookmark_bar")
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	again := newEntity("client1", "id3", bookmarksType, 1000)
+	again.ServerDefinedUniqueTag = aws.String("bookmark_bar")
+	err = ds.InsertSyncEntitiesWithServerTags([]*datastore.SyncEntity{newEntity("client1", "id4", bookmarksType, 1000), again})
+	assert.ErrorIs(t, err, internal.ErrConflict)
+	assert.False(t, hasItem(t, ds, "client1", "id3"))
+	assert.False(t, hasItem(t, ds, "client1", "id4"), "the batch is inserted all or nothing")
+}
+
+func testUpdateSyncEntity(t *testing.T, ds datastore.Datastore) {
+	entity := newEntity("client1", "id1", bookmarksType, 1000)
+	_, err := ds.InsertSyncEntity(entity)
+	require.NoError(t, err)
+
+	update := *entity
+	update.Version = aws.Int64(2)
+	update.Mtime = aws.Int64(2000)
+	update.Name = nil
+	update.Specifics = []byte("new specifics")
+	conflict, deleted, err := ds.UpdateSyncEntity(&update, 5)
+	require.NoError(t, err)
+	assert.True(t, conflict, "a stale version conflicts")
+	assert.False(t, deleted)
+
+	conflict, deleted, err = ds.UpdateSyncEntity(&update, 1)
+	require.NoError(t, err)
+	assert.False(t, conflict)
+	assert.False(t, deleted)
+
+	_, entities, err := ds.GetUpdatesForType(bookmarksType, 0, true, "client1", 10)
+	require.NoError(t, err)
+	require.Len(t, entities, 1)
+	assert.Equal(t, int64(2), *entities[0].Version)
+	assert.Equal(t, int64(2000), *entities[0].Mtime)
+	assert.Equal(t, "name of id1", *entities[0].Name, "a nil field keeps its stored value")
+	assert.Equal(t, []byte("new specifics"), entities[0].Specifics)
+
+	missing := newEntity("client1", "missing", bookmarksType, 1000)
+	conflict, _, err = ds.UpdateSyncEntity(missing, 1)
+	require.NoError(t, err)
+	assert.True(t, conflict, "a missing entity conflicts")
+}
+
+func testDeleteSyncEntity(t *testing.T, ds datastore.Datastore) {
+	entity := newEntity("client1", "id1", bookmarksType, 1000)
+	entity.ClientDefinedUniqueTag = aws.String("tag1")
+	_, err := ds.InsertSyncEntity(entity)
+	require.NoError(t, err)
+
+	update := *entity
+	update.Version = aws.Int64(2)
+	update.Mtime = aws.Int64(2000)
+	update.Deleted = aws.Bool(true)
+	conflict, deleted, err := ds.UpdateSyncEntity(&update, 1)
+	require.NoError(t, err)
+	assert.False(t, conflict)
+	assert.True(t, deleted)
+	assert.False(t, hasItem(t, ds, "client1", "Client#tag1"), "the tag item goes with the entity")
+
+	update.Version = aws.Int64(3)
+	conflict, deleted, err = ds.UpdateSyncEntity(&update, 2)
+	require.NoError(t, err)
+	assert.False(t, conflict)
+	assert.False(t, deleted, "only the first delete is reported")
+
+	_, entities, err := ds.GetUpdatesForType(bookmarksType, 0, true, "client1", 10)
+	require.NoError(t, err)
+	require.Len(t, entities, 1, "the tombstone is fetched")
+	assert.True(t, *entities[0].Deleted)
+
+	reuse := newEntity("client1", "id2", bookmarksType, 3000)
+	reuse.ClientDefinedUniqueTag = aws.String("tag1")
+	conflict, err = ds.InsertSyncEntity(reuse)
+	require.NoError(t, err, "the tag is free again")
+	assert.False(t, conflict)
+}
+
+func testHistoryIgnoresVersion(t *testing.T, ds datastore.Datastore) {
+	entity := newEntity("client1", "id1", historyType, 1000)
+	_, err := ds.InsertSyncEntity(entity)
+	require.NoError(t, err)
+
+	update := *entity
+	update.Version = aws.Int64(7)
+	update.Specifics = []byte("visited again")
+	conflict, _, err := ds.UpdateSyncEntity(&update, 5)
+	require.NoError(t, err)
+	assert.False(t, conflict, "every device overwrites history")
+
+	_, entities, err := ds.GetUpdatesForType(historyType, 0, true, "client1", 10)
+	require.NoError(t, err)
+	require.Len(t, entities, 1)
+	assert.Equal(t, []byte("visited again"), entities[0].Specifics)
+}
+
+func testGetUpdatesForType(t *testing.T, ds datastore.Datastore) {
+	first := newEntity("client1", "id1", bookmarksType, 1000)
+	first.UniquePosition = []byte{1, 2}
+	first.OriginatorCacheGUID = aws.String("cache guid")
+	first.OriginatorClientItemID = aws.String("client item")
+	first.NonUniqueName = aws.String("non unique")
+	folder := newEntity("client1", "id2", bookmarksType, 2000)
+	folder.Folder = aws.Bool(true)
+	for _, entity := range []*datastore.SyncEntity{
+		newEntity("client1", "id3", bookmarksType, 3000),
+		folder,
+		first,
+		newEntity("client1", "id4", historyType, 1500),
+		newEntity("client2", "id5", bookmarksType, 1000),
+	} {
+		_, err := ds.InsertSyncEntity(entity)
+		require.NoError(t, err)
+	}
+
+	hasMore, entities, err := ds.GetUpdatesForType(bookmarksType, 0, true, "client1", 10)
+	require.NoError(t, err)
+	assert.False(t, hasMore)
+	assert.Equal(t, []string{"id1", "id2", "id3"}, ids(entities), "in mtime order")
+	require.NotEmpty(t, entities)
+	assert.Equal(t, *first, entities[0], "every field is kept")
+
+	_, entities, err = ds.GetUpdatesForType(bookmarksType, 1000, true, "client1", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"id2", "id3"}, ids(entities), "only changes after the token")
+
+	_, entities, err = ds.GetUpdatesForType(bookmarksType, 0, false, "client1", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"id1", "id3"}, ids(entities), "without folders")
+
+	hasMore, entities, err = ds.GetUpdatesForType(bookmarksType, 0, true, "client1", 2)
+	require.NoError(t, err)
+	assert.True(t, hasMore, "a full page has more")
+	assert.Equal(t, []string{"id1", "id2"}, ids(entities))
+	hasMore, entities, err = ds.GetUpdatesForType(bookmarksType, *entities[1].Mtime, true, "client1", 2)
+	require.NoError(t, err)
+	assert.False(t, hasMore)
+	assert.Equal(t, []string{"id3"}, ids(entities))
+
+	_, entities, err = ds.GetUpdatesForType(bookmarksType, 0, true, "client3", 10)
+	require.NoError(t, err)
+	assert.Empty(t, entities)
+}
+
+func testExpiration(t *testing.T, ds datastore.Datastore) {
+	now := time.Now().Unix()
+	expired := newEntity("client1", "id1", historyType, 1000)
+	expired.ExpirationTime = aws.Int64(now - 60)
+	expiring := newEntity("client1", "id2", historyType, 2000)
+	expiring.ExpirationTime = aws.Int64(now + 3600)
+	for _, entity := range []*datastore.SyncEntity{expired, expiring, newEntity("client1", "id3", historyType, 3000)} {
+		_, err := ds.InsertSyncEntity(entity)
+		require.NoError(t, err)
+	}
+
+	_, entities, err := ds.GetUpdatesForType(historyType, 0, true, "client1", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"id2", "id3"}, ids(entities), "expired entities are not fetched")
+}
+
+func testClientItemCount(t *testing.T, ds datastore.Datastore) {
+	counts, err := ds.GetClientItemCount("client1")
+	require.NoError(t, err)
+	assert.Equal(t, "client1", counts.ClientID)
+	assert.Equal(t, "client1", counts.ID)
+	assert.Equal(t, 0, counts.ItemCount)
+	assert.Equal(t, 0, counts.SumHistoryCounts())
+
+	require.NoError(t, ds.UpdateClientItemCount(counts, 3, 2))
+	counts, err = ds.GetClientItemCount("client1")
+	require.NoError(t, err)
+	assert.Equal(t, 3, counts.ItemCount)
+	assert.Equal(t, 2, counts.SumHistoryCounts())
+
+	require.NoError(t, ds.UpdateClientItemCount(counts, -1, 1))
+	counts, err = ds.GetClientItemCount("client1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, counts.ItemCount)
+	assert.Equal(t, 3, counts.SumHistoryCounts())
+
+	counts, err = ds.GetClientItemCount("client2")
+	require.NoError(t, err)
+	assert.Equal(t, 0, counts.ItemCount, "counts are per chain")
+}
+
+func testClearServerData(t *testing.T, ds datastore.Datastore) {
+	entity := newEntity("client1", "id1", bookmarksType, 1000)
+	entity.ClientDefinedUniqueTag = aws.String("tag1")
+	_, err := ds.InsertSyncEntity(entity)
+	require.NoError(t, err)
+	folder := newEntity("client1", "id2", bookmarksType, 1000)
+	folder.ServerDefinedUniqueTag = aws.String("bookmark_bar")
+	require.NoError(t, ds.InsertSyncEntitiesWithServerTags([]*datastore.SyncEntity{folder}))
+	_, err = ds.InsertSyncEntity(newEntity("client2", "id1", bookmarksType, 1000))
+	require.NoError(t, err)
+	counts, err := ds.GetClientItemCount("client1")
+	require.NoError(t, err)
+	require.NoError(t, ds.UpdateClientItemCount(counts, 2, 0))
+
+	cleared, err := ds.ClearServerData("client1")
+	require.NoError(t, err)
+	clearedIDs := ids(cleared)
+	sort.Strings(clearedIDs)
+	assert.Equal(t, []string{"Client#tag1", "Server#bookmark_bar", "id1", "id2"}, clearedIDs,
+		"entities and tag items are returned")
+
+	_, entities, err := ds.GetUpdatesForType(bookmarksType, 0, true, "client1", 10)
+	require.NoError(t, err)
+	assert.Empty(t, entities)
+	assert.False(t, hasItem(t, ds, "client1", "Client#tag1"))
+	has, err := ds.HasServerDefinedUniqueTag("client1", "bookmark_bar")
+	require.NoError(t, err)
+	assert.False(t, has)
+	counts, err = ds.GetClientItemCount("client1")
+	require.NoError(t, err)
+	assert.Equal(t, 0, counts.ItemCount)
+	assert.True(t, hasItem(t, ds, "client2", "id1"), "other chains are left alone")
+
+	// A cleared chain is then disabled, and stays disabled when cleared
+	// again.
+	require.NoError(t, ds.DisableSyncChain("client1"))
+	cleared, err = ds.ClearServerData("client1")
+	require.NoError(t, err)
+	assert.Empty(t, cleared)
+	disabled, err := ds.IsSyncChainDisabled("client1")
+	require.NoError(t, err)
+	assert.True(t, disabled)
+}
+
+func testDisableSyncChain(t *testing.T, ds datastore.Datastore) {
+	disabled, err := ds.IsSyncChainDisabled("client1")
+	require.NoError(t, err)
+	assert.False(t, disabled)
+
+	require.NoError(t, ds.DisableSyncChain("client1"))
+	require.NoError(t, ds.DisableSyncChain("client1"), "disabling twice is fine")
+	disabled, err = ds.IsSyncChainDisabled("client1")
+	require.NoError(t, err)
+	assert.True(t, disabled)
+
+	disabled, err = ds.IsSyncChainDisabled("client2")
+	require.NoError(t, err)
+	assert.False(t, disabled)
+}
@@ -8,65 +8,54 @@ import (
 	"github.com/mikaelhg/litesync/internal"
 )
 
-// DeleteTable deletes datastore.Table in dynamoDB.
-func DeleteTable(dynamo *internal.SqliteDatastore) error {
-	// _, err := dynamo.DeleteTable(
-	// 	&dynamodb.DeleteTableInput{TableName: aws.String(datastore.Table)})
-	// if err != nil {
-	// 	if aerr, ok := err.(awserr.Error); ok {
-	// 		// Return as successful if the table is not existed.
-	// 		if aerr.Code() == dynamodb.ErrCodeResourceNotFoundException {
-	// 			return nil
-	// 		}
-	// 	} else {
-	// 		return fmt.Errorf("error deleting table: %w", err)
-	// 	}
-	// }
-
-	// return dynamo.WaitUntilTableNotExists(
-	// 	&dynamodb.DescribeTableInput{TableName: aws.String(datastore.Table)})
+// DeleteTable drops every table in SQLite, including the schema version, so
+// the next CreateTable starts from an empty database.
+func DeleteTable(sqlite *internal.SqliteDatastore) error {
+	rows, err := sqlite.Db.Query(
+		"SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return fmt.Errorf("error listing tables: %w", err)
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning table name: %w", err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("error listing tables: %w", err)
+	}
 
+	for _, table := range tables {
+		if _, err := sqlite.Db.Exec(`DROP TABLE IF EXISTS "` + table + `"`); err != nil {
+			return fmt.Errorf("error deleting table %s: %w", table, err)
+		}
+	}
 	return nil
 }
 
-// CreateTable creates datastore.Table in dynamoDB.
-func CreateTable(dynamo *internal.SqliteDatastore) error {
-	// _, b, _, _ := runtime.Caller(0)
-	// root := filepath.Join(filepath.Dir(b), "../../")
-	// raw, err := os.ReadFile(filepath.Join(root, "schema/dynamodb/table.json"))
-	// if err != nil {
-	// 	return fmt.Errorf("error reading table.json: %w", err)
-	// }
-
-	// var input dynamodb.CreateTableInput
-	// err = json.Unmarshal(raw, &input)
-	// if err != nil {
-	// 	return fmt.Errorf("error unmarshalling raw data from table.json: %w", err)
-	// }
-	// input.TableName = aws.String(datastore.Table)
-
-	// _, err = dynamo.CreateTable(&input)
-	// if err != nil {
-	// 	return fmt.Errorf("error creating table: %w", err)
-	// }
-
-	// return dynamo.WaitUntilTableExists(
-	// 	&dynamodb.DescribeTableInput{TableName: aws.String(datastore.Table)})
-
+// CreateTable applies the schema migrations in SQLite.
+func CreateTable(sqlite *internal.SqliteDatastore) error {
+	if err := sqlite.CreateTable(); err != nil {
+		return fmt.Errorf("error creating table: %w", err)
+	}
 	return nil
 }
 
-// ResetTable deletes and creates datastore.Table in dynamoDB.
-func ResetTable(dynamo *internal.SqliteDatastore) error {
-	// if err := DeleteTable(dynamo); err != nil {
-	// 	return fmt.Errorf("error deleting table to reset table: %w", err)
-	// }
-	// return CreateTable(dynamo)
-
-	return nil
+// ResetTable drops and recreates the schema in SQLite.
+func ResetTable(sqlite *internal.SqliteDatastore) error {
+	if err := DeleteTable(sqlite); err != nil {
+		return fmt.Errorf("error deleting table to reset table: %w", err)
+	}
+	return CreateTable(sqlite)
 }
 
-// ScanSyncEntities scans the SQLite table and returns all sync items.
+// ScanSyncEntities scans the SQLite table and returns all sync items, tag
+// items and disabled chain markers have no version and are left out.
 func ScanSyncEntities(sqlite *internal.SqliteDatastore) ([]datastore.SyncEntity, error) {
 	var syncItems []datastore.SyncEntity
 	var scanErr error
@@ -77,7 +66,8 @@ func ScanSyncEntities(sqlite *internal.SqliteDatastore) ([]datastore.SyncEntity,
                    server_defined_unique_tag, deleted, originator_cache_guid,
                    originator_client_item_id, specifics, data_type, folder,
                    client_defined_unique_tag, unique_position, data_type_mtime, expiration_time
-            FROM sync_entities`
+            FROM sync_entities
+            WHERE version IS NOT NULL`
 
 		rows, err := tx.Query(query)
 		if err != nil {
@@ -171,32 +161,45 @@ func ScanTagItems(sqlite *internal.SqliteDatastore) ([]datastore.ServerClientUni
 	return tagItems, nil
 }
 
-// ScanClientItemCounts scans the dynamoDB table and returns all client item
-// counts.
-func ScanClientItemCounts(dynamo *internal.SqliteDatastore) ([]datastore.ClientItemCounts, error) {
-	// filter := expression.AttributeExists(expression.Name("ItemCount"))
-	// expr, err := expression.NewBuilder().WithFilter(filter).Build()
-	// if err != nil {
-	// 	return nil, fmt.Errorf("error building expression to scan item counts: %w", err)
-	// }
-
-	// input := &dynamodb.ScanInput{
-	// 	ExpressionAttributeNames:  expr.Names(),
-	// 	ExpressionAttributeValues: expr.Values(),
-	// 	FilterExpression:          expr.Filter(),
-	// 	TableName:                 aws.String(datastore.Table),
-	// }
-	// out, err := dynamo.Scan(input)
-	// if err != nil {
-	// 	return nil, fmt.Errorf("error doing scan for item counts: %w", err)
-	// }
-	// clientItemCounts := []datastore.ClientItemCounts{}
-	// err = dynamodbattribute.UnmarshalListOfMaps(out.Items, &clientItemCounts)
-	// if err != nil {
-	// 	return nil, fmt.Errorf("error unmarshalling item counts: %w", err)
-	// }
-
-	// return clientItemCounts, nil
-
-	return nil, nil
+// ScanClientItemCounts scans the SQLite client_item_counts table and returns
+// all client item counts.
+func ScanClientItemCounts(sqlite *internal.SqliteDatastore) ([]datastore.ClientItemCounts, error) {
+	const query = `
+        SELECT client_id, item_count,
+               history_item_count_period1, history_item_count_period2,
+               history_item_count_period3, history_item_count_period4,
+               last_period_change_time, version
+        FROM client_item_counts`
+
+	rows, err := sqlite.Db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error querying item counts: %w", err)
+	}
+	defer rows.Close()
+
+	clientItemCounts := []datastore.ClientItemCounts{}
+	for rows.Next() {
+		var counts datastore.ClientItemCounts
+		err := rows.Scan(
+			&counts.ClientID,
+			&counts.ItemCount,
+			&counts.HistoryItemCountPeriod1,
+			&counts.HistoryItemCountPeriod2,
+			&counts.HistoryItemCountPeriod3,
+			&counts.HistoryItemCountPeriod4,
+			&counts.LastPeriodChangeTime,
+			&counts.Version,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning item counts: %w", err)
+		}
+		counts.ID = counts.ClientID
+		clientItemCounts = append(clientItemCounts, counts)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating item counts: %w", err)
+	}
+
+	return clientItemCounts, nil
 }
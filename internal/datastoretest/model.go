@@ -0,0 +1,268 @@
+package datastoretest
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal"
+)
+
+const disabledChainID = "disabled_chain"
+
+type modelKey struct {
+	clientID string
+	id       string
+}
+
+// Model is a reference datastore.Datastore, kept as plain as possible so
+// that it is obviously right. It keeps rows like SqliteDatastore does, with
+// the tag items and disabled chain markers as rows without a version, but
+// in maps and without any of the storage concerns.
+type Model struct {
+	mu     sync.Mutex
+	rows   map[modelKey]datastore.SyncEntity
+	counts map[string]datastore.ClientItemCounts
+}
+
+func NewModel() *Model {
+	return &Model{
+		rows:   map[modelKey]datastore.SyncEntity{},
+		counts: map[string]datastore.ClientItemCounts{},
+	}
+}
+
+// clone copies the model, to try an order of ops on. The copies share the
+// fields of the rows, which the model never changes in place.
+func (m *Model) clone() *Model {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &Model{rows: maps.Clone(m.rows), counts: maps.Clone(m.counts)}
+}
+
+// tagItem returns the row of a tag item or disabled chain marker.
+func tagItem(clientID, id string, mtime, ctime *int64) datastore.SyncEntity {
+	return datastore.SyncEntity{ClientID: clientID, ID: id, Mtime: mtime, Ctime: ctime}
+}
+
+func (m *Model) InsertSyncEntity(entity *datastore.SyncEntity) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := modelKey{entity.ClientID, entity.ID}
+	if _, ok := m.rows[key]; ok {
+		return true, fmt.Errorf("InsertSyncEntity: %w: %s", internal.ErrConflict, entity.ID)
+	}
+	if entity.ClientDefinedUniqueTag != nil {
+		tagKey := modelKey{entity.ClientID, "Client#" + *entity.ClientDefinedUniqueTag}
+		if _, ok := m.rows[tagKey]; ok {
+			return true, fmt.Errorf("InsertSyncEntity: %w: %s", internal.ErrConflict, tagKey.id)
+		}
+		m.rows[tagKey] = tagItem(tagKey.clientID, tagKey.id, entity.Mtime, entity.Ctime)
+	}
+	m.rows[key] = *entity
+	return false, nil
+}
+
+// InsertSyncEntitiesWithServerTags adds a tag item for every server tag,
+// and inserts nothing when a tag or ID is taken.
+func (m *Model) InsertSyncEntitiesWithServerTags(entities []*datastore.SyncEntity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	added := map[modelKey]datastore.SyncEntity{}
+	taken := func(key modelKey) bool {
+		_, stored := m.rows[key]
+		_, batch := added[key]
+		return stored || batch
+	}
+	for _, entity := range entities {
+		if entity.ServerDefinedUniqueTag != nil {
+			tagKey := modelKey{entity.ClientID, "Server#" + *entity.ServerDefinedUniqueTag}
+			if taken(tagKey) {
+				return fmt.Errorf("InsertSyncEntitiesWithServerTags: %w: server tag %s", internal.ErrConflict, *entity.ServerDefinedUniqueTag)
+			}
+			added[tagKey] = tagItem(tagKey.clientID, tagKey.id, entity.Mtime, entity.Ctime)
+		}
+		key := modelKey{entity.ClientID, entity.ID}
+		if taken(key) {
+			return fmt.Errorf("InsertSyncEntitiesWithServerTags: %w: %s", internal.ErrConflict, entity.ID)
+		}
+		added[key] = *entity
+	}
+	for key, row := range added {
+		m.rows[key] = row
+	}
+	return nil
+}
+
+// UpdateSyncEntity overwrites the version, mtime, specifics and data type
+// mtime, and the other fields the update sets. History entities are updated
+// whatever their version.
+func (m *Model) UpdateSyncEntity(entity *datastore.SyncEntity, oldVersion int64) (bool, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := modelKey{entity.ClientID, entity.ID}
+	stored, ok := m.rows[key]
+	if !ok {
+		return true, false, nil
+	}
+	isHistory := stored.DataType != nil && *stored.DataType == historyType
+	if !isHistory && (stored.Version == nil || *stored.Version != oldVersion) {
+		return true, false, nil
+	}
+	wasDeleted := stored.Deleted != nil && *stored.Deleted
+
+	stored.Version = entity.Version
+	stored.Mtime = entity.Mtime
+	stored.Specifics = entity.Specifics
+	stored.DataTypeMtime = entity.DataTypeMtime
+	if entity.UniquePosition != nil {
+		stored.UniquePosition = entity.UniquePosition
+	}
+	stored.ParentID = cmp.Or(entity.ParentID, stored.ParentID)
+	stored.Name = cmp.Or(entity.Name, stored.Name)
+	stored.NonUniqueName = cmp.Or(entity.NonUniqueName, stored.NonUniqueName)
+	stored.Deleted = cmp.Or(entity.Deleted, stored.Deleted)
+	stored.Folder = cmp.Or(entity.Folder, stored.Folder)
+	stored.ExpirationTime = cmp.Or(entity.ExpirationTime, stored.ExpirationTime)
+	m.rows[key] = stored
+
+	deleted := false
+	if entity.Deleted != nil && *entity.Deleted {
+		if entity.ClientDefinedUniqueTag != nil {
+			delete(m.rows, modelKey{entity.ClientID, "Client#" + *entity.ClientDefinedUniqueTag})
+		}
+		deleted = !wasDeleted
+	}
+	return false, deleted, nil
+}
+
+// GetUpdatesForType returns the entities of a type changed after
+// clientToken, in mtime and then ID order, leaving out the expired ones.
+func (m *Model) GetUpdatesForType(dataType int, clientToken int64, fetchFolders bool, clientID string, maxSize int64) (bool, []datastore.SyncEntity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().Unix()
+	entities := []datastore.SyncEntity{}
+	for key, row := range m.rows {
+		switch {
+		case key.clientID != clientID,
+			row.DataType == nil || *row.DataType != dataType,
+			row.Mtime == nil || *row.Mtime <= clientToken,
+			!fetchFolders && (row.Folder == nil || *row.Folder),
+			row.ExpirationTime != nil && *row.ExpirationTime <= now:
+			continue
+		}
+		entities = append(entities, row)
+	}
+	slices.SortFunc(entities, func(a, b datastore.SyncEntity) int {
+		return cmp.Or(cmp.Compare(*a.Mtime, *b.Mtime), strings.Compare(a.ID, b.ID))
+	})
+	if int64(len(entities)) > maxSize {
+		entities = entities[:maxSize]
+	}
+	return int64(len(entities)) == maxSize, entities, nil
+}
+
+func (m *Model) HasServerDefinedUniqueTag(clientID string, tag string) (bool, error) {
+	return m.HasItem(clientID, "Server#"+tag)
+}
+
+func (m *Model) HasItem(clientID string, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.rows[modelKey{clientID, id}]
+	return ok, nil
+}
+
+// GetClientItemCount returns the stored counts. The history periods never
+// rotate, a test does not run for days.
+func (m *Model) GetClientItemCount(clientID string) (*datastore.ClientItemCounts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts, ok := m.counts[clientID]
+	if !ok {
+		counts = datastore.ClientItemCounts{ClientID: clientID, ID: clientID, LastPeriodChangeTime: time.Now().Unix()}
+	}
+	return &counts, nil
+}
+
+func (m *Model) UpdateClientItemCount(counts *datastore.ClientItemCounts, newNormalItemCount int, newHistoryItemCount int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts.ItemCount += newNormalItemCount
+	counts.HistoryItemCountPeriod4 += newHistoryItemCount
+	m.counts[counts.ClientID] = *counts
+	return nil
+}
+
+// ClearServerData removes every row of the chain but its disabled chain
+// marker, and its counts.
+func (m *Model) ClearServerData(clientID string) ([]datastore.SyncEntity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cleared := []datastore.SyncEntity{}
+	for key, row := range m.rows {
+		if key.clientID == clientID && key.id != disabledChainID {
+			cleared = append(cleared, row)
+			delete(m.rows, key)
+		}
+	}
+	delete(m.counts, clientID)
+	return cleared, nil
+}
+
+// DeleteExpiredEntities deletes up to limit entities expired at now, and the
+// client tag items of the live ones, a tombstone's tag may be taken again.
+// Live entities of normal types come off the item count.
+func (m *Model) DeleteExpiredEntities(now int64, limit int) (map[string]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleted := map[string]int{}
+	total := 0
+	for key, row := range m.rows {
+		if total == limit {
+			break
+		}
+		if row.ExpirationTime == nil || *row.ExpirationTime > now {
+			continue
+		}
+		delete(m.rows, key)
+		deleted[key.clientID]++
+		total++
+		if row.Version == nil || (row.Deleted != nil && *row.Deleted) {
+			continue
+		}
+		if row.ClientDefinedUniqueTag != nil {
+			delete(m.rows, modelKey{key.clientID, "Client#" + *row.ClientDefinedUniqueTag})
+		}
+		if counts, ok := m.counts[key.clientID]; ok && *row.DataType != historyType {
+			counts.ItemCount = max(counts.ItemCount-1, 0)
+			m.counts[key.clientID] = counts
+		}
+	}
+	return deleted, nil
+}
+
+func (m *Model) DisableSyncChain(clientID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := modelKey{clientID, disabledChainID}
+	if _, ok := m.rows[key]; !ok {
+		now := time.Now().UnixMilli()
+		m.rows[key] = tagItem(clientID, disabledChainID, &now, &now)
+	}
+	return nil
+}
+
+func (m *Model) IsSyncChainDisabled(clientID string) (bool, error) {
+	return m.HasItem(clientID, disabledChainID)
+}
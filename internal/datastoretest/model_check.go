@@ -0,0 +1,503 @@
+package datastoretest
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal"
+)
+
+// Op is one call of a datastore.Datastore method, as generated by
+// DecodeOps. Only the fields of its method are set.
+type Op struct {
+	Method string
+
+	ClientID     string
+	ID           string
+	Entity       *datastore.SyncEntity
+	Entities     []*datastore.SyncEntity
+	OldVersion   int64
+	DataType     int
+	Token        int64
+	FetchFolders bool
+	MaxSize      int64
+	NormalItems  int
+	HistoryItems int
+}
+
+// The ops draw from a handful of chains, IDs, tags and mtimes, so that they
+// run into each other's conflicts, tags and pages often.
+var (
+	opClientIDs  = []string{"client1", "client2"}
+	opIDs        = []string{"id1", "id2", "id3", "id4", "id5"}
+	opTags       = []string{"tag1", "tag2"}
+	opDataTypes  = []int{bookmarksType, historyType}
+	opServerTags = []string{"bookmark_bar", "other_bookmarks"}
+)
+
+// Expiration times in seconds, well before and after any test run, and the
+// time the expired entities are reaped at, in between. No sequence expires
+// reapLimit entities, which ones a smaller limit picks differs between
+// datastores.
+const (
+	expiredTime  = 1
+	unexpireTime = 1 << 40
+	reapTime     = 1 << 30
+	reapLimit    = 1000
+)
+
+// expiredEntityDeleter is implemented by the datastores and the Model.
+type expiredEntityDeleter interface {
+	DeleteExpiredEntities(now int64, limit int) (map[string]int, error)
+}
+
+// opReader hands out the bytes of a fuzz input as small choices, and zeros
+// once they run out.
+type opReader struct {
+	data []byte
+}
+
+func (r *opReader) choose(n int) int {
+	if len(r.data) == 0 {
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return int(b) % n
+}
+
+func (r *opReader) pick(values []string) string {
+	return values[r.choose(len(values))]
+}
+
+// maybe returns one of values, or nil one time in n+1.
+func (r *opReader) maybe(values []string) *string {
+	i := r.choose(len(values) + 1)
+	if i == len(values) {
+		return nil
+	}
+	return aws.String(values[i])
+}
+
+func (r *opReader) entity(clientID string) *datastore.SyncEntity {
+	dataType := opDataTypes[r.choose(len(opDataTypes))]
+	mtime := int64(1+r.choose(8)) * 1000
+	entity := &datastore.SyncEntity{
+		ClientID:               clientID,
+		ID:                     r.pick(opIDs),
+		ParentID:               r.maybe([]string{"root", "folder"}),
+		Version:                aws.Int64(int64(1 + r.choose(4))),
+		Mtime:                  aws.Int64(mtime),
+		Ctime:                  aws.Int64(mtime),
+		Name:                   r.maybe([]string{"name1", "name2"}),
+		Deleted:                aws.Bool(false),
+		Specifics:              []byte(fmt.Sprintf("specifics%d", r.choose(4))),
+		DataType:               aws.Int(dataType),
+		Folder:                 aws.Bool(r.choose(3) == 0),
+		ClientDefinedUniqueTag: r.maybe(opTags),
+		DataTypeMtime:          aws.String(fmt.Sprintf("%d#%d", dataType, mtime)),
+	}
+	switch r.choose(5) {
+	case 0:
+		entity.ExpirationTime = aws.Int64(expiredTime)
+	case 1:
+		entity.ExpirationTime = aws.Int64(unexpireTime)
+	}
+	return entity
+}
+
+// DecodeOps turns fuzz input into a sequence of at most 100 ops.
+func DecodeOps(data []byte) []Op {
+	r := &opReader{data: data}
+	var ops []Op
+	for len(r.data) > 0 && len(ops) < 100 {
+		clientID := r.pick(opClientIDs)
+		var op Op
+		switch r.choose(11) {
+		case 0, 1:
+			op = Op{Method: "InsertSyncEntity", Entity: r.entity(clientID)}
+		case 2:
+			op = Op{Method: "InsertSyncEntitiesWithServerTags"}
+			for range 1 + r.choose(2) {
+				entity := r.entity(clientID)
+				entity.ClientDefinedUniqueTag = nil
+				entity.ServerDefinedUniqueTag = r.maybe(opServerTags)
+				op.Entities = append(op.Entities, entity)
+			}
+		case 3, 4:
+			op = Op{Method: "UpdateSyncEntity", Entity: r.entity(clientID), OldVersion: int64(1 + r.choose(4))}
+			op.Entity.Deleted = aws.Bool(r.choose(3) == 0)
+			if r.choose(3) == 0 {
+				op.Entity.Deleted = nil
+			}
+		case 5, 6:
+			op = Op{
+				Method:       "GetUpdatesForType",
+				ClientID:     clientID,
+				DataType:     opDataTypes[r.choose(len(opDataTypes))],
+				Token:        int64(r.choose(9)) * 1000,
+				FetchFolders: r.choose(2) == 0,
+				MaxSize:      int64(1 + r.choose(4)),
+			}
+		case 7:
+			op = Op{Method: "HasItem", ClientID: clientID, ID: r.pick(append(opIDs, "Client#tag1", "Server#bookmark_bar"))}
+		case 8:
+			op = Op{Method: "UpdateClientItemCount", ClientID: clientID, NormalItems: r.choose(5) - 2, HistoryItems: r.choose(3)}
+		case 9:
+			op = Op{Method: []string{"ClearServerData", "DisableSyncChain", "IsSyncChainDisabled"}[r.choose(3)], ClientID: clientID}
+		case 10:
+			op = Op{Method: "DeleteExpiredEntities"}
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+func formatEntity(e *datastore.SyncEntity) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "{%s %s", e.ClientID, e.ID)
+	field := func(name string, value any) {
+		switch v := value.(type) {
+		case *string:
+			if v != nil {
+				fmt.Fprintf(&b, " %s:%q", name, *v)
+			}
+		case *int64:
+			if v != nil {
+				fmt.Fprintf(&b, " %s:%d", name, *v)
+			}
+		case *int:
+			if v != nil {
+				fmt.Fprintf(&b, " %s:%d", name, *v)
+			}
+		case *bool:
+			if v != nil {
+				fmt.Fprintf(&b, " %s:%t", name, *v)
+			}
+		case []byte:
+			if v != nil {
+				fmt.Fprintf(&b, " %s:%q", name, v)
+			}
+		}
+	}
+	field("ParentID", e.ParentID)
+	field("Version", e.Version)
+	field("Mtime", e.Mtime)
+	field("Ctime", e.Ctime)
+	field("Name", e.Name)
+	field("NonUniqueName", e.NonUniqueName)
+	field("ServerDefinedUniqueTag", e.ServerDefinedUniqueTag)
+	field("Deleted", e.Deleted)
+	field("OriginatorCacheGUID", e.OriginatorCacheGUID)
+	field("OriginatorClientItemID", e.OriginatorClientItemID)
+	field("Specifics", e.Specifics)
+	field("DataType", e.DataType)
+	field("Folder", e.Folder)
+	field("ClientDefinedUniqueTag", e.ClientDefinedUniqueTag)
+	field("UniquePosition", e.UniquePosition)
+	field("DataTypeMtime", e.DataTypeMtime)
+	field("ExpirationTime", e.ExpirationTime)
+	b.WriteString("}")
+	return b.String()
+}
+
+func (op Op) String() string {
+	switch op.Method {
+	case "InsertSyncEntity":
+		return fmt.Sprintf("InsertSyncEntity(%s)", formatEntity(op.Entity))
+	case "InsertSyncEntitiesWithServerTags":
+		entities := make([]string, len(op.Entities))
+		for i, entity := range op.Entities {
+			entities[i] = formatEntity(entity)
+		}
+		return fmt.Sprintf("InsertSyncEntitiesWithServerTags(%s)", strings.Join(entities, ", "))
+	case "UpdateSyncEntity":
+		return fmt.Sprintf("UpdateSyncEntity(%s, %d)", formatEntity(op.Entity), op.OldVersion)
+	case "GetUpdatesForType":
+		return fmt.Sprintf("GetUpdatesForType(%d, %d, %t, %s, %d)", op.DataType, op.Token, op.FetchFolders, op.ClientID, op.MaxSize)
+	case "HasItem":
+		return fmt.Sprintf("HasItem(%s, %s)", op.ClientID, op.ID)
+	case "UpdateClientItemCount":
+		return fmt.Sprintf("UpdateClientItemCount(%s, %d, %d)", op.ClientID, op.NormalItems, op.HistoryItems)
+	case "DeleteExpiredEntities":
+		return fmt.Sprintf("DeleteExpiredEntities(%d, %d)", reapTime, reapLimit)
+	default:
+		return fmt.Sprintf("%s(%s)", op.Method, op.ClientID)
+	}
+}
+
+// describeError tells conflicts from other errors, their messages differ
+// between datastores.
+func describeError(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, internal.ErrConflict):
+		return "conflict error"
+	default:
+		return "error"
+	}
+}
+
+// apply runs op on ds and describes what the caller can observe of it. The
+// entities an op takes are copied, a datastore may keep them.
+func apply(ds datastore.Datastore, op Op) string {
+	copyEntity := func(e *datastore.SyncEntity) *datastore.SyncEntity {
+		c := *e
+		return &c
+	}
+	switch op.Method {
+	case "InsertSyncEntity":
+		conflict, err := ds.InsertSyncEntity(copyEntity(op.Entity))
+		return fmt.Sprintf("conflict %t, %s", conflict, describeError(err))
+	case "InsertSyncEntitiesWithServerTags":
+		entities := make([]*datastore.SyncEntity, len(op.Entities))
+		for i, entity := range op.Entities {
+			entities[i] = copyEntity(entity)
+		}
+		return describeError(ds.InsertSyncEntitiesWithServerTags(entities))
+	case "UpdateSyncEntity":
+		conflict, deleted, err := ds.UpdateSyncEntity(copyEntity(op.Entity), op.OldVersion)
+		return fmt.Sprintf("conflict %t, deleted %t, %s", conflict, deleted, describeError(err))
+	case "GetUpdatesForType":
+		hasMore, entities, err := ds.GetUpdatesForType(op.DataType, op.Token, op.FetchFolders, op.ClientID, op.MaxSize)
+		described := make([]string, len(entities))
+		for i := range entities {
+			described[i] = formatEntity(&entities[i])
+		}
+		return fmt.Sprintf("has more %t, %s, [%s]", hasMore, describeError(err), strings.Join(described, ", "))
+	case "HasItem":
+		has, err := ds.HasItem(op.ClientID, op.ID)
+		return fmt.Sprintf("%t, %s", has, describeError(err))
+	case "UpdateClientItemCount":
+		counts, err := ds.GetClientItemCount(op.ClientID)
+		if err != nil {
+			return describeError(err)
+		}
+		if err = ds.UpdateClientItemCount(counts, op.NormalItems, op.HistoryItems); err != nil {
+			return describeError(err)
+		}
+		counts, err = ds.GetClientItemCount(op.ClientID)
+		if err != nil {
+			return describeError(err)
+		}
+		return fmt.Sprintf("items %d, history items %d", counts.ItemCount, counts.SumHistoryCounts())
+	case "ClearServerData":
+		entities, err := ds.ClearServerData(op.ClientID)
+		cleared := ids(entities)
+		slices.Sort(cleared)
+		return fmt.Sprintf("%s, cleared %v", describeError(err), cleared)
+	case "DisableSyncChain":
+		return describeError(ds.DisableSyncChain(op.ClientID))
+	case "DeleteExpiredEntities":
+		deleted, err := ds.(expiredEntityDeleter).DeleteExpiredEntities(reapTime, reapLimit)
+		return fmt.Sprintf("%s, deleted %v", describeError(err), deleted)
+	case "IsSyncChainDisabled":
+		disabled, err := ds.IsSyncChainDisabled(op.ClientID)
+		return fmt.Sprintf("%t, %s", disabled, describeError(err))
+	default:
+		panic("unknown method " + op.Method)
+	}
+}
+
+// Mismatch is the first op after which a datastore and the model differ.
+type Mismatch struct {
+	Ops   []Op
+	Index int
+	Got   string
+	Want  string
+}
+
+func (m *Mismatch) String() string {
+	var b strings.Builder
+	for i, op := range m.Ops {
+		fmt.Fprintf(&b, "%d: %s\n", i, op)
+	}
+	fmt.Fprintf(&b, "op %d returned\n  %s\nthe model returned\n  %s", m.Index, m.Got, m.Want)
+	return b.String()
+}
+
+// compareOps runs ops on a fresh datastore and a fresh Model, and returns the
+// first mismatch, nil when there is none.
+func compareOps(t *testing.T, factory Factory, ops []Op) *Mismatch {
+	ds := factory(t)
+	model := NewModel()
+	for i, op := range ops {
+		got, want := apply(ds, op), apply(model, op)
+		if got != want {
+			return &Mismatch{Ops: ops, Index: i, Got: got, Want: want}
+		}
+	}
+	return nil
+}
+
+// shrink removes ops from a mismatching sequence for as long as it keeps
+// mismatching, halving the chunks it tries to remove down to single ops.
+func shrink(t *testing.T, factory Factory, mismatch *Mismatch) *Mismatch {
+	ops := mismatch.Ops[:mismatch.Index+1]
+	for chunk := len(ops) / 2; chunk >= 1; chunk /= 2 {
+		for start := 0; start+chunk <= len(ops); {
+			candidate := slices.Concat(ops[:start], ops[start+chunk:])
+			if smaller := compareOps(t, factory, candidate); smaller != nil {
+				mismatch = smaller
+				ops = candidate[:smaller.Index+1]
+				continue
+			}
+			start += chunk
+		}
+	}
+	return mismatch
+}
+
+// CheckOps fails t when the datastore and the Model differ on ops, with the
+// shortest sequence of them found to still differ.
+func CheckOps(t *testing.T, factory Factory, ops []Op) {
+	t.Helper()
+	if mismatch := compareOps(t, factory, ops); mismatch != nil {
+		t.Fatalf("the datastore differs from the model:\n%s", shrink(t, factory, mismatch))
+	}
+}
+
+// CheckAgainstModel runs random sequences of ops on the datastore and the
+// Model, and fails on the first difference, shrunk to a minimal reproducer.
+// The sequences come from fixed seeds, so a failure repeats. The ops run one
+// at a time, CheckConcurrentAgainstModel runs them at once.
+func CheckAgainstModel(t *testing.T, factory Factory, runs int) {
+	t.Helper()
+	for seed := range int64(runs) {
+		data := make([]byte, 400)
+		rand.New(rand.NewSource(seed)).Read(data)
+		if mismatch := compareOps(t, factory, DecodeOps(data)); mismatch != nil {
+			t.Fatalf("seed %d: the datastore differs from the model:\n%s", seed, shrink(t, factory, mismatch))
+		}
+	}
+}
+
+// The concurrent check runs a few short goroutines, the orders their calls
+// can be put in grow fast with their length.
+const (
+	concurrentWorkers   = 3
+	concurrentWorkerOps = 4
+)
+
+// call is an op a goroutine ran, what it returned, and when it started and
+// ended on a clock the goroutines share.
+type call struct {
+	op         Op
+	got        string
+	start, end int64
+}
+
+// runConcurrently runs the ops of each worker in order on ds, the workers
+// all at once.
+func runConcurrently(ds datastore.Datastore, workers [][]Op) [][]call {
+	var clock atomic.Int64
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	histories := make([][]call, len(workers))
+	for w, ops := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for _, op := range ops {
+				c := call{op: op, start: clock.Add(1)}
+				c.got = apply(ds, op)
+				c.end = clock.Add(1)
+				histories[w] = append(histories[w], c)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return histories
+}
+
+// linearizable reports whether the calls from next on can be put in an
+// order, which keeps the order of each goroutine and of the calls which did
+// not overlap, in which the model returns what the datastore did.
+func linearizable(model *Model, histories [][]call, next []int) bool {
+	done := true
+	for w, history := range histories {
+		if next[w] == len(history) {
+			continue
+		}
+		done = false
+		c := history[next[w]]
+		if endedBefore(c, histories, next) {
+			continue
+		}
+		candidate := model.clone()
+		if apply(candidate, c.op) != c.got {
+			continue
+		}
+		next[w]++
+		found := linearizable(candidate, histories, next)
+		next[w]--
+		if found {
+			return true
+		}
+	}
+	return done
+}
+
+// endedBefore reports whether another goroutine's next call ended before c
+// started, and so has to come first.
+func endedBefore(c call, histories [][]call, next []int) bool {
+	for w, history := range histories {
+		if next[w] < len(history) && history[next[w]].end < c.start {
+			return true
+		}
+	}
+	return false
+}
+
+func formatHistories(histories [][]call) string {
+	var b strings.Builder
+	for w, history := range histories {
+		fmt.Fprintf(&b, "goroutine %d:\n", w)
+		for _, c := range history {
+			fmt.Fprintf(&b, "  %d-%d: %s\n    returned %s\n", c.start, c.end, c.op, c.got)
+		}
+	}
+	return b.String()
+}
+
+// CheckConcurrentAgainstModel runs random ops from several goroutines at
+// once, and fails when no order of the calls, keeping the order of each
+// goroutine and of the calls which did not overlap, has the Model return
+// what the datastore did. The ops come from fixed seeds, but how they
+// interleave does not, so a failure need not repeat, and it is not shrunk.
+// UpdateClientItemCount is left out, it reads and writes the counts in
+// separate calls, as go-sync does, and is not atomic.
+func CheckConcurrentAgainstModel(t *testing.T, factory Factory, runs int) {
+	t.Helper()
+	for seed := range int64(runs) {
+		data := make([]byte, 400)
+		rand.New(rand.NewSource(seed)).Read(data)
+		workers := make([][]Op, concurrentWorkers)
+		i := 0
+		for _, op := range DecodeOps(data) {
+			if op.Method == "UpdateClientItemCount" {
+				continue
+			}
+			if i == concurrentWorkers*concurrentWorkerOps {
+				break
+			}
+			workers[i%concurrentWorkers] = append(workers[i%concurrentWorkers], op)
+			i++
+		}
+		histories := runConcurrently(factory(t), workers)
+		if !linearizable(NewModel(), histories, make([]int, len(histories))) {
+			t.Fatalf("seed %d: no order of the calls matches the model:\n%s", seed, formatHistories(histories))
+		}
+	}
+}
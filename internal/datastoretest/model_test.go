@@ -0,0 +1,16 @@
+package datastoretest_test
+
+import (
+	"testing"
+
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal/datastoretest"
+)
+
+// The model has to pass the suite the datastores pass, or the datastores
+// are only checked against a model of its own mistakes.
+func TestModelConformance(t *testing.T) {
+	datastoretest.RunConformance(t, func(t *testing.T) datastore.Datastore {
+		return datastoretest.NewModel()
+	})
+}
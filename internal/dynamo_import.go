@@ -0,0 +1,444 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	braveds "github.com/brave/go-sync/datastore"
+)
+
+// The go-sync DynamoDB table keeps everything of a chain under the ClientID
+// hash key. The ID range key is the entity ID, a tag item ID with its
+// Client# or Server# prefix, disabledChainID for the disabled chain marker,
+// or the client ID itself for the item counts. That maps onto sync_entities
+// and client_item_counts as it is.
+
+// DynamoImportResult counts what ImportDynamoExport loaded.
+type DynamoImportResult struct {
+	Chains         int
+	Entities       int
+	TagItems       int
+	DisabledChains int
+	ItemCounts     int
+
+	// Skipped lists the chains which the database already had, and which
+	// were left alone for want of replace.
+	Skipped []string
+}
+
+// ImportDynamoExport loads a DynamoDB export of the go-sync table into the
+// store of cfg, one chain per transaction. Each path is an export data file,
+// in DynamoDB JSON or Amazon Ion and optionally gzipped, or a directory which
+// is searched for them, such as the directory of an export to S3.
+//
+// The whole export is read before anything is written. A chain the store
+// already has is skipped, or replaced with replace.
+func ImportDynamoExport(cfg StoreConfig, paths []string, replace bool) (DynamoImportResult, error) {
+	var result DynamoImportResult
+	files, err := dynamoExportFiles(paths)
+	if err != nil {
+		return result, err
+	}
+	if len(files) == 0 {
+		return result, errors.New("no DynamoDB export data files found")
+	}
+
+	chains := map[string]*ChainExport{}
+	seen := map[entityKey]bool{}
+	for _, file := range files {
+		err := readDynamoExportFile(file, func(attrs map[string]any) error {
+			entity, counts, err := dynamoItemRow(attrs)
+			if err != nil {
+				return err
+			}
+			key := entityKey{clientID: entity.ClientID, id: entity.ID}
+			if seen[key] {
+				return fmt.Errorf("item %s/%s appears twice", key.clientID, key.id)
+			}
+			seen[key] = true
+
+			chain := chains[entity.ClientID]
+			if chain == nil {
+				chain = &ChainExport{ClientID: entity.ClientID}
+				chains[entity.ClientID] = chain
+			}
+			switch {
+			case counts != nil:
+				chain.Counts = counts
+				result.ItemCounts++
+			case entity.ID == disabledChainID:
+				chain.Entities = append(chain.Entities, entity)
+				result.DisabledChains++
+			case strings.HasPrefix(entity.ID, "Client#") || strings.HasPrefix(entity.ID, "Server#"):
+				chain.Entities = append(chain.Entities, entity)
+				result.TagItems++
+			default:
+				chain.Entities = append(chain.Entities, entity)
+				result.Entities++
+			}
+			return nil
+		})
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+
+	store, err := openStore(cfg)
+	if err != nil {
+		return result, err
+	}
+	defer store.Close()
+
+	clientIDs := make([]string, 0, len(chains))
+	for clientID := range chains {
+		clientIDs = append(clientIDs, clientID)
+	}
+	sort.Strings(clientIDs)
+	for _, clientID := range clientIDs {
+		err := store.ImportChain(*chains[clientID], replace)
+		if errors.Is(err, ErrConflict) && !replace {
+			result.Skipped = append(result.Skipped, clientID)
+			continue
+		}
+		if err != nil {
+			return result, fmt.Errorf("chain %s: %w", clientID, err)
+		}
+		result.Chains++
+	}
+	return result, nil
+}
+
+// dynamoExportFiles expands directories into the export data files in them.
+// The manifest files of an S3 export are JSON too, and are left out.
+func dynamoExportFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			name := strings.TrimSuffix(entry.Name(), ".gz")
+			if strings.HasPrefix(name, "manifest-") {
+				return nil
+			}
+			if strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".ion") {
+				files = append(files, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// readDynamoExportFile calls fn with the attributes of every item in an
+// export data file. The format and compression are told from the contents.
+func readDynamoExportFile(path string, fn func(attrs map[string]any) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = bufio.NewReader(gz)
+	}
+
+	// DynamoDB JSON quotes the "Item" key, Ion starts with $ion_1_0 or an
+	// unquoted Item field.
+	start, err := r.Peek(64)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if bytes.HasPrefix(bytes.TrimLeft(start, " \t\r\n"), []byte(`{"`)) {
+		return readDynamoJSON(r, fn)
+	}
+	return readDynamoIon(r, fn)
+}
+
+// dynamoJSONValue is an attribute value in DynamoDB JSON, such as
+// {"S": "text"} or {"N": "12"}. Binary values are base64 encoded, as
+// encoding/json expects for []byte.
+type dynamoJSONValue struct {
+	S    *string                    `json:"S"`
+	N    *string                    `json:"N"`
+	B    []byte                     `json:"B"`
+	BOOL *bool                      `json:"BOOL"`
+	NULL *bool                      `json:"NULL"`
+	SS   []string                   `json:"SS"`
+	NS   []string                   `json:"NS"`
+	BS   [][]byte                   `json:"BS"`
+	L    []dynamoJSONValue          `json:"L"`
+	M    map[string]dynamoJSONValue `json:"M"`
+}
+
+func (v dynamoJSONValue) value() any {
+	switch {
+	case v.S != nil:
+		return *v.S
+	case v.N != nil:
+		return dynamoNumber(*v.N)
+	case v.B != nil:
+		return v.B
+	case v.BOOL != nil:
+		return *v.BOOL
+	case v.SS != nil:
+		values := make([]any, len(v.SS))
+		for i, s := range v.SS {
+			values[i] = s
+		}
+		return values
+	case v.NS != nil:
+		values := make([]any, len(v.NS))
+		for i, n := range v.NS {
+			values[i] = dynamoNumber(n)
+		}
+		return values
+	case v.BS != nil:
+		values := make([]any, len(v.BS))
+		for i, b := range v.BS {
+			values[i] = b
+		}
+		return values
+	case v.L != nil:
+		values := make([]any, len(v.L))
+		for i, element := range v.L {
+			values[i] = element.value()
+		}
+		return values
+	case v.M != nil:
+		return dynamoJSONAttrs(v.M)
+	}
+	return nil
+}
+
+func dynamoJSONAttrs(m map[string]dynamoJSONValue) map[string]any {
+	attrs := make(map[string]any, len(m))
+	for name, v := range m {
+		attrs[name] = v.value()
+	}
+	return attrs
+}
+
+// readDynamoJSON reads DynamoDB JSON, one {"Item": {...}} object per line.
+func readDynamoJSON(r io.Reader, fn func(attrs map[string]any) error) error {
+	dec := json.NewDecoder(r)
+	for item := 1; ; item++ {
+		var line struct {
+			Item map[string]dynamoJSONValue `json:"Item"`
+		}
+		if err := dec.Decode(&line); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("item %d: %w", item, err)
+		}
+		if line.Item == nil {
+			return fmt.Errorf("item %d: no Item", item)
+		}
+		if err := fn(dynamoJSONAttrs(line.Item)); err != nil {
+			return fmt.Errorf("item %d: %w", item, err)
+		}
+	}
+}
+
+// readDynamoIon reads Ion text, one {Item: {...}} struct per line.
+func readDynamoIon(r *bufio.Reader, fn func(attrs map[string]any) error) error {
+	reader := newIonReader(r)
+	for item := 1; ; item++ {
+		value, err := reader.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("item %d: %w", item, err)
+		}
+		line, _ := value.(map[string]any)
+		attrs, ok := line["Item"].(map[string]any)
+		if !ok {
+			return fmt.Errorf("item %d: no Item", item)
+		}
+		if err := fn(attrs); err != nil {
+			return fmt.Errorf("item %d: %w", item, err)
+		}
+	}
+}
+
+// dynamoNumber is a number as exported, DynamoDB numbers are decimals of up
+// to 38 digits. Ion writes 12 as "12." or "12d0".
+type dynamoNumber string
+
+func (n dynamoNumber) int64() (int64, error) {
+	text := strings.ReplaceAll(string(n), "_", "")
+	if !strings.HasPrefix(strings.TrimLeft(text, "+-"), "0x") {
+		text = strings.NewReplacer("d", "e", "D", "e").Replace(text)
+	}
+	var value big.Rat
+	if _, ok := value.SetString(text); !ok || !value.IsInt() || !value.Num().IsInt64() {
+		return 0, fmt.Errorf("%s is not a 64-bit integer", n)
+	}
+	return value.Num().Int64(), nil
+}
+
+// dynamoAttrs reads typed attributes of an item, and keeps the first error.
+type dynamoAttrs struct {
+	attrs map[string]any
+	err   error
+}
+
+func (a *dynamoAttrs) fail(name string, value any, want string) {
+	if a.err == nil {
+		a.err = fmt.Errorf("attribute %s: %T is not %s", name, value, want)
+	}
+}
+
+func (a *dynamoAttrs) string(name string) *string {
+	switch value := a.attrs[name].(type) {
+	case nil:
+		return nil
+	case string:
+		return &value
+	default:
+		a.fail(name, value, "a string")
+		return nil
+	}
+}
+
+func (a *dynamoAttrs) int64(name string) *int64 {
+	switch value := a.attrs[name].(type) {
+	case nil:
+		return nil
+	case dynamoNumber:
+		n, err := value.int64()
+		if err != nil && a.err == nil {
+			a.err = fmt.Errorf("attribute %s: %w", name, err)
+		}
+		return &n
+	default:
+		a.fail(name, value, "a number")
+		return nil
+	}
+}
+
+func (a *dynamoAttrs) int(name string) *int {
+	n := a.int64(name)
+	if n == nil {
+		return nil
+	}
+	value := int(*n)
+	return &value
+}
+
+func (a *dynamoAttrs) bool(name string) *bool {
+	switch value := a.attrs[name].(type) {
+	case nil:
+		return nil
+	case bool:
+		return &value
+	default:
+		a.fail(name, value, "a boolean")
+		return nil
+	}
+}
+
+func (a *dynamoAttrs) bytes(name string) []byte {
+	switch value := a.attrs[name].(type) {
+	case nil:
+		return nil
+	case []byte:
+		return value
+	default:
+		a.fail(name, value, "binary")
+		return nil
+	}
+}
+
+// dynamoItemRow translates an item of the go-sync table. The item counts
+// come back as counts, with only the key set in the entity, everything else
+// as a sync_entities row. Tag items and the disabled chain marker carry no
+// more than their times, the marker's reason has no column and is dropped.
+func dynamoItemRow(attrs map[string]any) (braveds.SyncEntity, *braveds.ClientItemCounts, error) {
+	a := &dynamoAttrs{attrs: attrs}
+	clientID := a.string("ClientID")
+	id := a.string("ID")
+	if a.err != nil {
+		return braveds.SyncEntity{}, nil, a.err
+	}
+	if clientID == nil || *clientID == "" || id == nil || *id == "" {
+		return braveds.SyncEntity{}, nil, errors.New("item without ClientID and ID, not a go-sync table export")
+	}
+	entity := braveds.SyncEntity{ClientID: *clientID, ID: *id}
+
+	if *id == *clientID {
+		value := func(name string) int64 {
+			if n := a.int64(name); n != nil {
+				return *n
+			}
+			return 0
+		}
+		counts := &braveds.ClientItemCounts{
+			ClientID:                *clientID,
+			ID:                      *id,
+			ItemCount:               int(value("ItemCount")),
+			HistoryItemCountPeriod1: int(value("HistoryItemCountPeriod1")),
+			HistoryItemCountPeriod2: int(value("HistoryItemCountPeriod2")),
+			HistoryItemCountPeriod3: int(value("HistoryItemCountPeriod3")),
+			HistoryItemCountPeriod4: int(value("HistoryItemCountPeriod4")),
+			LastPeriodChangeTime:    value("LastPeriodChangeTime"),
+			Version:                 int(value("Version")),
+		}
+		return entity, counts, a.err
+	}
+
+	entity.Mtime = a.int64("Mtime")
+	entity.Ctime = a.int64("Ctime")
+	entity.ExpirationTime = a.int64("ExpirationTime")
+	if *id == disabledChainID || strings.HasPrefix(*id, "Client#") || strings.HasPrefix(*id, "Server#") {
+		return entity, nil, a.err
+	}
+
+	entity.ParentID = a.string("ParentID")
+	entity.Version = a.int64("Version")
+	entity.Name = a.string("Name")
+	entity.NonUniqueName = a.string("NonUniqueName")
+	entity.ServerDefinedUniqueTag = a.string("ServerDefinedUniqueTag")
+	entity.Deleted = a.bool("Deleted")
+	entity.OriginatorCacheGUID = a.string("OriginatorCacheGUID")
+	entity.OriginatorClientItemID = a.string("OriginatorClientItemID")
+	entity.Specifics = a.bytes("Specifics")
+	entity.DataType = a.int("DataType")
+	entity.Folder = a.bool("Folder")
+	entity.ClientDefinedUniqueTag = a.string("ClientDefinedUniqueTag")
+	entity.UniquePosition = a.bytes("UniquePosition")
+	entity.DataTypeMtime = a.string("DataTypeMtime")
+	if a.err == nil && entity.Version == nil {
+		a.err = fmt.Errorf("entity %s has no Version", *id)
+	}
+	return entity, nil, a.err
+}
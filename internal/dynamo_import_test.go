@@ -0,0 +1,126 @@
+package internal_test
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// An S3 export of a go-sync table in DynamoDB JSON, with an entity, its
+// client tag item, a server tag item, the item counts and a disabled chain.
+const dynamoJSONExport = `{"Item":{"ClientID":{"S":"client1"},"ID":{"S":"id1"},"ParentID":{"S":"root"},"Version":{"N":"3"},"Mtime":{"N":"1700000000000"},"Ctime":{"N":"1690000000000"},"Name":{"S":"Bookmark \"one\""},"Deleted":{"BOOL":false},"Specifics":{"B":"AQID"},"DataType":{"N":"32904"},"Folder":{"BOOL":false},"ClientDefinedUniqueTag":{"S":"tag1"},"UniquePosition":{"B":"BAU="},"DataTypeMtime":{"S":"32904#1700000000000"},"ExpirationTime":{"NULL":true}}}
+{"Item":{"ClientID":{"S":"client1"},"ID":{"S":"Client#tag1"},"Mtime":{"N":"1690000000000"},"Ctime":{"N":"1690000000000"}}}
+{"Item":{"ClientID":{"S":"client1"},"ID":{"S":"Server#bookmark_bar"},"Mtime":{"N":"1690000000000"},"Ctime":{"N":"1690000000000"}}}
+{"Item":{"ClientID":{"S":"client1"},"ID":{"S":"client1"},"ItemCount":{"N":"1"},"HistoryItemCountPeriod4":{"N":"0"},"LastPeriodChangeTime":{"N":"1700000000"},"Version":{"N":"2"}}}
+{"Item":{"ClientID":{"S":"client2"},"ID":{"S":"disabled_chain"},"Reason":{"S":"deleted"},"Mtime":{"N":"1700000000000"},"Ctime":{"N":"1700000000000"}}}
+`
+
+// The same table exported as Amazon Ion.
+const dynamoIonExport = `$ion_1_0 {Item:{ClientID:"client1",ID:"id1",ParentID:"root",Version:3.,Mtime:1700000000000.,Ctime:1.69d12,Name:"Bookmark \"one\"",Deleted:false,Specifics:{{AQID}},DataType:32904.,Folder:false,ClientDefinedUniqueTag:"tag1",UniquePosition:{{ BAU= }},DataTypeMtime:"32904#1700000000000",ExpirationTime:null}}
+$ion_1_0 {Item:{ClientID:"client1",ID:"Client#tag1",Mtime:1690000000000.,Ctime:1690000000000.}}
+$ion_1_0 {Item:{ClientID:"client1",ID:"Server#bookmark_bar",Mtime:1690000000000.,Ctime:1690000000000.}}
+$ion_1_0 {Item:{ClientID:"client1",ID:"client1",ItemCount:1.,HistoryItemCountPeriod4:0.,LastPeriodChangeTime:1700000000.,Version:2.}}
+$ion_1_0 {Item:{ClientID:"client2",ID:"disabled_chain",Reason:"deleted",Mtime:1700000000000.,Ctime:1700000000000.,Tags:$dynamodb_SS::["a","b"]}}
+`
+
+func writeGzipFile(t *testing.T, path string, text string) {
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	gz := gzip.NewWriter(file)
+	_, err = gz.Write([]byte(text))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	require.NoError(t, file.Close())
+}
+
+func TestImportDynamoExport(t *testing.T) {
+	for format, text := range map[string]string{"json": dynamoJSONExport, "ion": dynamoIonExport} {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			exportDir := filepath.Join(dir, "AWSDynamoDB", "01700000000000-abcdef")
+			require.NoError(t, os.MkdirAll(filepath.Join(exportDir, "data"), 0o700))
+			require.NoError(t, os.WriteFile(filepath.Join(exportDir, "manifest-summary.json"), []byte(`{"version":"2020-06-30"}`), 0o600))
+			writeGzipFile(t, filepath.Join(exportDir, "data", "abcdef."+format+".gz"), text)
+
+			cfg := internal.StoreConfig{
+				Backend:    internal.BackendSqlite,
+				SqlitePath: filepath.Join(dir, "litesync.sqlite"),
+				Sqlite:     internal.DefaultSqliteOptions(),
+			}
+			result, err := internal.ImportDynamoExport(cfg, []string{dir}, false)
+			require.NoError(t, err)
+			assert.Equal(t, internal.DynamoImportResult{
+				Chains: 2, Entities: 1, TagItems: 2, DisabledChains: 1, ItemCounts: 1,
+			}, result)
+
+			ds, err := internal.NewSqliteDatastore(cfg.SqlitePath)
+			require.NoError(t, err)
+			defer ds.Close()
+
+			_, entities, err := ds.GetUpdatesForType(32904, 0, true, "client1", 100)
+			require.NoError(t, err)
+			require.Len(t, entities, 1)
+			entity := entities[0]
+			assert.Equal(t, "id1", entity.ID)
+			assert.Equal(t, "root", *entity.ParentID)
+			assert.Equal(t, int64(3), *entity.Version)
+			assert.Equal(t, int64(1700000000000), *entity.Mtime)
+			assert.Equal(t, int64(1690000000000), *entity.Ctime)
+			assert.Equal(t, `Bookmark "one"`, *entity.Name)
+			assert.Equal(t, []byte{1, 2, 3}, entity.Specifics)
+			assert.Equal(t, []byte{4, 5}, entity.UniquePosition)
+			assert.Equal(t, "32904#1700000000000", *entity.DataTypeMtime)
+			assert.Nil(t, entity.ExpirationTime)
+
+			has, err := ds.HasServerDefinedUniqueTag("client1", "bookmark_bar")
+			require.NoError(t, err)
+			assert.True(t, has)
+			has, err = ds.HasItem("client1", "Client#tag1")
+			require.NoError(t, err)
+			assert.True(t, has)
+			counts, err := ds.GetClientItemCount("client1")
+			require.NoError(t, err)
+			assert.Equal(t, 1, counts.ItemCount)
+			disabled, err := ds.IsSyncChainDisabled("client2")
+			require.NoError(t, err)
+			assert.True(t, disabled)
+
+			// A second run leaves the chains alone unless told to replace them.
+			result, err = internal.ImportDynamoExport(cfg, []string{dir}, false)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"client1", "client2"}, result.Skipped)
+			result, err = internal.ImportDynamoExport(cfg, []string{dir}, true)
+			require.NoError(t, err)
+			assert.Equal(t, 2, result.Chains)
+			assert.Empty(t, result.Skipped)
+		})
+	}
+}
+
+func TestImportDynamoExportRejectsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	cfg := internal.StoreConfig{
+		Backend:    internal.BackendSqlite,
+		SqlitePath: filepath.Join(dir, "litesync.sqlite"),
+		Sqlite:     internal.DefaultSqliteOptions(),
+	}
+	for name, text := range map[string]string{
+		"no key":       `{"Item":{"pk":{"S":"x"}}}`,
+		"no version":   `{"Item":{"ClientID":{"S":"c"},"ID":{"S":"id1"}}}`,
+		"wrong type":   `{Item:{ClientID:"c",ID:"id1",Version:"1"}}`,
+		"fraction":     `{Item:{ClientID:"c",ID:"id1",Version:1.5}}`,
+		"duplicate":    `{Item:{ClientID:"c",ID:"Client#t"}} {Item:{ClientID:"c",ID:"Client#t"}}`,
+		"broken ion":   `{Item:{ClientID:"c",ID:`,
+		"comma in ion": `{Item:{ClientID:"c" ID:"id1"}}`,
+	} {
+		path := filepath.Join(dir, "export.json")
+		require.NoError(t, os.WriteFile(path, []byte(text), 0o600))
+		_, err := internal.ImportDynamoExport(cfg, []string{path}, false)
+		assert.Error(t, err, name)
+	}
+}
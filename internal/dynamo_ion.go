@@ -0,0 +1,372 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ionReader reads the subset of Amazon Ion text which DynamoDB table exports
+// are written in: structs, lists, strings, symbols, blobs, booleans, nulls
+// and numbers, with annotations such as $dynamodb_SS:: skipped. Numbers are
+// returned as dynamoNumber, strings and symbols as string, blobs as []byte,
+// structs as map[string]any and lists as []any.
+type ionReader struct {
+	r *bufio.Reader
+}
+
+func newIonReader(r *bufio.Reader) *ionReader {
+	return &ionReader{r: r}
+}
+
+// next returns the next top level value, io.EOF after the last one.
+func (p *ionReader) next() (any, error) {
+	for {
+		if err := p.skipSpace(); err != nil {
+			return nil, err
+		}
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		// Version markers, $ion_1_0, sit between the values.
+		if symbol, ok := value.(string); ok && strings.HasPrefix(symbol, "$ion_") {
+			continue
+		}
+		return value, nil
+	}
+}
+
+func (p *ionReader) skipSpace() error {
+	for {
+		c, err := p.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch c {
+		case ' ', '\t', '\n', '\r', '\v', '\f':
+			continue
+		case '/':
+			next, err := p.r.Peek(1)
+			if err != nil || (next[0] != '/' && next[0] != '*') {
+				return fmt.Errorf("ion: unexpected '/'")
+			}
+			p.r.ReadByte()
+			if next[0] == '/' {
+				if _, err = p.r.ReadString('\n'); err != nil {
+					return err
+				}
+				continue
+			}
+			if err = p.skipBlockComment(); err != nil {
+				return err
+			}
+			continue
+		}
+		return p.r.UnreadByte()
+	}
+}
+
+func (p *ionReader) skipBlockComment() error {
+	for {
+		if _, err := p.r.ReadString('*'); err != nil {
+			return unexpectedEOF(err)
+		}
+		if next, err := p.r.Peek(1); err == nil && next[0] == '/' {
+			p.r.ReadByte()
+			return nil
+		}
+	}
+}
+
+func (p *ionReader) value() (any, error) {
+	c, err := p.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c == '{':
+		if next, err := p.r.Peek(1); err == nil && next[0] == '{' {
+			p.r.ReadByte()
+			return p.blob()
+		}
+		return p.structValue()
+	case c == '[':
+		return p.list()
+	case c == '"':
+		return p.quoted('"')
+	case c == '\'':
+		if next, err := p.r.Peek(2); err == nil && string(next) == "''" {
+			return nil, errors.New("ion: long strings are not supported")
+		}
+		symbol, err := p.quoted('\'')
+		if err != nil {
+			return nil, err
+		}
+		return p.annotated(symbol)
+	case c == '-' || c == '+' || (c >= '0' && c <= '9'):
+		p.r.UnreadByte()
+		return p.number()
+	case isIonIdentifierStart(c):
+		p.r.UnreadByte()
+		return p.identifier()
+	}
+	return nil, fmt.Errorf("ion: unexpected %q", c)
+}
+
+// annotated skips the annotation symbol when it is followed by "::", or
+// returns it as a symbol value when it is not.
+func (p *ionReader) annotated(symbol string) (any, error) {
+	if err := p.skipSpace(); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if next, err := p.r.Peek(2); err == nil && string(next) == "::" {
+		p.r.Discard(2)
+		if err = p.skipSpace(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return p.value()
+	}
+	return symbol, nil
+}
+
+func (p *ionReader) identifier() (any, error) {
+	var b strings.Builder
+	for {
+		c, err := p.r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// null.string and the other typed nulls.
+		if !isIonIdentifierPart(c) && !(c == '.' && b.String() == "null") {
+			p.r.UnreadByte()
+			break
+		}
+		b.WriteByte(c)
+	}
+
+	symbol := b.String()
+	switch {
+	case symbol == "true":
+		return true, nil
+	case symbol == "false":
+		return false, nil
+	case symbol == "null" || strings.HasPrefix(symbol, "null."):
+		return nil, nil
+	}
+	return p.annotated(symbol)
+}
+
+func (p *ionReader) number() (any, error) {
+	var b strings.Builder
+	for {
+		c, err := p.r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !isIonIdentifierPart(c) && c != '.' && c != '-' && c != '+' {
+			p.r.UnreadByte()
+			break
+		}
+		b.WriteByte(c)
+	}
+	return dynamoNumber(b.String()), nil
+}
+
+func (p *ionReader) blob() (any, error) {
+	text, err := p.r.ReadString('}')
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if c, err := p.r.ReadByte(); err != nil || c != '}' {
+		return nil, errors.New("ion: blob not closed by }}")
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(strings.TrimSuffix(text, "}")), ""))
+	if err != nil {
+		return nil, fmt.Errorf("ion: blob: %w", err)
+	}
+	return data, nil
+}
+
+func (p *ionReader) structValue() (any, error) {
+	fields := map[string]any{}
+	for {
+		if err := p.skipSpace(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		c, err := p.r.ReadByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if c == '}' {
+			return fields, nil
+		}
+
+		var name string
+		switch {
+		case c == '"' || c == '\'':
+			name, err = p.quoted(c)
+		case isIonIdentifierStart(c):
+			p.r.UnreadByte()
+			name, err = p.fieldName()
+		default:
+			err = fmt.Errorf("ion: unexpected %q in struct", c)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if err = p.skipSpace(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if c, err = p.r.ReadByte(); err != nil || c != ':' {
+			return nil, fmt.Errorf("ion: expected ':' after field %s", name)
+		}
+		if err = p.skipSpace(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if fields[name], err = p.value(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if err = p.endOfElement('}'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *ionReader) fieldName() (string, error) {
+	var b strings.Builder
+	for {
+		c, err := p.r.ReadByte()
+		if err != nil {
+			return "", unexpectedEOF(err)
+		}
+		if !isIonIdentifierPart(c) {
+			p.r.UnreadByte()
+			return b.String(), nil
+		}
+		b.WriteByte(c)
+	}
+}
+
+func (p *ionReader) list() (any, error) {
+	values := []any{}
+	for {
+		if err := p.skipSpace(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if next, err := p.r.Peek(1); err == nil && next[0] == ']' {
+			p.r.ReadByte()
+			return values, nil
+		}
+		value, err := p.value()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		values = append(values, value)
+		if err = p.endOfElement(']'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// endOfElement consumes the comma after a struct field or list element, and
+// leaves the closing bracket to the caller.
+func (p *ionReader) endOfElement(closing byte) error {
+	if err := p.skipSpace(); err != nil {
+		return unexpectedEOF(err)
+	}
+	c, err := p.r.ReadByte()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if c == closing {
+		return p.r.UnreadByte()
+	}
+	if c != ',' {
+		return fmt.Errorf("ion: expected ',' or %q, got %q", closing, c)
+	}
+	return nil
+}
+
+// quoted reads a string or quoted symbol up to the closing quote.
+func (p *ionReader) quoted(quote byte) (string, error) {
+	var b strings.Builder
+	for {
+		c, err := p.r.ReadByte()
+		if err != nil {
+			return "", unexpectedEOF(err)
+		}
+		if c == quote {
+			return b.String(), nil
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+
+		if c, err = p.r.ReadByte(); err != nil {
+			return "", unexpectedEOF(err)
+		}
+		switch c {
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'f':
+			b.WriteByte('\f')
+		case 'r':
+			b.WriteByte('\r')
+		case 'v':
+			b.WriteByte('\v')
+		case '0':
+			b.WriteByte(0)
+		case '\n':
+			// An escaped newline continues the string on the next line.
+		case 'x', 'u', 'U':
+			digits := map[byte]int{'x': 2, 'u': 4, 'U': 8}[c]
+			hex := make([]byte, digits)
+			if _, err = io.ReadFull(p.r, hex); err != nil {
+				return "", unexpectedEOF(err)
+			}
+			code, err := strconv.ParseUint(string(hex), 16, 32)
+			if err != nil || !utf8.ValidRune(rune(code)) {
+				return "", fmt.Errorf("ion: invalid escape \\%c%s", c, hex)
+			}
+			b.WriteRune(rune(code))
+		default:
+			// \" \' \\ \/ \? stand for themselves.
+			b.WriteByte(c)
+		}
+	}
+}
+
+func isIonIdentifierStart(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIonIdentifierPart(c byte) bool {
+	return isIonIdentifierStart(c) || (c >= '0' && c <= '9')
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,342 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	braveds "github.com/brave/go-sync/datastore"
+)
+
+// EncryptionKeysEnv holds keys in the key file format, for deployments which
+// hand secrets to the process through the environment.
+const EncryptionKeysEnv = "LITESYNC_ENCRYPTION_KEYS"
+
+const encryptionKeySize = 32 // AES-256
+
+// EncryptionKeys seals the specifics, name, non_unique_name and
+// originator_cache_guid of entities with AES-GCM before they are stored.
+// Every row records the ID of the key which sealed it.
+//
+// The first key seals new rows and any key opens the rows it sealed, so a key
+// is rotated by putting the new one first. Rows move to it as they are
+// updated or by ReencryptEntities, after which the old key can be dropped.
+type EncryptionKeys struct {
+	currentID string
+	aeads     map[string]cipher.AEAD
+}
+
+// LoadEncryptionKeys reads a key file, see ParseEncryptionKeys.
+func LoadEncryptionKeys(path string) (*EncryptionKeys, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ParseEncryptionKeys(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// ParseEncryptionKeys reads one key per line as "<id>:<base64 of 32 bytes>".
+// Blank lines and lines starting with # are skipped.
+func ParseEncryptionKeys(text string) (*EncryptionKeys, error) {
+	keys := &EncryptionKeys{aeads: map[string]cipher.AEAD{}}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("line %d: expected <id>:<base64 key>", line)
+		}
+		if _, dup := keys.aeads[id]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key ID %q", line, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if len(key) != encryptionKeySize {
+			return nil, fmt.Errorf("line %d: key %q is %d bytes, expected %d", line, id, len(key), encryptionKeySize)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if keys.currentID == "" {
+			keys.currentID = id
+		}
+		keys.aeads[id] = aead
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if keys.currentID == "" {
+		return nil, errors.New("no encryption keys")
+	}
+	return keys, nil
+}
+
+// CurrentID returns the ID of the key which seals new rows.
+func (k *EncryptionKeys) CurrentID() string {
+	return k.currentID
+}
+
+// rowKeyID is the key_id stored with rows sealed now, nil when encryption is
+// off and rows are stored in the clear.
+func (k *EncryptionKeys) rowKeyID() *string {
+	if k == nil {
+		return nil
+	}
+	id := k.currentID
+	return &id
+}
+
+// The sealed fields are bound to their row and column, so that a value can
+// not be copied into another entity's row and still open.
+func sealedFieldAAD(clientID, id, column string) []byte {
+	return []byte(clientID + "\x00" + id + "\x00" + column)
+}
+
+func (k *EncryptionKeys) seal(keyID string, aad, plaintext []byte) ([]byte, error) {
+	aead := k.aeads[keyID]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func (k *EncryptionKeys) open(keyID string, aad, sealed []byte) ([]byte, error) {
+	if k == nil {
+		return nil, fmt.Errorf("row is encrypted with key %q and encryption is not configured", keyID)
+	}
+	aead, ok := k.aeads[keyID]
+	if !ok {
+		return nil, fmt.Errorf("row is encrypted with unknown key %q", keyID)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted value is truncated")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	// Keep an empty value apart from a NULL one.
+	return aead.Open([]byte{}, nonce, ciphertext, aad)
+}
+
+// sealEntity returns a copy of entity with its encrypted fields sealed by the
+// current key, and the key ID to store with it. Text columns hold the sealed
+// value base64 encoded. Without keys entity is returned as it is.
+func (k *EncryptionKeys) sealEntity(entity *braveds.SyncEntity) (*braveds.SyncEntity, *string, error) {
+	keyID := k.rowKeyID()
+	if keyID == nil {
+		return entity, nil, nil
+	}
+
+	sealed := *entity
+	var err error
+	sealString := func(column string, value *string) *string {
+		if value == nil || err != nil {
+			return value
+		}
+		var out []byte
+		out, err = k.seal(*keyID, sealedFieldAAD(entity.ClientID, entity.ID, column), []byte(*value))
+		encoded := base64.StdEncoding.EncodeToString(out)
+		return &encoded
+	}
+	sealed.Name = sealString("name", entity.Name)
+	sealed.NonUniqueName = sealString("non_unique_name", entity.NonUniqueName)
+	sealed.OriginatorCacheGUID = sealString("originator_cache_guid", entity.OriginatorCacheGUID)
+	if err == nil {
+		sealed.Specifics, err = k.sealSpecifics(keyID, entity.ClientID, entity.ID, entity.Specifics)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("encrypting entity %s: %w", entity.ID, err)
+	}
+	return &sealed, keyID, nil
+}
+
+// openEntity replaces the encrypted fields of entity, read from a row stored
+// with keyID, by their plaintext.
+func (k *EncryptionKeys) openEntity(entity *braveds.SyncEntity, keyID *string) error {
+	if keyID == nil {
+		return nil
+	}
+
+	var err error
+	openString := func(column string, value *string) *string {
+		if value == nil || err != nil {
+			return value
+		}
+		var sealed, out []byte
+		if sealed, err = base64.StdEncoding.DecodeString(*value); err != nil {
+			return nil
+		}
+		out, err = k.open(*keyID, sealedFieldAAD(entity.ClientID, entity.ID, column), sealed)
+		plaintext := string(out)
+		return &plaintext
+	}
+	entity.Name = openString("name", entity.Name)
+	entity.NonUniqueName = openString("non_unique_name", entity.NonUniqueName)
+	entity.OriginatorCacheGUID = openString("originator_cache_guid", entity.OriginatorCacheGUID)
+	if err == nil {
+		entity.Specifics, err = k.openSpecifics(keyID, entity.ClientID, entity.ID, entity.Specifics)
+	}
+	if err != nil {
+		return fmt.Errorf("decrypting entity %s: %w", entity.ID, err)
+	}
+	return nil
+}
+
+// sealSpecifics seals the specifics of a row stored with keyID, they are
+// left as they are when keyID is nil.
+func (k *EncryptionKeys) sealSpecifics(keyID *string, clientID, id string, specifics []byte) ([]byte, error) {
+	if keyID == nil || specifics == nil {
+		return specifics, nil
+	}
+	return k.seal(*keyID, sealedFieldAAD(clientID, id, "specifics"), specifics)
+}
+
+// openSpecifics undoes sealSpecifics.
+func (k *EncryptionKeys) openSpecifics(keyID *string, clientID, id string, specifics []byte) ([]byte, error) {
+	if keyID == nil || specifics == nil {
+		return specifics, nil
+	}
+	return k.open(*keyID, sealedFieldAAD(clientID, id, "specifics"), specifics)
+}
+
+func sameKeyID(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+const selectResealEntitiesQuery = `
+SELECT client_id, id, key_id, name, non_unique_name, originator_cache_guid, specifics
+FROM sync_entities
+WHERE version IS NOT NULL AND key_id IS NOT ?
+LIMIT ?
+`
+
+const resealEntityQuery = `
+UPDATE sync_entities
+SET name = ?, non_unique_name = ?, originator_cache_guid = ?, specifics = ?, key_id = ?
+WHERE client_id = ? AND id = ?
+`
+
+// ReencryptEntities seals up to limit entities which are not sealed by the
+// current key with it, and returns how many it rewrote. After a key rotation
+// it is run until it returns 0, the old key is then no longer used. Rows
+// keep their mtime, clients do not fetch them again.
+func (d *SqliteDatastore) ReencryptEntities(limit int) (int, error) {
+	fail := func(err error) (int, error) {
+		return 0, fmt.Errorf("ReencryptEntities: %w", classifySqliteError(err))
+	}
+
+	tx, err := d.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+
+	type storedEntity struct {
+		entity braveds.SyncEntity
+		keyID  *string
+	}
+	rows, err := tx.Query(selectResealEntitiesQuery, d.keys.rowKeyID(), limit)
+	if err != nil {
+		return fail(err)
+	}
+	defer rows.Close()
+	var stale []storedEntity
+	for rows.Next() {
+		var s storedEntity
+		err = rows.Scan(&s.entity.ClientID, &s.entity.ID, &s.keyID,
+			&s.entity.Name, &s.entity.NonUniqueName, &s.entity.OriginatorCacheGUID, &s.entity.Specifics)
+		if err != nil {
+			return fail(err)
+		}
+		stale = append(stale, s)
+	}
+	if err = rows.Err(); err != nil {
+		return fail(err)
+	}
+	rows.Close()
+
+	for _, s := range stale {
+		if err = d.keys.openEntity(&s.entity, s.keyID); err != nil {
+			return fail(err)
+		}
+		sealed, keyID, err := d.keys.sealEntity(&s.entity)
+		if err != nil {
+			return fail(err)
+		}
+		_, err = tx.Exec(resealEntityQuery,
+			sealed.Name, sealed.NonUniqueName, sealed.OriginatorCacheGUID, sealed.Specifics, keyID,
+			s.entity.ClientID, s.entity.ID)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+	return len(stale), nil
+}
+
+type entityReencrypter interface {
+	ReencryptEntities(limit int) (int, error)
+}
+
+// ReencryptStore reseals every entity of the store of cfg with its current
+// key, batchSize entities per transaction, and returns how many it rewrote.
+// progress, when set, is called with the running total after each batch.
+// Once it is done the other keys can be dropped.
+func ReencryptStore(cfg StoreConfig, batchSize int, progress func(resealed int)) (int, error) {
+	if cfg.Sqlite.EncryptionKeys == nil {
+		return 0, errors.New("no encryption keys given")
+	}
+	if batchSize <= 0 {
+		return 0, errors.New("batch size must be positive")
+	}
+	store, err := openStore(cfg)
+	if err != nil {
+		return 0, err
+	}
+	defer store.Close()
+
+	reencrypter, ok := store.(entityReencrypter)
+	if !ok {
+		return 0, fmt.Errorf("the %s backend does not encrypt entities", cfg.Backend)
+	}
+	total := 0
+	for {
+		resealed, err := reencrypter.ReencryptEntities(batchSize)
+		total += resealed
+		if err != nil {
+			return total, err
+		}
+		if resealed == 0 {
+			return total, nil
+		}
+		if progress != nil {
+			progress(total)
+		}
+	}
+}
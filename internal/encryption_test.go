@@ -0,0 +1,194 @@
+package internal_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encryptionKeyLine(t *testing.T, id string) string {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return id + ":" + base64.StdEncoding.EncodeToString(key) + "\n"
+}
+
+func openEncryptedDatastore(t *testing.T, path string, keyText string) *internal.SqliteDatastore {
+	opts := internal.DefaultSqliteOptions()
+	if keyText != "" {
+		keys, err := internal.ParseEncryptionKeys(keyText)
+		require.NoError(t, err)
+		opts.EncryptionKeys = keys
+	}
+	ds, err := internal.NewSqliteDatastoreWithOptions(path, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { ds.Close() })
+	return ds
+}
+
+func encryptedTestEntity(id string) *datastore.SyncEntity {
+	return &datastore.SyncEntity{
+		ClientID:            "client",
+		ID:                  id,
+		Version:             aws.Int64(1),
+		Mtime:               aws.Int64(1),
+		Name:                aws.String("secret name " + id),
+		NonUniqueName:       aws.String("secret non unique name"),
+		OriginatorCacheGUID: aws.String("secret cache guid"),
+		Specifics:           []byte("secret specifics"),
+		DataType:            aws.Int(123),
+		Folder:              aws.Bool(false),
+	}
+}
+
+func TestEncryptedEntitiesRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "litesync.sqlite")
+	ds := openEncryptedDatastore(t, path, encryptionKeyLine(t, "k1"))
+
+	_, err := ds.InsertSyncEntity(encryptedTestEntity("id1"))
+	require.NoError(t, err)
+
+	var keyID string
+	var name, specifics []byte
+	err = ds.Db.QueryRow("SELECT key_id, name, specifics FROM sync_entities WHERE id = 'id1'").
+		Scan(&keyID, &name, &specifics)
+	require.NoError(t, err)
+	assert.Equal(t, "k1", keyID)
+	assert.NotContains(t, string(name), "secret")
+	assert.False(t, bytes.Contains(specifics, []byte("secret")))
+
+	update := encryptedTestEntity("id1")
+	update.Version = aws.Int64(2)
+	update.Mtime = aws.Int64(2)
+	update.Name = nil // keeps the stored name
+	update.Specifics = []byte("new specifics")
+	conflict, _, err := ds.UpdateSyncEntity(update, 1)
+	require.NoError(t, err)
+	assert.False(t, conflict)
+
+	_, entities, err := ds.GetUpdatesForType(123, 0, true, "client", 10)
+	require.NoError(t, err)
+	require.Len(t, entities, 1)
+	assert.Equal(t, "secret name id1", *entities[0].Name)
+	assert.Equal(t, "secret cache guid", *entities[0].OriginatorCacheGUID)
+	assert.Equal(t, []byte("new specifics"), entities[0].Specifics)
+
+	// A sealed value moved to another row does not open.
+	_, err = ds.InsertSyncEntity(encryptedTestEntity("id2"))
+	require.NoError(t, err)
+	_, err = ds.Db.Exec("UPDATE sync_entities SET specifics = (SELECT specifics FROM sync_entities WHERE id = 'id1') WHERE id = 'id2'")
+	require.NoError(t, err)
+	_, _, err = ds.GetUpdatesForType(123, 0, true, "client", 10)
+	assert.Error(t, err)
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "litesync.sqlite")
+	oldKey, newKey := encryptionKeyLine(t, "old"), encryptionKeyLine(t, "new")
+
+	// Rows written in the clear and with the old key.
+	plain := openEncryptedDatastore(t, path, "")
+	_, err := plain.InsertSyncEntity(encryptedTestEntity("clear"))
+	require.NoError(t, err)
+	require.NoError(t, plain.Close())
+	old := openEncryptedDatastore(t, path, oldKey)
+	_, err = old.InsertSyncEntity(encryptedTestEntity("id1"))
+	require.NoError(t, err)
+	_, err = old.InsertSyncEntity(encryptedTestEntity("id2"))
+	require.NoError(t, err)
+	require.NoError(t, old.Close())
+
+	ds := openEncryptedDatastore(t, path, newKey+oldKey)
+
+	// An update reseals the fields it keeps as well.
+	update := encryptedTestEntity("id1")
+	update.Version = aws.Int64(2)
+	update.Name = nil
+	_, _, err = ds.UpdateSyncEntity(update, 1)
+	require.NoError(t, err)
+
+	resealed, err := ds.ReencryptEntities(10)
+	require.NoError(t, err)
+	assert.Equal(t, 2, resealed)
+	resealed, err = ds.ReencryptEntities(10)
+	require.NoError(t, err)
+	assert.Equal(t, 0, resealed)
+	require.NoError(t, ds.Close())
+
+	ds = openEncryptedDatastore(t, path, newKey)
+	_, entities, err := ds.GetUpdatesForType(123, 0, true, "client", 10)
+	require.NoError(t, err)
+	require.Len(t, entities, 3)
+	for _, entity := range entities {
+		assert.Equal(t, "secret name "+entity.ID, *entity.Name)
+		assert.Equal(t, "secret cache guid", *entity.OriginatorCacheGUID)
+		assert.Equal(t, []byte("secret specifics"), entity.Specifics)
+	}
+
+	// Without the key the rows can not be read.
+	require.NoError(t, ds.Close())
+	ds = openEncryptedDatastore(t, path, "")
+	_, _, err = ds.GetUpdatesForType(123, 0, true, "client", 10)
+	assert.Error(t, err)
+}
+
+func TestParseEncryptionKeys(t *testing.T) {
+	keys, err := internal.ParseEncryptionKeys("# rotated 2024\n\n" + encryptionKeyLine(t, "b") + encryptionKeyLine(t, "a"))
+	require.NoError(t, err)
+	assert.Equal(t, "b", keys.CurrentID())
+
+	for _, text := range []string{
+		"",
+		"no-separator",
+		"short:" + base64.StdEncoding.EncodeToString([]byte("16 bytes is AES1")),
+		"bad:not base64!",
+		encryptionKeyLine(t, "dup") + encryptionKeyLine(t, "dup"),
+	} {
+		_, err := internal.ParseEncryptionKeys(text)
+		assert.Error(t, err, text)
+	}
+}
+
+func TestReencryptStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "litesync.sqlite")
+	oldKey, newKey := encryptionKeyLine(t, "old"), encryptionKeyLine(t, "new")
+
+	old := openEncryptedDatastore(t, path, oldKey)
+	for _, id := range []string{"id1", "id2", "id3"} {
+		_, err := old.InsertSyncEntity(encryptedTestEntity(id))
+		require.NoError(t, err)
+	}
+	require.NoError(t, old.Close())
+
+	cfg := internal.StoreConfig{Backend: internal.BackendSqlite, SqlitePath: path, Sqlite: internal.DefaultSqliteOptions()}
+	_, err := internal.ReencryptStore(cfg, 2, nil)
+	assert.Error(t, err, "no keys to reseal with")
+
+	keys, err := internal.ParseEncryptionKeys(newKey + oldKey)
+	require.NoError(t, err)
+	cfg.Sqlite.EncryptionKeys = keys
+	var progress []int
+	resealed, err := internal.ReencryptStore(cfg, 2, func(resealed int) { progress = append(progress, resealed) })
+	require.NoError(t, err)
+	assert.Equal(t, 3, resealed)
+	assert.Equal(t, []int{2, 3}, progress)
+
+	// The old key is no longer needed.
+	ds := openEncryptedDatastore(t, path, newKey)
+	_, entities, err := ds.GetUpdatesForType(123, 0, true, "client", 10)
+	require.NoError(t, err)
+	require.Len(t, entities, 3)
+	for _, entity := range entities {
+		assert.Equal(t, "secret name "+entity.ID, *entity.Name)
+		assert.Equal(t, "secret cache guid", *entity.OriginatorCacheGUID)
+		assert.Equal(t, []byte("secret specifics"), entity.Specifics)
+	}
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Expired rows are deleted through their rowid, so that a batch can be
+// bounded with LIMIT without the optional SQLITE_ENABLE_UPDATE_DELETE_LIMIT.
+const deleteExpiredEntitiesQuery = `
+DELETE FROM sync_entities
+WHERE rowid IN (
+    SELECT rowid FROM sync_entities
+    WHERE expiration_time IS NOT NULL AND expiration_time <= ?
+    LIMIT ?
+)
+RETURNING client_id, data_type, version, deleted, client_defined_unique_tag
+`
+
+// DeleteExpiredEntities deletes up to limit entities whose expiration time
+// is at or before now, together with the client tag items of the live ones,
+// and returns how many entities were deleted per client. A tombstone's tag
+// was freed by its delete, and may belong to a newer entity by now.
+//
+// Live entities of normal types are taken off the client's item count.
+// History entities are not, their counts already age out with the history
+// count periods in GetClientItemCount.
+func (d *SqliteDatastore) DeleteExpiredEntities(now int64, limit int) (map[string]int, error) {
+	fail := func(err error) (map[string]int, error) {
+		return nil, fmt.Errorf("DeleteExpiredEntities: %w", classifySqliteError(err))
+	}
+
+	tx, err := d.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(deleteExpiredEntitiesQuery, now, limit)
+	if err != nil {
+		return fail(err)
+	}
+	defer rows.Close()
+
+	deleted := map[string]int{}
+	liveNormalItems := map[string]int{}
+	var clientTags [][2]string
+	for rows.Next() {
+		var clientID string
+		var dataType *int
+		var version *int64
+		var wasDeleted *bool
+		var clientTag *string
+		if err := rows.Scan(&clientID, &dataType, &version, &wasDeleted, &clientTag); err != nil {
+			return fail(err)
+		}
+		deleted[clientID]++
+		if version == nil || (wasDeleted != nil && *wasDeleted) {
+			continue
+		}
+		if !isHistoryDataType(dataType) {
+			liveNormalItems[clientID]++
+		}
+		if clientTag != nil {
+			clientTags = append(clientTags, [2]string{clientID, "Client#" + *clientTag})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fail(err)
+	}
+	rows.Close()
+
+	for _, tag := range clientTags {
+		if _, err = tx.Exec("DELETE FROM sync_entities WHERE client_id = ? AND id = ?", tag[0], tag[1]); err != nil {
+			return fail(err)
+		}
+	}
+	for clientID, count := range liveNormalItems {
+		_, err = tx.Exec("UPDATE client_item_counts SET item_count = MAX(item_count - ?, 0) WHERE client_id = ?",
+			count, clientID)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+	return deleted, nil
+}
+
+// expiredEntityDeleter is implemented by the datastores.
+type expiredEntityDeleter interface {
+	DeleteExpiredEntities(now int64, limit int) (map[string]int, error)
+}
+
+// ExpirationReaper periodically deletes expired entities, mostly history,
+// which would otherwise grow the database forever.
+type ExpirationReaper struct {
+	store     expiredEntityDeleter
+	logger    *zerolog.Logger
+	interval  time.Duration
+	batchSize int
+}
+
+func NewExpirationReaper(store expiredEntityDeleter, logger *zerolog.Logger, interval time.Duration, batchSize int) *ExpirationReaper {
+	return &ExpirationReaper{
+		store:     store,
+		logger:    logger,
+		interval:  interval,
+		batchSize: batchSize,
+	}
+}
+
+// Run reaps once right away and then every interval, until ctx is done.
+func (r *ExpirationReaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		r.reap(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reap deletes batches until a batch comes back short. Each batch is its own
+// transaction, so commits are never blocked for long.
+func (r *ExpirationReaper) reap(ctx context.Context) {
+	now := time.Now().Unix()
+	total := 0
+	clients := map[string]int{}
+
+	for ctx.Err() == nil {
+		deleted, err := r.store.DeleteExpiredEntities(now, r.batchSize)
+		if err != nil {
+			r.logger.Error().Err(err).Msg("Failed to delete expired entities")
+			return
+		}
+		batch := 0
+		for clientID, count := range deleted {
+			clients[clientID] += count
+			batch += count
+		}
+		total += batch
+		if batch < r.batchSize {
+			break
+		}
+	}
+
+	if total > 0 {
+		r.logger.Info().Int("deleted", total).Int("clients", len(clients)).Msg("Deleted expired entities")
+	}
+}
@@ -0,0 +1,160 @@
+package internal_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteExpiredEntities(t *testing.T) {
+	ds, err := internal.NewSqliteDatastore(":memory:")
+	require.NoError(t, err)
+
+	now := time.Now().Unix()
+	entity := datastore.SyncEntity{
+		ClientID:       "client1",
+		ID:             "id1",
+		Version:        aws.Int64(1),
+		Mtime:          aws.Int64(12345678),
+		DataType:       aws.Int(123),
+		Deleted:        aws.Bool(false),
+		ExpirationTime: aws.Int64(now - 10),
+	}
+	history := entity
+	history.ID = "history1"
+	history.DataType = aws.Int(963985)
+	history.ClientDefinedUniqueTag = aws.String("history1")
+	live := entity
+	live.ID = "id2"
+	live.ExpirationTime = aws.Int64(now + 300)
+	for _, e := range []datastore.SyncEntity{entity, history, live} {
+		_, err = ds.InsertSyncEntity(&e)
+		require.NoError(t, err)
+	}
+
+	counts, err := ds.GetClientItemCount("client1")
+	require.NoError(t, err)
+	require.NoError(t, ds.UpdateClientItemCount(counts, 2, 1))
+
+	// Batches are bounded.
+	deleted, err := ds.DeleteExpiredEntities(now, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"client1": 1}, deleted)
+
+	deleted, err = ds.DeleteExpiredEntities(now, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"client1": 1}, deleted)
+
+	deleted, err = ds.DeleteExpiredEntities(now, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, deleted)
+
+	for id, expected := range map[string]bool{"id1": false, "history1": false, "Client#history1": false, "id2": true} {
+		has, err := ds.HasItem("client1", id)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, has, id)
+	}
+
+	// Only the normal entity comes off the item count.
+	counts, err = ds.GetClientItemCount("client1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, counts.ItemCount)
+	assert.Equal(t, 1, counts.SumHistoryCounts())
+}
+
+func TestDeleteExpiredEntitiesKeepsReusedTags(t *testing.T) {
+	ds, err := internal.NewSqliteDatastore(":memory:")
+	require.NoError(t, err)
+	checkReapKeepsReusedTag(t, ds)
+}
+
+// checkReapKeepsReusedTag deletes a tagged entity, gives its tag to a new
+// one, and reaps the old tombstone, which must leave the new tag item be.
+func checkReapKeepsReusedTag(t *testing.T, ds interface {
+	datastore.Datastore
+	DeleteExpiredEntities(now int64, limit int) (map[string]int, error)
+}) {
+	t.Helper()
+	now := time.Now().Unix()
+	entity := &datastore.SyncEntity{
+		ClientID:               "client1",
+		ID:                     "id1",
+		Version:                aws.Int64(1),
+		Mtime:                  aws.Int64(12345678),
+		DataType:               aws.Int(123),
+		Deleted:                aws.Bool(false),
+		ClientDefinedUniqueTag: aws.String("tag1"),
+	}
+	_, err := ds.InsertSyncEntity(entity)
+	require.NoError(t, err)
+	deleting := *entity
+	deleting.Version = aws.Int64(2)
+	deleting.Deleted = aws.Bool(true)
+	deleting.ExpirationTime = aws.Int64(now - 10)
+	_, deleted, err := ds.UpdateSyncEntity(&deleting, 1)
+	require.NoError(t, err)
+	require.True(t, deleted)
+
+	reused := *entity
+	reused.ID = "id2"
+	_, err = ds.InsertSyncEntity(&reused)
+	require.NoError(t, err)
+
+	reaped, err := ds.DeleteExpiredEntities(now, 10)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"client1": 1}, reaped)
+	has, err := ds.HasItem("client1", "Client#tag1")
+	require.NoError(t, err)
+	assert.True(t, has, "the tag item of the new entity")
+
+	duplicate := *entity
+	duplicate.ID = "id3"
+	conflict, err := ds.InsertSyncEntity(&duplicate)
+	assert.True(t, conflict)
+	assert.ErrorIs(t, err, internal.ErrConflict)
+}
+
+func TestExpirationReaperStops(t *testing.T) {
+	// A file, since every connection to :memory: gets its own database and
+	// the reaper runs concurrently with the test.
+	ds, err := internal.NewSqliteDatastore(filepath.Join(t.TempDir(), "litesync.sqlite"))
+	require.NoError(t, err)
+
+	_, err = ds.InsertSyncEntity(&datastore.SyncEntity{
+		ClientID:       "client1",
+		ID:             "id1",
+		Version:        aws.Int64(1),
+		Mtime:          aws.Int64(12345678),
+		DataType:       aws.Int(963985),
+		ExpirationTime: aws.Int64(time.Now().Unix() - 10),
+	})
+	require.NoError(t, err)
+
+	logger := zerolog.Nop()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		internal.NewExpirationReaper(ds, &logger, time.Hour, 10).Run(ctx)
+	}()
+
+	assert.Eventually(t, func() bool {
+		has, err := ds.HasItem("client1", "id1")
+		return err == nil && !has
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reaper did not stop")
+	}
+}
@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/brave/go-sync/cache"
+	braveds "github.com/brave/go-sync/datastore"
+	"github.com/brave/go-sync/schema/protobuf/sync_pb"
+)
+
+// AcquireShard holds the store of a chain until release is called, as a
+// request does.
+func (d *ShardedSqliteDatastore) AcquireShard(clientID string) (store *SqliteDatastore, release func(), err error) {
+	shard, err := d.acquire(clientID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return shard.store, func() { d.release(shard) }, nil
+}
+
+// TrackOverQuota wraps the datastore of a command, and mark reports the
+// entries whose writes went over quota as OVER_QUOTA.
+func TrackOverQuota(store braveds.Datastore) (tracked braveds.Datastore, mark func(*sync_pb.CommitMessage, *sync_pb.CommitResponse)) {
+	tracker := newOverQuotaTracker(store)
+	return tracker, tracker.markOverQuota
+}
+
+// CommandHandler serves the sync commands of a request with its client ID
+// in the context, as the server does.
+func CommandHandler(store braveds.Datastore) http.HandlerFunc {
+	return commandHandler(cache.NewCache(NewFakeRedisClient()), store)
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package internal
+
+import "os"
+
+// lockDatabaseFile only creates the lock file, there are no advisory locks
+// here, and restores and checks cannot tell whether a server is running.
+func lockDatabaseFile(path string, exclusive bool) (*os.File, error) {
+	return os.OpenFile(path+lockFileSuffix, os.O_RDWR|os.O_CREATE, 0o600)
+}
@@ -0,0 +1,35 @@
+//go:build unix
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockDatabaseFile takes a lock on the lock file next to the database at
+// path, without waiting, and holds it until the returned file is closed.
+// Stores take a shared lock and restores and checks an exclusive one, so
+// the latter fail with ErrDatabaseInUse while a server has the database
+// open, whatever its journal mode. The lock is independent of SQLite's own
+// locks on the database file.
+func lockDatabaseFile(path string, exclusive bool) (*os.File, error) {
+	file, err := os.OpenFile(path+lockFileSuffix, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s", ErrDatabaseInUse, path)
+		}
+		return nil, err
+	}
+	return file, nil
+}
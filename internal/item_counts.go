@@ -0,0 +1,40 @@
+package internal
+
+import (
+	braveds "github.com/brave/go-sync/datastore"
+)
+
+const (
+	// Version of the counts row layout, rows written by older upstream
+	// servers are recounted from the entities on first read.
+	clientItemCountsVersion = 2
+
+	// History entities expire, so their count is kept in four rolling
+	// periods which together span the expiration interval.
+	historyCountPeriodSecs = int64(braveds.HistoryExpirationIntervalSecs) / 4
+
+	historyTypeID                = 963985
+	historyDeleteDirectiveTypeID = 150251
+)
+
+func isHistoryDataType(dataType *int) bool {
+	return dataType != nil && (*dataType == historyTypeID || *dataType == historyDeleteDirectiveTypeID)
+}
+
+// rotateHistoryCounts drops the history items which have expired since the
+// counts were last stored. Items counted in the oldest period have expired
+// by now, every period shifts down once for each period that has passed.
+func rotateHistoryCounts(counts *braveds.ClientItemCounts, now int64) {
+	elapsed := now - counts.LastPeriodChangeTime
+	if elapsed < historyCountPeriodSecs {
+		return
+	}
+	changeCount := elapsed / historyCountPeriodSecs
+	for i := int64(0); i < changeCount && i < 4; i++ {
+		counts.HistoryItemCountPeriod1 = counts.HistoryItemCountPeriod2
+		counts.HistoryItemCountPeriod2 = counts.HistoryItemCountPeriod3
+		counts.HistoryItemCountPeriod3 = counts.HistoryItemCountPeriod4
+		counts.HistoryItemCountPeriod4 = 0
+	}
+	counts.LastPeriodChangeTime += changeCount * historyCountPeriodSecs
+}
@@ -0,0 +1,791 @@
+package internal
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	braveds "github.com/brave/go-sync/datastore"
+)
+
+// MemoryDatastore keeps the sync data in maps, with the same semantics as
+// SqliteDatastore, for demos and tests which need no database. Given a
+// snapshot file, it loads its state from the file when opened and writes it
+// back when closed, otherwise everything is lost with the process.
+type MemoryDatastore struct {
+	braveds.Datastore
+
+	mu     sync.RWMutex
+	chains map[string]*memoryChain
+	// watermarks holds the lowest token each chain fetched each type with,
+	// per day, like fetch_watermarks.
+	watermarks map[watermarkKey]map[int64]int64
+	// keepTombstones is set when the tombstones are never compacted. Only
+	// compacting prunes the watermarks, so they are then not recorded.
+	keepTombstones bool
+
+	quotas       *Quotas
+	snapshotPath string
+}
+
+// memoryChain is one chain, its sync_entities rows by ID, tag items and the
+// disabled chain marker included, and its counts row.
+type memoryChain struct {
+	rows   map[string]braveds.SyncEntity
+	counts *braveds.ClientItemCounts
+}
+
+// NewMemoryDatastore returns an empty datastore, or one holding the state
+// in snapshotPath when that file exists. With an empty snapshotPath the
+// state is never written.
+func NewMemoryDatastore(snapshotPath string) (*MemoryDatastore, error) {
+	d := &MemoryDatastore{
+		chains:       map[string]*memoryChain{},
+		watermarks:   map[watermarkKey]map[int64]int64{},
+		snapshotPath: snapshotPath,
+	}
+	if snapshotPath == "" {
+		return d, nil
+	}
+	if err := d.loadSnapshot(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Close writes the snapshot, when the datastore has a snapshot file.
+func (d *MemoryDatastore) Close() error {
+	if d.snapshotPath == "" {
+		return nil
+	}
+	return d.writeSnapshot()
+}
+
+// SchemaVersion returns the version of the snapshot format, there is no
+// schema to migrate.
+func (d *MemoryDatastore) SchemaVersion() (int, error) {
+	return memorySnapshotVersion, nil
+}
+
+func clonePointer[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+// cloneEntity copies every field of entity, so that the rows do not change
+// with the entities the callers were given or have handed in.
+func cloneEntity(e braveds.SyncEntity) braveds.SyncEntity {
+	e.ParentID = clonePointer(e.ParentID)
+	e.Version = clonePointer(e.Version)
+	e.Mtime = clonePointer(e.Mtime)
+	e.Ctime = clonePointer(e.Ctime)
+	e.Name = clonePointer(e.Name)
+	e.NonUniqueName = clonePointer(e.NonUniqueName)
+	e.ServerDefinedUniqueTag = clonePointer(e.ServerDefinedUniqueTag)
+	e.Deleted = clonePointer(e.Deleted)
+	e.OriginatorCacheGUID = clonePointer(e.OriginatorCacheGUID)
+	e.OriginatorClientItemID = clonePointer(e.OriginatorClientItemID)
+	e.Specifics = bytes.Clone(e.Specifics)
+	e.DataType = clonePointer(e.DataType)
+	e.Folder = clonePointer(e.Folder)
+	e.ClientDefinedUniqueTag = clonePointer(e.ClientDefinedUniqueTag)
+	e.UniquePosition = bytes.Clone(e.UniquePosition)
+	e.DataTypeMtime = clonePointer(e.DataTypeMtime)
+	e.ExpirationTime = clonePointer(e.ExpirationTime)
+	return e
+}
+
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
+
+// isLiveEntity reports whether row is an entity which is not deleted, tag
+// items and the disabled chain marker have no version.
+func isLiveEntity(row braveds.SyncEntity) bool {
+	return row.Version != nil && !isTrue(row.Deleted)
+}
+
+// updatesVersion reports whether an update at oldVersion applies to stored.
+// History entities are updated whatever their version.
+func updatesVersion(stored braveds.SyncEntity, oldVersion int64) bool {
+	isHistory := stored.DataType != nil && *stored.DataType == historyTypeID
+	return isHistory || (stored.Version != nil && *stored.Version == oldVersion)
+}
+
+// updatedEntity returns stored as UpdateSyncEntity leaves it after se, like
+// updateSyncEntityQuery. The version, mtime, specifics and data type mtime
+// are overwritten, the other fields only when se sets them, and the
+// originator cache GUID is kept.
+func updatedEntity(stored braveds.SyncEntity, se *braveds.SyncEntity) braveds.SyncEntity {
+	update := cloneEntity(*se)
+	updated := stored
+	updated.Version = update.Version
+	updated.Mtime = update.Mtime
+	updated.Specifics = update.Specifics
+	updated.DataTypeMtime = update.DataTypeMtime
+	if update.UniquePosition != nil {
+		updated.UniquePosition = update.UniquePosition
+	}
+	updated.ParentID = cmp.Or(update.ParentID, stored.ParentID)
+	updated.Name = cmp.Or(update.Name, stored.Name)
+	updated.NonUniqueName = cmp.Or(update.NonUniqueName, stored.NonUniqueName)
+	updated.Deleted = cmp.Or(update.Deleted, stored.Deleted)
+	updated.Folder = cmp.Or(update.Folder, stored.Folder)
+	updated.ExpirationTime = cmp.Or(update.ExpirationTime, stored.ExpirationTime)
+	return updated
+}
+
+// usageGrowth returns how replacing row before by row after changes the
+// usage of a chain, which counts the live entities only.
+func usageGrowth(before, after braveds.SyncEntity) chainUsage {
+	var grown chainUsage
+	if isLiveEntity(after) {
+		grown.entities++
+		grown.specificsBytes += int64(len(after.Specifics))
+	}
+	if isLiveEntity(before) {
+		grown.entities--
+		grown.specificsBytes -= int64(len(before.Specifics))
+	}
+	return grown
+}
+
+// chain returns the chain of clientID, creating an empty one.
+func (d *MemoryDatastore) chain(clientID string) *memoryChain {
+	chain, ok := d.chains[clientID]
+	if !ok {
+		chain = &memoryChain{rows: map[string]braveds.SyncEntity{}}
+		d.chains[clientID] = chain
+	}
+	return chain
+}
+
+func (c *memoryChain) has(id string) bool {
+	_, ok := c.rows[id]
+	return ok
+}
+
+// checkChainUsage checks the usage of the chain once grown, before the
+// change is made, unlike SqliteDatastore which rolls the change back.
+func (d *MemoryDatastore) checkChainUsage(clientID string, grown chainUsage) error {
+	quota := d.quotas.For(clientID)
+	if !quota.limitsUsage() || (grown.entities <= 0 && grown.specificsBytes <= 0) {
+		return nil
+	}
+	usage := grown
+	for _, row := range d.chain(clientID).rows {
+		if isLiveEntity(row) {
+			usage.entities++
+			usage.specificsBytes += int64(len(row.Specifics))
+		}
+	}
+	return quota.checkUsage(usage, grown)
+}
+
+// tagItem returns a tag item row. Like SqliteDatastore, a missing mtime or
+// ctime is set to the current time in seconds.
+func tagItem(clientID, id string, mtime, ctime *int64) braveds.SyncEntity {
+	now := time.Now().Unix()
+	return braveds.SyncEntity{
+		ClientID: clientID,
+		ID:       id,
+		Mtime:    cmp.Or(clonePointer(mtime), clonePointer(&now)),
+		Ctime:    cmp.Or(clonePointer(ctime), clonePointer(&now)),
+	}
+}
+
+// InsertSyncEntity inserts a new entity, together with its client tag item
+// when it has a client defined unique tag. A duplicate ID or tag returns
+// conflict along with an error wrapping ErrConflict, and an entity taking
+// the chain over its quota fails with ErrOverQuota.
+func (d *MemoryDatastore) InsertSyncEntity(entity *braveds.SyncEntity) (bool, error) {
+	fail := func(err error) (bool, error) {
+		return errors.Is(err, ErrConflict), fmt.Errorf("InsertSyncEntity: %w", err)
+	}
+
+	if err := d.quotas.For(entity.ClientID).checkEntity(entity); err != nil {
+		return fail(err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	chain := d.chain(entity.ClientID)
+	if chain.has(entity.ID) {
+		return fail(fmt.Errorf("%w: %s", ErrConflict, entity.ID))
+	}
+	var tagID string
+	if entity.ClientDefinedUniqueTag != nil {
+		tagID = "Client#" + *entity.ClientDefinedUniqueTag
+		if chain.has(tagID) {
+			return fail(fmt.Errorf("%w: client tag %s", ErrConflict, *entity.ClientDefinedUniqueTag))
+		}
+	}
+	grown := chainUsage{entities: 1, specificsBytes: int64(len(entity.Specifics))}
+	if err := d.checkChainUsage(entity.ClientID, grown); err != nil {
+		return fail(err)
+	}
+
+	chain.rows[entity.ID] = cloneEntity(*entity)
+	if tagID != "" {
+		chain.rows[tagID] = tagItem(entity.ClientID, tagID, entity.Mtime, entity.Ctime)
+	}
+	return false, nil
+}
+
+// InsertSyncEntitiesWithServerTags inserts the entities and a tag item for
+// each server tag, or none of them when an ID or tag is taken.
+func (d *MemoryDatastore) InsertSyncEntitiesWithServerTags(entities []*braveds.SyncEntity) error {
+	fail := func(err error) error {
+		return fmt.Errorf("InsertSyncEntitiesWithServerTags: %w", err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	type rowKey struct{ clientID, id string }
+	var added []braveds.SyncEntity
+	taken := map[rowKey]bool{}
+	isTaken := func(clientID, id string) bool {
+		return taken[rowKey{clientID, id}] || d.chain(clientID).has(id)
+	}
+	grown := map[string]chainUsage{}
+	for _, se := range entities {
+		if err := d.quotas.For(se.ClientID).checkEntity(se); err != nil {
+			return fail(err)
+		}
+		usage := grown[se.ClientID]
+		usage.entities++
+		usage.specificsBytes += int64(len(se.Specifics))
+		grown[se.ClientID] = usage
+
+		if se.ServerDefinedUniqueTag != nil {
+			tagID := "Server#" + *se.ServerDefinedUniqueTag
+			if isTaken(se.ClientID, tagID) {
+				return fail(fmt.Errorf("%w: server tag %s", ErrConflict, *se.ServerDefinedUniqueTag))
+			}
+			taken[rowKey{se.ClientID, tagID}] = true
+			added = append(added, braveds.SyncEntity{
+				ClientID: se.ClientID, ID: tagID, Mtime: clonePointer(se.Mtime), Ctime: clonePointer(se.Ctime),
+			})
+		}
+		if isTaken(se.ClientID, se.ID) {
+			return fail(fmt.Errorf("%w: %s", ErrConflict, se.ID))
+		}
+		taken[rowKey{se.ClientID, se.ID}] = true
+		added = append(added, cloneEntity(*se))
+	}
+	for clientID, usage := range grown {
+		if err := d.checkChainUsage(clientID, usage); err != nil {
+			return fail(err)
+		}
+	}
+
+	for _, row := range added {
+		d.chain(row.ClientID).rows[row.ID] = row
+	}
+	return nil
+}
+
+// UpdateSyncEntity updates an entity at oldVersion, a changed version
+// returns conflict, see updatedEntity. An update growing the chain over its
+// quota fails with ErrOverQuota, deletes always go through.
+func (d *MemoryDatastore) UpdateSyncEntity(se *braveds.SyncEntity, oldVersion int64) (bool, bool, error) {
+	fail := func(err error) (bool, bool, error) {
+		return false, false, fmt.Errorf("UpdateSyncEntity: %w", err)
+	}
+
+	deleting := isTrue(se.Deleted)
+	if !deleting {
+		if err := d.quotas.For(se.ClientID).checkEntity(se); err != nil {
+			return fail(err)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	chain := d.chain(se.ClientID)
+	stored, ok := chain.rows[se.ID]
+	if !ok {
+		return true, false, nil // Conflict
+	}
+	if !updatesVersion(stored, oldVersion) {
+		return true, false, nil // Conflict
+	}
+	updated := updatedEntity(stored, se)
+	if err := d.checkChainUsage(se.ClientID, usageGrowth(stored, updated)); err != nil {
+		return fail(err)
+	}
+
+	chain.rows[se.ID] = updated
+	if deleting && se.ClientDefinedUniqueTag != nil {
+		delete(chain.rows, "Client#"+*se.ClientDefinedUniqueTag)
+	}
+	// The caller decrements the client's item count when we report a delete,
+	// so only report it for the transition into the deleted state.
+	return false, deleting && !isTrue(stored.Deleted), nil
+}
+
+// GetUpdatesForType returns up to maxSize entities of the given type that
+// were modified after clientToken, ordered by mtime and ID, leaving out the
+// expired ones. hasChangesRemaining is true when the batch is full. The
+// token is recorded for tombstone compaction.
+func (d *MemoryDatastore) GetUpdatesForType(dataType int, clientToken int64, fetchFolders bool, clientID string, maxSize int64) (bool, []braveds.SyncEntity, error) {
+	now := time.Now().Unix()
+	syncEntities := []braveds.SyncEntity{}
+	d.mu.RLock()
+	if chain, ok := d.chains[clientID]; ok {
+		for _, row := range chain.rows {
+			switch {
+			case row.DataType == nil || *row.DataType != dataType,
+				row.Mtime == nil || *row.Mtime <= clientToken,
+				!fetchFolders && (row.Folder == nil || *row.Folder),
+				row.ExpirationTime != nil && *row.ExpirationTime <= now:
+				continue
+			}
+			syncEntities = append(syncEntities, cloneEntity(row))
+		}
+	}
+	d.mu.RUnlock()
+
+	slices.SortFunc(syncEntities, func(a, b braveds.SyncEntity) int {
+		return cmp.Or(cmp.Compare(*a.Mtime, *b.Mtime), strings.Compare(a.ID, b.ID))
+	})
+	if maxSize >= 0 && int64(len(syncEntities)) > maxSize {
+		syncEntities = syncEntities[:maxSize]
+	}
+	d.recordFetch(clientID, dataType, clientToken)
+
+	hasChangesRemaining := int64(len(syncEntities)) == maxSize
+	return hasChangesRemaining, syncEntities, nil
+}
+
+// recordFetch lowers the day's watermark of the chain and type to token.
+func (d *MemoryDatastore) recordFetch(clientID string, dataType int, token int64) {
+	if d.keepTombstones || token <= 0 {
+		return
+	}
+	key := watermarkKey{clientID: clientID, dataType: dataType}
+	day := time.Now().UnixMilli() / millisPerDay
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	days, ok := d.watermarks[key]
+	if !ok {
+		days = map[int64]int64{}
+		d.watermarks[key] = days
+	}
+	if stored, ok := days[day]; !ok || token < stored {
+		days[day] = token
+	}
+}
+
+func (d *MemoryDatastore) HasServerDefinedUniqueTag(clientID string, tag string) (bool, error) {
+	return d.HasItem(clientID, "Server#"+tag)
+}
+
+func (d *MemoryDatastore) HasItem(clientID string, ID string) (bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	chain, ok := d.chains[clientID]
+	return ok && chain.has(ID), nil
+}
+
+// GetClientItemCount returns the stored counts with the expired history
+// periods rotated out. Counts imported from before clientItemCountsVersion
+// are recounted from the entities.
+func (d *MemoryDatastore) GetClientItemCount(clientID string) (*braveds.ClientItemCounts, error) {
+	now := time.Now().Unix()
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	chain, ok := d.chains[clientID]
+	if !ok || chain.counts == nil {
+		return &braveds.ClientItemCounts{
+			ClientID:             clientID,
+			ID:                   clientID,
+			LastPeriodChangeTime: now,
+			Version:              clientItemCountsVersion,
+		}, nil
+	}
+
+	counts := *chain.counts
+	if counts.Version < clientItemCountsVersion {
+		counts = braveds.ClientItemCounts{
+			ClientID:             clientID,
+			ID:                   clientID,
+			LastPeriodChangeTime: now,
+			Version:              clientItemCountsVersion,
+		}
+		for _, row := range chain.rows {
+			switch {
+			case !isLiveEntity(row):
+			case isHistoryDataType(row.DataType):
+				counts.HistoryItemCountPeriod4++
+			default:
+				counts.ItemCount++
+			}
+		}
+	} else {
+		rotateHistoryCounts(&counts, now)
+	}
+	return &counts, nil
+}
+
+// UpdateClientItemCount adds the new items to counts, which must come from
+// GetClientItemCount, and stores the result.
+func (d *MemoryDatastore) UpdateClientItemCount(counts *braveds.ClientItemCounts, newNormalItemCount int, newHistoryItemCount int) error {
+	counts.ItemCount += newNormalItemCount
+	counts.HistoryItemCountPeriod4 += newHistoryItemCount
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stored := *counts
+	d.chain(counts.ClientID).counts = &stored
+	return nil
+}
+
+// ClearServerData deletes every row of a chain but its disabled chain
+// marker, and its counts, and returns the deleted rows.
+func (d *MemoryDatastore) ClearServerData(clientID string) ([]braveds.SyncEntity, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	syncEntities := []braveds.SyncEntity{}
+	chain, ok := d.chains[clientID]
+	if !ok {
+		return syncEntities, nil
+	}
+	for id, row := range chain.rows {
+		if id != disabledChainID {
+			syncEntities = append(syncEntities, row)
+			delete(chain.rows, id)
+		}
+	}
+	chain.counts = nil
+	slices.SortFunc(syncEntities, func(a, b braveds.SyncEntity) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return syncEntities, nil
+}
+
+// DisableSyncChain stores the disabled chain marker of the chain, which
+// ClearServerData keeps.
+func (d *MemoryDatastore) DisableSyncChain(clientID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	chain := d.chain(clientID)
+	if !chain.has(disabledChainID) {
+		now := time.Now().UnixMilli()
+		chain.rows[disabledChainID] = braveds.SyncEntity{
+			ClientID: clientID, ID: disabledChainID, Mtime: clonePointer(&now), Ctime: clonePointer(&now),
+		}
+	}
+	return nil
+}
+
+func (d *MemoryDatastore) IsSyncChainDisabled(clientID string) (bool, error) {
+	return d.HasItem(clientID, disabledChainID)
+}
+
+// DeleteExpiredEntities deletes up to limit entities whose expiration time
+// is at or before now, together with the client tag items of the live ones,
+// and returns how many entities were deleted per client. Live entities of
+// normal types are taken off the client's item count.
+func (d *MemoryDatastore) DeleteExpiredEntities(now int64, limit int) (map[string]int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	deleted := map[string]int{}
+	total := 0
+	for clientID, chain := range d.chains {
+		for id, row := range chain.rows {
+			if total == limit {
+				return deleted, nil
+			}
+			if row.ExpirationTime == nil || *row.ExpirationTime > now {
+				continue
+			}
+			delete(chain.rows, id)
+			// A tombstone's tag may belong to a newer entity by now.
+			if isLiveEntity(row) && row.ClientDefinedUniqueTag != nil {
+				delete(chain.rows, "Client#"+*row.ClientDefinedUniqueTag)
+			}
+			if chain.counts != nil && !isHistoryDataType(row.DataType) && isLiveEntity(row) {
+				chain.counts.ItemCount = max(chain.counts.ItemCount-1, 0)
+			}
+			deleted[clientID]++
+			total++
+		}
+	}
+	return deleted, nil
+}
+
+// storedBytes adds up the lengths of the text and blob fields of row, as
+// CompactTombstones counts them.
+func storedBytes(row braveds.SyncEntity) int64 {
+	size := len(row.ClientID) + len(row.ID) + len(row.Specifics) + len(row.UniquePosition)
+	for _, field := range []*string{
+		row.ParentID, row.Name, row.NonUniqueName, row.ServerDefinedUniqueTag, row.OriginatorCacheGUID,
+		row.OriginatorClientItemID, row.ClientDefinedUniqueTag, row.DataTypeMtime,
+	} {
+		if field != nil {
+			size += len(*field)
+		}
+	}
+	return int64(size)
+}
+
+// fetchedUpTo returns the lowest token the chain fetched the type with
+// since cutoffDay, false when it has not fetched the type since.
+func (d *MemoryDatastore) fetchedUpTo(key watermarkKey, cutoffDay int64) (int64, bool) {
+	var lowest int64
+	found := false
+	for day, token := range d.watermarks[key] {
+		if day >= cutoffDay && (!found || token < lowest) {
+			lowest, found = token, true
+		}
+	}
+	return lowest, found
+}
+
+// hasStaleDevice reports whether the chain has a device info older than
+// cutoff, see SqliteDatastore.CompactTombstones.
+func (c *memoryChain) hasStaleDevice(cutoff int64) bool {
+	for _, row := range c.rows {
+		if row.DataType != nil && *row.DataType == deviceInfoTypeID && row.Mtime != nil && *row.Mtime < cutoff &&
+			row.Version != nil && !isTrue(row.Deleted) {
+			return true
+		}
+	}
+	return false
+}
+
+// CompactTombstones removes up to limit tombstones with an mtime before
+// cutoff which every device syncing since cutoff has fetched, and the
+// watermarks from before cutoff, see SqliteDatastore.CompactTombstones.
+func (d *MemoryDatastore) CompactTombstones(cutoff int64, limit int) (map[string]TombstoneStats, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cutoffDay := cutoff / millisPerDay
+	compacted := map[string]TombstoneStats{}
+	total := 0
+compact:
+	for clientID, chain := range d.chains {
+		if chain.hasStaleDevice(cutoff) {
+			continue
+		}
+		for id, row := range chain.rows {
+			if total == limit {
+				break compact
+			}
+			if row.Version == nil || !isTrue(row.Deleted) || row.DataType == nil || row.Mtime == nil || *row.Mtime >= cutoff {
+				continue
+			}
+			fetched, ok := d.fetchedUpTo(watermarkKey{clientID: clientID, dataType: *row.DataType}, cutoffDay)
+			if !ok || *row.Mtime > fetched {
+				continue
+			}
+			delete(chain.rows, id)
+			stats := compacted[clientID]
+			stats.add(TombstoneStats{Rows: 1, Bytes: storedBytes(row)})
+			compacted[clientID] = stats
+			total++
+		}
+	}
+
+	for key, days := range d.watermarks {
+		for day := range days {
+			if day < cutoffDay {
+				delete(days, day)
+			}
+		}
+		if len(days) == 0 {
+			delete(d.watermarks, key)
+		}
+	}
+	return compacted, nil
+}
+
+// ExportChain returns a copy of the chain of clientID, rows ordered by ID.
+func (d *MemoryDatastore) ExportChain(clientID string) (ChainExport, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.exportChain(clientID), nil
+}
+
+func (d *MemoryDatastore) exportChain(clientID string) ChainExport {
+	export := ChainExport{ClientID: clientID, Entities: []braveds.SyncEntity{}}
+	chain, ok := d.chains[clientID]
+	if !ok {
+		return export
+	}
+	for _, row := range chain.rows {
+		export.Entities = append(export.Entities, cloneEntity(row))
+	}
+	slices.SortFunc(export.Entities, func(a, b braveds.SyncEntity) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	if chain.counts != nil {
+		counts := *chain.counts
+		export.Counts = &counts
+	}
+	return export
+}
+
+// ImportChain stores chain. A chain which already has data is replaced with
+// replace, otherwise the import fails with ErrConflict.
+func (d *MemoryDatastore) ImportChain(chain ChainExport, replace bool) error {
+	fail := func(err error) error {
+		return fmt.Errorf("ImportChain: %w", err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if stored, ok := d.chains[chain.ClientID]; ok && (len(stored.rows) > 0 || stored.counts != nil) && !replace {
+		return fail(fmt.Errorf("%w: chain %s already has data", ErrConflict, chain.ClientID))
+	}
+	imported, err := newMemoryChain(chain)
+	if err != nil {
+		return fail(err)
+	}
+	d.chains[chain.ClientID] = imported
+	return nil
+}
+
+// newMemoryChain builds the chain of an export, which must not have an ID
+// twice.
+func newMemoryChain(chain ChainExport) (*memoryChain, error) {
+	imported := &memoryChain{rows: make(map[string]braveds.SyncEntity, len(chain.Entities))}
+	for _, entity := range chain.Entities {
+		if imported.has(entity.ID) {
+			return nil, fmt.Errorf("%w: %s", ErrConflict, entity.ID)
+		}
+		entity = cloneEntity(entity)
+		entity.ClientID = chain.ClientID
+		imported.rows[entity.ID] = entity
+	}
+	if chain.Counts != nil {
+		counts := *chain.Counts
+		counts.ClientID = chain.ClientID
+		counts.ID = chain.ClientID
+		imported.counts = &counts
+	}
+	return imported, nil
+}
+
+// A snapshot is a single JSON document of every chain, as ExportChain
+// returns it, and the fetch watermarks.
+const (
+	memorySnapshotFormat  = "litesync-memory"
+	memorySnapshotVersion = 1
+)
+
+type memorySnapshot struct {
+	Format        string                 `json:"format"`
+	FormatVersion int                    `json:"format_version"`
+	Chains        []ChainExport          `json:"chains"`
+	Watermarks    []memoryWatermarkEntry `json:"watermarks"`
+}
+
+type memoryWatermarkEntry struct {
+	ClientID string `json:"client_id"`
+	DataType int    `json:"data_type"`
+	Day      int64  `json:"day"`
+	MinToken int64  `json:"min_token"`
+}
+
+// writeSnapshot writes the state to a temporary file and renames it over
+// the snapshot, so that a failed write leaves the previous snapshot.
+func (d *MemoryDatastore) writeSnapshot() error {
+	d.mu.RLock()
+	snapshot := memorySnapshot{
+		Format:        memorySnapshotFormat,
+		FormatVersion: memorySnapshotVersion,
+		Chains:        make([]ChainExport, 0, len(d.chains)),
+		Watermarks:    []memoryWatermarkEntry{},
+	}
+	for clientID, chain := range d.chains {
+		if len(chain.rows) > 0 || chain.counts != nil {
+			snapshot.Chains = append(snapshot.Chains, d.exportChain(clientID))
+		}
+	}
+	for key, days := range d.watermarks {
+		for day, token := range days {
+			snapshot.Watermarks = append(snapshot.Watermarks, memoryWatermarkEntry{
+				ClientID: key.clientID, DataType: key.dataType, Day: day, MinToken: token,
+			})
+		}
+	}
+	d.mu.RUnlock()
+
+	// Sorted, so that the same state always writes the same file.
+	slices.SortFunc(snapshot.Chains, func(a, b ChainExport) int {
+		return strings.Compare(a.ClientID, b.ClientID)
+	})
+	slices.SortFunc(snapshot.Watermarks, func(a, b memoryWatermarkEntry) int {
+		return cmp.Or(strings.Compare(a.ClientID, b.ClientID), cmp.Compare(a.DataType, b.DataType), cmp.Compare(a.Day, b.Day))
+	})
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("writeSnapshot: %w", err)
+	}
+	if err = writeFileAtomic(d.snapshotPath, data); err != nil {
+		return fmt.Errorf("writeSnapshot: %w", err)
+	}
+	return nil
+}
+
+func (d *MemoryDatastore) loadSnapshot() error {
+	fail := func(err error) error {
+		return fmt.Errorf("loadSnapshot: %s: %w", d.snapshotPath, err)
+	}
+
+	data, err := os.ReadFile(d.snapshotPath)
+	if err != nil {
+		return fail(err)
+	}
+	var snapshot memorySnapshot
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return fail(err)
+	}
+	if snapshot.Format != memorySnapshotFormat {
+		return fail(errors.New("not a litesync memory snapshot"))
+	}
+	if snapshot.FormatVersion != memorySnapshotVersion {
+		return fail(fmt.Errorf("unsupported format version %d", snapshot.FormatVersion))
+	}
+
+	for _, export := range snapshot.Chains {
+		if _, ok := d.chains[export.ClientID]; ok {
+			return fail(fmt.Errorf("chain %s is in the snapshot twice", export.ClientID))
+		}
+		chain, err := newMemoryChain(export)
+		if err != nil {
+			return fail(fmt.Errorf("chain %s: %w", export.ClientID, err))
+		}
+		d.chains[export.ClientID] = chain
+	}
+	for _, w := range snapshot.Watermarks {
+		key := watermarkKey{clientID: w.ClientID, dataType: w.DataType}
+		if d.watermarks[key] == nil {
+			d.watermarks[key] = map[int64]int64{}
+		}
+		d.watermarks[key][w.Day] = w.MinToken
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package internal_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemorySnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "litesync.json")
+	ds, err := internal.NewMemoryDatastore(path)
+	require.NoError(t, err)
+
+	entity := &datastore.SyncEntity{
+		ClientID:               "client",
+		ID:                     "id1",
+		Version:                aws.Int64(1),
+		Mtime:                  aws.Int64(1000),
+		Specifics:              []byte("specifics"),
+		DataType:               aws.Int(123),
+		Folder:                 aws.Bool(false),
+		Deleted:                aws.Bool(false),
+		ClientDefinedUniqueTag: aws.String("tag1"),
+		UniquePosition:         []byte{0, 1, 2},
+	}
+	_, err = ds.InsertSyncEntity(entity)
+	require.NoError(t, err)
+	counts, err := ds.GetClientItemCount("client")
+	require.NoError(t, err)
+	require.NoError(t, ds.UpdateClientItemCount(counts, 1, 0))
+	require.NoError(t, ds.DisableSyncChain("disabled"))
+	_, _, err = ds.GetUpdatesForType(123, 1000, true, "client", 100)
+	require.NoError(t, err)
+	exported, err := ds.ExportChain("client")
+	require.NoError(t, err)
+	require.NoError(t, ds.Close())
+
+	ds, err = internal.NewMemoryDatastore(path)
+	require.NoError(t, err)
+	reloaded, err := ds.ExportChain("client")
+	require.NoError(t, err)
+	assert.Equal(t, exported, reloaded)
+	disabled, err := ds.IsSyncChainDisabled("disabled")
+	require.NoError(t, err)
+	assert.True(t, disabled)
+
+	// The fetch at 1000 survives too, so the tombstone it covers can go.
+	entity.Version = aws.Int64(2)
+	entity.Deleted = aws.Bool(true)
+	_, deleted, err := ds.UpdateSyncEntity(entity, 1)
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	compacted, err := ds.CompactTombstones(time.Now().UnixMilli(), 100)
+	require.NoError(t, err)
+	assert.Equal(t, 1, compacted["client"].Rows)
+}
+
+func TestMemorySnapshotRejectsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "litesync.json")
+	for _, content := range []string{"", "{}", `{"format":"litesync-memory","format_version":2}`} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err := internal.NewMemoryDatastore(path)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestMemoryDeleteExpiredEntitiesKeepsReusedTags(t *testing.T) {
+	ds, err := internal.NewMemoryDatastore("")
+	require.NoError(t, err)
+	checkReapKeepsReusedTag(t, ds)
+}
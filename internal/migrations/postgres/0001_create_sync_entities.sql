@@ -0,0 +1,31 @@
+-- Entities, Client#/Server# tag items and disabled chain markers share one
+-- table, tag items and markers have no version.
+CREATE TABLE IF NOT EXISTS sync_entities (
+     client_id TEXT NOT NULL,
+     id TEXT NOT NULL,
+     parent_id TEXT,
+     version BIGINT,
+     mtime BIGINT,
+     ctime BIGINT,
+     name TEXT,
+     non_unique_name TEXT,
+     server_defined_unique_tag TEXT,
+     deleted BOOLEAN,
+     originator_cache_guid TEXT,
+     originator_client_item_id TEXT,
+     specifics BYTEA,
+     data_type INTEGER,
+     folder BOOLEAN,
+     client_defined_unique_tag TEXT,
+     unique_position BYTEA,
+     data_type_mtime TEXT,
+     expiration_time BIGINT,
+     PRIMARY KEY (client_id, id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sync_entities_updates
+ON sync_entities (client_id, data_type, mtime);
+
+CREATE INDEX IF NOT EXISTS idx_sync_entities_expiration
+ON sync_entities (expiration_time)
+WHERE expiration_time IS NOT NULL;
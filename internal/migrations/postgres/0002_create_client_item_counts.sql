@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS client_item_counts (
+     client_id TEXT NOT NULL PRIMARY KEY,
+     item_count INTEGER NOT NULL DEFAULT 0,
+     history_item_count_period1 INTEGER NOT NULL DEFAULT 0,
+     history_item_count_period2 INTEGER NOT NULL DEFAULT 0,
+     history_item_count_period3 INTEGER NOT NULL DEFAULT 0,
+     history_item_count_period4 INTEGER NOT NULL DEFAULT 0,
+     last_period_change_time BIGINT NOT NULL DEFAULT 0,
+     version INTEGER NOT NULL DEFAULT 0
+);
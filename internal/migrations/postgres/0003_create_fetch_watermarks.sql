@@ -0,0 +1,14 @@
+-- The lowest progress token each chain fetched each type with, per UTC day.
+-- Every device which synced that day had received all changes up to it, so
+-- tombstones up to it can be compacted.
+CREATE TABLE IF NOT EXISTS fetch_watermarks (
+     client_id TEXT NOT NULL,
+     data_type INTEGER NOT NULL,
+     day INTEGER NOT NULL,
+     min_token BIGINT NOT NULL,
+     PRIMARY KEY (client_id, data_type, day)
+);
+
+CREATE INDEX IF NOT EXISTS idx_tombstones
+ON sync_entities (client_id, data_type, mtime)
+WHERE deleted;
@@ -0,0 +1,39 @@
+-- The live entities of each chain and the bytes of their specifics, as the
+-- quotas count them. The trigger keeps it up to date within the writing
+-- transaction, so that a quota check does not have to count the chain.
+CREATE TABLE IF NOT EXISTS chain_usage (
+     client_id TEXT NOT NULL PRIMARY KEY,
+     entities BIGINT NOT NULL,
+     specifics_bytes BIGINT NOT NULL
+);
+
+INSERT INTO chain_usage (client_id, entities, specifics_bytes)
+SELECT client_id, COUNT(*), COALESCE(SUM(octet_length(specifics)), 0)
+FROM sync_entities
+WHERE version IS NOT NULL AND deleted IS NOT TRUE
+GROUP BY client_id
+ON CONFLICT (client_id) DO NOTHING;
+
+CREATE OR REPLACE FUNCTION update_chain_usage() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') AND OLD.version IS NOT NULL AND OLD.deleted IS NOT TRUE THEN
+        UPDATE chain_usage SET
+            entities = entities - 1,
+            specifics_bytes = specifics_bytes - COALESCE(octet_length(OLD.specifics), 0)
+        WHERE client_id = OLD.client_id;
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') AND NEW.version IS NOT NULL AND NEW.deleted IS NOT TRUE THEN
+        INSERT INTO chain_usage (client_id, entities, specifics_bytes)
+        VALUES (NEW.client_id, 1, COALESCE(octet_length(NEW.specifics), 0))
+        ON CONFLICT (client_id) DO UPDATE SET
+            entities = chain_usage.entities + 1,
+            specifics_bytes = chain_usage.specifics_bytes + excluded.specifics_bytes;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS chain_usage ON sync_entities;
+CREATE TRIGGER chain_usage
+AFTER INSERT OR UPDATE OF client_id, version, deleted, specifics OR DELETE ON sync_entities
+FOR EACH ROW EXECUTE FUNCTION update_chain_usage();
@@ -0,0 +1,28 @@
+-- Entities, Client#/Server# tag items and disabled chain markers share one
+-- table, tag items and markers have no version.
+CREATE TABLE IF NOT EXISTS sync_entities (
+     client_id TEXT NOT NULL,
+     id TEXT NOT NULL,
+     parent_id TEXT,
+     version INTEGER,
+     mtime INTEGER,
+     ctime INTEGER,
+     name TEXT,
+     non_unique_name TEXT,
+     server_defined_unique_tag TEXT,
+     deleted BOOLEAN,
+     originator_cache_guid TEXT,
+     originator_client_item_id TEXT,
+     specifics BLOB,
+     data_type INTEGER,
+     folder BOOLEAN,
+     client_defined_unique_tag TEXT,
+     unique_position BLOB,
+     data_type_mtime TEXT,
+     expiration_time INTEGER,
+     PRIMARY KEY (client_id, id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_unique_client_tag
+ON sync_entities (client_id, client_defined_unique_tag)
+WHERE client_defined_unique_tag IS NOT NULL;
@@ -0,0 +1,4 @@
+-- Client# tag items already keep a client tag unique among live entities,
+-- and are removed on delete. The index also covered soft-deleted entities,
+-- which kept a deleted item's tag from being reused.
+DROP INDEX IF EXISTS idx_unique_client_tag;
@@ -0,0 +1,3 @@
+-- ID of the key which encrypted the row's specifics, name, non_unique_name
+-- and originator_cache_guid, NULL for rows stored in the clear.
+ALTER TABLE sync_entities ADD COLUMN key_id TEXT;
@@ -0,0 +1,6 @@
+-- Finds the device infos which have not been updated for a while, whose
+-- chains keep their tombstones. The queries spell out the DEVICE_INFO type
+-- to use it.
+CREATE INDEX IF NOT EXISTS idx_device_infos
+ON sync_entities (mtime)
+WHERE data_type = 154522;
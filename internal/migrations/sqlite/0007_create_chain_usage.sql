@@ -0,0 +1,51 @@
+-- The live entities of each chain and the bytes of their specifics, as the
+-- quotas count them. The triggers keep it up to date within the writing
+-- transaction, so that a quota check does not have to count the chain.
+CREATE TABLE IF NOT EXISTS chain_usage (
+     client_id TEXT NOT NULL PRIMARY KEY,
+     entities INTEGER NOT NULL,
+     specifics_bytes INTEGER NOT NULL
+);
+
+INSERT INTO chain_usage (client_id, entities, specifics_bytes)
+SELECT client_id, COUNT(*), COALESCE(SUM(length(specifics)), 0)
+FROM sync_entities
+WHERE version IS NOT NULL AND NOT COALESCE(deleted, 0)
+GROUP BY client_id;
+
+CREATE TRIGGER IF NOT EXISTS chain_usage_insert
+AFTER INSERT ON sync_entities
+WHEN NEW.version IS NOT NULL AND NOT COALESCE(NEW.deleted, 0)
+BEGIN
+    INSERT INTO chain_usage (client_id, entities, specifics_bytes)
+    VALUES (NEW.client_id, 1, COALESCE(length(NEW.specifics), 0))
+    ON CONFLICT (client_id) DO UPDATE SET
+        entities = entities + 1,
+        specifics_bytes = specifics_bytes + excluded.specifics_bytes;
+END;
+
+CREATE TRIGGER IF NOT EXISTS chain_usage_update
+AFTER UPDATE OF client_id, version, deleted, specifics ON sync_entities
+BEGIN
+    UPDATE chain_usage SET
+        entities = entities - 1,
+        specifics_bytes = specifics_bytes - COALESCE(length(OLD.specifics), 0)
+    WHERE client_id = OLD.client_id
+      AND OLD.version IS NOT NULL AND NOT COALESCE(OLD.deleted, 0);
+    INSERT INTO chain_usage (client_id, entities, specifics_bytes)
+    SELECT NEW.client_id, 1, COALESCE(length(NEW.specifics), 0)
+    WHERE NEW.version IS NOT NULL AND NOT COALESCE(NEW.deleted, 0)
+    ON CONFLICT (client_id) DO UPDATE SET
+        entities = entities + 1,
+        specifics_bytes = specifics_bytes + excluded.specifics_bytes;
+END;
+
+CREATE TRIGGER IF NOT EXISTS chain_usage_delete
+AFTER DELETE ON sync_entities
+WHEN OLD.version IS NOT NULL AND NOT COALESCE(OLD.deleted, 0)
+BEGIN
+    UPDATE chain_usage SET
+        entities = entities - 1,
+        specifics_bytes = specifics_bytes - COALESCE(length(OLD.specifics), 0)
+    WHERE client_id = OLD.client_id;
+END;
@@ -0,0 +1,5 @@
+-- Finds the expired entities for the reaper, mostly history. Only they have
+-- an expiration time, so the index stays small.
+CREATE INDEX IF NOT EXISTS idx_sync_entities_expiration
+ON sync_entities (expiration_time)
+WHERE expiration_time IS NOT NULL;
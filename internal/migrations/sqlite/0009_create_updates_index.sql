@@ -0,0 +1,5 @@
+-- Reads the updates of a chain and type in the order GetUpdatesForType
+-- returns them, so that a page is read from the index instead of sorting
+-- the chain. The id breaks ties between equal mtimes.
+CREATE INDEX IF NOT EXISTS idx_sync_entities_updates
+ON sync_entities (client_id, data_type, mtime, id);
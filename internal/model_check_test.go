@@ -0,0 +1,48 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/mikaelhg/litesync/internal/datastoretest"
+)
+
+// modelRuns is the number of random sequences a model test runs, a tenth
+// of them with -short.
+func modelRuns(runs int) int {
+	if testing.Short() {
+		return runs / 10
+	}
+	return runs
+}
+
+func TestSqliteMatchesModel(t *testing.T) {
+	datastoretest.CheckAgainstModel(t, newTestSqlite(internal.DefaultSqliteOptions()), modelRuns(200))
+}
+
+func TestMemoryMatchesModel(t *testing.T) {
+	datastoretest.CheckAgainstModel(t, newTestMemory, modelRuns(200))
+}
+
+func TestBoltMatchesModel(t *testing.T) {
+	datastoretest.CheckAgainstModel(t, newTestBolt, modelRuns(200))
+}
+
+func TestSqliteConcurrentlyMatchesModel(t *testing.T) {
+	datastoretest.CheckConcurrentAgainstModel(t, newTestSqlite(internal.DefaultSqliteOptions()), modelRuns(100))
+}
+
+func TestMemoryConcurrentlyMatchesModel(t *testing.T) {
+	datastoretest.CheckConcurrentAgainstModel(t, newTestMemory, modelRuns(100))
+}
+
+func TestBoltConcurrentlyMatchesModel(t *testing.T) {
+	datastoretest.CheckConcurrentAgainstModel(t, newTestBolt, modelRuns(100))
+}
+
+func FuzzSqliteMatchesModel(f *testing.F) {
+	f.Add([]byte("\x00\x00\x00\x00\x03\x00\x00\x00\x05\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		datastoretest.CheckOps(t, newTestSqlite(internal.DefaultSqliteOptions()), datastoretest.DecodeOps(data))
+	})
+}
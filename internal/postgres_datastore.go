@@ -0,0 +1,797 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	braveds "github.com/brave/go-sync/datastore"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// PostgresDatastore stores the sync data in Postgres, in the same tables
+// and with the same semantics as SqliteDatastore. Postgres does the locking
+// itself, so there is a single pool for reads and writes.
+type PostgresDatastore struct {
+	braveds.Datastore
+	Db *sql.DB
+
+	quotas     *Quotas
+	watermarks *fetchWatermarks
+}
+
+// NewPostgresDatastore connects to the database named by dsn, a libpq
+// connection string or URL, and brings its schema up to date.
+func NewPostgresDatastore(dsn string) (*PostgresDatastore, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	d := &PostgresDatastore{Db: db, watermarks: newFetchWatermarks()}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("database cannot be opened: %w", classifyPostgresError(err))
+	}
+	if err = d.Migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Close writes the pending fetch watermarks and closes the connection pool.
+func (d *PostgresDatastore) Close() error {
+	return errors.Join(d.FlushWatermarks(), d.Db.Close())
+}
+
+const insertPostgresSyncEntityQuery = `
+INSERT INTO sync_entities (` + syncEntityColumns + `)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)
+`
+
+const insertPostgresTagItemQuery = `
+INSERT INTO sync_entities (client_id, id, mtime, ctime) VALUES ($1, $2, $3, $4)
+`
+
+// InsertSyncEntity inserts a new entity, together with its client tag item
+// when it has a client defined unique tag. A duplicate ID or tag returns
+// conflict along with an error wrapping ErrConflict. An entity taking the
+// chain over its quota fails with ErrOverQuota.
+func (d *PostgresDatastore) InsertSyncEntity(entity *braveds.SyncEntity) (bool, error) {
+	fail := func(err error) (bool, error) {
+		err = classifyPostgresError(err)
+		return errors.Is(err, ErrConflict), fmt.Errorf("InsertSyncEntity: %w", err)
+	}
+
+	if err := d.quotas.For(entity.ClientID).checkEntity(entity); err != nil {
+		return fail(err)
+	}
+
+	tx, err := d.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(insertPostgresSyncEntityQuery, syncEntityArgs(entity)...); err != nil {
+		return fail(err)
+	}
+
+	if entity.ClientDefinedUniqueTag != nil {
+		now := time.Now().Unix()
+		mtime := entity.Mtime
+		ctime := entity.Ctime
+		if mtime == nil {
+			mtime = &now
+		}
+		if ctime == nil {
+			ctime = &now
+		}
+
+		_, err = tx.Exec(insertPostgresTagItemQuery,
+			entity.ClientID, "Client#"+*entity.ClientDefinedUniqueTag, mtime, ctime)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	grown := chainUsage{entities: 1, specificsBytes: int64(len(entity.Specifics))}
+	if err = d.checkChainUsage(tx, entity.ClientID, grown); err != nil {
+		return fail(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+
+	return false, nil
+}
+
+func (d *PostgresDatastore) InsertSyncEntitiesWithServerTags(entities []*braveds.SyncEntity) error {
+	fail := func(err error) error {
+		return fmt.Errorf("InsertSyncEntitiesWithServerTags: %w", classifyPostgresError(err))
+	}
+	tx, err := d.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+
+	grown := map[string]chainUsage{}
+	for _, se := range entities {
+		if err = d.quotas.For(se.ClientID).checkEntity(se); err != nil {
+			return fail(err)
+		}
+		usage := grown[se.ClientID]
+		usage.entities++
+		usage.specificsBytes += int64(len(se.Specifics))
+		grown[se.ClientID] = usage
+
+		if se.ServerDefinedUniqueTag != nil {
+			// The primary key rejects a second tag item, ON CONFLICT turns
+			// that into no row instead of an aborted transaction.
+			var inserted bool
+			err = tx.QueryRow(insertPostgresTagItemQuery+" ON CONFLICT (client_id, id) DO NOTHING RETURNING true",
+				se.ClientID, "Server#"+*se.ServerDefinedUniqueTag, se.Mtime, se.Ctime).Scan(&inserted)
+			if errors.Is(err, sql.ErrNoRows) {
+				return fail(fmt.Errorf("%w: server tag %s", ErrConflict, *se.ServerDefinedUniqueTag))
+			}
+			if err != nil {
+				return fail(err)
+			}
+		}
+
+		if _, err = tx.Exec(insertPostgresSyncEntityQuery, syncEntityArgs(se)...); err != nil {
+			return fail(err)
+		}
+	}
+	for clientID, usage := range grown {
+		if err = d.checkChainUsage(tx, clientID, usage); err != nil {
+			return fail(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+
+	return nil
+}
+
+// See updateSyncEntityQuery.
+const updatePostgresSyncEntityQuery = `
+UPDATE sync_entities
+SET version = $1,
+    mtime = $2,
+    specifics = $3,
+    data_type_mtime = $4,
+    unique_position = COALESCE($5, unique_position),
+    parent_id = COALESCE($6, parent_id),
+    name = COALESCE($7, name),
+    non_unique_name = COALESCE($8, non_unique_name),
+    deleted = COALESCE($9, deleted),
+    folder = COALESCE($10, folder),
+    expiration_time = COALESCE($11, expiration_time)
+WHERE client_id = $12 AND id = $13 AND (version = $14 OR data_type = $15)
+`
+
+// See SqliteDatastore.UpdateSyncEntity.
+func (d *PostgresDatastore) UpdateSyncEntity(se *braveds.SyncEntity, oldVersion int64) (conflict bool, delete bool, err error) {
+	fail := func(err error) (bool, bool, error) {
+		return false, false, fmt.Errorf("UpdateSyncEntity: %w", classifyPostgresError(err))
+	}
+
+	deleting := se.Deleted != nil && *se.Deleted
+	if !deleting {
+		if err = d.quotas.For(se.ClientID).checkEntity(se); err != nil {
+			return fail(err)
+		}
+	}
+
+	tx, err := d.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+
+	// Lock the row, so a concurrent update cannot slip in between reading
+	// the deleted state and the version checked update.
+	var wasDeleted sql.NullBool
+	var storedSize int64
+	err = tx.QueryRow("SELECT deleted, COALESCE(octet_length(specifics), 0) FROM sync_entities WHERE client_id = $1 AND id = $2 FOR UPDATE",
+		se.ClientID, se.ID).Scan(&wasDeleted, &storedSize)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, false, nil // Conflict
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	res, err := tx.Exec(updatePostgresSyncEntityQuery,
+		se.Version, se.Mtime, se.Specifics, se.DataTypeMtime,
+		se.UniquePosition, se.ParentID, se.Name, se.NonUniqueName, se.Deleted, se.Folder,
+		se.ExpirationTime,
+		se.ClientID, se.ID, oldVersion, historyTypeID)
+	if err != nil {
+		return fail(err)
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return fail(err)
+	}
+
+	if rowsAffected == 0 {
+		return true, false, nil // Conflict
+	}
+
+	if deleting {
+		if se.ClientDefinedUniqueTag != nil {
+			_, err = tx.Exec("DELETE FROM sync_entities WHERE client_id = $1 AND id = $2",
+				se.ClientID, "Client#"+*se.ClientDefinedUniqueTag)
+			if err != nil {
+				return fail(err)
+			}
+		}
+		delete = !wasDeleted.Bool
+	} else if se.Deleted != nil || !wasDeleted.Bool {
+		grown := chainUsage{specificsBytes: int64(len(se.Specifics))}
+		if wasDeleted.Bool {
+			grown.entities = 1
+		} else {
+			grown.specificsBytes -= storedSize
+		}
+		if err = d.checkChainUsage(tx, se.ClientID, grown); err != nil {
+			return fail(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+
+	return false, delete, nil
+}
+
+const getPostgresClientItemCountQuery = `
+SELECT item_count,
+       history_item_count_period1,
+       history_item_count_period2,
+       history_item_count_period3,
+       history_item_count_period4,
+       last_period_change_time,
+       version
+FROM client_item_counts
+WHERE client_id = $1
+`
+
+const countPostgresClientItemsQuery = `
+SELECT
+    COALESCE(SUM(CASE WHEN data_type IN ($1, $2) THEN 0 ELSE 1 END), 0),
+    COALESCE(SUM(CASE WHEN data_type IN ($1, $2) THEN 1 ELSE 0 END), 0)
+FROM sync_entities
+WHERE client_id = $3 AND version IS NOT NULL AND NOT COALESCE(deleted, false)
+`
+
+func (d *PostgresDatastore) GetClientItemCount(clientID string) (*braveds.ClientItemCounts, error) {
+	fail := func(err error) (*braveds.ClientItemCounts, error) {
+		return nil, fmt.Errorf("GetClientItemCount: %w", classifyPostgresError(err))
+	}
+
+	now := time.Now().Unix()
+	counts := braveds.ClientItemCounts{ClientID: clientID, ID: clientID}
+	err := d.Db.QueryRow(getPostgresClientItemCountQuery, clientID).Scan(
+		&counts.ItemCount,
+		&counts.HistoryItemCountPeriod1,
+		&counts.HistoryItemCountPeriod2,
+		&counts.HistoryItemCountPeriod3,
+		&counts.HistoryItemCountPeriod4,
+		&counts.LastPeriodChangeTime,
+		&counts.Version,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		counts.LastPeriodChangeTime = now
+		counts.Version = clientItemCountsVersion
+		return &counts, nil
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	if counts.Version < clientItemCountsVersion {
+		err = d.Db.QueryRow(countPostgresClientItemsQuery,
+			historyTypeID, historyDeleteDirectiveTypeID, clientID,
+		).Scan(&counts.ItemCount, &counts.HistoryItemCountPeriod4)
+		if err != nil {
+			return fail(err)
+		}
+		counts.HistoryItemCountPeriod1 = 0
+		counts.HistoryItemCountPeriod2 = 0
+		counts.HistoryItemCountPeriod3 = 0
+		counts.LastPeriodChangeTime = now
+		counts.Version = clientItemCountsVersion
+	} else {
+		rotateHistoryCounts(&counts, now)
+	}
+
+	return &counts, nil
+}
+
+const upsertPostgresClientItemCountQuery = `
+INSERT INTO client_item_counts (
+    client_id, item_count,
+    history_item_count_period1, history_item_count_period2,
+    history_item_count_period3, history_item_count_period4,
+    last_period_change_time, version
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (client_id) DO UPDATE SET
+    item_count = excluded.item_count,
+    history_item_count_period1 = excluded.history_item_count_period1,
+    history_item_count_period2 = excluded.history_item_count_period2,
+    history_item_count_period3 = excluded.history_item_count_period3,
+    history_item_count_period4 = excluded.history_item_count_period4,
+    last_period_change_time = excluded.last_period_change_time,
+    version = excluded.version
+`
+
+// UpdateClientItemCount adds the new items to counts, which must come from
+// GetClientItemCount, and stores the result.
+func (d *PostgresDatastore) UpdateClientItemCount(counts *braveds.ClientItemCounts, newNormalItemCount int, newHistoryItemCount int) error {
+	counts.ItemCount += newNormalItemCount
+	counts.HistoryItemCountPeriod4 += newHistoryItemCount
+
+	_, err := d.Db.Exec(upsertPostgresClientItemCountQuery,
+		counts.ClientID,
+		counts.ItemCount,
+		counts.HistoryItemCountPeriod1,
+		counts.HistoryItemCountPeriod2,
+		counts.HistoryItemCountPeriod3,
+		counts.HistoryItemCountPeriod4,
+		counts.LastPeriodChangeTime,
+		counts.Version,
+	)
+	if err != nil {
+		return fmt.Errorf("UpdateClientItemCount: %w", classifyPostgresError(err))
+	}
+	return nil
+}
+
+const getPostgresUpdatesForTypeQuery = `
+SELECT ` + syncEntityColumns + `
+FROM sync_entities
+WHERE client_id = $1
+  AND data_type = $2
+  AND mtime > $3
+  AND ($4 OR folder = false)
+  AND (expiration_time IS NULL OR expiration_time > $5)
+ORDER BY mtime, id
+LIMIT $6
+`
+
+// GetUpdatesForType returns up to maxSize entities of the given type that
+// were modified after clientToken, ordered by mtime, and records the token
+// for tombstone compaction.
+func (d *PostgresDatastore) GetUpdatesForType(dataType int, clientToken int64, fetchFolders bool, clientID string, maxSize int64) (bool, []braveds.SyncEntity, error) {
+	fail := func(err error) (bool, []braveds.SyncEntity, error) {
+		return false, nil, fmt.Errorf("GetUpdatesForType: %w", classifyPostgresError(err))
+	}
+
+	rows, err := d.Db.Query(getPostgresUpdatesForTypeQuery,
+		clientID, dataType, clientToken, fetchFolders, time.Now().Unix(), maxSize)
+	if err != nil {
+		return fail(err)
+	}
+	defer rows.Close()
+
+	syncEntities := []braveds.SyncEntity{}
+	for rows.Next() {
+		entity, err := scanSyncEntity(rows)
+		if err != nil {
+			return fail(err)
+		}
+		syncEntities = append(syncEntities, entity)
+	}
+	if err = rows.Err(); err != nil {
+		return fail(err)
+	}
+	d.watermarks.record(clientID, dataType, clientToken)
+
+	hasChangesRemaining := int64(len(syncEntities)) == maxSize
+	return hasChangesRemaining, syncEntities, nil
+}
+
+func (d *PostgresDatastore) HasServerDefinedUniqueTag(clientID string, tag string) (bool, error) {
+	return d.HasItem(clientID, "Server#"+tag)
+}
+
+func (d *PostgresDatastore) HasItem(clientID string, ID string) (bool, error) {
+	var exists bool
+	err := d.Db.QueryRow("SELECT EXISTS(SELECT 1 FROM sync_entities WHERE client_id = $1 AND id = $2)",
+		clientID, ID).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("HasItem: %w", classifyPostgresError(err))
+	}
+	return exists, nil
+}
+
+// See clearServerDataQuery.
+const clearPostgresServerDataQuery = `
+DELETE FROM sync_entities
+WHERE client_id = $1 AND id != $2
+RETURNING ` + syncEntityColumns
+
+// ClearServerData deletes every entity, tag item and the item counts of a
+// client in one transaction, and returns the removed sync_entities rows.
+func (d *PostgresDatastore) ClearServerData(clientID string) ([]braveds.SyncEntity, error) {
+	fail := func(err error) ([]braveds.SyncEntity, error) {
+		return nil, fmt.Errorf("ClearServerData: %w", classifyPostgresError(err))
+	}
+
+	tx, err := d.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(clearPostgresServerDataQuery, clientID, disabledChainID)
+	if err != nil {
+		return fail(err)
+	}
+	defer rows.Close()
+
+	syncEntities := []braveds.SyncEntity{}
+	for rows.Next() {
+		entity, err := scanSyncEntity(rows)
+		if err != nil {
+			return fail(err)
+		}
+		syncEntities = append(syncEntities, entity)
+	}
+	if err = rows.Err(); err != nil {
+		return fail(err)
+	}
+	rows.Close()
+
+	if _, err = tx.Exec("DELETE FROM client_item_counts WHERE client_id = $1", clientID); err != nil {
+		return fail(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+
+	return syncEntities, nil
+}
+
+// DisableSyncChain stores the disabled chain marker, see
+// SqliteDatastore.DisableSyncChain.
+func (d *PostgresDatastore) DisableSyncChain(clientID string) error {
+	now := time.Now().UnixMilli()
+	_, err := d.Db.Exec(insertPostgresTagItemQuery+" ON CONFLICT (client_id, id) DO NOTHING",
+		clientID, disabledChainID, now, now)
+	if err != nil {
+		return fmt.Errorf("DisableSyncChain: %w", classifyPostgresError(err))
+	}
+	return nil
+}
+
+func (d *PostgresDatastore) IsSyncChainDisabled(clientID string) (bool, error) {
+	disabled, err := d.HasItem(clientID, disabledChainID)
+	if err != nil {
+		return false, fmt.Errorf("IsSyncChainDisabled: %w", err)
+	}
+	return disabled, nil
+}
+
+// SKIP LOCKED leaves rows that a commit is updating right now to the next
+// round, instead of waiting for it.
+const deletePostgresExpiredEntitiesQuery = `
+DELETE FROM sync_entities
+WHERE (client_id, id) IN (
+    SELECT client_id, id FROM sync_entities
+    WHERE expiration_time IS NOT NULL AND expiration_time <= $1
+    LIMIT $2
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING client_id, data_type, version, deleted, client_defined_unique_tag
+`
+
+// DeleteExpiredEntities deletes up to limit expired entities, see
+// SqliteDatastore.DeleteExpiredEntities.
+func (d *PostgresDatastore) DeleteExpiredEntities(now int64, limit int) (map[string]int, error) {
+	fail := func(err error) (map[string]int, error) {
+		return nil, fmt.Errorf("DeleteExpiredEntities: %w", classifyPostgresError(err))
+	}
+
+	tx, err := d.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(deletePostgresExpiredEntitiesQuery, now, limit)
+	if err != nil {
+		return fail(err)
+	}
+	defer rows.Close()
+
+	deleted := map[string]int{}
+	liveNormalItems := map[string]int{}
+	var clientTags [][2]string
+	for rows.Next() {
+		var clientID string
+		var dataType *int
+		var version *int64
+		var wasDeleted *bool
+		var clientTag *string
+		if err := rows.Scan(&clientID, &dataType, &version, &wasDeleted, &clientTag); err != nil {
+			return fail(err)
+		}
+		deleted[clientID]++
+		// A tombstone's tag may belong to a newer entity by now.
+		if version == nil || (wasDeleted != nil && *wasDeleted) {
+			continue
+		}
+		if !isHistoryDataType(dataType) {
+			liveNormalItems[clientID]++
+		}
+		if clientTag != nil {
+			clientTags = append(clientTags, [2]string{clientID, "Client#" + *clientTag})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fail(err)
+	}
+	rows.Close()
+
+	for _, tag := range clientTags {
+		if _, err = tx.Exec("DELETE FROM sync_entities WHERE client_id = $1 AND id = $2", tag[0], tag[1]); err != nil {
+			return fail(err)
+		}
+	}
+	for clientID, count := range liveNormalItems {
+		_, err = tx.Exec("UPDATE client_item_counts SET item_count = GREATEST(item_count - $1, 0) WHERE client_id = $2",
+			count, clientID)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+	return deleted, nil
+}
+
+const exportPostgresChainQuery = `
+SELECT ` + syncEntityColumns + `
+FROM sync_entities
+WHERE client_id = $1
+ORDER BY id
+`
+
+// ExportChain reads the chain of clientID in one transaction, see
+// SqliteDatastore.ExportChain.
+func (d *PostgresDatastore) ExportChain(clientID string) (ChainExport, error) {
+	fail := func(err error) (ChainExport, error) {
+		return ChainExport{}, fmt.Errorf("ExportChain: %w", classifyPostgresError(err))
+	}
+
+	tx, err := d.Db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(exportPostgresChainQuery, clientID)
+	if err != nil {
+		return fail(err)
+	}
+	defer rows.Close()
+
+	chain := ChainExport{ClientID: clientID, Entities: []braveds.SyncEntity{}}
+	for rows.Next() {
+		entity, err := scanSyncEntity(rows)
+		if err != nil {
+			return fail(err)
+		}
+		chain.Entities = append(chain.Entities, entity)
+	}
+	if err = rows.Err(); err != nil {
+		return fail(err)
+	}
+	rows.Close()
+
+	if chain.Counts, err = scanClientItemCounts(tx.QueryRow(getPostgresClientItemCountQuery, clientID), clientID); err != nil {
+		return fail(err)
+	}
+	return chain, nil
+}
+
+// ImportChain stores chain in one transaction, see
+// SqliteDatastore.ImportChain.
+func (d *PostgresDatastore) ImportChain(chain ChainExport, replace bool) error {
+	fail := func(err error) error {
+		return fmt.Errorf("ImportChain: %w", classifyPostgresError(err))
+	}
+
+	tx, err := d.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+
+	var hasData bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM sync_entities WHERE client_id = $1)
+		OR EXISTS(SELECT 1 FROM client_item_counts WHERE client_id = $1)`, chain.ClientID).Scan(&hasData)
+	if err != nil {
+		return fail(err)
+	}
+	if hasData && !replace {
+		return fail(fmt.Errorf("%w: chain %s already has data", ErrConflict, chain.ClientID))
+	}
+	if _, err = tx.Exec("DELETE FROM sync_entities WHERE client_id = $1", chain.ClientID); err != nil {
+		return fail(err)
+	}
+	if _, err = tx.Exec("DELETE FROM client_item_counts WHERE client_id = $1", chain.ClientID); err != nil {
+		return fail(err)
+	}
+
+	for i := range chain.Entities {
+		entity := chain.Entities[i]
+		entity.ClientID = chain.ClientID
+		if _, err = tx.Exec(insertPostgresSyncEntityQuery, syncEntityArgs(&entity)...); err != nil {
+			return fail(err)
+		}
+	}
+
+	if c := chain.Counts; c != nil {
+		_, err = tx.Exec(upsertPostgresClientItemCountQuery,
+			chain.ClientID,
+			c.ItemCount,
+			c.HistoryItemCountPeriod1,
+			c.HistoryItemCountPeriod2,
+			c.HistoryItemCountPeriod3,
+			c.HistoryItemCountPeriod4,
+			c.LastPeriodChangeTime,
+			c.Version,
+		)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+// See SqliteDatastore.checkChainUsage. The trigger's write to the chain's
+// usage row locks it until the commit, so two commits growing a chain cannot
+// both stay just under its quota.
+func (d *PostgresDatastore) checkChainUsage(tx *sql.Tx, clientID string, grown chainUsage) error {
+	quota := d.quotas.For(clientID)
+	if !quota.limitsUsage() || (grown.entities <= 0 && grown.specificsBytes <= 0) {
+		return nil
+	}
+	usage, err := readChainUsage(tx, "SELECT entities, specifics_bytes FROM chain_usage WHERE client_id = $1", clientID)
+	if err != nil {
+		return err
+	}
+	return quota.checkUsage(usage, grown)
+}
+
+const recordPostgresFetchQuery = `
+INSERT INTO fetch_watermarks (client_id, data_type, day, min_token)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (client_id, data_type, day) DO UPDATE SET
+    min_token = LEAST(fetch_watermarks.min_token, excluded.min_token)
+`
+
+// FlushWatermarks writes the fetches recorded since the last write.
+func (d *PostgresDatastore) FlushWatermarks() error {
+	pending := d.watermarks.take()
+	if len(pending) == 0 {
+		return nil
+	}
+	err := func() error {
+		tx, err := d.Db.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err = writeWatermarks(tx, recordPostgresFetchQuery, pending); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		d.watermarks.giveBack(pending)
+		return fmt.Errorf("FlushWatermarks: %w", classifyPostgresError(err))
+	}
+	return nil
+}
+
+const compactPostgresTombstonesQuery = `
+DELETE FROM sync_entities
+WHERE (client_id, id) IN (
+    SELECT e.client_id, e.id FROM sync_entities e
+    WHERE e.deleted AND e.version IS NOT NULL AND e.mtime < $1
+      AND e.mtime <= (
+          SELECT MIN(w.min_token) FROM fetch_watermarks w
+          WHERE w.client_id = e.client_id AND w.data_type = e.data_type AND w.day >= $2
+      )
+      AND e.client_id NOT IN (
+          SELECT d.client_id FROM sync_entities d
+          WHERE d.data_type = 154522 AND d.mtime < $1
+            AND d.deleted IS NOT TRUE AND d.version IS NOT NULL
+      )
+    LIMIT $3
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING client_id,
+    octet_length(client_id) + octet_length(id)
+    + COALESCE(octet_length(parent_id), 0)
+    + COALESCE(octet_length(name), 0)
+    + COALESCE(octet_length(non_unique_name), 0)
+    + COALESCE(octet_length(server_defined_unique_tag), 0)
+    + COALESCE(octet_length(originator_cache_guid), 0)
+    + COALESCE(octet_length(originator_client_item_id), 0)
+    + COALESCE(octet_length(specifics), 0)
+    + COALESCE(octet_length(client_defined_unique_tag), 0)
+    + COALESCE(octet_length(unique_position), 0)
+    + COALESCE(octet_length(data_type_mtime), 0)
+`
+
+// CompactTombstones removes up to limit tombstones, see
+// SqliteDatastore.CompactTombstones.
+func (d *PostgresDatastore) CompactTombstones(cutoff int64, limit int) (map[string]TombstoneStats, error) {
+	pending := d.watermarks.take()
+	fail := func(err error) (map[string]TombstoneStats, error) {
+		d.watermarks.giveBack(pending)
+		return nil, fmt.Errorf("CompactTombstones: %w", classifyPostgresError(err))
+	}
+
+	tx, err := d.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+	if err = writeWatermarks(tx, recordPostgresFetchQuery, pending); err != nil {
+		return fail(err)
+	}
+
+	cutoffDay := cutoff / millisPerDay
+	rows, err := tx.Query(compactPostgresTombstonesQuery, cutoff, cutoffDay, limit)
+	if err != nil {
+		return fail(err)
+	}
+	defer rows.Close()
+
+	compacted := map[string]TombstoneStats{}
+	for rows.Next() {
+		var clientID string
+		var bytes int64
+		if err := rows.Scan(&clientID, &bytes); err != nil {
+			return fail(err)
+		}
+		stats := compacted[clientID]
+		stats.add(TombstoneStats{Rows: 1, Bytes: bytes})
+		compacted[clientID] = stats
+	}
+	if err = rows.Err(); err != nil {
+		return fail(err)
+	}
+	rows.Close()
+
+	if _, err = tx.Exec("DELETE FROM fetch_watermarks WHERE day < $1", cutoffDay); err != nil {
+		return fail(err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+	return compacted, nil
+}
@@ -0,0 +1,367 @@
+package internal_test
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/mikaelhg/litesync/internal/datastoretest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lookPostgresBinary finds a postgres program in $PG_BIN or on the PATH.
+func lookPostgresBinary(name string) (string, error) {
+	if dir := os.Getenv("PG_BIN"); dir != "" {
+		return exec.LookPath(filepath.Join(dir, name))
+	}
+	return exec.LookPath(name)
+}
+
+// skipPostgres skips a test which has no server to run against, except on
+// CI, which provides one and where a skip would go unnoticed.
+func skipPostgres(t *testing.T, reason string) {
+	if os.Getenv("CI") != "" {
+		t.Fatalf("%s, the CI workflow must provide a server", reason)
+	}
+	t.Skip(reason)
+}
+
+// startPostgres returns the DSN of a Postgres server to test against. That
+// is $LITESYNC_TEST_POSTGRES_DSN, whose tables the tests drop, or else a
+// throwaway server started from the local postgres binaries.
+func startPostgres(t *testing.T) string {
+	if dsn := os.Getenv("LITESYNC_TEST_POSTGRES_DSN"); dsn != "" {
+		return dsn
+	}
+	initdb, err := lookPostgresBinary("initdb")
+	if err != nil {
+		skipPostgres(t, "postgres binaries not found, set PG_BIN or LITESYNC_TEST_POSTGRES_DSN")
+	}
+	postgres, err := lookPostgresBinary("postgres")
+	if err != nil {
+		skipPostgres(t, "postgres binaries not found, set PG_BIN or LITESYNC_TEST_POSTGRES_DSN")
+	}
+	if os.Geteuid() == 0 {
+		skipPostgres(t, "postgres refuses to run as root, set LITESYNC_TEST_POSTGRES_DSN")
+	}
+
+	dataDir := t.TempDir()
+	// Unix socket paths are limited to about 100 bytes, test temp dirs
+	// can be longer than that.
+	socketDir, err := os.MkdirTemp("", "pg")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(socketDir) })
+
+	out, err := exec.Command(initdb, "-D", dataDir, "-U", "postgres", "-A", "trust", "--no-sync").CombinedOutput()
+	require.NoError(t, err, "initdb: %s", out)
+
+	server := exec.Command(postgres, "-D", dataDir, "-k", socketDir, "-c", "listen_addresses=", "-F")
+	require.NoError(t, server.Start())
+	t.Cleanup(func() {
+		server.Process.Signal(os.Interrupt)
+		server.Wait()
+	})
+
+	dsn := fmt.Sprintf("host=%s user=postgres dbname=postgres sslmode=disable", socketDir)
+	db, err := sql.Open("pgx", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Eventually(t, func() bool { return db.Ping() == nil }, 30*time.Second, 100*time.Millisecond,
+		"postgres did not start")
+	return dsn
+}
+
+// newPostgresDatastore opens a datastore on an empty schema.
+func newPostgresDatastore(t *testing.T, dsn string) *internal.PostgresDatastore {
+	db, err := sql.Open("pgx", dsn)
+	require.NoError(t, err)
+	_, err = db.Exec("DROP TABLE IF EXISTS sync_entities, client_item_counts, fetch_watermarks, chain_usage, schema_version")
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	ds, err := internal.NewPostgresDatastore(dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { ds.Close() })
+	return ds
+}
+
+func TestPostgresDatastore(t *testing.T) {
+	dsn := startPostgres(t)
+
+	t.Run("Migrate", func(t *testing.T) {
+		ds := newPostgresDatastore(t, dsn)
+		files, err := filepath.Glob(filepath.Join("migrations", "postgres", "*.sql"))
+		require.NoError(t, err)
+
+		version, err := ds.SchemaVersion()
+		assert.NoError(t, err)
+		assert.Equal(t, len(files), version)
+
+		assert.NoError(t, ds.Migrate())
+		version, err = ds.SchemaVersion()
+		assert.NoError(t, err)
+		assert.Equal(t, len(files), version)
+	})
+
+	t.Run("Conformance", func(t *testing.T) {
+		datastoretest.RunConformance(t, func(t *testing.T) datastore.Datastore {
+			return newPostgresDatastore(t, dsn)
+		})
+	})
+
+	t.Run("InsertConflict", func(t *testing.T) {
+		ds := newPostgresDatastore(t, dsn)
+		entity := datastore.SyncEntity{
+			ClientID:               "client1",
+			ID:                     "id1",
+			Version:                aws.Int64(1),
+			ClientDefinedUniqueTag: aws.String("tag1"),
+			DataType:               aws.Int(123),
+		}
+		conflict, err := ds.InsertSyncEntity(&entity)
+		require.NoError(t, err)
+		assert.False(t, conflict)
+
+		conflict, err = ds.InsertSyncEntity(&entity)
+		assert.ErrorIs(t, err, internal.ErrConflict)
+		assert.True(t, conflict)
+
+		entity.ID = "id2"
+		conflict, err = ds.InsertSyncEntity(&entity)
+		assert.ErrorIs(t, err, internal.ErrConflict)
+		assert.True(t, conflict)
+
+		has, err := ds.HasItem("client1", "id2")
+		assert.NoError(t, err)
+		assert.False(t, has, "the failed insert must not leave the entity behind")
+		has, err = ds.HasItem("client1", "Client#tag1")
+		assert.NoError(t, err)
+		assert.True(t, has)
+	})
+
+	t.Run("UpdateSyncEntity", func(t *testing.T) {
+		ds := newPostgresDatastore(t, dsn)
+		entity := datastore.SyncEntity{
+			ClientID:               "client1",
+			ID:                     "id1",
+			Version:                aws.Int64(1),
+			Mtime:                  aws.Int64(1),
+			ClientDefinedUniqueTag: aws.String("tag1"),
+			DataType:               aws.Int(123),
+			Folder:                 aws.Bool(false),
+			Deleted:                aws.Bool(false),
+			Name:                   aws.String("name"),
+			Specifics:              []byte{1},
+		}
+		_, err := ds.InsertSyncEntity(&entity)
+		require.NoError(t, err)
+
+		update := entity
+		update.Version = aws.Int64(2)
+		update.Name = nil
+		update.Specifics = []byte{2}
+		conflict, deleted, err := ds.UpdateSyncEntity(&update, 5)
+		assert.NoError(t, err)
+		assert.True(t, conflict, "a stale version should conflict")
+		assert.False(t, deleted)
+
+		conflict, deleted, err = ds.UpdateSyncEntity(&update, 1)
+		assert.NoError(t, err)
+		assert.False(t, conflict)
+		assert.False(t, deleted)
+
+		_, entities, err := ds.GetUpdatesForType(123, 0, true, "client1", 10)
+		require.NoError(t, err)
+		require.Len(t, entities, 1)
+		assert.Equal(t, int64(2), *entities[0].Version)
+		assert.Equal(t, "name", *entities[0].Name, "a nil field keeps its stored value")
+		assert.Equal(t, []byte{2}, entities[0].Specifics)
+
+		update.Version = aws.Int64(3)
+		update.Deleted = aws.Bool(true)
+		conflict, deleted, err = ds.UpdateSyncEntity(&update, 2)
+		assert.NoError(t, err)
+		assert.False(t, conflict)
+		assert.True(t, deleted)
+
+		// The tag is free again once its entity is deleted.
+		reuse := entity
+		reuse.ID = "id2"
+		conflict, err = ds.InsertSyncEntity(&reuse)
+		assert.NoError(t, err)
+		assert.False(t, conflict)
+
+		conflict, _, err = ds.UpdateSyncEntity(&datastore.SyncEntity{
+			ClientID: "client1", ID: "missing", Version: aws.Int64(2),
+		}, 1)
+		assert.NoError(t, err)
+		assert.True(t, conflict)
+	})
+
+	t.Run("HistoryIgnoresVersion", func(t *testing.T) {
+		ds := newPostgresDatastore(t, dsn)
+		entity := datastore.SyncEntity{
+			ClientID: "client1",
+			ID:       "id1",
+			Version:  aws.Int64(1),
+			Mtime:    aws.Int64(1),
+			DataType: aws.Int(963985),
+		}
+		_, err := ds.InsertSyncEntity(&entity)
+		require.NoError(t, err)
+
+		entity.Version = aws.Int64(7)
+		conflict, _, err := ds.UpdateSyncEntity(&entity, 42)
+		assert.NoError(t, err)
+		assert.False(t, conflict)
+	})
+
+	t.Run("GetUpdatesForType", func(t *testing.T) {
+		ds := newPostgresDatastore(t, dsn)
+		past := time.Now().Add(-time.Hour).Unix()
+		for _, entity := range []datastore.SyncEntity{
+			{ClientID: "client1", ID: "c", Version: aws.Int64(1), Mtime: aws.Int64(30), DataType: aws.Int(123), Folder: aws.Bool(false)},
+			{ClientID: "client1", ID: "a", Version: aws.Int64(1), Mtime: aws.Int64(10), DataType: aws.Int(123), Folder: aws.Bool(false)},
+			{ClientID: "client1", ID: "b", Version: aws.Int64(1), Mtime: aws.Int64(20), DataType: aws.Int(123), Folder: aws.Bool(true)},
+			{ClientID: "client1", ID: "d", Version: aws.Int64(1), Mtime: aws.Int64(40), DataType: aws.Int(123), Folder: aws.Bool(false), ExpirationTime: &past},
+			{ClientID: "client1", ID: "e", Version: aws.Int64(1), Mtime: aws.Int64(50), DataType: aws.Int(124), Folder: aws.Bool(false)},
+			{ClientID: "client2", ID: "f", Version: aws.Int64(1), Mtime: aws.Int64(60), DataType: aws.Int(123), Folder: aws.Bool(false)},
+		} {
+			_, err := ds.InsertSyncEntity(&entity)
+			require.NoError(t, err)
+		}
+
+		hasChangesRemaining, entities, err := ds.GetUpdatesForType(123, 0, true, "client1", 2)
+		require.NoError(t, err)
+		assert.True(t, hasChangesRemaining)
+		require.Len(t, entities, 2)
+		assert.Equal(t, "a", entities[0].ID)
+		assert.Equal(t, "b", entities[1].ID)
+
+		hasChangesRemaining, entities, err = ds.GetUpdatesForType(123, 20, true, "client1", 2)
+		require.NoError(t, err)
+		assert.False(t, hasChangesRemaining)
+		require.Len(t, entities, 1, "expired entities are left out")
+		assert.Equal(t, "c", entities[0].ID)
+
+		_, entities, err = ds.GetUpdatesForType(123, 0, false, "client1", 10)
+		require.NoError(t, err)
+		require.Len(t, entities, 2, "folders are left out")
+	})
+
+	t.Run("ClientItemCount", func(t *testing.T) {
+		ds := newPostgresDatastore(t, dsn)
+		counts, err := ds.GetClientItemCount("client1")
+		require.NoError(t, err)
+		assert.Equal(t, 0, counts.ItemCount)
+
+		require.NoError(t, ds.UpdateClientItemCount(counts, 3, 2))
+		counts, err = ds.GetClientItemCount("client1")
+		require.NoError(t, err)
+		assert.Equal(t, 3, counts.ItemCount)
+		assert.Equal(t, 2, counts.SumHistoryCounts())
+
+		require.NoError(t, ds.UpdateClientItemCount(counts, -1, 0))
+		counts, err = ds.GetClientItemCount("client1")
+		require.NoError(t, err)
+		assert.Equal(t, 2, counts.ItemCount)
+	})
+
+	t.Run("ServerTags", func(t *testing.T) {
+		ds := newPostgresDatastore(t, dsn)
+		entity := datastore.SyncEntity{
+			ClientID:               "client1",
+			ID:                     "id1",
+			Version:                aws.Int64(1),
+			Mtime:                  aws.Int64(1),
+			Ctime:                  aws.Int64(1),
+			ServerDefinedUniqueTag: aws.String("bookmarks"),
+			DataType:               aws.Int(123),
+		}
+		require.NoError(t, ds.InsertSyncEntitiesWithServerTags([]*datastore.SyncEntity{&entity}))
+
+		has, err := ds.HasServerDefinedUniqueTag("client1", "bookmarks")
+		assert.NoError(t, err)
+		assert.True(t, has)
+
+		again := entity
+		again.ID = "id2"
+		err = ds.InsertSyncEntitiesWithServerTags([]*datastore.SyncEntity{&again})
+		assert.ErrorIs(t, err, internal.ErrConflict)
+		has, err = ds.HasItem("client1", "id2")
+		assert.NoError(t, err)
+		assert.False(t, has)
+	})
+
+	t.Run("ClearAndDisable", func(t *testing.T) {
+		ds := newPostgresDatastore(t, dsn)
+		entity := datastore.SyncEntity{
+			ClientID:               "client1",
+			ID:                     "id1",
+			Version:                aws.Int64(1),
+			ClientDefinedUniqueTag: aws.String("tag1"),
+			DataType:               aws.Int(123),
+		}
+		_, err := ds.InsertSyncEntity(&entity)
+		require.NoError(t, err)
+		counts, err := ds.GetClientItemCount("client1")
+		require.NoError(t, err)
+		require.NoError(t, ds.UpdateClientItemCount(counts, 1, 0))
+
+		require.NoError(t, ds.DisableSyncChain("client1"))
+		require.NoError(t, ds.DisableSyncChain("client1"), "disabling twice is fine")
+
+		cleared, err := ds.ClearServerData("client1")
+		require.NoError(t, err)
+		assert.Len(t, cleared, 2, "the entity and its tag item")
+
+		disabled, err := ds.IsSyncChainDisabled("client1")
+		assert.NoError(t, err)
+		assert.True(t, disabled, "clearing keeps the disabled marker")
+		disabled, err = ds.IsSyncChainDisabled("client2")
+		assert.NoError(t, err)
+		assert.False(t, disabled)
+
+		counts, err = ds.GetClientItemCount("client1")
+		require.NoError(t, err)
+		assert.Equal(t, 0, counts.ItemCount)
+	})
+
+	t.Run("DeleteExpiredEntities", func(t *testing.T) {
+		ds := newPostgresDatastore(t, dsn)
+		past := time.Now().Add(-time.Hour).Unix()
+		for _, entity := range []datastore.SyncEntity{
+			{ClientID: "client1", ID: "expired", Version: aws.Int64(1), DataType: aws.Int(123), ClientDefinedUniqueTag: aws.String("tag1"), ExpirationTime: &past},
+			{ClientID: "client1", ID: "live", Version: aws.Int64(1), DataType: aws.Int(123)},
+		} {
+			_, err := ds.InsertSyncEntity(&entity)
+			require.NoError(t, err)
+		}
+		counts, err := ds.GetClientItemCount("client1")
+		require.NoError(t, err)
+		require.NoError(t, ds.UpdateClientItemCount(counts, 2, 0))
+
+		deleted, err := ds.DeleteExpiredEntities(time.Now().Unix(), 10)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{"client1": 1}, deleted)
+
+		has, err := ds.HasItem("client1", "Client#tag1")
+		assert.NoError(t, err)
+		assert.False(t, has)
+		counts, err = ds.GetClientItemCount("client1")
+		require.NoError(t, err)
+		assert.Equal(t, 1, counts.ItemCount)
+	})
+
+	t.Run("DeleteExpiredEntitiesKeepsReusedTags", func(t *testing.T) {
+		checkReapKeepsReusedTag(t, newPostgresDatastore(t, dsn))
+	})
+}
@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// classifyPostgresError wraps err in the sentinel matching its Postgres
+// SQLSTATE, like classifySqliteError does for SQLite.
+func classifyPostgresError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+
+	var kind error
+	switch pgErr.Code {
+	case "23505": // unique_violation
+		kind = ErrConflict
+	case "40001", "40P01", "55P03": // serialization_failure, deadlock_detected, lock_not_available
+		kind = ErrBusy
+	case "XX001", "XX002": // data_corrupted, index_corrupted
+		kind = ErrCorrupt
+	case "53100": // disk_full
+		kind = ErrDiskFull
+	case "25006": // read_only_sql_transaction
+		kind = ErrReadOnly
+	}
+	if kind == nil {
+		return err
+	}
+	return fmt.Errorf("%w: %w", kind, err)
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"time"
+)
+
+// The Postgres schema has its own migration history, it started out as the
+// SQLite schema of the time.
+//
+//go:embed migrations/postgres/*.sql
+var postgresMigrationFiles embed.FS
+
+// postgresMigrationLockID keeps servers started at the same time from
+// applying a migration twice.
+const postgresMigrationLockID int64 = 0x6c69746573796e63 // "litesync"
+
+const createPostgresSchemaVersionTableQuery = `
+CREATE TABLE IF NOT EXISTS schema_version (
+     version INTEGER NOT NULL PRIMARY KEY,
+     name TEXT NOT NULL,
+     applied_at BIGINT NOT NULL
+)
+`
+
+// SchemaVersion returns the version of the last migration applied to the
+// database, or 0 for a database which has never been migrated.
+func (d *PostgresDatastore) SchemaVersion() (int, error) {
+	if _, err := d.Db.Exec(createPostgresSchemaVersionTableQuery); err != nil {
+		return 0, fmt.Errorf("SchemaVersion: %w", classifyPostgresError(err))
+	}
+	var version int
+	if err := d.Db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("SchemaVersion: %w", classifyPostgresError(err))
+	}
+	return version, nil
+}
+
+// Migrate applies every migration newer than the database's schema version,
+// each one in its own transaction.
+func (d *PostgresDatastore) Migrate() error {
+	fail := func(err error) error {
+		return fmt.Errorf("Migrate: %w", err)
+	}
+
+	migrations, err := loadMigrations(postgresMigrationFiles, "migrations/postgres")
+	if err != nil {
+		return fail(err)
+	}
+
+	current, err := d.SchemaVersion()
+	if err != nil {
+		return fail(err)
+	}
+	if current > len(migrations) {
+		return fail(fmt.Errorf("%w: database is at version %d, latest known is %d",
+			ErrSchemaTooNew, current, len(migrations)))
+	}
+
+	for _, m := range migrations[current:] {
+		if err := d.applyMigration(m); err != nil {
+			return fail(fmt.Errorf("migration %s: %w", m.name, classifyPostgresError(err)))
+		}
+	}
+	return nil
+}
+
+func (d *PostgresDatastore) applyMigration(m migration) error {
+	tx, err := d.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", postgresMigrationLockID); err != nil {
+		return err
+	}
+	// Another server may have applied it while we waited for the lock.
+	var applied bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM schema_version WHERE version = $1)", m.version).Scan(&applied)
+	if err != nil || applied {
+		return err
+	}
+
+	if _, err = tx.Exec(m.query); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES ($1, $2, $3)",
+		m.version, m.name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
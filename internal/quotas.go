@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	braveds "github.com/brave/go-sync/datastore"
+)
+
+// ErrOverQuota is returned when a write would take a chain over its quota.
+// The command handler reports the commits it fails as OVER_QUOTA.
+var ErrOverQuota = errors.New("chain is over its quota")
+
+// Quota limits what a chain stores, a zero limit is unlimited. Entities
+// and specifics bytes count the live entities, tombstones and tag items are
+// not counted. Specifics bytes are counted as stored, after compression and
+// encryption, while MaxEntitySize limits the specifics a device sends.
+type Quota struct {
+	MaxEntities       int
+	MaxSpecificsBytes int64
+	MaxEntitySize     int
+}
+
+// limitsUsage reports whether the quota limits the chain as a whole, which
+// takes reading the chain's usage on every write.
+func (q Quota) limitsUsage() bool {
+	return q.MaxEntities > 0 || q.MaxSpecificsBytes > 0
+}
+
+func (q Quota) checkEntity(entity *braveds.SyncEntity) error {
+	if q.MaxEntitySize > 0 && len(entity.Specifics) > q.MaxEntitySize {
+		return fmt.Errorf("%w: entity %s has %d bytes of specifics, the limit is %d",
+			ErrOverQuota, entity.ID, len(entity.Specifics), q.MaxEntitySize)
+	}
+	return nil
+}
+
+// chainUsage is what a chain stores, or what a write added to it.
+type chainUsage struct {
+	entities       int
+	specificsBytes int64
+}
+
+// checkUsage only checks the limits which the write grew, so that a chain
+// over a lowered quota can still delete and shrink its entities.
+func (q Quota) checkUsage(usage, grown chainUsage) error {
+	if q.MaxEntities > 0 && grown.entities > 0 && usage.entities > q.MaxEntities {
+		return fmt.Errorf("%w: %d entities, the limit is %d", ErrOverQuota, usage.entities, q.MaxEntities)
+	}
+	if q.MaxSpecificsBytes > 0 && grown.specificsBytes > 0 && usage.specificsBytes > q.MaxSpecificsBytes {
+		return fmt.Errorf("%w: %d bytes of specifics, the limit is %d", ErrOverQuota, usage.specificsBytes, q.MaxSpecificsBytes)
+	}
+	return nil
+}
+
+// Quotas are the quota of every chain, and the overrides of some of them.
+type Quotas struct {
+	Default   Quota
+	Overrides map[string]Quota
+}
+
+// For returns the quota of a chain, a nil Quotas leaves chains unlimited.
+func (q *Quotas) For(clientID string) Quota {
+	if q == nil {
+		return Quota{}
+	}
+	if quota, ok := q.Overrides[clientID]; ok {
+		return quota
+	}
+	return q.Default
+}
+
+func LoadQuotas(defaults Quota, path string) (*Quotas, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	quotas, err := ParseQuotas(defaults, string(text))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return quotas, nil
+}
+
+// ParseQuotas reads one override per line as "<client id> <limit>=<value>...",
+// with the limits max_entities, max_specifics_bytes and max_entity_size. The
+// limits a line leaves out are the defaults, 0 lifts one. Blank lines and
+// lines starting with # are skipped.
+func ParseQuotas(defaults Quota, text string) (*Quotas, error) {
+	quotas := &Quotas{Default: defaults, Overrides: map[string]Quota{}}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		clientID := fields[0]
+		if _, dup := quotas.Overrides[clientID]; dup {
+			return nil, fmt.Errorf("line %d: duplicate client ID %q", line, clientID)
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("line %d: expected <client id> <limit>=<value>...", line)
+		}
+		quota := defaults
+		for _, field := range fields[1:] {
+			name, value, ok := strings.Cut(field, "=")
+			limit, err := strconv.ParseInt(value, 10, 64)
+			if !ok || err != nil || limit < 0 {
+				return nil, fmt.Errorf("line %d: expected <limit>=<non-negative number>, got %q", line, field)
+			}
+			switch name {
+			case "max_entities":
+				quota.MaxEntities = int(limit)
+			case "max_specifics_bytes":
+				quota.MaxSpecificsBytes = limit
+			case "max_entity_size":
+				quota.MaxEntitySize = int(limit)
+			default:
+				return nil, fmt.Errorf("line %d: unknown limit %q", line, name)
+			}
+		}
+		quotas.Overrides[clientID] = quota
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return quotas, nil
+}
+
+// readChainUsage reads the chain_usage row of the chain, which the triggers
+// of sync_entities keep up to date within the transaction.
+func readChainUsage(tx *sql.Tx, query, clientID string) (chainUsage, error) {
+	var usage chainUsage
+	err := tx.QueryRow(query, clientID).Scan(&usage.entities, &usage.specificsBytes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return chainUsage{}, nil
+	}
+	return usage, err
+}
+
+// checkChainUsage reads the usage of the chain within the write's
+// transaction, once the write is done, and fails when it grew the chain over
+// its quota.
+func (d *SqliteDatastore) checkChainUsage(tx *sql.Tx, clientID string, grown chainUsage) error {
+	quota := d.quotas.For(clientID)
+	if !quota.limitsUsage() || (grown.entities <= 0 && grown.specificsBytes <= 0) {
+		return nil
+	}
+	usage, err := readChainUsage(tx, "SELECT entities, specifics_bytes FROM chain_usage WHERE client_id = ?", clientID)
+	if err != nil {
+		return err
+	}
+	return quota.checkUsage(usage, grown)
+}
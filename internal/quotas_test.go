@@ -0,0 +1,167 @@
+package internal_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/brave/go-sync/datastore"
+	"github.com/brave/go-sync/schema/protobuf/sync_pb"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQuotas(t *testing.T) {
+	defaults := internal.Quota{MaxEntities: 100, MaxSpecificsBytes: 1000, MaxEntitySize: 10}
+	quotas, err := internal.ParseQuotas(defaults, `
+# a heavy user
+client1 max_entities=500 max_entity_size=0
+client2   max_specifics_bytes=5000
+`)
+	require.NoError(t, err)
+	assert.Equal(t, internal.Quota{MaxEntities: 500, MaxSpecificsBytes: 1000}, quotas.For("client1"))
+	assert.Equal(t, internal.Quota{MaxEntities: 100, MaxSpecificsBytes: 5000, MaxEntitySize: 10}, quotas.For("client2"))
+	assert.Equal(t, defaults, quotas.For("client3"))
+
+	for _, text := range []string{
+		"client1",
+		"client1 max_entities",
+		"client1 max_entities=-1",
+		"client1 max_items=1",
+		"client1 max_entities=1\nclient1 max_entities=2",
+	} {
+		_, err := internal.ParseQuotas(defaults, text)
+		assert.Error(t, err, text)
+	}
+}
+
+func quotaEntity(clientID, id string, specifics string) *datastore.SyncEntity {
+	return &datastore.SyncEntity{
+		ClientID:  clientID,
+		ID:        id,
+		Version:   aws.Int64(1),
+		Mtime:     aws.Int64(1000),
+		Specifics: []byte(specifics),
+		DataType:  aws.Int(123),
+		Folder:    aws.Bool(false),
+	}
+}
+
+func TestQuotasLimitInserts(t *testing.T) {
+	opts := internal.DefaultSqliteOptions()
+	opts.Quotas = &internal.Quotas{
+		Default:   internal.Quota{MaxEntities: 2, MaxSpecificsBytes: 10, MaxEntitySize: 6},
+		Overrides: map[string]internal.Quota{"unlimited": {}},
+	}
+	ds, err := internal.NewSqliteDatastoreWithOptions(filepath.Join(t.TempDir(), "litesync.sqlite"), opts)
+	require.NoError(t, err)
+	defer ds.Close()
+
+	_, err = ds.InsertSyncEntity(quotaEntity("client", "big", "1234567"))
+	assert.ErrorIs(t, err, internal.ErrOverQuota, "entity size")
+
+	for i := 1; i <= 2; i++ {
+		_, err = ds.InsertSyncEntity(quotaEntity("client", fmt.Sprintf("id%d", i), "12345"))
+		require.NoError(t, err)
+	}
+	conflict, err := ds.InsertSyncEntity(quotaEntity("client", "id3", "1"))
+	assert.ErrorIs(t, err, internal.ErrOverQuota, "entities")
+	assert.False(t, conflict)
+
+	for i := 1; i <= 3; i++ {
+		_, err = ds.InsertSyncEntity(quotaEntity("unlimited", fmt.Sprintf("id%d", i), "1234567"))
+		require.NoError(t, err)
+	}
+
+	err = ds.InsertSyncEntitiesWithServerTags([]*datastore.SyncEntity{
+		quotaEntity("client2", "id1", "123456"), quotaEntity("client2", "id2", "123456"),
+	})
+	assert.ErrorIs(t, err, internal.ErrOverQuota, "specifics bytes")
+	has, err := ds.HasItem("client2", "id1")
+	require.NoError(t, err)
+	assert.False(t, has, "the batch is rolled back")
+}
+
+func TestQuotasLimitUpdates(t *testing.T) {
+	opts := internal.DefaultSqliteOptions()
+	opts.Quotas = &internal.Quotas{Default: internal.Quota{MaxEntities: 1, MaxSpecificsBytes: 10}}
+	ds, err := internal.NewSqliteDatastoreWithOptions(filepath.Join(t.TempDir(), "litesync.sqlite"), opts)
+	require.NoError(t, err)
+	defer ds.Close()
+
+	entity := quotaEntity("client", "id1", "12345")
+	_, err = ds.InsertSyncEntity(entity)
+	require.NoError(t, err)
+
+	entity.Version = aws.Int64(2)
+	entity.Specifics = []byte("12345678901")
+	_, _, err = ds.UpdateSyncEntity(entity, 1)
+	assert.ErrorIs(t, err, internal.ErrOverQuota, "growing past the limit")
+
+	entity.Specifics = []byte("1234567890")
+	_, _, err = ds.UpdateSyncEntity(entity, 1)
+	require.NoError(t, err)
+
+	// Deleting frees the entity for another one, which then keeps the first
+	// from coming back.
+	entity.Version = aws.Int64(3)
+	entity.Deleted = aws.Bool(true)
+	_, deleted, err := ds.UpdateSyncEntity(entity, 2)
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	_, err = ds.InsertSyncEntity(quotaEntity("client", "id2", "1"))
+	require.NoError(t, err)
+
+	entity.Version = aws.Int64(4)
+	entity.Deleted = aws.Bool(false)
+	_, _, err = ds.UpdateSyncEntity(entity, 3)
+	assert.ErrorIs(t, err, internal.ErrOverQuota, "undeleting")
+}
+
+func TestOverQuotaResponses(t *testing.T) {
+	opts := internal.DefaultSqliteOptions()
+	opts.Quotas = &internal.Quotas{Default: internal.Quota{MaxEntities: 1, MaxEntitySize: 6}}
+	ds, err := internal.NewSqliteDatastoreWithOptions(filepath.Join(t.TempDir(), "litesync.sqlite"), opts)
+	require.NoError(t, err)
+	defer ds.Close()
+	store, mark := internal.TrackOverQuota(ds)
+
+	// A new entity is known by the client's ID, an update by the server's.
+	first := quotaEntity("client", "server1", "12345")
+	first.OriginatorClientItemID = aws.String("client1")
+	_, err = store.InsertSyncEntity(first)
+	require.NoError(t, err)
+	second := quotaEntity("client", "server2", "1")
+	second.OriginatorClientItemID = aws.String("client2")
+	_, err = store.InsertSyncEntity(second)
+	require.ErrorIs(t, err, internal.ErrOverQuota)
+	first.Version = aws.Int64(2)
+	first.Specifics = []byte("1234567")
+	_, _, err = store.UpdateSyncEntity(first, 1)
+	require.ErrorIs(t, err, internal.ErrOverQuota)
+
+	commit := &sync_pb.CommitMessage{}
+	rsp := &sync_pb.CommitResponse{}
+	for id, responseType := range map[string]sync_pb.CommitResponse_ResponseType{
+		"client2": sync_pb.CommitResponse_TRANSIENT_ERROR,
+		"server1": sync_pb.CommitResponse_TRANSIENT_ERROR,
+		"client3": sync_pb.CommitResponse_TRANSIENT_ERROR,
+		"client1": sync_pb.CommitResponse_SUCCESS,
+	} {
+		commit.Entries = append(commit.Entries, &sync_pb.SyncEntity{IdString: aws.String(id)})
+		rsp.Entryresponse = append(rsp.Entryresponse, &sync_pb.CommitResponse_EntryResponse{ResponseType: responseType.Enum()})
+	}
+	mark(commit, rsp)
+
+	expected := map[string]sync_pb.CommitResponse_ResponseType{
+		"client2": sync_pb.CommitResponse_OVER_QUOTA,
+		"server1": sync_pb.CommitResponse_OVER_QUOTA,
+		"client3": sync_pb.CommitResponse_TRANSIENT_ERROR,
+		"client1": sync_pb.CommitResponse_SUCCESS,
+	}
+	for i, entry := range commit.Entries {
+		assert.Equal(t, expected[entry.GetIdString()], rsp.Entryresponse[i].GetResponseType(), entry.GetIdString())
+	}
+}
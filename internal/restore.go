@@ -0,0 +1,337 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ErrDatabaseInUse is returned by RestoreSnapshot when another process, such
+// as a running server, has the database open.
+var ErrDatabaseInUse = errors.New("database is in use")
+
+// ChainDiff is how restoring a snapshot changes one chain.
+type ChainDiff struct {
+	ClientID string
+
+	// Before and After count the live entities.
+	Before int
+	After  int
+
+	// Added entities are only in the snapshot and Removed ones only in the
+	// current database. Changed ones are in both, at another version.
+	Added   int
+	Removed int
+	Changed int
+}
+
+// RestoreResult describes a restore, or with dry run the restore which would
+// have been done.
+type RestoreResult struct {
+	SchemaVersion int
+
+	// Previous is where the replaced database was kept, empty when there
+	// was none.
+	Previous string
+
+	Chains []ChainDiff
+}
+
+// RestoreSnapshot replaces the database at dbPath by a snapshot, after
+// checking the snapshot's integrity and schema version. A checksum file next
+// to the snapshot is checked too. The replaced database is kept next to it.
+//
+// The database's lock file is locked exclusively for the whole restore, so it
+// fails with ErrDatabaseInUse rather than pull the file from under a running
+// server, and a server starting meanwhile fails instead.
+func RestoreSnapshot(snapshotPath, dbPath string, dryRun bool) (RestoreResult, error) {
+	fail := func(err error) (RestoreResult, error) {
+		return RestoreResult{}, fmt.Errorf("RestoreSnapshot: %w", err)
+	}
+	ctx := context.Background()
+
+	var result RestoreResult
+	var err error
+	if result.SchemaVersion, err = validateSnapshot(snapshotPath); err != nil {
+		return fail(err)
+	}
+	restored, err := readSnapshotVersions(snapshotPath)
+	if err != nil {
+		return fail(err)
+	}
+
+	lock, err := lockDatabaseFile(dbPath, true)
+	if err != nil {
+		return fail(err)
+	}
+	defer lock.Close()
+
+	current := map[entityKey]entityVersion{}
+	_, statErr := os.Stat(dbPath)
+	exists := statErr == nil
+	if exists {
+		if current, err = readDatabaseVersions(ctx, dbPath); err != nil {
+			return fail(err)
+		}
+	}
+	result.Chains = diffChains(current, restored)
+	if dryRun {
+		return result, nil
+	}
+
+	if exists {
+		result.Previous = fmt.Sprintf("%s.pre-restore-%s", dbPath, time.Now().UTC().Format(snapshotTimeLayout))
+		if err = os.Link(dbPath, result.Previous); err != nil {
+			return fail(err)
+		}
+	}
+	if err = swapInFile(snapshotPath, dbPath); err != nil {
+		return fail(err)
+	}
+	return result, nil
+}
+
+// validateSnapshot checks a snapshot and returns its schema version.
+func validateSnapshot(path string) (int, error) {
+	if _, err := os.Stat(path + checksumSuffix); err == nil {
+		if err = VerifySnapshot(path); err != nil {
+			return 0, err
+		}
+	} else if errors.Is(err, os.ErrNotExist) {
+		db, err := openSnapshot(path)
+		if err != nil {
+			return 0, err
+		}
+		defer db.Close()
+		if err = runIntegrityCheck(db, "integrity_check"); err != nil {
+			return 0, fmt.Errorf("%s: %w", path, err)
+		}
+	} else {
+		return 0, err
+	}
+
+	db, err := openSnapshot(path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	tableExists := func(name string) (bool, error) {
+		var exists bool
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)", name).Scan(&exists)
+		return exists, err
+	}
+	if exists, err := tableExists("sync_entities"); err != nil || !exists {
+		return 0, errors.Join(fmt.Errorf("%s is not a litesync database", path), err)
+	}
+	// A database from before schema versioning is adopted by Migrate.
+	version := 0
+	if exists, err := tableExists("schema_version"); err != nil {
+		return 0, err
+	} else if exists {
+		if err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+			return 0, err
+		}
+	}
+
+	migrations, err := loadMigrations(sqliteMigrationFiles, "migrations/sqlite")
+	if err != nil {
+		return 0, err
+	}
+	if version > len(migrations) {
+		return 0, fmt.Errorf("%w: snapshot is at version %d, latest known is %d",
+			ErrSchemaTooNew, version, len(migrations))
+	}
+	return version, nil
+}
+
+// openSnapshot opens a snapshot read-only. It is never written to, immutable
+// spares SQLite looking for a journal or WAL next to it.
+func openSnapshot(path string) (*sql.DB, error) {
+	return sql.Open(SqliteDriver, appendDSNParams(path, url.Values{"mode": {"ro"}, "immutable": {"1"}}))
+}
+
+// openDatabase opens a single connection to the database at path, for a
+// caller holding its lock file's exclusive lock.
+func openDatabase(ctx context.Context, path string) (*sql.DB, *sql.Conn, error) {
+	db, err := sql.Open(SqliteDriver, appendDSNParams(path, url.Values{}))
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, nil, classifySqliteError(err)
+	}
+	return db, conn, nil
+}
+
+// readDatabaseVersions reads the entity versions of the database at path,
+// and closes it again before it is replaced.
+func readDatabaseVersions(ctx context.Context, path string) (map[entityKey]entityVersion, error) {
+	db, conn, err := openDatabase(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	defer conn.Close()
+
+	// Fold the WAL into the file, which is then complete on its own and
+	// can be kept as it is.
+	if _, err = conn.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return nil, classifySqliteError(err)
+	}
+	versions, err := readEntityVersions(ctx, conn)
+	if err != nil {
+		return nil, classifySqliteError(err)
+	}
+	return versions, nil
+}
+
+type entityKey struct {
+	clientID string
+	id       string
+}
+
+type entityVersion struct {
+	version int64
+	deleted bool
+}
+
+const selectEntityVersionsQuery = `
+SELECT client_id, id, version, COALESCE(deleted, 0)
+FROM sync_entities
+WHERE version IS NOT NULL
+`
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func readEntityVersions(ctx context.Context, db queryer) (map[entityKey]entityVersion, error) {
+	rows, err := db.QueryContext(ctx, selectEntityVersionsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := map[entityKey]entityVersion{}
+	for rows.Next() {
+		var key entityKey
+		var version entityVersion
+		if err = rows.Scan(&key.clientID, &key.id, &version.version, &version.deleted); err != nil {
+			return nil, err
+		}
+		versions[key] = version
+	}
+	return versions, rows.Err()
+}
+
+func readSnapshotVersions(path string) (map[entityKey]entityVersion, error) {
+	db, err := openSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	versions, err := readEntityVersions(context.Background(), db)
+	if err != nil {
+		return nil, classifySqliteError(err)
+	}
+	return versions, nil
+}
+
+// diffChains compares the entities of every chain in either database, in
+// client ID order.
+func diffChains(current, restored map[entityKey]entityVersion) []ChainDiff {
+	chains := map[string]*ChainDiff{}
+	chain := func(clientID string) *ChainDiff {
+		if chains[clientID] == nil {
+			chains[clientID] = &ChainDiff{ClientID: clientID}
+		}
+		return chains[clientID]
+	}
+
+	for key, before := range current {
+		diff := chain(key.clientID)
+		if !before.deleted {
+			diff.Before++
+		}
+		after, ok := restored[key]
+		if !ok {
+			diff.Removed++
+		} else if after != before {
+			diff.Changed++
+		}
+	}
+	for key, after := range restored {
+		diff := chain(key.clientID)
+		if !after.deleted {
+			diff.After++
+		}
+		if _, ok := current[key]; !ok {
+			diff.Added++
+		}
+	}
+
+	diffs := make([]ChainDiff, 0, len(chains))
+	for _, diff := range chains {
+		diffs = append(diffs, *diff)
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].ClientID < diffs[j].ClientID
+	})
+	return diffs
+}
+
+// swapInFile copies src next to dest and renames it over dest, so that dest
+// is either the old or the new database, never a partial copy. The WAL and
+// shared memory files of the old database go with it.
+func swapInFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmpPath := dest + ".restore.tmp"
+	out, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err = os.Rename(tmpPath, dest); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err = os.Remove(dest + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	// Make the rename itself durable.
+	dir, err := os.Open(filepath.Dir(dest))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,142 @@
+package internal_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func takeTestSnapshot(t *testing.T, ds *internal.SqliteDatastore, dir string) string {
+	snapshot, _, err := internal.TakeSnapshot(ds, internal.BackupConfig{Dir: dir}, time.Now())
+	require.NoError(t, err)
+	return snapshot.Path
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "litesync.sqlite")
+	ds, err := internal.NewSqliteDatastore(dbPath)
+	require.NoError(t, err)
+	insertTestEntities(t, ds, "kept", 3)
+	snapshot := takeTestSnapshot(t, ds, filepath.Join(dir, "backups"))
+
+	insertTestEntities(t, ds, "new", 2)
+	_, _, err = ds.UpdateSyncEntity(&datastore.SyncEntity{
+		ClientID: "client",
+		ID:       "kept0",
+		Version:  aws.Int64(2),
+		Mtime:    aws.Int64(100),
+	}, 1)
+	require.NoError(t, err)
+
+	_, err = internal.RestoreSnapshot(snapshot, dbPath, false)
+	assert.ErrorIs(t, err, internal.ErrDatabaseInUse)
+	require.NoError(t, ds.Close())
+
+	result, err := internal.RestoreSnapshot(snapshot, dbPath, true)
+	require.NoError(t, err)
+	assert.Empty(t, result.Previous, "a dry run changes nothing")
+	result, err = internal.RestoreSnapshot(snapshot, dbPath, false)
+	require.NoError(t, err)
+	assert.Equal(t, []internal.ChainDiff{{
+		ClientID: "client",
+		Before:   5,
+		After:    3,
+		Removed:  2,
+		Changed:  1,
+	}}, result.Chains)
+	assert.FileExists(t, result.Previous)
+
+	ds, err = internal.NewSqliteDatastore(dbPath)
+	require.NoError(t, err)
+	defer ds.Close()
+	_, entities, err := ds.GetUpdatesForType(123, -1, true, "client", 100)
+	require.NoError(t, err)
+	assert.Len(t, entities, 3)
+	for _, entity := range entities {
+		assert.Equal(t, int64(1), *entity.Version, entity.ID)
+	}
+
+	previous, err := internal.NewSqliteDatastore(result.Previous)
+	require.NoError(t, err)
+	defer previous.Close()
+	_, entities, err = previous.GetUpdatesForType(123, -1, true, "client", 100)
+	require.NoError(t, err)
+	assert.Len(t, entities, 5, "the replaced database is kept whole")
+}
+
+func TestRestoreRejectsBadSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "litesync.sqlite")
+	ds, err := internal.NewSqliteDatastore(filepath.Join(dir, "source.sqlite"))
+	require.NoError(t, err)
+	defer ds.Close()
+	insertTestEntities(t, ds, "id", 3)
+
+	damaged := takeTestSnapshot(t, ds, filepath.Join(dir, "damaged"))
+	require.NoError(t, os.WriteFile(damaged+".sha256", []byte("0000  x\n"), 0o600))
+	_, err = internal.RestoreSnapshot(damaged, dbPath, false)
+	assert.ErrorIs(t, err, internal.ErrCorrupt)
+
+	tooNew := takeTestSnapshot(t, ds, filepath.Join(dir, "too-new"))
+	require.NoError(t, os.Remove(tooNew+".sha256"))
+	db, err := sql.Open(internal.SqliteDriver, tooNew)
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (9999, 'future', 0)")
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	_, err = internal.RestoreSnapshot(tooNew, dbPath, false)
+	assert.ErrorIs(t, err, internal.ErrSchemaTooNew)
+
+	other := filepath.Join(dir, "other.sqlite")
+	db, err = sql.Open(internal.SqliteDriver, other)
+	require.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE unrelated (x INTEGER)")
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	_, err = internal.RestoreSnapshot(other, dbPath, false)
+	assert.ErrorContains(t, err, "not a litesync database")
+
+	_, err = os.Stat(dbPath)
+	assert.ErrorIs(t, err, os.ErrNotExist, "nothing was restored")
+}
+
+func TestRestoreRefusesDatabaseInUseWithoutWAL(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "litesync.sqlite")
+	opts := internal.DefaultSqliteOptions()
+	opts.JournalMode = "DELETE"
+	ds, err := internal.NewSqliteDatastoreWithOptions(dbPath, opts)
+	require.NoError(t, err)
+	insertTestEntities(t, ds, "id", 3)
+	snapshot := takeTestSnapshot(t, ds, filepath.Join(dir, "backups"))
+	insertTestEntities(t, ds, "new", 2)
+
+	// An idle connection to a database out of WAL mode holds no lock.
+	_, err = internal.RestoreSnapshot(snapshot, dbPath, false)
+	assert.ErrorIs(t, err, internal.ErrDatabaseInUse)
+	_, err = internal.CheckStore(internal.StoreConfig{Backend: internal.BackendSqlite, SqlitePath: dbPath, Sqlite: opts}, false)
+	assert.ErrorIs(t, err, internal.ErrDatabaseInUse)
+	_, entities, err := ds.GetUpdatesForType(123, -1, true, "client", 100)
+	require.NoError(t, err)
+	assert.Len(t, entities, 5, "the database was left alone")
+	require.NoError(t, ds.Close())
+
+	_, err = internal.RestoreSnapshot(snapshot, dbPath, false)
+	require.NoError(t, err)
+	// A server starting during a restore is refused too.
+	ds, err = internal.NewSqliteDatastoreWithOptions(dbPath, opts)
+	require.NoError(t, err)
+	defer ds.Close()
+	_, entities, err = ds.GetUpdatesForType(123, -1, true, "client", 100)
+	require.NoError(t, err)
+	assert.Len(t, entities, 3)
+}
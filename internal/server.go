@@ -16,7 +16,7 @@ import (
 	"github.com/brave-intl/bat-go/libs/logging"
 	"github.com/brave/go-sync/cache"
 	syncContext "github.com/brave/go-sync/context"
-	"github.com/brave/go-sync/controller"
+	"github.com/brave/go-sync/datastore"
 	syncMiddleware "github.com/brave/go-sync/middleware"
 	"github.com/go-chi/chi/v5"
 	chiware "github.com/go-chi/chi/v5/middleware"
@@ -27,18 +27,95 @@ import (
 const (
 	defaultTimeout  = 60 * time.Second
 	shutdownTimeout = 30 * time.Second
+
+	reapInterval  = 10 * time.Minute
+	reapBatchSize = 500
+
+	compactInterval  = 6 * time.Hour
+	compactBatchSize = 500
 )
 
-// StartServer initializes and starts the HTTP server with graceful shutdown handling.
-func StartServer(bindAddr, dbPath string) error {
+// StartServer initializes and starts the HTTP server with graceful shutdown
+// handling. Snapshots are taken into backupConfig.Dir when it is set, and
+// tombstones older than tombstoneMaxAge are compacted unless it is 0.
+func StartServer(bindAddr string, storeConfig StoreConfig, backupConfig BackupConfig, tombstoneMaxAge time.Duration) error {
+	if backupConfig.Dir != "" {
+		if err := backupConfig.validate(true); err != nil {
+			return err
+		}
+	}
+
 	ctx := context.Background()
 	ctx, logger := setupLogger(ctx)
 
-	ctx, router, err := setupRouter(ctx, logger, dbPath)
+	// Open the database before binding the listener, so a server which
+	// cannot store anything never starts accepting syncs.
+	storeConfig.KeepTombstones = tombstoneMaxAge <= 0
+	store, err := openStore(storeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to open %s database %s: %w", storeConfig.Backend, storeConfig.name(), err)
+	}
+	defer store.Close()
+
+	schemaVersion, err := store.SchemaVersion()
+	if err != nil {
+		return fmt.Errorf("failed to read schema version of %s: %w", storeConfig.name(), err)
+	}
+	logger.Info().Str("backend", storeConfig.Backend).Str("database", storeConfig.name()).
+		Int("schema_version", schemaVersion).Msg("Database ready")
+
+	var snapshots snapshotSource
+	if backupConfig.Dir != "" {
+		var ok bool
+		if snapshots, ok = store.(snapshotSource); !ok {
+			return errors.New("backups need the sqlite backend with a single database file")
+		}
+	}
+
+	ctx, router, err := setupRouter(ctx, logger, store)
 	if err != nil {
 		return fmt.Errorf("failed to setup router: %w", err)
 	}
 
+	// Delete expired history in the background, stopped before the
+	// database is closed on the way out.
+	reaperCtx, stopReaper := context.WithCancel(ctx)
+	reaperDone := make(chan struct{})
+	go func() {
+		defer close(reaperDone)
+		NewExpirationReaper(store, logger, reapInterval, reapBatchSize).Run(reaperCtx)
+	}()
+	defer func() {
+		stopReaper()
+		<-reaperDone
+	}()
+
+	if tombstoneMaxAge > 0 {
+		compactorCtx, stopCompactor := context.WithCancel(ctx)
+		compactorDone := make(chan struct{})
+		go func() {
+			defer close(compactorDone)
+			NewTombstoneCompactor(store, logger, compactInterval, tombstoneMaxAge, compactBatchSize).Run(compactorCtx)
+		}()
+		defer func() {
+			stopCompactor()
+			<-compactorDone
+		}()
+	}
+
+	if snapshots != nil {
+		schedulerCtx, stopScheduler := context.WithCancel(ctx)
+		schedulerDone := make(chan struct{})
+		go func() {
+			defer close(schedulerDone)
+			NewBackupScheduler(snapshots, backupConfig, logger).Run(schedulerCtx)
+		}()
+		defer func() {
+			stopScheduler()
+			<-schedulerDone
+		}()
+	}
+
 	server := &http.Server{
 		Addr:    bindAddr,
 		Handler: router,
@@ -92,7 +169,7 @@ func setupLogger(ctx context.Context) (context.Context, *zerolog.Logger) {
 }
 
 // setupRouter configures the HTTP router with middleware and routes.
-func setupRouter(ctx context.Context, logger *zerolog.Logger, dbPath string) (context.Context, chi.Router, error) {
+func setupRouter(ctx context.Context, logger *zerolog.Logger, store datastore.Datastore) (context.Context, chi.Router, error) {
 	router := chi.NewRouter()
 
 	// Middleware setup
@@ -111,23 +188,17 @@ func setupRouter(ctx context.Context, logger *zerolog.Logger, dbPath string) (co
 	router.Use(bearerToken)
 	router.Use(syncMiddleware.CommonResponseHeaders)
 
-	// Data store initialization
-	sqliteStore, err := NewSqliteDatastore(dbPath)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create sqlite datastore: %w", err)
-	}
-
 	// Cache initialization
 	cacheInstance := cache.NewCache(NewFakeRedisClient())
 
 	// Context value injection
-	ctx = context.WithValue(ctx, syncContext.ContextKeyDatastore, sqliteStore)
+	ctx = context.WithValue(ctx, syncContext.ContextKeyDatastore, store)
 	ctx = context.WithValue(ctx, syncContext.ContextKeyCache, &cacheInstance)
 
 	r := chi.NewRouter()
 	r.Use(syncMiddleware.Auth)
 	r.Use(syncMiddleware.DisabledChain)
-	r.Method("POST", "/command/", controller.Command(cacheInstance, sqliteStore))
+	r.Method("POST", "/command/", commandHandler(cacheInstance, store))
 	router.Mount("/litesync", r)
 
 	return ctx, router, nil
@@ -3,57 +3,115 @@ package internal
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"strings"
+	"os"
 	"time"
 
 	braveds "github.com/brave/go-sync/datastore"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 type SqliteDatastore struct {
 	braveds.Datastore
+	// Db is the writer pool, it holds a single connection so writers queue
+	// up in the process instead of fighting over the file lock.
 	Db *sql.DB
+	// ReadDb is a read-only pool for reads which do not need to see the
+	// writer's open transaction. It is Db itself for in-memory databases.
+	ReadDb *sql.DB
+
+	keys       *EncryptionKeys
+	compress   bool
+	quotas     *Quotas
+	watermarks *fetchWatermarks
+	// lock is the shared lock on the database's lock file, nil in memory.
+	lock *os.File
 }
 
+// lockFileSuffix names the file next to a database which a store holds a
+// shared lock on while it has the database open, see lockDatabaseFile.
+const lockFileSuffix = ".lock"
+
+// NewSqliteDatastore opens the database with DefaultSqliteOptions.
 func NewSqliteDatastore(filename string) (*SqliteDatastore, error) {
-	db, err := sql.Open("sqlite3", filename)
+	return NewSqliteDatastoreWithOptions(filename, DefaultSqliteOptions())
+}
+
+// NewSqliteDatastoreWithOptions opens the database, checks that it is intact
+// and writable, and brings its schema up to date. sql.Open does not touch
+// the file, so without the checks a bad database would only show up on the
+// first commit.
+func NewSqliteDatastoreWithOptions(filename string, opts SqliteOptions) (*SqliteDatastore, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	var lock *os.File
+	if !isMemoryDatabase(filename) {
+		var err error
+		if lock, err = lockDatabaseFile(databaseFilePath(filename), false); err != nil {
+			if errors.Is(err, os.ErrPermission) {
+				err = fmt.Errorf("%w: %v", ErrReadOnly, err)
+			}
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open(SqliteDriver, opts.writerDSN(filename))
 	if err != nil {
+		closeLock(lock)
 		return nil, err
 	}
-	return &SqliteDatastore{Db: db}, nil
+	db.SetMaxOpenConns(1)
+	d := &SqliteDatastore{
+		Db:         db,
+		ReadDb:     db,
+		keys:       opts.EncryptionKeys,
+		compress:   opts.CompressSpecifics,
+		quotas:     opts.Quotas,
+		watermarks: newFetchWatermarks(),
+		lock:       lock,
+	}
+	d.watermarks.off = opts.KeepTombstones
+	for _, step := range []func() error{d.checkIntegrity, d.checkWritable, d.Migrate} {
+		if err = step(); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+
+	// The reader pool is opened once the writer has created the file and
+	// set its journal mode, a read-only connection can do neither.
+	if !isMemoryDatabase(filename) {
+		readDb, err := sql.Open(SqliteDriver, opts.readerDSN(filename))
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		readDb.SetMaxOpenConns(opts.ReadConns)
+		readDb.SetMaxIdleConns(opts.ReadConns)
+		d.ReadDb = readDb
+	}
+	return d, nil
 }
 
-const createTableQuery = `
-CREATE TABLE IF NOT EXISTS sync_entities (
-     client_id TEXT NOT NULL,
-     id TEXT NOT NULL,
-     parent_id TEXT,
-     version INTEGER,
-     mtime INTEGER,
-     ctime INTEGER,
-     name TEXT,
-     non_unique_name TEXT,
-     server_defined_unique_tag TEXT,
-     deleted BOOLEAN,
-     originator_cache_guid TEXT,
-     originator_client_item_id TEXT,
-     specifics BLOB,
-     data_type INTEGER,
-     folder BOOLEAN,
-     client_defined_unique_tag TEXT,
-     unique_position BLOB,
-     data_type_mtime TEXT,
-     expiration_time INTEGER,
-     PRIMARY KEY (client_id, id)
-)
-`
+// Close writes the pending fetch watermarks, closes both connection pools,
+// and then releases the lock.
+func (d *SqliteDatastore) Close() error {
+	flushErr := d.FlushWatermarks()
+	var readErr error
+	if d.ReadDb != d.Db {
+		readErr = d.ReadDb.Close()
+	}
+	return errors.Join(flushErr, d.Db.Close(), readErr, closeLock(d.lock))
+}
 
-const createSyncEntityIndex = `
-CREATE UNIQUE INDEX IF NOT EXISTS idx_unique_client_tag
-ON sync_entities (client_id, client_defined_unique_tag)
-WHERE client_defined_unique_tag IS NOT NULL
-`
+func closeLock(lock *os.File) error {
+	if lock == nil {
+		return nil
+	}
+	return lock.Close()
+}
 
 type execFunc func(tx *sql.Tx) (sql.Result, error)
 
@@ -70,70 +128,19 @@ func (d *SqliteDatastore) ExecInTransaction(proxied execFunc) (*sql.Result, erro
 	return &txRes, txErr
 }
 
+// CreateTable creates the schema by applying any pending migrations.
 func (d *SqliteDatastore) CreateTable() error {
-	_, err := d.ExecInTransaction(func(tx *sql.Tx) (sql.Result, error) {
-		// Create table
-		if _, err := tx.Exec(createTableQuery); err != nil {
-			return nil, err
-		}
-		// Create index
-		if _, err := tx.Exec(createSyncEntityIndex); err != nil {
-			return nil, err
-		}
-		return nil, nil // or return the result of the last operation
-	})
-	return err
+	return d.Migrate()
 }
 
 const insertSyncEntityQuery = `
-INSERT INTO sync_entities (
-	id,
-	client_id,
-	"version",
-	mtime,
-	specifics,
-	datatype_mtime,
-	unique_position,
-	parent_id,
-	"name",
-	"non_unique_name",
-	"deleted",
-	"folder"
-)
-VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+INSERT INTO sync_entities (` + syncEntityColumns + `, key_id)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 `
 
-func (d *SqliteDatastore) InsertSyncEntity(entity *braveds.SyncEntity) (bool, error) {
-	// First, try to insert the main sync entity
-	conflict, err := d.insertMainSyncEntity(entity)
-	if err != nil || conflict {
-		return conflict, err
-	}
-
-	// If entity has a client defined unique tag, also insert the tag item
-	if entity.ClientDefinedUniqueTag != nil {
-		tagConflict, err := d.insertTagItem(entity)
-		if err != nil {
-			return false, err
-		}
-		if tagConflict {
-			return true, nil
-		}
-	}
-
-	return false, nil
-}
-
-func (d *SqliteDatastore) insertMainSyncEntity(entity *braveds.SyncEntity) (bool, error) {
-	const query = `
-        INSERT INTO sync_entities (
-            client_id, id, parent_id, version, mtime, ctime, name, non_unique_name,
-            server_defined_unique_tag, deleted, originator_cache_guid,
-            originator_client_item_id, specifics, data_type, folder,
-            client_defined_unique_tag, unique_position, data_type_mtime, expiration_time
-        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
-
-	_, err := d.Db.Exec(query,
+// syncEntityArgs returns the values of entity in syncEntityColumns order.
+func syncEntityArgs(entity *braveds.SyncEntity) []any {
+	return []any{
 		entity.ClientID,
 		entity.ID,
 		entity.ParentID,
@@ -153,70 +160,93 @@ func (d *SqliteDatastore) insertMainSyncEntity(entity *braveds.SyncEntity) (bool
 		entity.UniquePosition,
 		entity.DataTypeMtime,
 		entity.ExpirationTime,
-	)
+	}
+}
 
+// sealedSyncEntityArgs returns the values of insertSyncEntityQuery, with the
+// specifics of entity compressed and its encrypted fields sealed when those
+// are turned on.
+func (d *SqliteDatastore) sealedSyncEntityArgs(entity *braveds.SyncEntity) ([]any, error) {
+	sealed, keyID, err := d.keys.sealEntity(d.compressEntity(entity))
 	if err != nil {
-		// Check if it's a conflict (duplicate key) error
-		if isUniqueConstraintError(err) {
-			return true, nil
-		}
-		return false, err
+		return nil, err
 	}
-
-	return false, nil
+	return append(syncEntityArgs(sealed), keyID), nil
 }
 
-func (d *SqliteDatastore) insertTagItem(entity *braveds.SyncEntity) (bool, error) {
-	if entity.ClientDefinedUniqueTag == nil {
-		return false, nil
+const insertTagItemQuery = `
+INSERT INTO sync_entities (client_id, id, mtime, ctime)
+VALUES (?, ?, ?, ?)
+`
+
+// InsertSyncEntity inserts a new entity, together with its client tag item
+// when it has a client defined unique tag. A duplicate ID or tag returns
+// conflict along with an error wrapping ErrConflict, as upstream does. An
+// entity taking the chain over its quota fails with ErrOverQuota.
+func (d *SqliteDatastore) InsertSyncEntity(entity *braveds.SyncEntity) (bool, error) {
+	fail := func(err error) (bool, error) {
+		err = classifySqliteError(err)
+		return errors.Is(err, ErrConflict), fmt.Errorf("InsertSyncEntity: %w", err)
 	}
 
-	const query = `
-        INSERT INTO sync_entities (
-            client_id, id, mtime, ctime
-        ) VALUES (?, ?, ?, ?)`
+	if err := d.quotas.For(entity.ClientID).checkEntity(entity); err != nil {
+		return fail(err)
+	}
 
-	// Set current time for mtime and ctime if not already set
-	now := time.Now().Unix()
-	mtime := entity.Mtime
-	ctime := entity.Ctime
-	if mtime == nil {
-		mtime = &now
+	tx, err := d.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+
+	args, err := d.sealedSyncEntityArgs(entity)
+	if err != nil {
+		return fail(err)
 	}
-	if ctime == nil {
-		ctime = &now
+	if _, err = tx.Exec(insertSyncEntityQuery, args...); err != nil {
+		return fail(err)
 	}
 
-	_, err := d.Db.Exec(query,
-		entity.ClientID,
-		"Client#"+*entity.ClientDefinedUniqueTag, // Construct the tag ID
-		mtime,
-		ctime,
-	)
+	// The tag item makes the tag unique among the client's live entities,
+	// UpdateSyncEntity removes it when the entity is deleted.
+	if entity.ClientDefinedUniqueTag != nil {
+		// Set current time for mtime and ctime if not already set
+		now := time.Now().Unix()
+		mtime := entity.Mtime
+		ctime := entity.Ctime
+		if mtime == nil {
+			mtime = &now
+		}
+		if ctime == nil {
+			ctime = &now
+		}
 
-	if err != nil {
-		// Check if it's a conflict (duplicate key) error
-		if isUniqueConstraintError(err) {
-			return true, nil
+		_, err = tx.Exec(insertTagItemQuery,
+			entity.ClientID,
+			"Client#"+*entity.ClientDefinedUniqueTag, // Construct the tag ID
+			mtime,
+			ctime,
+		)
+		if err != nil {
+			return fail(err)
 		}
-		return false, err
 	}
 
-	return false, nil
-}
+	grown := chainUsage{entities: 1, specificsBytes: int64(len(entity.Specifics))}
+	if err = d.checkChainUsage(tx, entity.ClientID, grown); err != nil {
+		return fail(err)
+	}
 
-func isUniqueConstraintError(err error) bool {
-	if err == nil {
-		return false
+	if err = tx.Commit(); err != nil {
+		return fail(err)
 	}
-	// SQLite unique constraint violation error
-	return strings.Contains(strings.ToLower(err.Error()), "unique constraint failed") ||
-		strings.Contains(strings.ToLower(err.Error()), "constraint failed")
+
+	return false, nil
 }
 
 func (d *SqliteDatastore) InsertSyncEntitiesWithServerTags(entities []*braveds.SyncEntity) error {
 	fail := func(err error) error {
-		return fmt.Errorf("InsertSyncEntitiesWithServerTags: %v", err)
+		return fmt.Errorf("InsertSyncEntitiesWithServerTags: %w", classifySqliteError(err))
 	}
 	tx, err := d.Db.BeginTx(context.Background(), nil)
 	if err != nil {
@@ -224,7 +254,16 @@ func (d *SqliteDatastore) InsertSyncEntitiesWithServerTags(entities []*braveds.S
 	}
 	defer tx.Rollback()
 
+	grown := map[string]chainUsage{}
 	for _, se := range entities {
+		if err = d.quotas.For(se.ClientID).checkEntity(se); err != nil {
+			return fail(err)
+		}
+		usage := grown[se.ClientID]
+		usage.entities++
+		usage.specificsBytes += int64(len(se.Specifics))
+		grown[se.ClientID] = usage
+
 		if se.ServerDefinedUniqueTag != nil {
 			// Check for existing tag item
 			var exists bool
@@ -234,26 +273,32 @@ func (d *SqliteDatastore) InsertSyncEntitiesWithServerTags(entities []*braveds.S
 				return fail(err)
 			}
 			if exists {
-				return fmt.Errorf("server tag already exists")
+				return fail(fmt.Errorf("%w: server tag %s", ErrConflict, *se.ServerDefinedUniqueTag))
 			}
 
 			// Insert tag item
-			_, err = tx.Exec(insertSyncEntityQuery,
-				"Server#"+*se.ServerDefinedUniqueTag, se.ClientID, 0, se.Mtime, nil, nil,
-				nil, nil, nil, nil, false, false)
+			_, err = tx.Exec(insertTagItemQuery,
+				se.ClientID, "Server#"+*se.ServerDefinedUniqueTag, se.Mtime, se.Ctime)
 			if err != nil {
 				return fail(err)
 			}
 		}
 
 		// Insert sync entity
-		_, err = tx.Exec(insertSyncEntityQuery,
-			se.ID, se.ClientID, se.Version, se.Mtime, se.Specifics, se.DataTypeMtime,
-			se.UniquePosition, se.ParentID, se.Name, se.NonUniqueName, se.Deleted, se.Folder)
+		args, err := d.sealedSyncEntityArgs(se)
+		if err != nil {
+			return fail(err)
+		}
+		_, err = tx.Exec(insertSyncEntityQuery, args...)
 		if err != nil {
 			return fail(err)
 		}
 	}
+	for clientID, usage := range grown {
+		if err = d.checkChainUsage(tx, clientID, usage); err != nil {
+			return fail(err)
+		}
+	}
 
 	if err = tx.Commit(); err != nil {
 		return fail(err)
@@ -262,24 +307,46 @@ func (d *SqliteDatastore) InsertSyncEntitiesWithServerTags(entities []*braveds.S
 	return nil
 }
 
+// Optional fields keep their stored value when the update leaves them nil.
+// History entities are keyed by their client tag and overwritten by every
+// device which visits the page, so their version is not checked.
 const updateSyncEntityQuery = `
 UPDATE sync_entities
-SET "version" = ?,
+SET version = ?,
     mtime = ?,
     specifics = ?,
-    datatype_mtime = ?,
-    unique_position = ?,
-    parent_id = ?,
-    "name" = ?,
-    "non_unique_name" = ?,
-    "deleted" = ?,
-    "folder" = ?
-WHERE client_id = ? AND id = ? AND "version" = ?
+    data_type_mtime = ?,
+    unique_position = COALESCE(?, unique_position),
+    parent_id = COALESCE(?, parent_id),
+    name = COALESCE(?, name),
+    non_unique_name = COALESCE(?, non_unique_name),
+    deleted = COALESCE(?, deleted),
+    folder = COALESCE(?, folder),
+    expiration_time = COALESCE(?, expiration_time),
+    originator_cache_guid = COALESCE(?, originator_cache_guid),
+    key_id = ?
+WHERE client_id = ? AND id = ? AND (version = ? OR data_type = ?)
 `
 
+const selectStoredEntityQuery = `
+SELECT deleted, key_id, name, non_unique_name, originator_cache_guid, COALESCE(length(specifics), 0)
+FROM sync_entities
+WHERE client_id = ? AND id = ?
+`
+
+// UpdateSyncEntity updates an entity at oldVersion, a changed version
+// returns conflict. An update growing the chain over its quota fails with
+// ErrOverQuota, deletes always go through.
 func (d *SqliteDatastore) UpdateSyncEntity(se *braveds.SyncEntity, oldVersion int64) (conflict bool, delete bool, err error) {
 	fail := func(err error) (bool, bool, error) {
-		return false, false, fmt.Errorf("UpdateSyncEntity: %v", err)
+		return false, false, fmt.Errorf("UpdateSyncEntity: %w", classifySqliteError(err))
+	}
+
+	deleting := se.Deleted != nil && *se.Deleted
+	if !deleting {
+		if err = d.quotas.For(se.ClientID).checkEntity(se); err != nil {
+			return fail(err)
+		}
 	}
 
 	tx, err := d.Db.BeginTx(context.Background(), nil)
@@ -288,10 +355,47 @@ func (d *SqliteDatastore) UpdateSyncEntity(se *braveds.SyncEntity, oldVersion in
 	}
 	defer tx.Rollback()
 
+	// The caller decrements the client's item count when we report a delete,
+	// so only report it for the transition into the deleted state.
+	var wasDeleted sql.NullBool
+	var storedKeyID *string
+	var storedSize int64
+	stored := braveds.SyncEntity{ClientID: se.ClientID, ID: se.ID}
+	err = tx.QueryRow(selectStoredEntityQuery, se.ClientID, se.ID).Scan(
+		&wasDeleted, &storedKeyID, &stored.Name, &stored.NonUniqueName, &stored.OriginatorCacheGUID, &storedSize)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, false, nil // Conflict
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	// A row is sealed by a single key. When it was sealed by another one,
+	// the fields this update keeps are resealed along with the new ones.
+	update := *se
+	update.OriginatorCacheGUID = nil
+	if !sameKeyID(storedKeyID, d.keys.rowKeyID()) {
+		if err = d.keys.openEntity(&stored, storedKeyID); err != nil {
+			return fail(err)
+		}
+		if update.Name == nil {
+			update.Name = stored.Name
+		}
+		if update.NonUniqueName == nil {
+			update.NonUniqueName = stored.NonUniqueName
+		}
+		update.OriginatorCacheGUID = stored.OriginatorCacheGUID
+	}
+	sealed, keyID, err := d.keys.sealEntity(d.compressEntity(&update))
+	if err != nil {
+		return fail(err)
+	}
+
 	res, err := tx.Exec(updateSyncEntityQuery,
-		se.Version, se.Mtime, se.Specifics, se.DataTypeMtime,
-		se.UniquePosition, se.ParentID, se.Name, se.NonUniqueName, se.Deleted, se.Folder,
-		se.ClientID, se.ID, oldVersion)
+		sealed.Version, sealed.Mtime, sealed.Specifics, sealed.DataTypeMtime,
+		sealed.UniquePosition, sealed.ParentID, sealed.Name, sealed.NonUniqueName, sealed.Deleted, sealed.Folder,
+		sealed.ExpirationTime, sealed.OriginatorCacheGUID, keyID,
+		se.ClientID, se.ID, oldVersion, historyTypeID)
 	if err != nil {
 		return fail(err)
 	}
@@ -305,12 +409,24 @@ func (d *SqliteDatastore) UpdateSyncEntity(se *braveds.SyncEntity, oldVersion in
 		return true, false, nil // Conflict
 	}
 
-	if se.Deleted != nil && *se.Deleted && se.ClientDefinedUniqueTag != nil {
-		_, err = tx.Exec("DELETE FROM sync_entities WHERE client_id = ? AND id = ?", se.ClientID, "Client#"+*se.ClientDefinedUniqueTag)
-		if err != nil {
+	if deleting {
+		if se.ClientDefinedUniqueTag != nil {
+			_, err = tx.Exec("DELETE FROM sync_entities WHERE client_id = ? AND id = ?", se.ClientID, "Client#"+*se.ClientDefinedUniqueTag)
+			if err != nil {
+				return fail(err)
+			}
+		}
+		delete = !wasDeleted.Bool
+	} else if se.Deleted != nil || !wasDeleted.Bool {
+		grown := chainUsage{specificsBytes: int64(len(sealed.Specifics))}
+		if wasDeleted.Bool {
+			grown.entities = 1
+		} else {
+			grown.specificsBytes -= storedSize
+		}
+		if err = d.checkChainUsage(tx, se.ClientID, grown); err != nil {
 			return fail(err)
 		}
-		delete = true
 	}
 
 	if err = tx.Commit(); err != nil {
@@ -321,45 +437,305 @@ func (d *SqliteDatastore) UpdateSyncEntity(se *braveds.SyncEntity, oldVersion in
 }
 
 const getClientItemCountQuery = `
-SELECT COUNT(*)
-FROM sync_entities
+SELECT item_count,
+       history_item_count_period1,
+       history_item_count_period2,
+       history_item_count_period3,
+       history_item_count_period4,
+       last_period_change_time,
+       version
+FROM client_item_counts
 WHERE client_id = ?
 `
 
+const countClientItemsQuery = `
+SELECT
+    COALESCE(SUM(CASE WHEN data_type IN (?, ?) THEN 0 ELSE 1 END), 0),
+    COALESCE(SUM(CASE WHEN data_type IN (?, ?) THEN 1 ELSE 0 END), 0)
+FROM sync_entities
+WHERE client_id = ? AND version IS NOT NULL AND NOT COALESCE(deleted, 0)
+`
+
 func (d SqliteDatastore) GetClientItemCount(clientID string) (*braveds.ClientItemCounts, error) {
-	tx, err := d.Db.BeginTx(context.Background(), nil)
+	fail := func(err error) (*braveds.ClientItemCounts, error) {
+		return nil, fmt.Errorf("GetClientItemCount: %w", classifySqliteError(err))
+	}
+
+	now := time.Now().Unix()
+	counts := braveds.ClientItemCounts{ClientID: clientID, ID: clientID}
+	err := d.Db.QueryRow(getClientItemCountQuery, clientID).Scan(
+		&counts.ItemCount,
+		&counts.HistoryItemCountPeriod1,
+		&counts.HistoryItemCountPeriod2,
+		&counts.HistoryItemCountPeriod3,
+		&counts.HistoryItemCountPeriod4,
+		&counts.LastPeriodChangeTime,
+		&counts.Version,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		counts.LastPeriodChangeTime = now
+		counts.Version = clientItemCountsVersion
+		return &counts, nil
+	}
 	if err != nil {
-		return nil, err
+		return fail(err)
 	}
-	var count braveds.ClientItemCounts
-	row := tx.QueryRow(getClientItemCountQuery, clientID)
-	row.Scan(&count)
-	if err = tx.Commit(); err != nil {
-		return nil, err
+
+	if counts.Version < clientItemCountsVersion {
+		err = d.Db.QueryRow(countClientItemsQuery,
+			historyTypeID, historyDeleteDirectiveTypeID,
+			historyTypeID, historyDeleteDirectiveTypeID,
+			clientID).Scan(&counts.ItemCount, &counts.HistoryItemCountPeriod4)
+		if err != nil {
+			return fail(err)
+		}
+		counts.HistoryItemCountPeriod1 = 0
+		counts.HistoryItemCountPeriod2 = 0
+		counts.HistoryItemCountPeriod3 = 0
+		counts.LastPeriodChangeTime = now
+		counts.Version = clientItemCountsVersion
+	} else {
+		rotateHistoryCounts(&counts, now)
+	}
+
+	return &counts, nil
+}
+
+const upsertClientItemCountQuery = `
+INSERT INTO client_item_counts (
+    client_id, item_count,
+    history_item_count_period1, history_item_count_period2,
+    history_item_count_period3, history_item_count_period4,
+    last_period_change_time, version
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (client_id) DO UPDATE SET
+    item_count = excluded.item_count,
+    history_item_count_period1 = excluded.history_item_count_period1,
+    history_item_count_period2 = excluded.history_item_count_period2,
+    history_item_count_period3 = excluded.history_item_count_period3,
+    history_item_count_period4 = excluded.history_item_count_period4,
+    last_period_change_time = excluded.last_period_change_time,
+    version = excluded.version
+`
+
+// UpdateClientItemCount adds the new items to counts, which must come from
+// GetClientItemCount, and stores the result. New history items always land
+// in the most recent period.
+func (d SqliteDatastore) UpdateClientItemCount(counts *braveds.ClientItemCounts, newNormalItemCount int, newHistoryItemCount int) error {
+	counts.ItemCount += newNormalItemCount
+	counts.HistoryItemCountPeriod4 += newHistoryItemCount
+
+	_, err := d.Db.Exec(upsertClientItemCountQuery,
+		counts.ClientID,
+		counts.ItemCount,
+		counts.HistoryItemCountPeriod1,
+		counts.HistoryItemCountPeriod2,
+		counts.HistoryItemCountPeriod3,
+		counts.HistoryItemCountPeriod4,
+		counts.LastPeriodChangeTime,
+		counts.Version,
+	)
+	if err != nil {
+		return fmt.Errorf("UpdateClientItemCount: %w", classifySqliteError(err))
 	}
-	return &count, nil
+	return nil
 }
 
+const syncEntityColumns = `
+client_id, id, parent_id, version, mtime, ctime, name, non_unique_name,
+server_defined_unique_tag, deleted, originator_cache_guid,
+originator_client_item_id, specifics, data_type, folder,
+client_defined_unique_tag, unique_position, data_type_mtime, expiration_time
+`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanSyncEntity reads a row selected with syncEntityColumns, followed by
+// the columns scanned into extra.
+func scanSyncEntity(row rowScanner, extra ...any) (braveds.SyncEntity, error) {
+	var entity braveds.SyncEntity
+	dest := []any{
+		&entity.ClientID,
+		&entity.ID,
+		&entity.ParentID,
+		&entity.Version,
+		&entity.Mtime,
+		&entity.Ctime,
+		&entity.Name,
+		&entity.NonUniqueName,
+		&entity.ServerDefinedUniqueTag,
+		&entity.Deleted,
+		&entity.OriginatorCacheGUID,
+		&entity.OriginatorClientItemID,
+		&entity.Specifics,
+		&entity.DataType,
+		&entity.Folder,
+		&entity.ClientDefinedUniqueTag,
+		&entity.UniquePosition,
+		&entity.DataTypeMtime,
+		&entity.ExpirationTime,
+	}
+	err := row.Scan(append(dest, extra...)...)
+	return entity, err
+}
+
+// scanSealedSyncEntity reads a row selected with syncEntityColumns and
+// key_id, decrypts its sealed fields and decompresses its specifics.
+func (d SqliteDatastore) scanSealedSyncEntity(row rowScanner) (braveds.SyncEntity, error) {
+	var keyID *string
+	entity, err := scanSyncEntity(row, &keyID)
+	if err != nil {
+		return entity, err
+	}
+	if err = d.keys.openEntity(&entity, keyID); err != nil {
+		return entity, err
+	}
+	entity.Specifics, err = decompressSpecifics(entity.Specifics)
+	return entity, err
+}
+
+// Tag items and the disabled chain marker have no data_type, so filtering on
+// it keeps them out of the results.
+const getUpdatesForTypeQuery = `
+SELECT ` + syncEntityColumns + `, key_id
+FROM sync_entities
+WHERE client_id = ?
+  AND data_type = ?
+  AND mtime > ?
+  AND (? OR folder = 0)
+  AND (expiration_time IS NULL OR expiration_time > ?)
+ORDER BY mtime, id
+LIMIT ?
+`
+
+// GetUpdatesForType returns up to maxSize entities of the given type that
+// were modified after clientToken, ordered by mtime. hasChangesRemaining is
+// true when the batch is full, the client then asks again with the mtime of
+// the last returned entity as its new token. The token is recorded for
+// tombstone compaction, see fetchWatermarks.
 func (d SqliteDatastore) GetUpdatesForType(dataType int, clientToken int64, fetchFolders bool, clientID string, maxSize int64) (bool, []braveds.SyncEntity, error) {
-	return false, nil, nil
+	fail := func(err error) (bool, []braveds.SyncEntity, error) {
+		return false, nil, fmt.Errorf("GetUpdatesForType: %w", classifySqliteError(err))
+	}
+
+	rows, err := d.ReadDb.Query(getUpdatesForTypeQuery,
+		clientID, dataType, clientToken, fetchFolders, time.Now().Unix(), maxSize)
+	if err != nil {
+		return fail(err)
+	}
+	defer rows.Close()
+
+	syncEntities := []braveds.SyncEntity{}
+	for rows.Next() {
+		entity, err := d.scanSealedSyncEntity(rows)
+		if err != nil {
+			return fail(err)
+		}
+		syncEntities = append(syncEntities, entity)
+	}
+	if err = rows.Err(); err != nil {
+		return fail(err)
+	}
+	d.watermarks.record(clientID, dataType, clientToken)
+
+	hasChangesRemaining := int64(len(syncEntities)) == maxSize
+	return hasChangesRemaining, syncEntities, nil
 }
 
+const hasItemQuery = `
+SELECT EXISTS(SELECT 1 FROM sync_entities WHERE client_id = ? AND id = ?)
+`
+
 func (d SqliteDatastore) HasServerDefinedUniqueTag(clientID string, tag string) (bool, error) {
-	return false, nil
+	return d.HasItem(clientID, "Server#"+tag)
 }
 
-func (d SqliteDatastore) UpdateClientItemCount(counts *braveds.ClientItemCounts, newNormalItemCount int, newHistoryItemCount int) error {
-	return nil
+func (d SqliteDatastore) HasItem(clientID string, ID string) (bool, error) {
+	var exists bool
+	if err := d.ReadDb.QueryRow(hasItemQuery, clientID, ID).Scan(&exists); err != nil {
+		return false, fmt.Errorf("HasItem: %w", classifySqliteError(err))
+	}
+	return exists, nil
 }
 
+// The disabled chain marker survives, clearing a chain is followed by
+// disabling it and the marker must not be lost in between.
+const clearServerDataQuery = `
+DELETE FROM sync_entities
+WHERE client_id = ? AND id != ?
+RETURNING ` + syncEntityColumns + `, key_id`
+
+// ClearServerData deletes every entity, tag item and the item counts of a
+// client in one transaction, and returns the removed sync_entities rows so
+// the caller can purge them from its cache.
 func (d SqliteDatastore) ClearServerData(clientID string) ([]braveds.SyncEntity, error) {
-	return nil, nil
+	fail := func(err error) ([]braveds.SyncEntity, error) {
+		return nil, fmt.Errorf("ClearServerData: %w", classifySqliteError(err))
+	}
+
+	tx, err := d.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(clearServerDataQuery, clientID, disabledChainID)
+	if err != nil {
+		return fail(err)
+	}
+	defer rows.Close()
+
+	syncEntities := []braveds.SyncEntity{}
+	for rows.Next() {
+		entity, err := d.scanSealedSyncEntity(rows)
+		if err != nil {
+			return fail(err)
+		}
+		syncEntities = append(syncEntities, entity)
+	}
+	if err = rows.Err(); err != nil {
+		return fail(err)
+	}
+	rows.Close()
+
+	if _, err = tx.Exec("DELETE FROM client_item_counts WHERE client_id = ?", clientID); err != nil {
+		return fail(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+
+	return syncEntities, nil
 }
 
+// disabledChainID is the id of the marker row which DisableSyncChain stores
+// next to the entities of a chain. Like tag items it has no version.
+const disabledChainID = "disabled_chain"
+
+const disableSyncChainQuery = `
+INSERT INTO sync_entities (client_id, id, mtime, ctime)
+VALUES (?, ?, ?, ?)
+ON CONFLICT (client_id, id) DO NOTHING
+`
+
+// DisableSyncChain marks a chain as disabled, the DisabledChain middleware
+// then rejects every further request for it. The marker is kept in the
+// database, so the chain stays disabled across server restarts.
 func (d SqliteDatastore) DisableSyncChain(clientID string) error {
+	now := time.Now().UnixMilli()
+	if _, err := d.Db.Exec(disableSyncChainQuery, clientID, disabledChainID, now, now); err != nil {
+		return fmt.Errorf("DisableSyncChain: %w", classifySqliteError(err))
+	}
 	return nil
 }
 
 func (d SqliteDatastore) IsSyncChainDisabled(clientID string) (bool, error) {
-	return false, nil
+	disabled, err := d.HasItem(clientID, disabledChainID)
+	if err != nil {
+		return false, fmt.Errorf("IsSyncChainDisabled: %w", err)
+	}
+	return disabled, nil
 }
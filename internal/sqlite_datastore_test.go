@@ -1,7 +1,9 @@
 package internal_test
 
 import (
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/brave/go-sync/datastore"
@@ -23,13 +25,71 @@ func TestInsertion(t *testing.T) {
 		Version:  &one,
 	}
 
-	ok, err := ds.InsertSyncEntity(&se)
+	conflict, err := ds.InsertSyncEntity(&se)
+	assert.NoError(t, err, "can't have an error here")
+	assert.False(t, conflict)
+
+	// Counts are maintained by the commit handler, not by the inserts.
+	counts, err := ds.GetClientItemCount(se.ClientID)
+	assert.NoError(t, err, "can't have an error here")
+	assert.Equal(t, 0, counts.ItemCount)
+
+	err = ds.UpdateClientItemCount(counts, 1, 0)
 	assert.NoError(t, err, "can't have an error here")
-	assert.True(t, ok)
 
-	count, err := ds.GetClientItemCount(se.ClientID)
+	counts, err = ds.GetClientItemCount(se.ClientID)
 	assert.NoError(t, err, "can't have an error here")
-	assert.Equal(t, count, 1, "we inserted a single row")
+	assert.Equal(t, 1, counts.ItemCount, "we inserted a single row")
+}
+
+func TestClientItemCount(t *testing.T) {
+	ds, err := internal.NewSqliteDatastore(":memory:")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.CreateTable())
+
+	// A client without a counts row starts from zero.
+	counts, err := ds.GetClientItemCount("client1")
+	assert.NoError(t, err)
+	assert.Equal(t, "client1", counts.ClientID)
+	assert.Equal(t, "client1", counts.ID)
+	assert.Equal(t, 0, counts.ItemCount)
+	assert.Equal(t, 0, counts.SumHistoryCounts())
+
+	assert.NoError(t, ds.UpdateClientItemCount(counts, 3, 2))
+	counts, err = ds.GetClientItemCount("client1")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, counts.ItemCount)
+	assert.Equal(t, 2, counts.HistoryItemCountPeriod4)
+
+	// Pretend two periods have passed, history counts shift down twice.
+	assert.NoError(t, ds.UpdateClientItemCount(counts, 0, 5))
+	_, err = ds.Db.Exec(
+		"UPDATE client_item_counts SET last_period_change_time = ? WHERE client_id = ?",
+		time.Now().Unix()-2*int64(datastore.HistoryExpirationIntervalSecs)/4-10, "client1")
+	assert.NoError(t, err)
+	counts, err = ds.GetClientItemCount("client1")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, counts.ItemCount)
+	assert.Equal(t, 7, counts.HistoryItemCountPeriod2)
+	assert.Equal(t, 0, counts.HistoryItemCountPeriod4)
+	assert.Equal(t, 7, counts.SumHistoryCounts())
+
+	// Rows from an older counts version are recounted from the entities.
+	_, err = ds.InsertSyncEntity(&datastore.SyncEntity{
+		ClientID: "client2",
+		ID:       "id1",
+		Version:  aws.Int64(1),
+		Mtime:    aws.Int64(12345678),
+		DataType: aws.Int(123),
+		Deleted:  aws.Bool(false),
+	})
+	assert.NoError(t, err)
+	_, err = ds.Db.Exec("INSERT INTO client_item_counts (client_id, item_count) VALUES (?, ?)", "client2", 42)
+	assert.NoError(t, err)
+	counts, err = ds.GetClientItemCount("client2")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, counts.ItemCount)
+	assert.Equal(t, 0, counts.SumHistoryCounts())
 }
 
 func TestInsertSyncEntity(t *testing.T) {
@@ -201,3 +261,82 @@ func TestUpdateSyncEntity(t *testing.T) {
 	assert.False(t, conflict)
 	assert.True(t, deleted)
 }
+
+func TestDisableSyncChainPersists(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "litesync.sqlite")
+
+	ds, err := internal.NewSqliteDatastore(dbPath)
+	assert.NoError(t, err)
+	assert.NoError(t, ds.CreateTable())
+	assert.NoError(t, ds.DisableSyncChain("client1"))
+	// Disabling twice is not an error.
+	assert.NoError(t, ds.DisableSyncChain("client1"))
+	assert.NoError(t, ds.Close())
+
+	// A restarted server still sees the chain as disabled.
+	ds, err = internal.NewSqliteDatastore(dbPath)
+	assert.NoError(t, err)
+	defer ds.Close()
+
+	disabled, err := ds.IsSyncChainDisabled("client1")
+	assert.NoError(t, err)
+	assert.True(t, disabled)
+
+	disabled, err = ds.IsSyncChainDisabled("client2")
+	assert.NoError(t, err)
+	assert.False(t, disabled)
+}
+
+func TestClearServerData(t *testing.T) {
+	ds, err := internal.NewSqliteDatastore(":memory:")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.CreateTable())
+
+	entity := datastore.SyncEntity{
+		ClientID:               "client1",
+		ID:                     "id1",
+		Version:                aws.Int64(1),
+		Ctime:                  aws.Int64(12345678),
+		Mtime:                  aws.Int64(12345678),
+		DataType:               aws.Int(123),
+		Folder:                 aws.Bool(false),
+		Deleted:                aws.Bool(false),
+		DataTypeMtime:          aws.String("123#12345678"),
+		ClientDefinedUniqueTag: aws.String("tag1"),
+	}
+	_, err = ds.InsertSyncEntity(&entity)
+	assert.NoError(t, err)
+	other := entity
+	other.ClientID = "client2"
+	_, err = ds.InsertSyncEntity(&other)
+	assert.NoError(t, err)
+
+	counts, err := ds.GetClientItemCount("client1")
+	assert.NoError(t, err)
+	assert.NoError(t, ds.UpdateClientItemCount(counts, 1, 0))
+	assert.NoError(t, ds.DisableSyncChain("client1"))
+
+	// The entity and its client tag item are returned.
+	removed, err := ds.ClearServerData("client1")
+	assert.NoError(t, err)
+	assert.Len(t, removed, 2)
+	ids := []string{removed[0].ID, removed[1].ID}
+	assert.ElementsMatch(t, []string{"id1", "Client#tag1"}, ids)
+
+	has, err := ds.HasItem("client1", "id1")
+	assert.NoError(t, err)
+	assert.False(t, has)
+
+	counts, err = ds.GetClientItemCount("client1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, counts.ItemCount)
+
+	// The chain stays disabled and other chains are untouched.
+	disabled, err := ds.IsSyncChainDisabled("client1")
+	assert.NoError(t, err)
+	assert.True(t, disabled)
+
+	has, err = ds.HasItem("client2", "id1")
+	assert.NoError(t, err)
+	assert.True(t, has)
+}
@@ -0,0 +1,89 @@
+//go:build !purego
+
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// SqliteDriver is the database/sql driver SqliteDatastore opens. Building
+// with the purego tag swaps the cgo driver for a pure Go one.
+const SqliteDriver = "sqlite3"
+
+// sqliteErrorCode returns the primary and extended result code of a SQLite
+// error.
+func sqliteErrorCode(err error) (code int, extendedCode int, ok bool) {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return 0, 0, false
+	}
+	return int(sqliteErr.Code), int(sqliteErr.ExtendedCode), true
+}
+
+// sqliteDriverParams turns the options into the driver's DSN parameters.
+// The journal mode is stored in the database, so it is only set by the
+// writer.
+func sqliteDriverParams(o SqliteOptions, readOnly bool) url.Values {
+	params := url.Values{}
+	params.Set("_busy_timeout", strconv.FormatInt(o.BusyTimeout.Milliseconds(), 10))
+	params.Set("_foreign_keys", strconv.FormatBool(o.ForeignKeys))
+	if !readOnly {
+		params.Set("_journal_mode", strings.ToUpper(o.JournalMode))
+		params.Set("_synchronous", strings.ToUpper(o.Synchronous))
+		// Taking the write lock at BEGIN avoids the deadlock of two
+		// readers upgrading at once, which busy_timeout cannot resolve.
+		params.Set("_txlock", "immediate")
+	}
+	return params
+}
+
+// sqliteBackup copies the database of src into a new file at destPath with
+// SQLite's online backup API.
+func sqliteBackup(ctx context.Context, src *sql.Conn, destPath string) error {
+	destDb, err := sql.Open(SqliteDriver, destPath)
+	if err != nil {
+		return err
+	}
+	defer destDb.Close()
+	dest, err := destDb.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	return dest.Raw(func(destConn any) error {
+		return src.Raw(func(srcConn any) error {
+			backup, err := destConn.(*sqlite3.SQLiteConn).Backup("main", srcConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			// Copying every page in one step reads them all in a single
+			// transaction. A step which finds the source locked copies
+			// nothing and is retried.
+			for {
+				done, err := backup.Step(-1)
+				if err != nil {
+					backup.Finish()
+					return err
+				}
+				if done {
+					return backup.Finish()
+				}
+				select {
+				case <-ctx.Done():
+					backup.Finish()
+					return ctx.Err()
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		})
+	})
+}
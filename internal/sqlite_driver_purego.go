@@ -0,0 +1,81 @@
+//go:build purego
+
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"modernc.org/sqlite"
+)
+
+// SqliteDriver is the database/sql driver SqliteDatastore opens. This is
+// the pure Go driver, which needs no C toolchain.
+const SqliteDriver = "sqlite"
+
+// sqliteErrorCode returns the primary and extended result code of a SQLite
+// error. The driver turns on extended result codes.
+func sqliteErrorCode(err error) (code int, extendedCode int, ok bool) {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return 0, 0, false
+	}
+	return sqliteErr.Code() & 0xff, sqliteErr.Code(), true
+}
+
+// sqliteDriverParams turns the options into the driver's DSN parameters.
+// The pragmas run in order, busy_timeout first so that the others wait for
+// a locked database too.
+func sqliteDriverParams(o SqliteOptions, readOnly bool) url.Values {
+	params := url.Values{}
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", o.BusyTimeout.Milliseconds()))
+	params.Add("_pragma", fmt.Sprintf("foreign_keys(%t)", o.ForeignKeys))
+	if !readOnly {
+		params.Add("_pragma", fmt.Sprintf("journal_mode(%s)", strings.ToUpper(o.JournalMode)))
+		params.Add("_pragma", fmt.Sprintf("synchronous(%s)", strings.ToUpper(o.Synchronous)))
+		// Taking the write lock at BEGIN avoids the deadlock of two
+		// readers upgrading at once, which busy_timeout cannot resolve.
+		params.Set("_txlock", "immediate")
+	}
+	return params
+}
+
+// sqliteBackuper is implemented by the driver's connections.
+type sqliteBackuper interface {
+	NewBackup(dstUri string) (*sqlite.Backup, error)
+}
+
+// sqliteBackup copies the database of src into a new file at destPath with
+// SQLite's online backup API.
+func sqliteBackup(ctx context.Context, src *sql.Conn, destPath string) error {
+	return src.Raw(func(srcConn any) error {
+		backuper, ok := srcConn.(sqliteBackuper)
+		if !ok {
+			return fmt.Errorf("driver connection %T cannot make backups", srcConn)
+		}
+		backup, err := backuper.NewBackup(destPath)
+		if err != nil {
+			return err
+		}
+		// Copying every page in one step reads them all in a single
+		// transaction.
+		for {
+			more, err := backup.Step(-1)
+			if err != nil {
+				backup.Finish()
+				return err
+			}
+			if !more {
+				return backup.Finish()
+			}
+			if err = ctx.Err(); err != nil {
+				backup.Finish()
+				return err
+			}
+		}
+	})
+}
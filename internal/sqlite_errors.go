@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Datastore methods wrap database failures in one of these errors, so callers
+// can tell them apart with errors.Is. The commit handler reports a conflict
+// returned together with ErrConflict as a sync CONFLICT, and every other
+// error as a TRANSIENT_ERROR which the browser retries.
+var (
+	// ErrConflict is returned when a row with the same key or unique tag
+	// already exists.
+	ErrConflict = errors.New("conflicting item already exists")
+
+	// ErrBusy is returned when the database stayed locked by another
+	// connection for longer than the busy timeout. Retrying later helps.
+	ErrBusy = errors.New("database is busy")
+
+	// ErrCorrupt is returned when the database file is damaged or is not a
+	// SQLite database at all.
+	ErrCorrupt = errors.New("database is corrupt")
+
+	// ErrDiskFull is returned when the disk holding the database is full.
+	ErrDiskFull = errors.New("database disk is full")
+
+	// ErrReadOnly is returned when the database cannot be written to.
+	ErrReadOnly = errors.New("database is read-only")
+)
+
+// SQLite result codes, the same whichever driver is built in.
+const (
+	sqliteBusy       = 5
+	sqliteLocked     = 6
+	sqliteReadOnly   = 8
+	sqliteCorrupt    = 11
+	sqliteFull       = 13
+	sqliteConstraint = 19
+	sqliteNotADB     = 26
+
+	sqliteConstraintPrimaryKey = sqliteConstraint | 6<<8
+	sqliteConstraintUnique     = sqliteConstraint | 8<<8
+)
+
+// classifySqliteError wraps err in the sentinel matching its SQLite error
+// code, keeping the original error in the chain. Only unique and primary
+// key violations are conflicts, NOT NULL and CHECK violations are bugs and
+// are returned as they are.
+func classifySqliteError(err error) error {
+	code, extendedCode, ok := sqliteErrorCode(err)
+	if !ok {
+		return err
+	}
+
+	var kind error
+	switch code {
+	case sqliteConstraint:
+		switch extendedCode {
+		case sqliteConstraintUnique, sqliteConstraintPrimaryKey:
+			kind = ErrConflict
+		}
+	case sqliteBusy, sqliteLocked:
+		kind = ErrBusy
+	case sqliteCorrupt, sqliteNotADB:
+		kind = ErrCorrupt
+	case sqliteFull:
+		kind = ErrDiskFull
+	case sqliteReadOnly:
+		kind = ErrReadOnly
+	}
+	if kind == nil {
+		return err
+	}
+	return fmt.Errorf("%w: %w", kind, err)
+}
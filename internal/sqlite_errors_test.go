@@ -0,0 +1,74 @@
+package internal_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInsertSyncEntityConflictIsTyped(t *testing.T) {
+	ds, err := internal.NewSqliteDatastore(":memory:")
+	require.NoError(t, err)
+	defer ds.Close()
+
+	entity := datastore.SyncEntity{
+		ClientID:               "client1",
+		ID:                     "id1",
+		Version:                aws.Int64(1),
+		ClientDefinedUniqueTag: aws.String("tag1"),
+		DataType:               aws.Int(123),
+	}
+	conflict, err := ds.InsertSyncEntity(&entity)
+	require.NoError(t, err)
+	assert.False(t, conflict)
+
+	// Same ID.
+	conflict, err = ds.InsertSyncEntity(&entity)
+	assert.ErrorIs(t, err, internal.ErrConflict)
+	assert.True(t, conflict)
+
+	// Same client tag, different ID.
+	entity.ID = "id2"
+	conflict, err = ds.InsertSyncEntity(&entity)
+	assert.ErrorIs(t, err, internal.ErrConflict)
+	assert.True(t, conflict)
+
+	// The failed insert must not leave the entity behind.
+	has, err := ds.HasItem("client1", "id2")
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestInsertSyncEntityBusyIsNotConflict(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "litesync.sqlite")
+
+	opts := internal.DefaultSqliteOptions()
+	opts.BusyTimeout = 10 * time.Millisecond
+	ds, err := internal.NewSqliteDatastoreWithOptions(dbPath, opts)
+	require.NoError(t, err)
+	defer ds.Close()
+
+	other, err := sql.Open(internal.SqliteDriver, dbPath)
+	require.NoError(t, err)
+	defer other.Close()
+	tx, err := other.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT INTO sync_entities (client_id, id) VALUES ('client2', 'lock')")
+	require.NoError(t, err)
+
+	conflict, err := ds.InsertSyncEntity(&datastore.SyncEntity{
+		ClientID: "client1",
+		ID:       "id1",
+		Version:  aws.Int64(1),
+	})
+	assert.ErrorIs(t, err, internal.ErrBusy)
+	assert.False(t, conflict, "a locked database should be retried, not reported as a conflict")
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// checkIntegrity runs SQLite's quick_check, which reads every page of the
+// database without the slower index cross-checks of integrity_check.
+func (d *SqliteDatastore) checkIntegrity() error {
+	if err := d.Db.Ping(); err != nil {
+		// The driver reads the header when it connects, so a file which is
+		// not a database already fails here.
+		if err = classifySqliteError(err); errors.Is(err, ErrCorrupt) {
+			return err
+		}
+		return fmt.Errorf("database cannot be opened: %w", err)
+	}
+	return runIntegrityCheck(d.Db, "quick_check")
+}
+
+// runIntegrityCheck runs quick_check or integrity_check, and returns the
+// problems found wrapped in ErrCorrupt.
+func runIntegrityCheck(db queryer, pragma string) error {
+	problems, err := integrityProblems(db, pragma)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrCorrupt, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// integrityProblems returns the lines of quick_check or integrity_check
+// other than "ok". A database too damaged to check fails instead.
+func integrityProblems(db queryer, pragma string) ([]string, error) {
+	rows, err := db.QueryContext(context.Background(), "PRAGMA "+pragma)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	return problems, rows.Err()
+}
+
+// checkWritable creates a table and rolls back. That touches a page, so
+// SQLite has to be able to lock the file and create its journal next to it,
+// which is what the first commit will need too.
+func (d *SqliteDatastore) checkWritable() error {
+	tx, err := d.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrReadOnly, err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("CREATE TABLE litesync_write_check (x INTEGER)"); err != nil {
+		// A lock held by another process is not a permission problem.
+		if err = classifySqliteError(err); errors.Is(err, ErrBusy) {
+			return fmt.Errorf("database is in use: %w", err)
+		}
+		return fmt.Errorf("%w: %v", ErrReadOnly, err)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package internal_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSqliteDatastoreRefusesCorruptFile(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "litesync.sqlite")
+	require.NoError(t, os.WriteFile(dbPath, bytes.Repeat([]byte("not a database "), 512), 0o600))
+
+	_, err := internal.NewSqliteDatastore(dbPath)
+	assert.ErrorIs(t, err, internal.ErrCorrupt)
+}
+
+func TestNewSqliteDatastoreRefusesReadOnlyFile(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "litesync.sqlite")
+	ds, err := internal.NewSqliteDatastore(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, ds.Close())
+
+	// Opening read-only stands in for a file we lack write permission on,
+	// which the tests cannot rely on when they run as root.
+	_, err = internal.NewSqliteDatastore("file:" + dbPath + "?mode=ro")
+	assert.ErrorIs(t, err, internal.ErrReadOnly)
+}
+
+func TestNewSqliteDatastoreRefusesMissingDirectory(t *testing.T) {
+	_, err := internal.NewSqliteDatastore(filepath.Join(t.TempDir(), "missing", "litesync.sqlite"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are named NNNN_description.sql and applied in version order.
+// A file is never edited once released, schema changes go into a new file.
+//
+//go:embed migrations/sqlite/*.sql
+var sqliteMigrationFiles embed.FS
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer
+// litesync than this one.
+var ErrSchemaTooNew = errors.New("database schema is newer than this litesync supports")
+
+type migration struct {
+	version int
+	name    string
+	query   string
+}
+
+// loadMigrations reads the migrations in dir, and checks that their versions
+// run from 1 upwards without gaps.
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]migration, 0, len(files))
+	for _, file := range files {
+		name := strings.TrimSuffix(path.Base(file), ".sql")
+		prefix, _, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: name must be NNNN_description.sql", file)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: bad version: %v", file, err)
+		}
+		query, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: name, query: string(query)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration %s: expected version %d", m.name, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+const createSchemaVersionTableQuery = `
+CREATE TABLE IF NOT EXISTS schema_version (
+     version INTEGER NOT NULL PRIMARY KEY,
+     name TEXT NOT NULL,
+     applied_at INTEGER NOT NULL
+)
+`
+
+// SchemaVersion returns the version of the last migration applied to the
+// database, or 0 for a database which has never been migrated.
+func (d *SqliteDatastore) SchemaVersion() (int, error) {
+	if _, err := d.Db.Exec(createSchemaVersionTableQuery); err != nil {
+		return 0, fmt.Errorf("SchemaVersion: %w", classifySqliteError(err))
+	}
+	var version int
+	if err := d.Db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("SchemaVersion: %w", classifySqliteError(err))
+	}
+	return version, nil
+}
+
+// Migrate applies every migration newer than the database's schema version,
+// each one in its own transaction. The first migrations use IF NOT EXISTS,
+// so databases created before schema versioning are adopted in place.
+func (d *SqliteDatastore) Migrate() error {
+	fail := func(err error) error {
+		return fmt.Errorf("Migrate: %w", err)
+	}
+
+	migrations, err := loadMigrations(sqliteMigrationFiles, "migrations/sqlite")
+	if err != nil {
+		return fail(err)
+	}
+
+	current, err := d.SchemaVersion()
+	if err != nil {
+		return fail(err)
+	}
+	if current > len(migrations) {
+		return fail(fmt.Errorf("%w: database is at version %d, latest known is %d",
+			ErrSchemaTooNew, current, len(migrations)))
+	}
+
+	for _, m := range migrations[current:] {
+		if err := d.applyMigration(m); err != nil {
+			return fail(fmt.Errorf("migration %s: %w", m.name, classifySqliteError(err)))
+		}
+	}
+	return nil
+}
+
+func (d *SqliteDatastore) applyMigration(m migration) error {
+	tx, err := d.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(m.query); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)",
+		m.version, m.name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,99 @@
+package internal_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func latestSchemaVersion(t *testing.T) int {
+	files, err := filepath.Glob(filepath.Join("migrations", "sqlite", "*.sql"))
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	return len(files)
+}
+
+func TestMigrateFreshDatabase(t *testing.T) {
+	ds, err := internal.NewSqliteDatastore(filepath.Join(t.TempDir(), "litesync.sqlite"))
+	require.NoError(t, err)
+	defer ds.Close()
+
+	version, err := ds.SchemaVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, latestSchemaVersion(t), version)
+
+	// Migrating an up to date database is a no-op.
+	assert.NoError(t, ds.Migrate())
+	version, err = ds.SchemaVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, latestSchemaVersion(t), version)
+}
+
+func TestMigrateAdoptsUnversionedDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "litesync.sqlite")
+
+	// The schema litesync created before migrations were versioned.
+	db, err := sql.Open(internal.SqliteDriver, dbPath)
+	require.NoError(t, err)
+	_, err = db.Exec(`
+CREATE TABLE sync_entities (
+     client_id TEXT NOT NULL,
+     id TEXT NOT NULL,
+     parent_id TEXT,
+     version INTEGER,
+     mtime INTEGER,
+     ctime INTEGER,
+     name TEXT,
+     non_unique_name TEXT,
+     server_defined_unique_tag TEXT,
+     deleted BOOLEAN,
+     originator_cache_guid TEXT,
+     originator_client_item_id TEXT,
+     specifics BLOB,
+     data_type INTEGER,
+     folder BOOLEAN,
+     client_defined_unique_tag TEXT,
+     unique_position BLOB,
+     data_type_mtime TEXT,
+     expiration_time INTEGER,
+     PRIMARY KEY (client_id, id)
+);
+INSERT INTO sync_entities (client_id, id, version, mtime, data_type)
+VALUES ('client1', 'id1', 1, 12345678, 123);`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	ds, err := internal.NewSqliteDatastore(dbPath)
+	require.NoError(t, err)
+	defer ds.Close()
+
+	version, err := ds.SchemaVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, latestSchemaVersion(t), version)
+
+	has, err := ds.HasItem("client1", "id1")
+	assert.NoError(t, err)
+	assert.True(t, has, "existing rows should survive the migration")
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "litesync.sqlite")
+
+	ds, err := internal.NewSqliteDatastore(dbPath)
+	require.NoError(t, err)
+	_, err = ds.Db.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)",
+		latestSchemaVersion(t)+1, "from_the_future", 0)
+	require.NoError(t, err)
+	require.NoError(t, ds.Close())
+
+	_, err = internal.NewSqliteDatastore(dbPath)
+	assert.ErrorIs(t, err, internal.ErrSchemaTooNew)
+
+	_, err = os.Stat(dbPath)
+	assert.NoError(t, err, "a refused database should be left alone")
+}
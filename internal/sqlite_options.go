@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SqliteOptions are the connection settings of a SqliteDatastore. They are
+// passed to the driver as DSN parameters, so every pooled connection gets
+// them, not just the first one.
+type SqliteOptions struct {
+	// JournalMode is one of DELETE, TRUNCATE, PERSIST, MEMORY, WAL or OFF.
+	// WAL lets readers run alongside the single writer.
+	JournalMode string
+
+	// Synchronous is one of OFF, NORMAL, FULL or EXTRA. NORMAL is safe
+	// with WAL, a power loss can only lose the last commits.
+	Synchronous string
+
+	// BusyTimeout is how long a connection waits for another one's lock
+	// before giving up with ErrBusy.
+	BusyTimeout time.Duration
+
+	ForeignKeys bool
+
+	// ReadConns is the size of the read-only pool used by GetUpdatesForType
+	// and HasItem. Writes always go through a single connection.
+	ReadConns int
+
+	// EncryptionKeys, when set, encrypts the content of entities before
+	// it is stored. Rows written without keys stay readable.
+	EncryptionKeys *EncryptionKeys
+
+	// CompressSpecifics stores large specifics zstd compressed. Compressed
+	// rows stay readable when it is turned off again.
+	CompressSpecifics bool
+
+	// Quotas, when set, limit what each chain stores.
+	Quotas *Quotas
+
+	// KeepTombstones is set for a server which never compacts tombstones,
+	// the fetches are then not recorded.
+	KeepTombstones bool
+}
+
+// DefaultSqliteOptions returns the settings used by NewSqliteDatastore.
+func DefaultSqliteOptions() SqliteOptions {
+	return SqliteOptions{
+		JournalMode: "WAL",
+		Synchronous: "NORMAL",
+		BusyTimeout: 5 * time.Second,
+		ForeignKeys: true,
+		ReadConns:   4,
+	}
+}
+
+var (
+	sqliteJournalModes = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+	sqliteSyncLevels   = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+)
+
+func (o SqliteOptions) validate() error {
+	if !slices.Contains(sqliteJournalModes, strings.ToUpper(o.JournalMode)) {
+		return fmt.Errorf("unknown journal mode %q", o.JournalMode)
+	}
+	if !slices.Contains(sqliteSyncLevels, strings.ToUpper(o.Synchronous)) {
+		return fmt.Errorf("unknown synchronous level %q", o.Synchronous)
+	}
+	if o.BusyTimeout < 0 {
+		return fmt.Errorf("busy timeout must not be negative")
+	}
+	if o.ReadConns < 1 {
+		return fmt.Errorf("at least one read connection is needed")
+	}
+	return nil
+}
+
+// isMemoryDatabase reports whether filename names an in-memory database.
+// Every connection to one gets its own empty database, so it cannot be
+// split into a writer and a reader pool.
+func isMemoryDatabase(filename string) bool {
+	return filename == ":memory:" ||
+		strings.HasPrefix(filename, "file::memory:") ||
+		strings.Contains(filename, "mode=memory")
+}
+
+// databaseFilePath is the path of the file filename opens, filename can be a
+// file: URI.
+func databaseFilePath(filename string) string {
+	if !strings.HasPrefix(filename, "file:") {
+		return filename
+	}
+	u, err := url.Parse(filename)
+	if err != nil {
+		return filename
+	}
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Path
+}
+
+// writerDSN adds the options to filename. Parameters already in filename
+// come first, and the driver takes the first value of a parameter.
+func (o SqliteOptions) writerDSN(filename string) string {
+	return appendDSNParams(filename, sqliteDriverParams(o, false))
+}
+
+// readerDSN opens filename read-only.
+func (o SqliteOptions) readerDSN(filename string) string {
+	params := sqliteDriverParams(o, true)
+	params.Set("mode", "ro")
+	return appendDSNParams(filename, params)
+}
+
+// appendDSNParams turns a plain path into a file: URI, the driver only hands
+// URI parameters like mode to SQLite for those.
+func appendDSNParams(filename string, params url.Values) string {
+	if filename == ":memory:" {
+		filename = "file::memory:"
+	} else if !strings.HasPrefix(filename, "file:") {
+		filename = "file:" + (&url.URL{Path: filename}).EscapedPath()
+	}
+	if strings.Contains(filename, "?") {
+		return filename + "&" + params.Encode()
+	}
+	return filename + "?" + params.Encode()
+}
@@ -0,0 +1,82 @@
+package internal_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSqliteOptionsApplied(t *testing.T) {
+	opts := internal.DefaultSqliteOptions()
+	opts.BusyTimeout = 1234 * time.Millisecond
+	ds, err := internal.NewSqliteDatastoreWithOptions(filepath.Join(t.TempDir(), "lite sync.sqlite"), opts)
+	require.NoError(t, err)
+	defer ds.Close()
+
+	var journalMode string
+	var synchronous, busyTimeout, foreignKeys int
+	require.NoError(t, ds.Db.QueryRow("PRAGMA journal_mode").Scan(&journalMode))
+	require.NoError(t, ds.Db.QueryRow("PRAGMA synchronous").Scan(&synchronous))
+	require.NoError(t, ds.Db.QueryRow("PRAGMA busy_timeout").Scan(&busyTimeout))
+	require.NoError(t, ds.Db.QueryRow("PRAGMA foreign_keys").Scan(&foreignKeys))
+	assert.Equal(t, "wal", journalMode)
+	assert.Equal(t, 1, synchronous, "NORMAL")
+	assert.Equal(t, 1234, busyTimeout)
+	assert.Equal(t, 1, foreignKeys)
+
+	require.NoError(t, ds.ReadDb.QueryRow("PRAGMA busy_timeout").Scan(&busyTimeout))
+	assert.Equal(t, 1234, busyTimeout)
+	_, err = ds.ReadDb.Exec("DELETE FROM sync_entities")
+	assert.ErrorContains(t, err, "readonly", "the read pool must not write")
+}
+
+func TestReadsDoNotWaitForWriter(t *testing.T) {
+	ds, err := internal.NewSqliteDatastore(filepath.Join(t.TempDir(), "litesync.sqlite"))
+	require.NoError(t, err)
+	defer ds.Close()
+
+	entity := datastore.SyncEntity{
+		ClientID: "client1",
+		ID:       "id1",
+		Version:  aws.Int64(1),
+		Mtime:    aws.Int64(1),
+		DataType: aws.Int(123),
+		Folder:   aws.Bool(false),
+	}
+	_, err = ds.InsertSyncEntity(&entity)
+	require.NoError(t, err)
+
+	// Hold the only writer connection, reads go through the read pool and
+	// see the last committed state.
+	tx, err := ds.Db.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM sync_entities")
+	require.NoError(t, err)
+
+	has, err := ds.HasItem("client1", "id1")
+	assert.NoError(t, err)
+	assert.True(t, has)
+
+	_, entities, err := ds.GetUpdatesForType(123, 0, true, "client1", 100)
+	assert.NoError(t, err)
+	assert.Len(t, entities, 1)
+}
+
+func TestSqliteOptionsValidated(t *testing.T) {
+	opts := internal.DefaultSqliteOptions()
+	opts.JournalMode = "sideways"
+	_, err := internal.NewSqliteDatastoreWithOptions(filepath.Join(t.TempDir(), "litesync.sqlite"), opts)
+	assert.ErrorContains(t, err, "journal mode")
+
+	opts = internal.DefaultSqliteOptions()
+	opts.ReadConns = 0
+	_, err = internal.NewSqliteDatastoreWithOptions(filepath.Join(t.TempDir(), "litesync.sqlite"), opts)
+	assert.Error(t, err)
+}
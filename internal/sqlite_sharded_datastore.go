@@ -0,0 +1,502 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	braveds "github.com/brave/go-sync/datastore"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const shardFileSuffix = ".sqlite"
+
+// Client IDs are hex encoded public keys, anything else would not make a
+// safe file name.
+var shardClientIDPattern = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+
+// ShardedSqliteDatastore keeps every chain in its own SQLite file under a
+// data directory, named after the client ID. A chain can then be backed up,
+// moved or deleted on its own, and a damaged file only affects one chain.
+//
+// Files are opened on first use and kept open in an LRU, the least recently
+// used one is closed when more than maxOpen chains are active. Opening a file
+// checks and migrates it, and closing one flushes and checkpoints it, which
+// are done outside mu so that a slow file only holds up its own chain.
+type ShardedSqliteDatastore struct {
+	braveds.Datastore
+	dir  string
+	opts SqliteOptions
+
+	mu     sync.Mutex
+	shards *lru.Cache // client ID -> *sqliteShard
+	// retired holds the shards evicted from the LRU while requests still
+	// use them. They are reused until the last request is done, a second
+	// store on the same file would be a second writer.
+	retired map[string]*sqliteShard
+	// unused holds the shards to close once mu is unlocked, and closing
+	// the shard of each chain being closed, which is only opened again
+	// once that is done.
+	unused  []*sqliteShard
+	closing map[string]*sqliteShard
+}
+
+// sqliteShard counts the requests using a store, so that a store evicted
+// from the LRU is only closed once the last of them is done. ready is closed
+// once the store is open, or err is set, and closed once it is closed again.
+type sqliteShard struct {
+	clientID string
+	ready    chan struct{}
+	closed   chan struct{}
+	store    *SqliteDatastore
+	err      error
+	refs     int
+	evicted  bool
+}
+
+// NewShardedSqliteDatastore creates dir if needed. No file is opened until
+// a chain is used.
+func NewShardedSqliteDatastore(dir string, opts SqliteOptions, maxOpen int) (*ShardedSqliteDatastore, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	d := &ShardedSqliteDatastore{
+		dir:     dir,
+		opts:    opts,
+		retired: map[string]*sqliteShard{},
+		closing: map[string]*sqliteShard{},
+	}
+	shards, err := lru.NewWithEvict(maxOpen, func(_, value interface{}) {
+		// Called with d.mu held, from Add, Remove and Purge.
+		shard := value.(*sqliteShard)
+		shard.evicted = true
+		switch {
+		case shard.refs == 0:
+			d.retire(shard)
+		case shard.err == nil:
+			d.retired[shard.clientID] = shard
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.shards = shards
+	return d, nil
+}
+
+// ShardPath returns the file holding the chain of clientID.
+func (d *ShardedSqliteDatastore) ShardPath(clientID string) (string, error) {
+	if !shardClientIDPattern.MatchString(clientID) {
+		return "", fmt.Errorf("client ID %q cannot be used as a file name", clientID)
+	}
+	return filepath.Join(d.dir, clientID+shardFileSuffix), nil
+}
+
+// acquire returns the shard of clientID, opening its file if needed. A
+// request for a chain whose file is being opened waits for that open.
+func (d *ShardedSqliteDatastore) acquire(clientID string) (*sqliteShard, error) {
+	path, err := d.ShardPath(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	shard, opening := d.lookup(clientID), false
+	if shard == nil {
+		shard, opening = &sqliteShard{clientID: clientID, ready: make(chan struct{})}, true
+		d.shards.Add(clientID, shard)
+	}
+	shard.refs++
+	previous := d.closing[clientID]
+	d.mu.Unlock()
+	d.closeUnused()
+
+	if opening {
+		if previous != nil {
+			<-previous.closed
+		}
+		store, err := NewSqliteDatastoreWithOptions(path, d.opts)
+		d.mu.Lock()
+		shard.store = store
+		if err != nil {
+			shard.err = fmt.Errorf("failed to open %s: %w", path, err)
+			// The next request tries again.
+			if value, ok := d.shards.Peek(clientID); ok && value == shard {
+				d.shards.Remove(clientID)
+			}
+			if d.retired[clientID] == shard {
+				delete(d.retired, clientID)
+			}
+		}
+		d.mu.Unlock()
+		close(shard.ready)
+	}
+	<-shard.ready
+
+	if shard.err != nil {
+		d.release(shard)
+		return nil, shard.err
+	}
+	return shard, nil
+}
+
+// lookup returns the shard of clientID, nil when there is none. A retired
+// shard goes back into the LRU. Called with d.mu held.
+func (d *ShardedSqliteDatastore) lookup(clientID string) *sqliteShard {
+	if value, ok := d.shards.Get(clientID); ok {
+		return value.(*sqliteShard)
+	}
+	shard, ok := d.retired[clientID]
+	if !ok {
+		return nil
+	}
+	delete(d.retired, clientID)
+	shard.evicted = false
+	d.shards.Add(clientID, shard)
+	return shard
+}
+
+func (d *ShardedSqliteDatastore) release(shard *sqliteShard) {
+	d.mu.Lock()
+	shard.refs--
+	if shard.evicted && shard.refs == 0 {
+		d.retire(shard)
+	}
+	d.mu.Unlock()
+	d.closeUnused()
+}
+
+// retire hands an evicted shard which no request uses any more over to
+// closeUnused. Called with d.mu held.
+func (d *ShardedSqliteDatastore) retire(shard *sqliteShard) {
+	if d.retired[shard.clientID] == shard {
+		delete(d.retired, shard.clientID)
+	}
+	if shard.store == nil {
+		return
+	}
+	shard.closed = make(chan struct{})
+	d.closing[shard.clientID] = shard
+	d.unused = append(d.unused, shard)
+}
+
+// closeUnused closes the retired shards. An error only loses the fetches
+// recorded since the last flush, see tombstones.go, so a request does not
+// fail on it, only Close reports it.
+func (d *ShardedSqliteDatastore) closeUnused() error {
+	d.mu.Lock()
+	unused := d.unused
+	d.unused = nil
+	d.mu.Unlock()
+
+	var errs []error
+	for _, shard := range unused {
+		if err := shard.store.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", shard.clientID, err))
+		}
+		d.mu.Lock()
+		if d.closing[shard.clientID] == shard {
+			delete(d.closing, shard.clientID)
+		}
+		d.mu.Unlock()
+		close(shard.closed)
+	}
+	return errors.Join(errs...)
+}
+
+// withShard runs fn on the store of clientID, opening it if needed.
+func (d *ShardedSqliteDatastore) withShard(clientID string, fn func(store *SqliteDatastore) error) error {
+	shard, err := d.acquire(clientID)
+	if err != nil {
+		return err
+	}
+	defer d.release(shard)
+	return fn(shard.store)
+}
+
+// ClientIDs lists the chains which have a file in the data directory.
+func (d *ShardedSqliteDatastore) ClientIDs() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(d.dir, "*"+shardFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	clientIDs := make([]string, 0, len(files))
+	for _, file := range files {
+		clientID := strings.TrimSuffix(filepath.Base(file), shardFileSuffix)
+		if shardClientIDPattern.MatchString(clientID) {
+			clientIDs = append(clientIDs, clientID)
+		}
+	}
+	sort.Strings(clientIDs)
+	return clientIDs, nil
+}
+
+// Close closes every open file. Files still in use are closed when their
+// last request is done.
+func (d *ShardedSqliteDatastore) Close() error {
+	d.mu.Lock()
+	d.shards.Purge()
+	d.mu.Unlock()
+	return d.closeUnused()
+}
+
+// SchemaVersion returns the version every file is migrated to when opened.
+func (d *ShardedSqliteDatastore) SchemaVersion() (int, error) {
+	migrations, err := loadMigrations(sqliteMigrationFiles, "migrations/sqlite")
+	if err != nil {
+		return 0, fmt.Errorf("SchemaVersion: %w", err)
+	}
+	return len(migrations), nil
+}
+
+func (d *ShardedSqliteDatastore) InsertSyncEntity(entity *braveds.SyncEntity) (conflict bool, err error) {
+	err = d.withShard(entity.ClientID, func(store *SqliteDatastore) error {
+		conflict, err = store.InsertSyncEntity(entity)
+		return err
+	})
+	return conflict, err
+}
+
+func (d *ShardedSqliteDatastore) InsertSyncEntitiesWithServerTags(entities []*braveds.SyncEntity) error {
+	if len(entities) == 0 {
+		return nil
+	}
+	clientID := entities[0].ClientID
+	for _, entity := range entities {
+		if entity.ClientID != clientID {
+			return errors.New("InsertSyncEntitiesWithServerTags: entities of several clients")
+		}
+	}
+	return d.withShard(clientID, func(store *SqliteDatastore) error {
+		return store.InsertSyncEntitiesWithServerTags(entities)
+	})
+}
+
+func (d *ShardedSqliteDatastore) UpdateSyncEntity(entity *braveds.SyncEntity, oldVersion int64) (conflict bool, deleted bool, err error) {
+	err = d.withShard(entity.ClientID, func(store *SqliteDatastore) error {
+		conflict, deleted, err = store.UpdateSyncEntity(entity, oldVersion)
+		return err
+	})
+	return conflict, deleted, err
+}
+
+func (d *ShardedSqliteDatastore) GetUpdatesForType(dataType int, clientToken int64, fetchFolders bool, clientID string, maxSize int64) (hasChangesRemaining bool, entities []braveds.SyncEntity, err error) {
+	err = d.withShard(clientID, func(store *SqliteDatastore) error {
+		hasChangesRemaining, entities, err = store.GetUpdatesForType(dataType, clientToken, fetchFolders, clientID, maxSize)
+		return err
+	})
+	return hasChangesRemaining, entities, err
+}
+
+func (d *ShardedSqliteDatastore) HasServerDefinedUniqueTag(clientID string, tag string) (has bool, err error) {
+	err = d.withShard(clientID, func(store *SqliteDatastore) error {
+		has, err = store.HasServerDefinedUniqueTag(clientID, tag)
+		return err
+	})
+	return has, err
+}
+
+func (d *ShardedSqliteDatastore) HasItem(clientID string, ID string) (has bool, err error) {
+	err = d.withShard(clientID, func(store *SqliteDatastore) error {
+		has, err = store.HasItem(clientID, ID)
+		return err
+	})
+	return has, err
+}
+
+func (d *ShardedSqliteDatastore) GetClientItemCount(clientID string) (counts *braveds.ClientItemCounts, err error) {
+	err = d.withShard(clientID, func(store *SqliteDatastore) error {
+		counts, err = store.GetClientItemCount(clientID)
+		return err
+	})
+	return counts, err
+}
+
+func (d *ShardedSqliteDatastore) UpdateClientItemCount(counts *braveds.ClientItemCounts, newNormalItemCount int, newHistoryItemCount int) error {
+	return d.withShard(counts.ClientID, func(store *SqliteDatastore) error {
+		return store.UpdateClientItemCount(counts, newNormalItemCount, newHistoryItemCount)
+	})
+}
+
+func (d *ShardedSqliteDatastore) ClearServerData(clientID string) (entities []braveds.SyncEntity, err error) {
+	err = d.withShard(clientID, func(store *SqliteDatastore) error {
+		entities, err = store.ClearServerData(clientID)
+		return err
+	})
+	return entities, err
+}
+
+func (d *ShardedSqliteDatastore) DisableSyncChain(clientID string) error {
+	return d.withShard(clientID, func(store *SqliteDatastore) error {
+		return store.DisableSyncChain(clientID)
+	})
+}
+
+func (d *ShardedSqliteDatastore) IsSyncChainDisabled(clientID string) (disabled bool, err error) {
+	err = d.withShard(clientID, func(store *SqliteDatastore) error {
+		disabled, err = store.IsSyncChainDisabled(clientID)
+		return err
+	})
+	return disabled, err
+}
+
+// DeleteExpiredEntities deletes up to limit expired entities, going through
+// the files in client ID order. A file which fails is skipped, so that one
+// damaged chain does not stop the others from being cleaned up.
+func (d *ShardedSqliteDatastore) DeleteExpiredEntities(now int64, limit int) (map[string]int, error) {
+	clientIDs, err := d.ClientIDs()
+	if err != nil {
+		return nil, fmt.Errorf("DeleteExpiredEntities: %w", err)
+	}
+
+	deleted := map[string]int{}
+	remaining := limit
+	var errs []error
+	for _, clientID := range clientIDs {
+		if remaining <= 0 {
+			break
+		}
+		err := d.withShard(clientID, func(store *SqliteDatastore) error {
+			shardDeleted, err := store.DeleteExpiredEntities(now, remaining)
+			for id, count := range shardDeleted {
+				deleted[id] += count
+				remaining -= count
+			}
+			return err
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", clientID, err))
+		}
+	}
+	return deleted, errors.Join(errs...)
+}
+
+// CompactTombstones compacts up to limit tombstones, going through the files
+// in client ID order. Like DeleteExpiredEntities it skips a file which fails.
+func (d *ShardedSqliteDatastore) CompactTombstones(cutoff int64, limit int) (map[string]TombstoneStats, error) {
+	clientIDs, err := d.ClientIDs()
+	if err != nil {
+		return nil, fmt.Errorf("CompactTombstones: %w", err)
+	}
+
+	compacted := map[string]TombstoneStats{}
+	remaining := limit
+	var errs []error
+	for _, clientID := range clientIDs {
+		if remaining <= 0 {
+			break
+		}
+		err := d.withShard(clientID, func(store *SqliteDatastore) error {
+			shardCompacted, err := store.CompactTombstones(cutoff, remaining)
+			for id, stats := range shardCompacted {
+				compacted[id] = stats
+				remaining -= stats.Rows
+			}
+			return err
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", clientID, err))
+		}
+	}
+	return compacted, errors.Join(errs...)
+}
+
+// FlushWatermarks writes the pending fetch watermarks of the open files, a
+// file's are also written when it is closed.
+func (d *ShardedSqliteDatastore) FlushWatermarks() error {
+	d.mu.Lock()
+	var open []*sqliteShard
+	for _, key := range d.shards.Keys() {
+		if value, ok := d.shards.Peek(key); ok {
+			open = append(open, value.(*sqliteShard))
+		}
+	}
+	for _, shard := range d.retired {
+		open = append(open, shard)
+	}
+	for _, shard := range open {
+		shard.refs++
+	}
+	d.mu.Unlock()
+
+	var errs []error
+	for _, shard := range open {
+		<-shard.ready
+		if shard.err == nil {
+			if err := shard.store.FlushWatermarks(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", shard.clientID, err))
+			}
+		}
+		d.release(shard)
+	}
+	return errors.Join(errs...)
+}
+
+// ReencryptEntities reseals up to limit entities with the current key, going
+// through the files in client ID order.
+func (d *ShardedSqliteDatastore) ReencryptEntities(limit int) (int, error) {
+	clientIDs, err := d.ClientIDs()
+	if err != nil {
+		return 0, fmt.Errorf("ReencryptEntities: %w", err)
+	}
+
+	resealed := 0
+	for _, clientID := range clientIDs {
+		if resealed >= limit {
+			break
+		}
+		err := d.withShard(clientID, func(store *SqliteDatastore) error {
+			count, err := store.ReencryptEntities(limit - resealed)
+			resealed += count
+			return err
+		})
+		if err != nil {
+			return resealed, fmt.Errorf("%s: %w", clientID, err)
+		}
+	}
+	return resealed, nil
+}
+
+// CompressSpecifics compresses the existing rows of every chain file.
+func (d *ShardedSqliteDatastore) CompressSpecifics(batchSize int) (CompressionStats, error) {
+	var stats CompressionStats
+	clientIDs, err := d.ClientIDs()
+	if err != nil {
+		return stats, fmt.Errorf("CompressSpecifics: %w", err)
+	}
+
+	for _, clientID := range clientIDs {
+		err := d.withShard(clientID, func(store *SqliteDatastore) error {
+			shardStats, err := store.CompressSpecifics(batchSize)
+			stats.add(shardStats)
+			return err
+		})
+		if err != nil {
+			return stats, fmt.Errorf("%s: %w", clientID, err)
+		}
+	}
+	return stats, nil
+}
+
+func (d *ShardedSqliteDatastore) ExportChain(clientID string) (chain ChainExport, err error) {
+	err = d.withShard(clientID, func(store *SqliteDatastore) error {
+		chain, err = store.ExportChain(clientID)
+		return err
+	})
+	return chain, err
+}
+
+func (d *ShardedSqliteDatastore) ImportChain(chain ChainExport, replace bool) error {
+	return d.withShard(chain.ClientID, func(store *SqliteDatastore) error {
+		return store.ImportChain(chain, replace)
+	})
+}
@@ -0,0 +1,205 @@
+package internal_test
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newShardedDatastore(t *testing.T, maxOpen int) *internal.ShardedSqliteDatastore {
+	ds, err := internal.NewShardedSqliteDatastore(t.TempDir(), internal.DefaultSqliteOptions(), maxOpen)
+	require.NoError(t, err)
+	t.Cleanup(func() { ds.Close() })
+	return ds
+}
+
+func TestShardedDatastoreKeepsChainsApart(t *testing.T) {
+	ds := newShardedDatastore(t, 4)
+
+	for _, clientID := range []string{"aaaa", "bbbb"} {
+		_, err := ds.InsertSyncEntity(&datastore.SyncEntity{
+			ClientID: clientID,
+			ID:       "id-" + clientID,
+			Version:  aws.Int64(1),
+			DataType: aws.Int(123),
+		})
+		require.NoError(t, err)
+	}
+
+	clientIDs, err := ds.ClientIDs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"aaaa", "bbbb"}, clientIDs)
+
+	has, err := ds.HasItem("aaaa", "id-bbbb")
+	assert.NoError(t, err)
+	assert.False(t, has)
+
+	// Removing a chain's file removes the chain and nothing else.
+	require.NoError(t, ds.DisableSyncChain("bbbb"))
+	_, err = ds.ClearServerData("aaaa")
+	require.NoError(t, err)
+	disabled, err := ds.IsSyncChainDisabled("aaaa")
+	assert.NoError(t, err)
+	assert.False(t, disabled)
+	disabled, err = ds.IsSyncChainDisabled("bbbb")
+	assert.NoError(t, err)
+	assert.True(t, disabled)
+
+	_, err = ds.HasItem("../etc", "id")
+	assert.Error(t, err, "client IDs must be safe file names")
+}
+
+func TestShardedDatastoreReopensEvictedChains(t *testing.T) {
+	ds := newShardedDatastore(t, 1)
+
+	for round := int64(1); round <= 3; round++ {
+		for _, clientID := range []string{"aaaa", "bbbb", "cccc"} {
+			counts, err := ds.GetClientItemCount(clientID)
+			require.NoError(t, err)
+			assert.Equal(t, int(round-1), counts.ItemCount, "counts must survive eviction")
+			require.NoError(t, ds.UpdateClientItemCount(counts, 1, 0))
+		}
+	}
+
+	path, err := ds.ShardPath("aaaa")
+	require.NoError(t, err)
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+}
+
+func TestShardedDatastoreConcurrentChains(t *testing.T) {
+	// Fewer open files than chains, so handles are evicted while other
+	// goroutines use them.
+	ds := newShardedDatastore(t, 2)
+
+	var wg sync.WaitGroup
+	for c := 0; c < 6; c++ {
+		clientID := fmt.Sprintf("client%d", c)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				_, err := ds.InsertSyncEntity(&datastore.SyncEntity{
+					ClientID: clientID,
+					ID:       fmt.Sprintf("id%d", i),
+					Version:  aws.Int64(1),
+					Mtime:    aws.Int64(int64(i)),
+					DataType: aws.Int(123),
+					Folder:   aws.Bool(false),
+				})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for c := 0; c < 6; c++ {
+		_, entities, err := ds.GetUpdatesForType(123, -1, true, fmt.Sprintf("client%d", c), 100)
+		assert.NoError(t, err)
+		assert.Len(t, entities, 20)
+	}
+}
+
+func TestShardedDatastoreReusesEvictedShards(t *testing.T) {
+	ds := newShardedDatastore(t, 1)
+
+	held, release, err := ds.AcquireShard("aaaa")
+	require.NoError(t, err)
+	// Evicts aaaa while it is in use, a second store on its file would be
+	// a second writer.
+	_, err = ds.HasItem("bbbb", "id")
+	require.NoError(t, err)
+	again, releaseAgain, err := ds.AcquireShard("aaaa")
+	require.NoError(t, err)
+	assert.Same(t, held, again)
+	release()
+	releaseAgain()
+
+	has, err := ds.HasItem("aaaa", "id")
+	assert.NoError(t, err)
+	assert.False(t, has)
+
+	// Concurrent first requests for a chain share one open.
+	stores := make([]*internal.SqliteDatastore, 8)
+	var wg sync.WaitGroup
+	for i := range stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store, release, err := ds.AcquireShard("cccc")
+			if assert.NoError(t, err) {
+				stores[i] = store
+				release()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, store := range stores {
+		assert.Same(t, stores[0], store)
+	}
+}
+
+func TestShardedDatastoreRetriesFailedOpens(t *testing.T) {
+	ds := newShardedDatastore(t, 4)
+	path, err := ds.ShardPath("aaaa")
+	require.NoError(t, err)
+
+	require.NoError(t, os.Mkdir(path, 0o700))
+	_, err = ds.HasItem("aaaa", "id")
+	assert.Error(t, err)
+
+	require.NoError(t, os.Remove(path))
+	_, err = ds.HasItem("aaaa", "id")
+	assert.NoError(t, err)
+}
+
+func TestShardedDatastoreDeleteExpiredEntities(t *testing.T) {
+	ds := newShardedDatastore(t, 1)
+	past := time.Now().Add(-time.Hour).Unix()
+
+	for _, clientID := range []string{"aaaa", "bbbb"} {
+		for i := 0; i < 2; i++ {
+			_, err := ds.InsertSyncEntity(&datastore.SyncEntity{
+				ClientID:       clientID,
+				ID:             fmt.Sprintf("id%d", i),
+				Version:        aws.Int64(1),
+				DataType:       aws.Int(963985),
+				ExpirationTime: &past,
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	deleted, err := ds.DeleteExpiredEntities(time.Now().Unix(), 3)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"aaaa": 2, "bbbb": 1}, deleted)
+
+	deleted, err = ds.DeleteExpiredEntities(time.Now().Unix(), 3)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"bbbb": 1}, deleted)
+}
+
+func TestShardedDatastoreCloseReportsErrors(t *testing.T) {
+	ds, err := internal.NewShardedSqliteDatastore(t.TempDir(), internal.DefaultSqliteOptions(), 2)
+	require.NoError(t, err)
+
+	_, _, err = ds.GetUpdatesForType(123, 1000, true, "aaaa", 10)
+	require.NoError(t, err)
+	store, release, err := ds.AcquireShard("aaaa")
+	require.NoError(t, err)
+	_, err = store.Db.Exec("DROP TABLE fetch_watermarks")
+	require.NoError(t, err)
+	release()
+
+	// The fetch cannot be written any more.
+	err = ds.Close()
+	assert.ErrorContains(t, err, "aaaa")
+}
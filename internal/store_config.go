@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+
+	braveds "github.com/brave/go-sync/datastore"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Datastore backends selectable with StoreConfig.Backend.
+const (
+	BackendSqlite   = "sqlite"
+	BackendPostgres = "postgres"
+	BackendMemory   = "memory"
+	BackendBolt     = "bolt"
+)
+
+// StoreConfig selects the datastore the server runs on.
+type StoreConfig struct {
+	Backend string
+
+	// SqlitePath is the database file of the sqlite backend.
+	SqlitePath string
+	Sqlite     SqliteOptions
+
+	// SqliteShardDir, when set, keeps each chain in its own file in this
+	// directory instead of SqlitePath. At most MaxOpenShards files are
+	// kept open.
+	SqliteShardDir string
+	MaxOpenShards  int
+
+	// PostgresDSN is the connection string of the postgres backend.
+	PostgresDSN string
+
+	// MemorySnapshotPath, when set, is where the memory backend loads its
+	// state from on start and writes it to on shutdown.
+	MemorySnapshotPath string
+
+	// BoltPath is the database file of the bolt backend.
+	BoltPath string
+
+	// Quotas, when set, limit what each chain stores, whichever the
+	// backend. The sqlite backend gets them as Sqlite.Quotas.
+	Quotas *Quotas
+
+	// KeepTombstones is set when the server never compacts tombstones, the
+	// stores then do not record fetches for it. The sqlite backend gets it
+	// as Sqlite.KeepTombstones.
+	KeepTombstones bool
+}
+
+// serverStore is a datastore together with the upkeep the server runs on it.
+type serverStore interface {
+	braveds.Datastore
+	expiredEntityDeleter
+	chainTransferer
+	tombstoneCompactor
+	SchemaVersion() (int, error)
+	Close() error
+}
+
+func openStore(cfg StoreConfig) (serverStore, error) {
+	switch cfg.Backend {
+	case BackendSqlite:
+		cfg.Sqlite.Quotas = cfg.Quotas
+		cfg.Sqlite.KeepTombstones = cfg.KeepTombstones
+		if cfg.SqliteShardDir != "" {
+			return NewShardedSqliteDatastore(cfg.SqliteShardDir, cfg.Sqlite, cfg.MaxOpenShards)
+		}
+		return NewSqliteDatastoreWithOptions(cfg.SqlitePath, cfg.Sqlite)
+	case BackendPostgres:
+		if cfg.Sqlite.EncryptionKeys != nil {
+			return nil, errors.New("encryption at rest is only supported by the sqlite backend")
+		}
+		if cfg.Sqlite.CompressSpecifics {
+			return nil, errors.New("compressing specifics is only supported by the sqlite backend, Postgres compresses large values itself")
+		}
+		store, err := NewPostgresDatastore(cfg.PostgresDSN)
+		if err != nil {
+			return nil, err
+		}
+		store.quotas = cfg.Quotas
+		store.watermarks.off = cfg.KeepTombstones
+		return store, nil
+	case BackendMemory:
+		if cfg.Sqlite.EncryptionKeys != nil || cfg.Sqlite.CompressSpecifics {
+			return nil, errors.New("encryption at rest and compression are only supported by the sqlite backend")
+		}
+		store, err := NewMemoryDatastore(cfg.MemorySnapshotPath)
+		if err != nil {
+			return nil, err
+		}
+		store.quotas = cfg.Quotas
+		store.keepTombstones = cfg.KeepTombstones
+		return store, nil
+	case BackendBolt:
+		if cfg.Sqlite.EncryptionKeys != nil || cfg.Sqlite.CompressSpecifics {
+			return nil, errors.New("encryption at rest and compression are only supported by the sqlite backend")
+		}
+		store, err := NewBoltDatastore(cfg.BoltPath)
+		if err != nil {
+			return nil, err
+		}
+		store.quotas = cfg.Quotas
+		store.watermarks.off = cfg.KeepTombstones
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q", cfg.Backend)
+	}
+}
+
+// name identifies the database in logs. The Postgres DSN can hold a
+// password, so only its host and database are shown.
+func (cfg StoreConfig) name() string {
+	switch cfg.Backend {
+	case BackendSqlite:
+		if cfg.SqliteShardDir != "" {
+			return cfg.SqliteShardDir
+		}
+		return cfg.SqlitePath
+	case BackendPostgres:
+		pgConfig, err := pgconn.ParseConfig(cfg.PostgresDSN)
+		if err != nil {
+			return "(invalid DSN)"
+		}
+		return fmt.Sprintf("%s:%d/%s", pgConfig.Host, pgConfig.Port, pgConfig.Database)
+	case BackendMemory:
+		if cfg.MemorySnapshotPath != "" {
+			return cfg.MemorySnapshotPath
+		}
+		return ":memory:"
+	case BackendBolt:
+		return cfg.BoltPath
+	default:
+		return ""
+	}
+}
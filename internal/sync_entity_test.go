@@ -32,13 +32,13 @@ func (suite *SyncEntityTestSuite) SetupSuite() {
 }
 
 func (suite *SyncEntityTestSuite) SetupTest() {
-	// suite.Require().NoError(
-	// 	datastoretest.ResetTable(suite.dynamo), "Failed to reset table")
+	suite.Require().NoError(
+		datastoretest.ResetTable(suite.dynamo), "Failed to reset table")
 }
 
 func (suite *SyncEntityTestSuite) TearDownTest() {
-	// suite.Require().NoError(
-	// 	datastoretest.DeleteTable(suite.dynamo), "Failed to delete table")
+	suite.Require().NoError(
+		datastoretest.DeleteTable(suite.dynamo), "Failed to delete table")
 }
 
 func (suite *SyncEntityTestSuite) TestNewServerClientUniqueTagItem() {
@@ -0,0 +1,376 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// A deleted entity stays behind as a tombstone, so that the devices which
+// still have it learn of the delete. A tombstone can go once every device
+// has fetched it. Devices are not told apart in a fetch, but a fetch of a
+// type with progress token t comes from a device which has received every
+// change up to t. The lowest token a chain fetched a type with is recorded
+// per day, in fetch_watermarks, and a tombstone is only compacted when it is
+// older than the maximum age and at or below the lowest token of the days
+// since.
+//
+// That only covers the devices which synced since the cutoff. The devices
+// of a chain are known from their device info entities, which a device
+// updates at least once a day while it syncs, so a chain with a device info
+// older than the cutoff has a device whose progress is unknown, and keeps
+// all its tombstones until the device syncs again or is removed from the
+// chain.
+//
+// Fetches are recorded in memory and written in batches, when the tombstones
+// are compacted, every watermarkFlushInterval and when the store is closed,
+// so that a fetch never waits on the writer. A crash loses the fetches since
+// the last write. A device which has not synced again since only lacks the
+// deletes made after its last sync, and once those are older than the
+// cutoff, so is its device info, which keeps them. A server which keeps its
+// tombstones records no fetches at all.
+
+const (
+	millisPerDay = 24 * 60 * 60 * 1000
+
+	// deviceInfoTypeID is the DEVICE_INFO type, the queries spell it out
+	// to match the partial indexes of the device infos.
+	deviceInfoTypeID = 154522
+
+	watermarkFlushInterval = time.Minute
+)
+
+type watermarkKey struct {
+	clientID string
+	dataType int
+}
+
+type watermark struct {
+	day      int64
+	minToken int64
+}
+
+// dayWatermark is the key of a watermark row.
+type dayWatermark struct {
+	watermarkKey
+	day int64
+}
+
+// fetchWatermarks holds the fetches which are yet to be written. It also
+// remembers the lowest token of the day of each chain and type, so that a
+// fetch is only recorded when it lowers it. Progress tokens only grow, so
+// that is about once per chain, type and day.
+type fetchWatermarks struct {
+	mu      sync.Mutex
+	lowest  map[watermarkKey]watermark
+	pending map[dayWatermark]int64
+
+	// off is set when the tombstones are never compacted, the watermarks
+	// would only pile up.
+	off bool
+}
+
+func newFetchWatermarks() *fetchWatermarks {
+	return &fetchWatermarks{lowest: map[watermarkKey]watermark{}, pending: map[dayWatermark]int64{}}
+}
+
+// record lowers the day's watermark of the chain and type to token. A device
+// without a token has nothing to delete and needs no tombstones.
+func (w *fetchWatermarks) record(clientID string, dataType int, token int64) {
+	if w.off || token <= 0 {
+		return
+	}
+	key := watermarkKey{clientID: clientID, dataType: dataType}
+	day := time.Now().UnixMilli() / millisPerDay
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if lowest, ok := w.lowest[key]; ok && lowest.day == day && lowest.minToken <= token {
+		return
+	}
+	w.lowest[key] = watermark{day: day, minToken: token}
+	w.pending[dayWatermark{watermarkKey: key, day: day}] = token
+}
+
+// take returns the pending watermarks, which the caller writes or gives
+// back. The lowest tokens of the days before are forgotten, a fetch of a
+// new day is recorded anyway.
+func (w *fetchWatermarks) take() map[dayWatermark]int64 {
+	today := time.Now().UnixMilli() / millisPerDay
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for key, lowest := range w.lowest {
+		if lowest.day < today {
+			delete(w.lowest, key)
+		}
+	}
+	pending := w.pending
+	w.pending = map[dayWatermark]int64{}
+	return pending
+}
+
+// giveBack returns watermarks which could not be written to the pending ones.
+func (w *fetchWatermarks) giveBack(watermarks map[dayWatermark]int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for key, token := range watermarks {
+		if pending, ok := w.pending[key]; !ok || token < pending {
+			w.pending[key] = token
+		}
+	}
+}
+
+// watermarkFlusher is implemented by the datastores which write the fetch
+// watermarks in batches.
+type watermarkFlusher interface {
+	FlushWatermarks() error
+}
+
+const recordFetchQuery = `
+INSERT INTO fetch_watermarks (client_id, data_type, day, min_token)
+VALUES (?, ?, ?, ?)
+ON CONFLICT (client_id, data_type, day) DO UPDATE SET
+    min_token = MIN(min_token, excluded.min_token)
+`
+
+// writeWatermarks writes watermarks taken from the pending ones with query,
+// which lowers the stored watermark of the day to the given token.
+func writeWatermarks(tx *sql.Tx, query string, watermarks map[dayWatermark]int64) error {
+	for key, token := range watermarks {
+		if _, err := tx.Exec(query, key.clientID, key.dataType, key.day, token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FlushWatermarks writes the fetches recorded since the last write.
+func (d *SqliteDatastore) FlushWatermarks() error {
+	pending := d.watermarks.take()
+	if len(pending) == 0 {
+		return nil
+	}
+	err := func() error {
+		tx, err := d.Db.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err = writeWatermarks(tx, recordFetchQuery, pending); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		d.watermarks.giveBack(pending)
+		return fmt.Errorf("FlushWatermarks: %w", classifySqliteError(err))
+	}
+	return nil
+}
+
+// TombstoneStats is what compacting the tombstones of a chain reclaimed.
+// Bytes counts the text and blob values of the removed rows.
+type TombstoneStats struct {
+	Rows  int
+	Bytes int64
+}
+
+func (s *TombstoneStats) add(other TombstoneStats) {
+	s.Rows += other.Rows
+	s.Bytes += other.Bytes
+}
+
+// tombstoneCompactor is implemented by the datastores.
+type tombstoneCompactor interface {
+	CompactTombstones(cutoff int64, limit int) (map[string]TombstoneStats, error)
+}
+
+// Tombstones are removed through their rowid, like expired entities.
+const compactTombstonesQuery = `
+DELETE FROM sync_entities
+WHERE rowid IN (
+    SELECT e.rowid FROM sync_entities e
+    WHERE e.deleted AND e.version IS NOT NULL AND e.mtime < ?
+      AND e.mtime <= (
+          SELECT MIN(w.min_token) FROM fetch_watermarks w
+          WHERE w.client_id = e.client_id AND w.data_type = e.data_type AND w.day >= ?
+      )
+      AND e.client_id NOT IN (
+          SELECT d.client_id FROM sync_entities d
+          WHERE d.data_type = 154522 AND d.mtime < ?
+            AND NOT COALESCE(d.deleted, 0) AND d.version IS NOT NULL
+      )
+    LIMIT ?
+)
+RETURNING client_id,
+    length(CAST(client_id AS BLOB)) + length(CAST(id AS BLOB))
+    + COALESCE(length(CAST(parent_id AS BLOB)), 0)
+    + COALESCE(length(CAST(name AS BLOB)), 0)
+    + COALESCE(length(CAST(non_unique_name AS BLOB)), 0)
+    + COALESCE(length(CAST(server_defined_unique_tag AS BLOB)), 0)
+    + COALESCE(length(CAST(originator_cache_guid AS BLOB)), 0)
+    + COALESCE(length(CAST(originator_client_item_id AS BLOB)), 0)
+    + COALESCE(length(specifics), 0)
+    + COALESCE(length(CAST(client_defined_unique_tag AS BLOB)), 0)
+    + COALESCE(length(unique_position), 0)
+    + COALESCE(length(CAST(data_type_mtime AS BLOB)), 0)
+    + COALESCE(length(CAST(key_id AS BLOB)), 0)
+`
+
+// CompactTombstones removes up to limit tombstones with an mtime, in
+// milliseconds, before cutoff which every device syncing since cutoff has
+// fetched, and the watermarks from before cutoff. A chain with a device
+// info older than cutoff keeps its tombstones. The pending watermarks are
+// written first, in the same transaction. Tombstones are not counted in the
+// item counts, and their client tag items went with the delete.
+func (d *SqliteDatastore) CompactTombstones(cutoff int64, limit int) (map[string]TombstoneStats, error) {
+	pending := d.watermarks.take()
+	fail := func(err error) (map[string]TombstoneStats, error) {
+		d.watermarks.giveBack(pending)
+		return nil, fmt.Errorf("CompactTombstones: %w", classifySqliteError(err))
+	}
+
+	tx, err := d.Db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+	if err = writeWatermarks(tx, recordFetchQuery, pending); err != nil {
+		return fail(err)
+	}
+
+	cutoffDay := cutoff / millisPerDay
+	rows, err := tx.Query(compactTombstonesQuery, cutoff, cutoffDay, cutoff, limit)
+	if err != nil {
+		return fail(err)
+	}
+	defer rows.Close()
+
+	compacted := map[string]TombstoneStats{}
+	for rows.Next() {
+		var clientID string
+		var bytes int64
+		if err := rows.Scan(&clientID, &bytes); err != nil {
+			return fail(err)
+		}
+		stats := compacted[clientID]
+		stats.add(TombstoneStats{Rows: 1, Bytes: bytes})
+		compacted[clientID] = stats
+	}
+	if err = rows.Err(); err != nil {
+		return fail(err)
+	}
+	rows.Close()
+
+	if _, err = tx.Exec("DELETE FROM fetch_watermarks WHERE day < ?", cutoffDay); err != nil {
+		return fail(err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fail(err)
+	}
+	return compacted, nil
+}
+
+// compactAllTombstones compacts batches until a batch comes back short, and
+// adds up what each chain reclaimed.
+func compactAllTombstones(ctx context.Context, store tombstoneCompactor, cutoff int64, batchSize int) (map[string]TombstoneStats, error) {
+	total := map[string]TombstoneStats{}
+	for ctx.Err() == nil {
+		compacted, err := store.CompactTombstones(cutoff, batchSize)
+		if err != nil {
+			return total, err
+		}
+		batch := 0
+		for clientID, stats := range compacted {
+			chain := total[clientID]
+			chain.add(stats)
+			total[clientID] = chain
+			batch += stats.Rows
+		}
+		if batch < batchSize {
+			break
+		}
+	}
+	return total, ctx.Err()
+}
+
+// CompactStoreTombstones compacts the tombstones older than maxAge in the
+// store of cfg, and returns what each chain reclaimed.
+func CompactStoreTombstones(cfg StoreConfig, maxAge time.Duration, batchSize int) (map[string]TombstoneStats, error) {
+	store, err := openStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	cutoff := time.Now().Add(-maxAge).UnixMilli()
+	return compactAllTombstones(context.Background(), store, cutoff, batchSize)
+}
+
+// TombstoneCompactor periodically compacts the tombstones older than maxAge.
+type TombstoneCompactor struct {
+	store     tombstoneCompactor
+	logger    *zerolog.Logger
+	interval  time.Duration
+	maxAge    time.Duration
+	batchSize int
+}
+
+func NewTombstoneCompactor(store tombstoneCompactor, logger *zerolog.Logger, interval, maxAge time.Duration, batchSize int) *TombstoneCompactor {
+	return &TombstoneCompactor{
+		store:     store,
+		logger:    logger,
+		interval:  interval,
+		maxAge:    maxAge,
+		batchSize: batchSize,
+	}
+}
+
+// Run compacts once right away and then every interval, until ctx is done.
+// In between it writes the fetch watermarks every watermarkFlushInterval.
+func (c *TombstoneCompactor) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	flushTicker := time.NewTicker(watermarkFlushInterval)
+	defer flushTicker.Stop()
+
+	c.compact(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.compact(ctx)
+		case <-flushTicker.C:
+			c.flush()
+		}
+	}
+}
+
+func (c *TombstoneCompactor) compact(ctx context.Context) {
+	cutoff := time.Now().Add(-c.maxAge).UnixMilli()
+	compacted, err := compactAllTombstones(ctx, c.store, cutoff, c.batchSize)
+	if err != nil && ctx.Err() == nil {
+		c.logger.Error().Err(err).Msg("Failed to compact tombstones")
+	}
+	for clientID, stats := range compacted {
+		c.logger.Info().Str("client_id", clientID).Int("rows", stats.Rows).Int64("bytes", stats.Bytes).
+			Msg("Compacted tombstones")
+	}
+}
+
+// flush writes the fetch watermarks, the ones which fail to be written are
+// tried again next time.
+func (c *TombstoneCompactor) flush() {
+	flusher, ok := c.store.(watermarkFlusher)
+	if !ok {
+		return
+	}
+	if err := flusher.FlushWatermarks(); err != nil {
+		c.logger.Error().Err(err).Msg("Failed to write fetch watermarks")
+	}
+}
@@ -0,0 +1,186 @@
+package internal_test
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/brave/go-sync/datastore"
+	"github.com/mikaelhg/litesync/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// insertTombstones inserts entities of clientID with mtimes 1000, 2000, ...
+// and deletes every one but the last.
+func insertTombstones(t *testing.T, ds *internal.SqliteDatastore, clientID string, count int) {
+	for i := 1; i <= count; i++ {
+		entity := datastore.SyncEntity{
+			ClientID:  clientID,
+			ID:        fmt.Sprintf("id%d", i),
+			Version:   aws.Int64(1),
+			Mtime:     aws.Int64(int64(i) * 1000),
+			Specifics: []byte("specifics"),
+			DataType:  aws.Int(123),
+			Folder:    aws.Bool(false),
+		}
+		_, err := ds.InsertSyncEntity(&entity)
+		require.NoError(t, err)
+		if i == count {
+			break
+		}
+		entity.Version = aws.Int64(2)
+		entity.Deleted = aws.Bool(true)
+		conflict, _, err := ds.UpdateSyncEntity(&entity, 1)
+		require.NoError(t, err)
+		require.False(t, conflict)
+	}
+}
+
+func TestCompactTombstones(t *testing.T) {
+	ds, err := internal.NewSqliteDatastore(filepath.Join(t.TempDir(), "litesync.sqlite"))
+	require.NoError(t, err)
+	defer ds.Close()
+	insertTombstones(t, ds, "client1", 4)
+	insertTombstones(t, ds, "client2", 4)
+	cutoff := time.Now().UnixMilli()
+
+	compacted, err := ds.CompactTombstones(cutoff, 100)
+	require.NoError(t, err)
+	assert.Empty(t, compacted, "no device has fetched the tombstones yet")
+
+	// A device starting from scratch needs no tombstones, and a device at
+	// 2000 has the first two.
+	_, _, err = ds.GetUpdatesForType(123, 0, true, "client1", 100)
+	require.NoError(t, err)
+	_, _, err = ds.GetUpdatesForType(123, 3000, true, "client1", 100)
+	require.NoError(t, err)
+	_, _, err = ds.GetUpdatesForType(123, 2000, true, "client1", 100)
+	require.NoError(t, err)
+	_, _, err = ds.GetUpdatesForType(123, 9000, true, "client2", 100)
+	require.NoError(t, err)
+
+	compacted, err = ds.CompactTombstones(2500, 100)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]internal.TombstoneStats{
+		"client1": {Rows: 2, Bytes: 2 * int64(len("client1id1specifics"))},
+		"client2": {Rows: 2, Bytes: 2 * int64(len("client2id1specifics"))},
+	}, compacted, "only tombstones before the cutoff go")
+
+	compacted, err = ds.CompactTombstones(cutoff, 100)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]internal.TombstoneStats{
+		"client2": {Rows: 1, Bytes: int64(len("client2id3specifics"))},
+	}, compacted, "the device at 2000 has not fetched the tombstone at 3000")
+
+	for clientID, ids := range map[string][]string{"client1": {"id3", "id4"}, "client2": {"id4"}} {
+		_, entities, err := ds.GetUpdatesForType(123, 0, true, clientID, 100)
+		require.NoError(t, err)
+		var kept []string
+		for _, entity := range entities {
+			kept = append(kept, entity.ID)
+		}
+		assert.Equal(t, ids, kept, clientID)
+	}
+}
+
+func TestCompactTombstonesForgetsOldFetches(t *testing.T) {
+	ds, err := internal.NewSqliteDatastore(filepath.Join(t.TempDir(), "litesync.sqlite"))
+	require.NoError(t, err)
+	defer ds.Close()
+	insertTombstones(t, ds, "client", 3)
+	_, _, err = ds.GetUpdatesForType(123, 1000, true, "client", 100)
+	require.NoError(t, err)
+
+	// Compacting after the fetch's day drops its watermark, without a fetch
+	// since then nothing is known to have been fetched.
+	tomorrow := time.Now().Add(24 * time.Hour).UnixMilli()
+	compacted, err := ds.CompactTombstones(tomorrow, 100)
+	require.NoError(t, err)
+	assert.Empty(t, compacted)
+	compacted, err = ds.CompactTombstones(time.Now().UnixMilli(), 100)
+	require.NoError(t, err)
+	assert.Empty(t, compacted)
+}
+
+func TestCompactTombstonesKeepsChainsWithStaleDevices(t *testing.T) {
+	ds, err := internal.NewSqliteDatastore(filepath.Join(t.TempDir(), "litesync.sqlite"))
+	require.NoError(t, err)
+	defer ds.Close()
+	insertTombstones(t, ds, "client1", 3)
+	insertTombstones(t, ds, "client2", 3)
+	// A device of client1 which has not synced since before the cutoff.
+	device := datastore.SyncEntity{
+		ClientID:  "client1",
+		ID:        "device",
+		Version:   aws.Int64(1),
+		Mtime:     aws.Int64(500),
+		Specifics: []byte("device info"),
+		DataType:  aws.Int(154522),
+		Folder:    aws.Bool(false),
+	}
+	_, err = ds.InsertSyncEntity(&device)
+	require.NoError(t, err)
+	for _, clientID := range []string{"client1", "client2"} {
+		_, _, err = ds.GetUpdatesForType(123, 9000, true, clientID, 100)
+		require.NoError(t, err)
+	}
+
+	compacted, err := ds.CompactTombstones(time.Now().UnixMilli(), 100)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"client2"}, slices.Sorted(maps.Keys(compacted)), "the device's progress is unknown")
+
+	// Removing the device from the chain deletes its device info.
+	device.Version = aws.Int64(2)
+	device.Mtime = aws.Int64(600)
+	device.Deleted = aws.Bool(true)
+	_, _, err = ds.UpdateSyncEntity(&device, 1)
+	require.NoError(t, err)
+	compacted, err = ds.CompactTombstones(time.Now().UnixMilli(), 100)
+	require.NoError(t, err)
+	assert.Equal(t, 2, compacted["client1"].Rows)
+}
+
+func TestFetchWatermarksAreWrittenInBatches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "litesync.sqlite")
+	ds, err := internal.NewSqliteDatastore(path)
+	require.NoError(t, err)
+	countWatermarks := func(ds *internal.SqliteDatastore) int {
+		var count int
+		require.NoError(t, ds.Db.QueryRow("SELECT COUNT(*) FROM fetch_watermarks").Scan(&count))
+		return count
+	}
+
+	_, _, err = ds.GetUpdatesForType(123, 1000, true, "client", 100)
+	require.NoError(t, err)
+	assert.Equal(t, 0, countWatermarks(ds), "a fetch does not write")
+	require.NoError(t, ds.FlushWatermarks())
+	assert.Equal(t, 1, countWatermarks(ds))
+
+	_, _, err = ds.GetUpdatesForType(456, 1000, true, "client", 100)
+	require.NoError(t, err)
+	require.NoError(t, ds.Close())
+	ds, err = internal.NewSqliteDatastore(path)
+	require.NoError(t, err)
+	defer ds.Close()
+	assert.Equal(t, 2, countWatermarks(ds), "closing writes the pending fetches")
+}
+
+func TestKeepTombstonesRecordsNoFetches(t *testing.T) {
+	opts := internal.DefaultSqliteOptions()
+	opts.KeepTombstones = true
+	ds, err := internal.NewSqliteDatastoreWithOptions(filepath.Join(t.TempDir(), "litesync.sqlite"), opts)
+	require.NoError(t, err)
+	defer ds.Close()
+
+	_, _, err = ds.GetUpdatesForType(123, 1000, true, "client", 100)
+	require.NoError(t, err)
+	require.NoError(t, ds.FlushWatermarks())
+	var count int
+	require.NoError(t, ds.Db.QueryRow("SELECT COUNT(*) FROM fetch_watermarks").Scan(&count))
+	assert.Equal(t, 0, count)
+}